@@ -0,0 +1,62 @@
+// createadmin creates an admin account. Admins can't sign up through the API.
+// The password is read from the first line of the standard input, so it doesn't end up in the shell history.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/mehiX/vending-machine-api/internal/app"
+)
+
+func main() {
+
+	var envFile, username string
+	flag.StringVar(&envFile, "e", ".env", "File with environment variables")
+	flag.StringVar(&username, "u", "", "Username of the admin")
+	flag.Parse()
+
+	if envFile != "" {
+		if err := godotenv.Load(envFile); err != nil {
+			fmt.Printf("ENV not loaded from '%s'. Error: %s\n", envFile, err.Error())
+		}
+	}
+
+	if username == "" {
+		fmt.Println("Missing the username (-u)")
+		os.Exit(1)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Println("Password not read:", err)
+		os.Exit(1)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	db, err := sql.Open("mysql", os.Getenv("MYSQL_CONN_STR"))
+	if err != nil {
+		fmt.Printf("DB: %v\n", err.Error())
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := app.NewApp("", db).CreateAdmin(ctx, username, password)
+	if err != nil {
+		fmt.Println("Admin not created:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Admin %s created with ID %s\n", username, userID)
+}
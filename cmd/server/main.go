@@ -16,10 +16,16 @@ import (
 
 var addr string
 var envFile string
+var tlsCert string
+var tlsKey string
+var redirectAddr string
 
 func init() {
 	flag.StringVar(&addr, "l", "localhost:7777", "Listen address for the server")
 	flag.StringVar(&envFile, "e", ".env", "File with environment variables")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file. With -tls-key the server talks HTTPS, and reloads the files when they change")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file")
+	flag.StringVar(&redirectAddr, "redirect", "", "Listen address for plain HTTP that redirects to HTTPS, e.g. :80. Needs -tls-cert")
 
 	flag.Parse()
 
@@ -43,29 +49,70 @@ func init() {
 
 // @host localhost:7777
 // @BasePath /
-// @schemes http
+// @schemes http https
 func main() {
 
 	vm := app.NewApp(addr, nil)
 
+	if (tlsCert == "") != (tlsKey == "") {
+		fmt.Println("TLS needs both -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
+	if tlsCert != "" {
+		if err := vm.UseTLS(tlsCert, tlsKey); err != nil {
+			fmt.Printf("TLS: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else if redirectAddr != "" {
+		fmt.Println("-redirect needs -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
 	srvr := vm.HttpServer()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
+	stop := func(err error) {
+		fmt.Println(err)
+		select {
+		case c <- os.Interrupt:
+		default:
+		}
+	}
+
 	go func() {
+		if srvr.TLSConfig != nil {
+			fmt.Printf("Start listening on %s (HTTPS)\n", srvr.Addr)
+			if err := srvr.ListenAndServeTLS("", ""); err != nil {
+				stop(err)
+			}
+			return
+		}
+
 		fmt.Printf("Start listening on %s\n", srvr.Addr)
 		if err := srvr.ListenAndServe(); err != nil {
-			fmt.Println(err)
-			select {
-			case c <- os.Interrupt:
-			default:
-			}
+			stop(err)
 		}
 	}()
 
+	redirect := vm.RedirectServer(redirectAddr)
+	if redirectAddr != "" {
+		go func() {
+			fmt.Printf("Redirecting HTTP on %s to HTTPS\n", redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil {
+				stop(err)
+			}
+		}()
+	}
+
 	done, stopDB := context.WithCancel(context.Background())
 	go ConnectDB(done, vm, os.Getenv("MYSQL_CONN_STR"), 5*time.Second)
+	go vm.RunPriceScheduler(done, time.Minute)
+	go vm.RunOutboxRelay(done, 2*time.Second)
+	go vm.RunWebhookDispatcher(done, 10*time.Second)
+	go vm.RunVendTimeouts(done, 10*time.Second)
 
 	<-c
 	fmt.Println("Shutting down...")
@@ -81,6 +128,12 @@ func main() {
 		fmt.Println(err)
 	}
 
+	if redirectAddr != "" {
+		if err := redirect.Shutdown(ctx); err != nil {
+			fmt.Println(err)
+		}
+	}
+
 	fmt.Println("Done")
 }
 
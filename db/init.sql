@@ -3,7 +3,8 @@ create table users (
     username varchar(64) not null,
     password varchar(256) not null,
     deposit int not null default 0,
-    role varchar(20) not null default 'BUYER',
+    role varchar(64) not null default 'BUYER', -- comma separated, the first one is the main role
+    session_version int not null default 0, -- bumped when the password or the roles change, revokes the user's tokens
     primary key (id)
 );
 
@@ -13,9 +14,319 @@ create table products (
     available_amount int not null default 0,
     cost int not null default 5,
     seller_id varchar(64) not null,
+    price_id varchar(64),
+    low_stock_threshold int not null default 0,
     primary key (id)
 );
 
+create table product_prices (
+    id varchar(64) not null,
+    product_id varchar(64) not null,
+    cost int not null,
+    effective_from datetime not null,
+    applied boolean not null default false,
+    primary key (id)
+);
+
+create table coin_inventory (
+    coin_value int not null,
+    amount int not null default 0,
+    primary key (coin_value)
+);
+
+create table escrow_notes (
+    id varchar(64) not null,
+    user_id varchar(64) not null,
+    note_value int not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table deposit_history (
+    id varchar(64) not null,
+    user_id varchar(64) not null,
+    coin_value int not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table promotions (
+    id varchar(64) not null,
+    seller_id varchar(64) not null,
+    product_id varchar(64),
+    name varchar(128) not null,
+    type varchar(20) not null,
+    value int not null,
+    from_hour int not null default 0,
+    to_hour int not null default 0,
+    primary key (id)
+);
+
+create table purchases (
+    id varchar(64) not null,
+    user_id varchar(64) not null,
+    product_id varchar(64) not null,
+    seller_id varchar(64) not null,
+    amount int not null,
+    unit_cost int not null,
+    base_price int not null,
+    total_price int not null,
+    price_id varchar(64),
+    promotion_id varchar(64),
+    status varchar(16) not null default 'COMPLETED',
+    created_at datetime not null,
+    primary key (id)
+);
+
+create index IX_purchase_pending on purchases (status, created_at);
+
+create table vend_failures (
+    id varchar(64) not null,
+    purchase_id varchar(64) not null,
+    user_id varchar(64) not null,
+    product_id varchar(64) not null,
+    amount int not null,
+    refunded int not null,
+    reason varchar(255) not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table refunds (
+    id varchar(64) not null,
+    purchase_id varchar(64) not null,
+    admin_id varchar(64) not null,
+    user_id varchar(64) not null,
+    product_id varchar(64) not null,
+    amount int not null,
+    method varchar(16) not null,
+    restocked int not null default 0,
+    reason varchar(255) not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table seller_ledger (
+    id varchar(64) not null,
+    seller_id varchar(64) not null,
+    entry_type varchar(16) not null,
+    amount int not null,
+    purchase_id varchar(64),
+    payout_id varchar(64),
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table stock_alerts (
+    id varchar(64) not null,
+    seller_id varchar(64) not null,
+    product_id varchar(64) not null,
+    alert_type varchar(16) not null,
+    stock int not null,
+    threshold int not null,
+    created_at datetime not null,
+    acknowledged_at datetime,
+    primary key (id)
+);
+
+create table outbox (
+    id varchar(64) not null,
+    event_type varchar(32) not null,
+    payload text not null,
+    created_at datetime not null,
+    published_at datetime,
+    primary key (id)
+);
+
+create index IX_outbox_pending on outbox (published_at, created_at);
+
+create table webhook_subscriptions (
+    id varchar(64) not null,
+    url varchar(512) not null,
+    events varchar(512) not null,
+    secret varchar(128) not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create table webhook_deliveries (
+    id varchar(64) not null,
+    subscription_id varchar(64) not null,
+    event_type varchar(32) not null,
+    payload text not null,
+    status varchar(16) not null,
+    attempts int not null default 0,
+    next_attempt_at datetime not null,
+    last_status_code int not null default 0,
+    last_error varchar(512),
+    created_at datetime not null,
+    delivered_at datetime,
+    primary key (id)
+);
+
+create index IX_delivery_due on webhook_deliveries (status, next_attempt_at);
+
+create table audit_log (
+    id varchar(64) not null,
+    actor_id varchar(64),
+    action varchar(32) not null,
+    target_type varchar(32) not null,
+    target_id varchar(255) not null,
+    before_value text,
+    after_value text,
+    ip varchar(64) not null,
+    request_id varchar(128) not null,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create index IX_audit_created on audit_log (created_at);
+create index IX_audit_actor on audit_log (actor_id, created_at);
+create index IX_audit_target on audit_log (target_type, target_id, created_at);
+
+-- the audit log is append-only
+create trigger audit_no_update before update on audit_log
+for each row signal sqlstate '45000' set message_text = 'audit log is append-only';
+
+create trigger audit_no_delete before delete on audit_log
+for each row signal sqlstate '45000' set message_text = 'audit log is append-only';
+
+create table user_mfa (
+    user_id varchar(64) not null,
+    secret varchar(64) not null,
+    enabled boolean not null default false,
+    last_step bigint not null default 0,
+    created_at datetime not null,
+    enabled_at datetime,
+    primary key (user_id)
+);
+
+create table mfa_recovery_codes (
+    id varchar(64) not null,
+    user_id varchar(64) not null,
+    code_hash varchar(64) not null,
+    used_at datetime,
+    created_at datetime not null,
+    primary key (id)
+);
+
+create index IX_recovery_user on mfa_recovery_codes (user_id, code_hash);
+
+create table mfa_policies (
+    role varchar(20) not null,
+    required boolean not null default false,
+    updated_at datetime not null,
+    primary key (role)
+);
+
+create table api_keys (
+    id varchar(64) not null,
+    user_id varchar(64) not null,
+    name varchar(64) not null,
+    prefix varchar(16) not null,
+    key_hash varchar(64) not null,
+    scopes varchar(255) not null,
+    created_at datetime not null,
+    last_used_at datetime,
+    revoked_at datetime,
+    primary key (id)
+);
+
+create unique index UK_apikey_hash on api_keys (key_hash);
+create index IX_apikey_user on api_keys (user_id, created_at);
+
+create table user_identities (
+    issuer varchar(255) not null,
+    subject varchar(255) not null,
+    user_id varchar(64) not null,
+    created_at datetime not null default current_timestamp,
+    primary key (issuer, subject)
+);
+
+create index IX_identity_user on user_identities (user_id);
+
+create table payouts (
+    id varchar(64) not null,
+    seller_id varchar(64) not null,
+    amount int not null,
+    status varchar(16) not null,
+    created_at datetime not null,
+    updated_at datetime not null,
+    primary key (id)
+);
+
+ALTER TABLE product_prices
+ADD CONSTRAINT FK_price_product
+FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE;
+
+ALTER TABLE promotions
+ADD CONSTRAINT FK_promotion_seller
+FOREIGN KEY (seller_id) REFERENCES users(id);
+
+ALTER TABLE promotions
+ADD CONSTRAINT FK_promotion_product
+FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE;
+
+ALTER TABLE purchases
+ADD CONSTRAINT FK_purchase_user
+FOREIGN KEY (user_id) REFERENCES users(id);
+
+ALTER TABLE seller_ledger
+ADD CONSTRAINT FK_ledger_seller
+FOREIGN KEY (seller_id) REFERENCES users(id);
+
+ALTER TABLE payouts
+ADD CONSTRAINT FK_payout_seller
+FOREIGN KEY (seller_id) REFERENCES users(id);
+
+ALTER TABLE vend_failures
+ADD CONSTRAINT FK_failure_purchase
+FOREIGN KEY (purchase_id) REFERENCES purchases(id);
+
+ALTER TABLE refunds
+ADD CONSTRAINT FK_refund_purchase
+FOREIGN KEY (purchase_id) REFERENCES purchases(id);
+
+ALTER TABLE refunds
+ADD CONSTRAINT FK_refund_admin
+FOREIGN KEY (admin_id) REFERENCES users(id);
+
+ALTER TABLE stock_alerts
+ADD CONSTRAINT FK_alert_seller
+FOREIGN KEY (seller_id) REFERENCES users(id);
+
+ALTER TABLE stock_alerts
+ADD CONSTRAINT FK_alert_product
+FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE;
+
+ALTER TABLE webhook_deliveries
+ADD CONSTRAINT FK_delivery_subscription
+FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE;
+
+ALTER TABLE deposit_history
+ADD CONSTRAINT FK_deposit_user
+FOREIGN KEY (user_id) REFERENCES users(id);
+
+ALTER TABLE escrow_notes
+ADD CONSTRAINT FK_escrow_user
+FOREIGN KEY (user_id) REFERENCES users(id);
+
+ALTER TABLE user_mfa
+ADD CONSTRAINT FK_mfa_user
+FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE mfa_recovery_codes
+ADD CONSTRAINT FK_recovery_user
+FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE api_keys
+ADD CONSTRAINT FK_apikey_user
+FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE user_identities
+ADD CONSTRAINT FK_identity_user
+FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
 ALTER TABLE products
 ADD CONSTRAINT FK_seller
 FOREIGN KEY (seller_id) REFERENCES users(id); 
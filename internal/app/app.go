@@ -1,9 +1,12 @@
 package app
 
 import (
+	"crypto/tls"
 	"database/sql"
+	"fmt"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -11,18 +14,134 @@ import (
 )
 
 type App struct {
-	Addr    string
-	Router  *chi.Mux
-	JwtAuth *jwtauth.JWTAuth
-	Db      *sql.DB
+	Addr      string
+	Router    *chi.Mux
+	JwtAuth   *jwtauth.JWTAuth
+	Db        *sql.DB
+	Currency  Currency
+	NoteRules NoteRules
+
+	CommissionPercent int64 // platform commission on every sale
+
+	Bus        *Bus          // events published in this process
+	Publishers []Publisher   // where the outbox relay sends the events
+	Dispenser  Dispenser     // delivers the products bought with `/buy`, if the API drives the machine itself
+	Logins     *LoginGuard   // throttles failed logins
+	Notifier   Notifier      // delivers password reset tokens to the users
+	OIDC       *OIDCProvider // the identity provider users can log in with, if any
+	Policy     Policy        // the permissions of every role
+	Users      *UserCache    // the users of the authenticated requests, for a short time
+	CORS       CORSConfig    // the other origins allowed to call the API from a browser
+	HSTSMaxAge time.Duration // of the Strict-Transport-Security header on HTTPS requests, 0 leaves it out
+
+	TrustedProxies TrustedProxies // allowed to tell the client's address, none by default
+
+	RateLimits map[string]RatePolicy // by policy name, a missing policy doesn't throttle
+	RateStore  RateLimitStore        // keeps the rate limit counts, in memory by default
+
+	Passwords     PasswordHashing // how new passwords are hashed
+	dummyHash     string          // see dummyPasswordHash
+	dummyHashOnce sync.Once
+
+	certs *certReloader // set by UseTLS
 }
 
 func NewApp(addr string, db *sql.DB) *App {
 
 	a := &App{
-		Addr:    addr,
-		Db:      db,
-		JwtAuth: jwtauth.New(os.Getenv("JWT_ALG"), []byte(os.Getenv("JWT_SIGNKEY")), nil),
+		Addr:     addr,
+		Db:       db,
+		JwtAuth:  jwtauth.New(os.Getenv("JWT_ALG"), []byte(os.Getenv("JWT_SIGNKEY")), nil),
+		Currency: defaultCurrency,
+		Bus:      NewBus(),
+		Policy:   defaultPolicy,
+	}
+
+	if cur, err := currencyFromEnv(); err != nil {
+		fmt.Printf("currency config error, using %s: %s\n", defaultCurrency.Code, err.Error())
+	} else {
+		a.Currency = cur
+	}
+
+	if rules, err := noteRulesFromEnv(); err != nil {
+		fmt.Printf("note rules config error, accepting no notes: %s\n", err.Error())
+		a.NoteRules = NoteRules{MaxValue: -1}
+	} else {
+		a.NoteRules = rules
+	}
+
+	if pct, err := commissionFromEnv(); err != nil {
+		fmt.Printf("commission config error, using 0: %s\n", err.Error())
+	} else {
+		a.CommissionPercent = pct
+	}
+
+	if h, err := passwordHashingFromEnv(); err != nil {
+		fmt.Printf("password hashing config error, using defaults: %s\n", err.Error())
+		a.Passwords = defaultPasswordHashing
+	} else {
+		a.Passwords = h
+	}
+
+	if limits, err := loginLimitsFromEnv(); err != nil {
+		fmt.Printf("login limits config error, using defaults: %s\n", err.Error())
+		a.Logins = NewLoginGuard(defaultLoginLimits)
+	} else {
+		a.Logins = NewLoginGuard(limits)
+	}
+
+	if c, err := corsConfigFromEnv(); err != nil {
+		fmt.Printf("cors config error, no other origins allowed: %s\n", err.Error())
+	} else {
+		a.CORS = c
+	}
+
+	if d, err := hstsFromEnv(); err != nil {
+		fmt.Printf("hsts config error, using %s: %s\n", default_hsts_max_age, err.Error())
+		a.HSTSMaxAge = default_hsts_max_age
+	} else {
+		a.HSTSMaxAge = d
+	}
+
+	if proxies, err := trustedProxiesFromEnv(); err != nil {
+		fmt.Printf("trusted proxies config error, trusting none: %s\n", err.Error())
+	} else {
+		a.TrustedProxies = proxies
+	}
+
+	if ttl, err := userCacheTTLFromEnv(); err != nil {
+		fmt.Printf("user cache config error, using %s: %s\n", default_user_cache_ttl, err.Error())
+		a.Users = NewUserCache(default_user_cache_ttl)
+	} else {
+		a.Users = NewUserCache(ttl)
+	}
+
+	if n, err := notifierFromEnv(); err != nil {
+		fmt.Printf("notifier config error, using log: %s\n", err.Error())
+		a.Notifier = LogNotifier{}
+	} else {
+		a.Notifier = n
+	}
+
+	if c, err := oidcConfigFromEnv(); err != nil {
+		fmt.Printf("oidc config error, oidc login disabled: %s\n", err.Error())
+	} else if c != nil {
+		a.OIDC = NewOIDCProvider(*c)
+	}
+
+	if policies, err := ratePoliciesFromEnv(); err != nil {
+		fmt.Printf("rate limits config error, using defaults: %s\n", err.Error())
+		a.RateLimits = defaultRatePolicies
+	} else {
+		a.RateLimits = policies
+	}
+	a.RateStore = NewMemoryRateStore()
+
+	if pubs, err := a.publishersFromEnv(); err != nil {
+		fmt.Printf("outbox publishers config error, using webhook: %s\n", err.Error())
+		a.Publishers = []Publisher{WebhookPublisher{App: a}}
+	} else {
+		a.Publishers = pubs
 	}
 
 	a.SetupRoutes()
@@ -30,10 +149,21 @@ func NewApp(addr string, db *sql.DB) *App {
 	return a
 }
 
+// HttpServer serves the API. After UseTLS it has a TLS config and is started with `ListenAndServeTLS("", "")`
 func (a *App) HttpServer() http.Server {
+
+	var tlsConfig *tls.Config
+	if a.certs != nil {
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: a.certs.GetCertificate,
+		}
+	}
+
 	return http.Server{
 		Addr:              a.Addr,
 		Handler:           a.Router,
+		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: 3 * time.Second,
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// Bus hands events to the subscribers in this process.
+// A subscriber that doesn't keep up misses events instead of blocking the publisher.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan model.Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan model.Event]struct{})}
+}
+
+// Subscribe returns a channel receiving the events published from now on, and a function to stop receiving them
+func (b *Bus) Subscribe(buffer int) (<-chan model.Event, func()) {
+
+	ch := make(chan model.Event, buffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+func (b *Bus) Publish(ctx context.Context, e model.Event) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestBusPublish(t *testing.T) {
+
+	bus := NewBus()
+
+	first, cancelFirst := bus.Subscribe(1)
+	second, cancelSecond := bus.Subscribe(1)
+	defer cancelSecond()
+
+	bus.Publish(context.Background(), model.Event{ID: "e1"})
+
+	for _, ch := range []<-chan model.Event{first, second} {
+		if e := <-ch; e.ID != "e1" {
+			t.Errorf("wrong event. expected: %s, got: %s", "e1", e.ID)
+		}
+	}
+
+	cancelFirst()
+
+	if _, ok := <-first; ok {
+		t.Error("channel should be closed after cancel")
+	}
+
+	// second is full after this one, the next event is dropped instead of blocking
+	bus.Publish(context.Background(), model.Event{ID: "e2"})
+	bus.Publish(context.Background(), model.Event{ID: "e3"})
+
+	if e := <-second; e.ID != "e2" {
+		t.Errorf("wrong event. expected: %s, got: %s", "e2", e.ID)
+	}
+
+	select {
+	case e := <-second:
+		t.Errorf("event should have been dropped, got: %s", e.ID)
+	default:
+	}
+
+	cancelFirst()
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const default_cors_max_age = 10 * time.Minute
+
+var (
+	cors_allowed_methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	cors_allowed_headers = []string{"Authorization", "Content-Type", "X-API-Key"}
+	cors_exposed_headers = []string{"Content-Disposition", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"}
+)
+
+// CORSConfig sets which other origins can call the API from a browser, e.g. the kiosk frontend
+type CORSConfig struct {
+	AllowedOrigins   []string      // e.g. `https://kiosk.example.com`, or `*` for any. None turns CORS off
+	AllowCredentials bool          // let the browser send cookies, not allowed with `*`
+	MaxAge           time.Duration // how long the browser keeps the answer to a preflight request
+}
+
+func corsConfigFromEnv() (CORSConfig, error) {
+
+	c := CORSConfig{MaxAge: default_cors_max_age}
+
+	for _, o := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		o = strings.TrimSuffix(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+				return CORSConfig{}, fmt.Errorf("CORS_ALLOWED_ORIGINS: not an origin: %s", o)
+			}
+		}
+		c.AllowedOrigins = append(c.AllowedOrigins, o)
+	}
+
+	if s := os.Getenv("CORS_ALLOW_CREDENTIALS"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return CORSConfig{}, fmt.Errorf("CORS_ALLOW_CREDENTIALS: %w", err)
+		}
+		c.AllowCredentials = b
+	}
+
+	if c.AllowCredentials && c.allowsAny() {
+		return CORSConfig{}, errors.New("CORS_ALLOW_CREDENTIALS is not allowed with any origin")
+	}
+
+	if s := os.Getenv("CORS_MAX_AGE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return CORSConfig{}, fmt.Errorf("CORS_MAX_AGE: %w", err)
+		}
+		if d < 0 {
+			return CORSConfig{}, errors.New("CORS_MAX_AGE cannot be negative")
+		}
+		c.MaxAge = d
+	}
+
+	return c, nil
+}
+
+func (c CORSConfig) allowsAny() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) allows(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CrossOrigin answers the preflight requests and adds the CORS headers for the allowed origins.
+// Requests from other origins get no CORS headers, so the browser doesn't let the page read the answer.
+func (a *App) CrossOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(a.CORS.AllowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !a.CORS.allows(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if a.CORS.allowsAny() && !a.CORS.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if a.CORS.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", strings.Join(cors_allowed_methods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(cors_allowed_headers, ", "))
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(a.CORS.MaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", strings.Join(cors_exposed_headers, ", "))
+
+		next.ServeHTTP(w, r)
+	})
+}
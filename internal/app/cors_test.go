@@ -0,0 +1,176 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCORSConfigFromEnv(t *testing.T) {
+
+	type scenario struct {
+		origins     string
+		credentials string
+		maxAge      string
+		isValid     bool
+		expected    []string
+	}
+
+	scenarios := []scenario{
+		{"", "", "", true, nil},
+		{"https://kiosk.example.com/, http://localhost:3000", "true", "1h", true, []string{"https://kiosk.example.com", "http://localhost:3000"}},
+		{"*", "", "", true, []string{"*"}},
+		{"*", "true", "", false, nil},
+		{"kiosk.example.com", "", "", false, nil},
+		{"https://kiosk.example.com/app", "", "", false, nil},
+		{"https://kiosk.example.com", "maybe", "", false, nil},
+		{"https://kiosk.example.com", "", "-1m", false, nil},
+	}
+
+	defer func() {
+		os.Unsetenv("CORS_ALLOWED_ORIGINS")
+		os.Unsetenv("CORS_ALLOW_CREDENTIALS")
+		os.Unsetenv("CORS_MAX_AGE")
+	}()
+
+	for _, s := range scenarios {
+		os.Setenv("CORS_ALLOWED_ORIGINS", s.origins)
+		os.Setenv("CORS_ALLOW_CREDENTIALS", s.credentials)
+		os.Setenv("CORS_MAX_AGE", s.maxAge)
+
+		c, err := corsConfigFromEnv()
+		if !s.isValid {
+			if err == nil {
+				t.Errorf("%q should not be valid", s.origins)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be valid, got: %v", s.origins, err)
+			continue
+		}
+
+		if len(c.AllowedOrigins) != len(s.expected) {
+			t.Fatalf("wrong origins. expected: %v, got: %v", s.expected, c.AllowedOrigins)
+		}
+		for i := range s.expected {
+			if c.AllowedOrigins[i] != s.expected[i] {
+				t.Errorf("wrong origins. expected: %v, got: %v", s.expected, c.AllowedOrigins)
+			}
+		}
+	}
+
+	os.Setenv("CORS_ALLOWED_ORIGINS", "https://kiosk.example.com")
+	os.Setenv("CORS_ALLOW_CREDENTIALS", "")
+	os.Setenv("CORS_MAX_AGE", "")
+
+	if c, _ := corsConfigFromEnv(); c.MaxAge != default_cors_max_age {
+		t.Errorf("wrong default max age. expected: %s, got: %s", default_cors_max_age, c.MaxAge)
+	}
+}
+
+func TestCrossOrigin(t *testing.T) {
+
+	vm := NewApp("", nil)
+	vm.CORS = CORSConfig{AllowedOrigins: []string{"https://kiosk.example.com"}, MaxAge: time.Hour}
+
+	type scenario struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		statusCode  int
+		allowOrigin string
+		nextCalled  bool
+	}
+
+	scenarios := []scenario{
+		{"same origin", http.MethodGet, "", false, http.StatusOK, "", true},
+		{"allowed origin", http.MethodGet, "https://kiosk.example.com", false, http.StatusOK, "https://kiosk.example.com", true},
+		{"other origin", http.MethodGet, "https://evil.example.com", false, http.StatusOK, "", true},
+		{"preflight", http.MethodOptions, "https://kiosk.example.com", true, http.StatusNoContent, "https://kiosk.example.com", false},
+		{"preflight from other origin", http.MethodOptions, "https://evil.example.com", true, http.StatusForbidden, "", false},
+		{"options without preflight", http.MethodOptions, "https://kiosk.example.com", false, http.StatusOK, "https://kiosk.example.com", true},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+			r, err := http.NewRequest(s.method, "/products", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.origin != "" {
+				r.Header.Set("Origin", s.origin)
+			}
+			if s.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+
+			vm.CrossOrigin(next).ServeHTTP(w, r)
+
+			if w.Code != s.statusCode {
+				t.Errorf("wrong status code. expected: %d, got: %d", s.statusCode, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != s.allowOrigin {
+				t.Errorf("wrong allowed origin. expected: %q, got: %q", s.allowOrigin, got)
+			}
+			if called != s.nextCalled {
+				t.Errorf("next handler called: %v, expected: %v", called, s.nextCalled)
+			}
+			if s.preflight && s.statusCode == http.StatusNoContent && w.Header().Get("Access-Control-Max-Age") != "3600" {
+				t.Errorf("wrong max age: %s", w.Header().Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
+
+func TestCrossOriginAnyOrigin(t *testing.T) {
+
+	vm := NewApp("", nil)
+	vm.CORS = CORSConfig{AllowedOrigins: []string{"*"}}
+
+	r, _ := http.NewRequest(http.MethodGet, "/products", nil)
+	r.Header.Set("Origin", "https://kiosk.example.com")
+	w := httptest.NewRecorder()
+
+	vm.CrossOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wrong allowed origin. expected: *, got: %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("credentials should not be allowed, got: %q", got)
+	}
+}
+
+func TestCrossOriginPreflightRoute(t *testing.T) {
+
+	vm := NewApp("", nil)
+	vm.CORS = CORSConfig{AllowedOrigins: []string{"https://kiosk.example.com"}, AllowCredentials: true}
+
+	// answered before the authentication
+	r, _ := http.NewRequest(http.MethodOptions, "/buy/product/abc/amount/1", nil)
+	r.Header.Set("Origin", "https://kiosk.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	r.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("credentials should be allowed, got: %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got == "" {
+		t.Error("allowed headers missing")
+	}
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Currency describes the money a machine works with.
+// All values are expressed in the currency's minor unit (e.g. cents).
+type Currency struct {
+	Code      string  `json:"code"`
+	Coins     []int64 `json:"coins"`      // accepted coin denominations, ascending
+	Notes     []int64 `json:"notes"`      // accepted banknote denominations, ascending. Notes are held in escrow
+	PriceStep int64   `json:"price_step"` // prices and deposits must be a multiple of this value
+}
+
+var defaultCurrency = Currency{
+	Code:      "EUR",
+	Coins:     []int64{5, 10, 20, 50, 100},
+	Notes:     []int64{500, 1000, 2000},
+	PriceStep: 5,
+}
+
+// NewCurrency validates the parameters and returns a currency with the coins and notes sorted ascending
+func NewCurrency(code string, coins []int64, notes []int64, priceStep int64) (Currency, error) {
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return Currency{}, errors.New("missing currency code")
+	}
+
+	if priceStep <= 0 {
+		return Currency{}, errors.New("price step must be positive")
+	}
+
+	if len(coins) == 0 {
+		return Currency{}, errors.New("at least one coin denomination is needed")
+	}
+
+	sortedCoins, err := sortedDenominations("coin", coins, priceStep)
+	if err != nil {
+		return Currency{}, err
+	}
+
+	sortedNotes, err := sortedDenominations("note", notes, priceStep)
+	if err != nil {
+		return Currency{}, err
+	}
+
+	return Currency{Code: code, Coins: sortedCoins, Notes: sortedNotes, PriceStep: priceStep}, nil
+}
+
+// sortedDenominations returns a sorted copy of `values` after checking they are positive, unique and multiples of `step`
+func sortedDenominations(kind string, values []int64, step int64) ([]int64, error) {
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i, v := range sorted {
+		if v <= 0 {
+			return nil, fmt.Errorf("%s value must be positive: %d", kind, v)
+		}
+		if v%step != 0 {
+			return nil, fmt.Errorf("%s value %d is not a multiple of the price step %d", kind, v, step)
+		}
+		if i > 0 && sorted[i-1] == v {
+			return nil, fmt.Errorf("duplicate %s value: %d", kind, v)
+		}
+	}
+
+	return sorted, nil
+}
+
+// currencyFromEnv reads CURRENCY_CODE, CURRENCY_COINS, CURRENCY_NOTES (comma separated) and CURRENCY_PRICE_STEP.
+// Missing values are taken from the default currency.
+func currencyFromEnv() (Currency, error) {
+
+	code := defaultCurrency.Code
+	if v := os.Getenv("CURRENCY_CODE"); v != "" {
+		code = v
+	}
+
+	coins := defaultCurrency.Coins
+	if v := os.Getenv("CURRENCY_COINS"); v != "" {
+		parsed, err := parseAmounts(v)
+		if err != nil {
+			return Currency{}, fmt.Errorf("CURRENCY_COINS: %w", err)
+		}
+		coins = parsed
+	}
+
+	notes := defaultCurrency.Notes
+	if v, ok := os.LookupEnv("CURRENCY_NOTES"); ok {
+		parsed, err := parseAmounts(v)
+		if err != nil {
+			return Currency{}, fmt.Errorf("CURRENCY_NOTES: %w", err)
+		}
+		notes = parsed
+	}
+
+	step := defaultCurrency.PriceStep
+	if v := os.Getenv("CURRENCY_PRICE_STEP"); v != "" {
+		s, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return Currency{}, fmt.Errorf("CURRENCY_PRICE_STEP: %w", err)
+		}
+		step = s
+	}
+
+	return NewCurrency(code, coins, notes, step)
+}
+
+// parseAmounts parses a comma separated list of values, like `5,10,20`
+func parseAmounts(s string) ([]int64, error) {
+	parts := strings.Split(s, ",")
+	values := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// coinRoutePattern returns a regular expression matching only the accepted coins, like `(5|10|20)`
+func (c Currency) coinRoutePattern() string {
+	return routePattern(c.Coins)
+}
+
+// noteRoutePattern returns a regular expression matching only the accepted notes
+func (c Currency) noteRoutePattern() string {
+	return routePattern(c.Notes)
+}
+
+func routePattern(values []int64) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.FormatInt(v, 10)
+	}
+
+	return "(" + strings.Join(s, "|") + ")"
+}
+
+// changeFromInventory splits the amount `n` using only the coins available in `inventory`, with as few coins as possible.
+// The result has one entry per coin denomination, in the same order as `Coins`.
+func (c Currency) changeFromInventory(n int64, inventory []coinCount) ([]int64, error) {
+
+	if n < 0 || n%c.PriceStep != 0 {
+		return nil, fmt.Errorf("amount should be a multiple of %d", c.PriceStep)
+	}
+
+	// bounded coin change solved as a 0/1 knapsack: the available coins of each denomination
+	// are split in groups of 1, 2, 4, ... coins. Values are expressed in price steps.
+	type group struct {
+		coin   int
+		amount int64
+		weight int64
+	}
+
+	groups := make([]group, 0)
+	for _, cc := range inventory {
+		for i, v := range c.Coins {
+			if v != cc.Coin {
+				continue
+			}
+			left := cc.Amount
+			for k := int64(1); left > 0; k <<= 1 {
+				if k > left {
+					k = left
+				}
+				groups = append(groups, group{coin: i, amount: k, weight: k * v / c.PriceStep})
+				left -= k
+			}
+		}
+	}
+
+	m := n / c.PriceStep
+	const unreachable = int64(-1)
+
+	best := make([]int64, m+1) // least coins needed for each value
+	for v := range best {
+		best[v] = unreachable
+	}
+	best[0] = 0
+
+	taken := make([][]bool, len(groups))
+	for j, g := range groups {
+		taken[j] = make([]bool, m+1)
+		for v := m; v >= g.weight; v-- {
+			prev := best[v-g.weight]
+			if prev != unreachable && (best[v] == unreachable || prev+g.amount < best[v]) {
+				best[v] = prev + g.amount
+				taken[j][v] = true
+			}
+		}
+	}
+
+	if best[m] == unreachable {
+		return nil, errors.New("not enough coins for change")
+	}
+
+	change := make([]int64, len(c.Coins))
+	for j, v := len(groups)-1, m; j >= 0; j-- {
+		if taken[j][v] {
+			change[groups[j].coin] += groups[j].amount
+			v -= groups[j].weight
+		}
+	}
+
+	return change, nil
+}
+
+// coinCounts pairs the counts in `change` with the coin denominations, skipping the coins not used
+func (c Currency) coinCounts(change []int64) []coinCount {
+	counts := make([]coinCount, 0)
+	for i, n := range change {
+		if n > 0 {
+			counts = append(counts, coinCount{Coin: c.Coins[i], Amount: n})
+		}
+	}
+
+	return counts
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewCurrency(t *testing.T) {
+
+	type scenario struct {
+		name    string
+		code    string
+		coins   []int64
+		notes   []int64
+		step    int64
+		isValid bool
+	}
+
+	scenarios := []scenario{
+		{"default", "EUR", []int64{5, 10, 20, 50, 100}, []int64{500, 1000, 2000}, 5, true},
+		{"unsorted", "usd", []int64{25, 1, 10, 5}, []int64{500, 100}, 1, true},
+		{"no notes", "EUR", []int64{5}, nil, 5, true},
+		{"no code", " ", []int64{5}, nil, 5, false},
+		{"no coins", "EUR", []int64{}, nil, 5, false},
+		{"zero step", "EUR", []int64{5}, nil, 0, false},
+		{"negative coin", "EUR", []int64{-5, 5}, nil, 5, false},
+		{"coin not multiple of step", "EUR", []int64{5, 12}, nil, 5, false},
+		{"duplicate coin", "EUR", []int64{5, 10, 5}, nil, 5, false},
+		{"note not multiple of step", "EUR", []int64{5}, []int64{502}, 5, false},
+		{"duplicate note", "EUR", []int64{5}, []int64{500, 500}, 5, false},
+	}
+
+	for _, s := range scenarios {
+		_, err := NewCurrency(s.code, s.coins, s.notes, s.step)
+		if s.isValid && err != nil {
+			t.Errorf("%s: unexpected error: %s", s.name, err)
+		}
+
+		if !s.isValid && err == nil {
+			t.Errorf("%s: currency should be rejected", s.name)
+		}
+	}
+}
+
+func TestNewCurrencySortsCoins(t *testing.T) {
+
+	c, err := NewCurrency("usd", []int64{25, 1, 10, 5}, []int64{500, 100}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Code != "USD" {
+		t.Errorf("wrong code. expected: %s, got: %s", "USD", c.Code)
+	}
+
+	if !reflect.DeepEqual(c.Coins, []int64{1, 5, 10, 25}) {
+		t.Errorf("coins not sorted: %v", c.Coins)
+	}
+
+	if !reflect.DeepEqual(c.Notes, []int64{100, 500}) {
+		t.Errorf("notes not sorted: %v", c.Notes)
+	}
+}
+
+func TestCurrencyFromEnv(t *testing.T) {
+
+	os.Setenv("CURRENCY_CODE", "CHF")
+	os.Setenv("CURRENCY_COINS", "10, 20, 50, 100, 200, 500")
+	os.Setenv("CURRENCY_NOTES", "1000,2000")
+	os.Setenv("CURRENCY_PRICE_STEP", "10")
+	defer func() {
+		os.Unsetenv("CURRENCY_CODE")
+		os.Unsetenv("CURRENCY_COINS")
+		os.Unsetenv("CURRENCY_NOTES")
+		os.Unsetenv("CURRENCY_PRICE_STEP")
+	}()
+
+	c, err := currencyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Code != "CHF" {
+		t.Errorf("wrong code. expected: %s, got: %s", "CHF", c.Code)
+	}
+
+	if !reflect.DeepEqual(c.Coins, []int64{10, 20, 50, 100, 200, 500}) {
+		t.Errorf("wrong coins: %v", c.Coins)
+	}
+
+	if !reflect.DeepEqual(c.Notes, []int64{1000, 2000}) {
+		t.Errorf("wrong notes: %v", c.Notes)
+	}
+
+	if c.PriceStep != 10 {
+		t.Errorf("wrong price step. expected: %d, got: %d", 10, c.PriceStep)
+	}
+
+	os.Setenv("CURRENCY_COINS", "10,abc")
+	if _, err := currencyFromEnv(); err == nil {
+		t.Error("should fail for non numeric coins")
+	}
+}
+
+func TestCurrencyFromEnvDefaults(t *testing.T) {
+
+	c, err := currencyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c, defaultCurrency) {
+		t.Errorf("expected the default currency, got: %v", c)
+	}
+}
+
+func TestCoinRoutePattern(t *testing.T) {
+	if p := defaultCurrency.coinRoutePattern(); p != "(5|10|20|50|100)" {
+		t.Errorf("wrong pattern. expected: %s, got: %s", "(5|10|20|50|100)", p)
+	}
+}
+
+func TestChangeFromInventory(t *testing.T) {
+
+	type scenario struct {
+		name      string
+		n         int64
+		inventory []coinCount
+		change    []int64
+		isValid   bool
+	}
+
+	plenty := []coinCount{{5, 100}, {10, 100}, {20, 100}, {50, 100}, {100, 100}}
+
+	scenarios := []scenario{
+		{"nothing to pay", 0, nil, []int64{0, 0, 0, 0, 0}, true},
+		{"plenty of coins", 385, plenty, []int64{1, 1, 1, 1, 3}, true},
+		{"no big coins", 100, []coinCount{{20, 10}, {5, 10}}, []int64{0, 0, 5, 0, 0}, true},
+		{"greedy would fail", 60, []coinCount{{20, 3}, {50, 1}}, []int64{0, 0, 3, 0, 0}, true},
+		{"small coins as last resort", 35, []coinCount{{5, 10}, {10, 1}, {20, 1}}, []int64{1, 1, 1, 0, 0}, true},
+		{"empty coin box", 5, nil, nil, false},
+		{"not enough coins", 60, []coinCount{{20, 2}, {50, 1}}, nil, false},
+		{"not a multiple of the step", 12, plenty, nil, false},
+		{"negative", -5, plenty, nil, false},
+		{"unknown coins are ignored", 3, []coinCount{{3, 1}}, nil, false},
+	}
+
+	for _, s := range scenarios {
+		res, err := defaultCurrency.changeFromInventory(s.n, s.inventory)
+		if s.isValid && err != nil {
+			t.Errorf("%s: unexpected error: %s", s.name, err)
+			continue
+		}
+
+		if !s.isValid {
+			if err == nil {
+				t.Errorf("%s: should fail, got: %v", s.name, res)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(res, s.change) {
+			t.Errorf("%s: wrong change. expected: %v, got: %v", s.name, s.change, res)
+		}
+	}
+}
+
+func TestCoinCounts(t *testing.T) {
+
+	res := defaultCurrency.coinCounts([]int64{1, 0, 2, 0, 3})
+	expected := []coinCount{{5, 1}, {20, 2}, {100, 3}}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("wrong coin counts. expected: %v, got: %v", expected, res)
+	}
+}
+
+func TestDepositRouteFollowsCurrency(t *testing.T) {
+
+	os.Setenv("CURRENCY_CODE", "USD")
+	os.Setenv("CURRENCY_COINS", "1,5,10,25")
+	os.Setenv("CURRENCY_PRICE_STEP", "1")
+	defer func() {
+		os.Unsetenv("CURRENCY_CODE")
+		os.Unsetenv("CURRENCY_COINS")
+		os.Unsetenv("CURRENCY_PRICE_STEP")
+	}()
+
+	router := NewApp("", nil).Router
+
+	type scenario struct {
+		path       string
+		statusCode int
+	}
+
+	// unauthorized means the route exists and is protected
+	scenarios := []scenario{
+		{"/deposit/25", http.StatusUnauthorized},
+		{"/deposit/1", http.StatusUnauthorized},
+		{"/deposit/20", http.StatusNotFound},
+		{"/deposit/100", http.StatusNotFound},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodPost, s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s wrong status code. expected: %d, got: %d", s.path, s.statusCode, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestHandleCurrency(t *testing.T) {
+
+	r, err := http.NewRequest(http.MethodGet, "/currency", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	NewApp("", nil).Router.ServeHTTP(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var c Currency
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c, defaultCurrency) {
+		t.Errorf("wrong currency. expected: %v, got: %v", defaultCurrency, c)
+	}
+}
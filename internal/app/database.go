@@ -2,8 +2,10 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/mehiX/vending-machine-api/internal/app/model"
@@ -11,16 +13,21 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-// dbCreateUser receives sanitized data and tries to create a new database record
-func (a *App) dbCreateUser(ctx context.Context, username, encPasswd string, role string) (err error) {
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// dbCreateUser receives sanitized data and tries to create a new database record. Returns the ID of the new user
+func (a *App) dbCreateUser(ctx context.Context, username, encPasswd string, role string) (userID string, err error) {
 
 	if a.Db == nil {
-		return errors.New("no database configured")
+		return "", errors.New("no database configured")
 	}
 
 	tx, err := a.Db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return
 	}
 
 	defer func() {
@@ -34,19 +41,23 @@ func (a *App) dbCreateUser(ctx context.Context, username, encPasswd string, role
 
 	qryUser := "insert into users (id, username, password, role) values (?, ?, ?, ?)"
 
-	_, err = tx.ExecContext(ctx, qryUser, uuid.New().String(), username, encPasswd, role)
-	if err != nil {
-		return err
+	userID = uuid.New().String()
+
+	if _, err = tx.ExecContext(ctx, qryUser, userID, username, encPasswd, role); err != nil {
+		return
 	}
 
+	err = addOutboxEvent(ctx, tx, model.EVENT_USER_CREATED, userEvent{ID: userID, Username: username, Role: role})
+
 	return
 
 }
 
-func (a *App) dbCreateProduct(ctx context.Context, sellerID string, amountAvailable int64, cost int64, name string) (err error) {
+// dbCreateProduct saves a new product and its first price version. Returns the ID of the new product
+func (a *App) dbCreateProduct(ctx context.Context, sellerID string, amountAvailable int64, cost int64, name string) (productID string, err error) {
 	tx, err := a.Db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return
 	}
 
 	defer func() {
@@ -60,11 +71,19 @@ func (a *App) dbCreateProduct(ctx context.Context, sellerID string, amountAvaila
 
 	qryProd := "insert into products (id, name, available_amount, cost, seller_id) values (?, ?, ?, ?, ?)"
 
-	_, err = tx.ExecContext(ctx, qryProd, uuid.New().String(), name, amountAvailable, cost, sellerID)
+	productID = uuid.New().String()
+
+	_, err = tx.ExecContext(ctx, qryProd, productID, name, amountAvailable, cost, sellerID)
 	if err != nil {
-		return err
+		return
 	}
 
+	if err = setPrice(ctx, tx, productID, cost); err != nil {
+		return
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_PRODUCT_CREATED, model.Product{ID: productID, Name: name, AmountAvailable: amountAvailable, Cost: cost, SellerID: sellerID})
+
 	return
 
 }
@@ -82,12 +101,15 @@ func (a *App) dbFindUserByID(ctx context.Context, userID string) (*model.User, e
 	defer conn.Close()
 
 	var usr model.User
+	var roles string
 
-	row := conn.QueryRowContext(ctx, `select id, username, password, deposit, role from users where id=?`, userID)
-	if err := row.Scan(&usr.ID, &usr.Username, &usr.Password, &usr.Deposit, &usr.Role); err != nil {
+	row := conn.QueryRowContext(ctx, `select id, username, password, deposit, role, session_version from users where id=?`, userID)
+	if err := row.Scan(&usr.ID, &usr.Username, &usr.Password, &usr.Deposit, &roles, &usr.SessionVersion); err != nil {
 		return nil, err
 	}
 
+	usr.SetRoles(parseRoles(roles))
+
 	return &usr, nil
 }
 
@@ -100,15 +122,77 @@ func (a *App) dbFindUserByUsername(ctx context.Context, username string) (*model
 	defer conn.Close()
 
 	var usr model.User
+	var roles string
 
-	row := conn.QueryRowContext(ctx, `select id, username, password, deposit, role from users where username=?`, username)
-	if err := row.Scan(&usr.ID, &usr.Username, &usr.Password, &usr.Deposit, &usr.Role); err != nil {
+	row := conn.QueryRowContext(ctx, `select id, username, password, deposit, role, session_version from users where username=?`, username)
+	if err := row.Scan(&usr.ID, &usr.Username, &usr.Password, &usr.Deposit, &roles, &usr.SessionVersion); err != nil {
 		return nil, err
 	}
 
+	usr.SetRoles(parseRoles(roles))
+
 	return &usr, nil
 }
 
+// dbChangePassword replaces the password hash, if it is still `oldHash`, and revokes the user's tokens.
+// Fails with errResetToken if it changed in the meantime
+func (a *App) dbChangePassword(ctx context.Context, userID, oldHash, newHash string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update users set password=?, session_version = session_version + 1 where id=? and password=?`, newHash, userID, oldHash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errResetToken
+	}
+
+	return nil
+}
+
+// dbRehashPassword replaces the password hash with one of the same password, if it is still `oldHash`.
+// The password didn't change, the tokens stay valid. Fails with errPasswordChanged if the hash changed in the meantime
+func (a *App) dbRehashPassword(ctx context.Context, userID, oldHash, newHash string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update users set password=? where id=? and password=?`, newHash, userID, oldHash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errPasswordChanged
+	}
+
+	return nil
+}
+
+// dbSetUserRoles replaces the user's roles, the first one is the main role, and revokes the user's tokens
+func (a *App) dbSetUserRoles(ctx context.Context, userID string, roles []model.TypeRole) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update users set role=?, session_version = session_version + 1 where id=?`, strings.Join(roles, ","), userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
 func (a *App) dbFindProductByID(ctx context.Context, productID string) (*model.Product, error) {
 
 	conn, err := a.Db.Conn(ctx)
@@ -119,13 +203,17 @@ func (a *App) dbFindProductByID(ctx context.Context, productID string) (*model.P
 
 	var prod model.Product
 
-	qryProdByID := `select id, name, available_amount, cost, seller_id from products where id=?`
+	var priceID sql.NullString
+
+	qryProdByID := `select id, name, available_amount, cost, seller_id, price_id from products where id=?`
 
 	row := conn.QueryRowContext(ctx, qryProdByID, productID)
-	if err := row.Scan(&prod.ID, &prod.Name, &prod.AmountAvailable, &prod.Cost, &prod.SellerID); err != nil {
+	if err := row.Scan(&prod.ID, &prod.Name, &prod.AmountAvailable, &prod.Cost, &prod.SellerID, &priceID); err != nil {
 		return nil, err
 	}
 
+	prod.PriceID = priceID.String
+
 	return &prod, nil
 }
 
@@ -147,7 +235,11 @@ func (a *App) dbDeleteProduct(ctx context.Context, productID, sellerID string) (
 
 	qryDelProd := `delete from products where id=? and seller_id=?`
 
-	_, err = tx.ExecContext(ctx, qryDelProd, productID, sellerID)
+	if _, err = tx.ExecContext(ctx, qryDelProd, productID, sellerID); err != nil {
+		return
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_PRODUCT_DELETED, productDeletedEvent{ID: productID, SellerID: sellerID})
 
 	return
 }
@@ -158,7 +250,7 @@ func (a *App) dbListProducts(ctx context.Context) ([]model.Product, error) {
 		return nil, err
 	}
 
-	rows, err := conn.QueryContext(ctx, `select id, name, available_amount, cost, seller_id from products`)
+	rows, err := conn.QueryContext(ctx, `select id, name, available_amount, cost, seller_id, price_id from products`)
 	if err != nil {
 		return nil, err
 	}
@@ -168,17 +260,21 @@ func (a *App) dbListProducts(ctx context.Context) ([]model.Product, error) {
 
 	for rows.Next() {
 		var p model.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.AmountAvailable, &p.Cost, &p.SellerID); err != nil {
+		var priceID sql.NullString
+		if err := rows.Scan(&p.ID, &p.Name, &p.AmountAvailable, &p.Cost, &p.SellerID, &priceID); err != nil {
 			fmt.Println("product record error", err)
 			continue
 		}
+		p.PriceID = priceID.String
 		products = append(products, p)
 	}
 
 	return products, nil
 }
 
-func (a *App) dbUpdateProduct(ctx context.Context, p model.Product) (err error) {
+// dbUpdateProduct saves the name and cost of the product.
+// If `newPrice` is true, the cost is also recorded as a new price version.
+func (a *App) dbUpdateProduct(ctx context.Context, p model.Product, newPrice bool) (err error) {
 
 	tx, err := a.Db.BeginTx(ctx, nil)
 	if err != nil {
@@ -196,15 +292,33 @@ func (a *App) dbUpdateProduct(ctx context.Context, p model.Product) (err error)
 
 	qryUpdProd := `update products set name=?, cost=? where id=? and seller_id=?`
 
-	_, err = tx.ExecContext(ctx, qryUpdProd, p.Name, p.Cost, p.ID, p.SellerID)
+	if _, err = tx.ExecContext(ctx, qryUpdProd, p.Name, p.Cost, p.ID, p.SellerID); err != nil {
+		return
+	}
+
+	if newPrice {
+		if err = setPrice(ctx, tx, p.ID, p.Cost); err != nil {
+			return
+		}
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_PRODUCT_UPDATED, p)
 
 	return
 }
 
-func (a *App) dbUserUpdateDeposit(ctx context.Context, userID string, newDeposit int64) (err error) {
+// dbBuy implements the buy logic at the database level
+// this would be better implemented in a stored procedure
+// If `fromEscrow` is positive, the deposit alone doesn't pay for the purchase. The notes held in escrow for the user are locked,
+// collected and added to the deposit before paying, and the buy fails if they are now worth less than `fromEscrow`.
+// The stock and the deposit are only taken if there is enough of them when the transaction runs, so concurrent buys can't oversell.
+// The purchase is recorded with a new ID and the seller is credited in the earnings ledger.
+// A stock alert raised by the buy is published with the purchase.
+// Returns the value of the collected notes.
+func (a *App) dbBuy(ctx context.Context, p *model.Purchase, fromEscrow int64) (escrowTotal int64, err error) {
 
 	if a.Db == nil {
-		return errors.New("no database configured")
+		return 0, errors.New("no database configured")
 	}
 
 	tx, err := a.Db.BeginTx(ctx, nil)
@@ -221,48 +335,102 @@ func (a *App) dbUserUpdateDeposit(ctx context.Context, userID string, newDeposit
 		}
 	}()
 
-	qryUpdateDeposit := `update users set deposit=? where id=?`
+	res, err := tx.ExecContext(ctx, `update products set available_amount = available_amount - ? where id=? and available_amount >= ?`, p.Amount, p.ProductID, p.Amount)
+	if err != nil {
+		return
+	}
 
-	_, err = tx.ExecContext(ctx, qryUpdateDeposit, newDeposit, userID)
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, errNoAvailability
+	}
 
-	return
+	if fromEscrow > 0 {
+		if escrowTotal, err = collectEscrow(ctx, tx, p.UserID); err != nil {
+			return
+		}
 
-}
+		if escrowTotal < fromEscrow {
+			return 0, errNotEnoughDeposit
+		}
+	}
 
-// dbBuy implements the buy logic at the database level
-// this would be better implemented in a stored procedure
-func (a *App) dbBuy(ctx context.Context, userID, prodID string, amount int, totalCost int64) (err error) {
+	if res, err = tx.ExecContext(ctx, `update users set deposit = deposit - ? where id=? and deposit >= ?`, p.TotalPrice, p.UserID, p.TotalPrice); err != nil {
+		return
+	}
 
-	if a.Db == nil {
-		return errors.New("no database configured")
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, errNotEnoughDeposit
 	}
 
-	tx, err := a.Db.BeginTx(ctx, nil)
-	if err != nil {
+	p.ID = uuid.New().String()
+	p.Status = model.VEND_PENDING
+
+	qryPurchase := `insert into purchases (id, user_id, product_id, seller_id, amount, unit_cost, base_price, total_price, price_id, promotion_id, status, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, now())`
+
+	if _, err = tx.ExecContext(ctx, qryPurchase, p.ID, p.UserID, p.ProductID, p.SellerID, p.Amount, p.UnitCost, p.BasePrice, p.TotalPrice, nullString(p.PriceID), nullString(p.PromotionID), p.Status); err != nil {
 		return
 	}
 
-	defer func() {
-		switch err {
-		case nil:
-			err = tx.Commit()
-		default:
-			tx.Rollback()
-		}
-	}()
+	if err = creditSale(ctx, tx, p); err != nil {
+		return
+	}
 
-	if _, err = tx.ExecContext(ctx, `update products set available_amount = available_amount - ? where id=?`, amount, prodID); err != nil {
+	alert, err := checkStockAlert(ctx, tx, p)
+	if err != nil {
 		return
 	}
 
-	if _, err = tx.ExecContext(ctx, `update users set deposit = deposit - ? where id=?`, totalCost, userID); err != nil {
+	if err = addOutboxEvent(ctx, tx, model.EVENT_PURCHASE, p); err != nil {
 		return
 	}
 
-	// TODO: extra checks if resting available_amount < 0 or deposit < 0
-	// the way these situations are handled in a concurrent environment
-	// depend a lot on the database as well (how transactions work, isolation, snapshots, etc)
+	if alert != nil {
+		if err = addOutboxEvent(ctx, tx, stockAlertEvents[alert.Type], alert); err != nil {
+			return
+		}
+	}
 
 	return
 
 }
+
+// collectEscrow locks the notes the user has in escrow, deletes them and adds their value to the deposit.
+// Only the rows that were read are deleted, so a note inserted meanwhile stays in escrow. Returns the value added.
+func collectEscrow(ctx context.Context, tx *sql.Tx, userID string) (total int64, err error) {
+
+	rows, err := tx.QueryContext(ctx, `select id, note_value from escrow_notes where user_id=? for update`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []any
+	for rows.Next() {
+		var id string
+		var value int64
+		if err = rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		total += value
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	qry := `delete from escrow_notes where id in (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	if _, err = tx.ExecContext(ctx, qry, ids...); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `update users set deposit = deposit + ? where id=?`, total, userID); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
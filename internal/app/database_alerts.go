@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// stockAlertEvents are the events published for the stock alerts
+var stockAlertEvents = map[model.TypeStockAlert]model.TypeEvent{
+	model.ALERT_LOW_STOCK: model.EVENT_STOCK_LOW,
+	model.ALERT_SOLD_OUT:  model.EVENT_STOCK_SOLD_OUT,
+}
+
+// checkStockAlert looks at the stock left after a purchase and adds an alert to the seller's inbox
+// when the product sold out or crossed its low-stock threshold. Runs as part of the buy transaction.
+func checkStockAlert(ctx context.Context, tx *sql.Tx, p *model.Purchase) (*model.StockAlert, error) {
+
+	var stock, threshold int64
+	if err := tx.QueryRowContext(ctx, `select available_amount, low_stock_threshold from products where id=?`, p.ProductID).Scan(&stock, &threshold); err != nil {
+		return nil, err
+	}
+
+	alertType, ok := model.StockAlertFor(stock+int64(p.Amount), stock, threshold)
+	if !ok {
+		return nil, nil
+	}
+
+	alert := model.StockAlert{
+		ID:        uuid.New().String(),
+		SellerID:  p.SellerID,
+		ProductID: p.ProductID,
+		Type:      alertType,
+		Stock:     stock,
+		Threshold: threshold,
+		CreatedAt: time.Now(),
+	}
+
+	qry := `insert into stock_alerts (id, seller_id, product_id, alert_type, stock, threshold, created_at) values (?, ?, ?, ?, ?, ?, now())`
+
+	if _, err := tx.ExecContext(ctx, qry, alert.ID, alert.SellerID, alert.ProductID, alert.Type, alert.Stock, alert.Threshold); err != nil {
+		return nil, err
+	}
+
+	return &alert, nil
+}
+
+func (a *App) dbSetLowStockThreshold(ctx context.Context, productID string, threshold int64) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `update products set low_stock_threshold=? where id=?`, threshold, productID)
+
+	return
+}
+
+// dbSellerAlerts lists the alerts of a seller, newest first. Acknowledged alerts are only included if `all` is true
+func (a *App) dbSellerAlerts(ctx context.Context, sellerID string, all bool) ([]model.StockAlert, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, seller_id, product_id, alert_type, stock, threshold, created_at, acknowledged_at from stock_alerts where seller_id=? and (? or acknowledged_at is null) order by created_at desc`
+
+	rows, err := conn.QueryContext(ctx, qry, sellerID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]model.StockAlert, 0)
+
+	for rows.Next() {
+		var al model.StockAlert
+		var ackAt sql.NullTime
+		if err := rows.Scan(&al.ID, &al.SellerID, &al.ProductID, &al.Type, &al.Stock, &al.Threshold, &al.CreatedAt, &ackAt); err != nil {
+			fmt.Println("alert record error", err)
+			continue
+		}
+		if ackAt.Valid {
+			al.AcknowledgedAt = &ackAt.Time
+		}
+		alerts = append(alerts, al)
+	}
+
+	return alerts, rows.Err()
+}
+
+func (a *App) dbAcknowledgeAlert(ctx context.Context, alertID, sellerID string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `update stock_alerts set acknowledged_at=now() where id=? and seller_id=? and acknowledged_at is null`, alertID, sellerID)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = errors.New("alert not found")
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbBuyRaisesStockAlert(t *testing.T) {
+
+	type scenario struct {
+		name      string
+		stock     int64
+		threshold int64
+		alert     model.TypeStockAlert
+		event     model.TypeEvent
+	}
+
+	scenarios := []scenario{
+		{"above threshold", 6, 5, "", ""},
+		{"crossed threshold", 4, 5, model.ALERT_LOW_STOCK, model.EVENT_STOCK_LOW},
+		{"sold out", 0, 5, model.ALERT_SOLD_OUT, model.EVENT_STOCK_SOLD_OUT},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(`update products set available_amount =`).WithArgs(2, "prod", 2).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(100, "user", 100).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`insert into seller_ledger`).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(`select available_amount, low_stock_threshold from products where id=\?`).WithArgs("prod").
+			WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(s.stock, s.threshold))
+		if s.alert != "" {
+			mock.ExpectExec(`insert into stock_alerts`).WithArgs(sqlmock.AnyArg(), "seller", "prod", s.alert, s.stock, s.threshold).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectExec(`insert into outbox`).WithArgs(sqlmock.AnyArg(), model.EVENT_PURCHASE, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		if s.event != "" {
+			mock.ExpectExec(`insert into outbox`).WithArgs(sqlmock.AnyArg(), s.event, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		p := &model.Purchase{UserID: "user", ProductID: "prod", SellerID: "seller", Amount: 2, TotalPrice: 100}
+		if _, err := NewApp("", db).dbBuy(context.Background(), p, 0); err != nil {
+			t.Fatalf("%s: %s", s.name, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestDbSellerAlerts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+
+	rows := sqlmock.NewRows([]string{"id", "seller_id", "product_id", "alert_type", "stock", "threshold", "created_at", "acknowledged_at"}).
+		AddRow("a1", "seller", "prod", model.ALERT_SOLD_OUT, 0, 5, now, nil).
+		AddRow("a2", "seller", "prod", model.ALERT_LOW_STOCK, 3, 5, now, now)
+
+	mock.ExpectQuery(`select .* from stock_alerts where seller_id=\? and \(\? or acknowledged_at is null\)`).WithArgs("seller", true).WillReturnRows(rows)
+
+	alerts, err := NewApp("", db).dbSellerAlerts(context.Background(), "seller", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(alerts) != 2 {
+		t.Fatalf("wrong number of alerts. expected: %d, got: %d", 2, len(alerts))
+	}
+
+	if alerts[0].AcknowledgedAt != nil || alerts[1].AcknowledgedAt == nil {
+		t.Errorf("wrong acknowledged dates: %v, %v", alerts[0].AcknowledgedAt, alerts[1].AcknowledgedAt)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbAcknowledgeAlertNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update stock_alerts set acknowledged_at=now\(\)`).WithArgs("alert", "seller").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = NewApp("", db).dbAcknowledgeAlert(context.Background(), "alert", "seller")
+	if err == nil || err.Error() != "alert not found" {
+		t.Errorf("wrong error. expected: %s, got: %v", "alert not found", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+var errAPIKeyNotFound = errors.New("api key not found")
+
+// dbCreateAPIKey saves the key with the hash of its secret. Fails if the user already has the most active keys allowed
+func (a *App) dbCreateAPIKey(ctx context.Context, key model.APIKey, keyHash string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	var active int
+	if err = tx.QueryRowContext(ctx, `select count(*) from api_keys where user_id=? and revoked_at is null for update`, key.UserID).Scan(&active); err != nil {
+		return
+	}
+
+	if active >= apikey_max_per_user {
+		err = fmt.Errorf("maximum %d active api keys", apikey_max_per_user)
+		return
+	}
+
+	qry := `insert into api_keys (id, user_id, name, prefix, key_hash, scopes, created_at) values (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.ExecContext(ctx, qry, key.ID, key.UserID, key.Name, key.Prefix, keyHash, strings.Join(key.Scopes, ","), key.CreatedAt)
+
+	return
+}
+
+// dbAPIKeys lists the user's keys, revoked ones included, newest first
+func (a *App) dbAPIKeys(ctx context.Context, userID string) ([]model.APIKey, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at from api_keys where user_id=? order by created_at desc`
+
+	rows, err := conn.QueryContext(ctx, qry, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]model.APIKey, 0)
+
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			fmt.Println("api key record error", err)
+			continue
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+// dbActiveAPIKey finds a key that is not revoked by the hash of its secret. Returns sql.ErrNoRows if there is none
+func (a *App) dbActiveAPIKey(ctx context.Context, keyHash string) (*model.APIKey, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at from api_keys where key_hash=? and revoked_at is null`
+
+	return scanAPIKey(conn.QueryRowContext(ctx, qry, keyHash))
+}
+
+// dbTouchAPIKey records the key was used. Updated at most once a minute, not to write on every request
+func (a *App) dbTouchAPIKey(ctx context.Context, keyID string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	qry := `update api_keys set last_used_at=now() where id=? and (last_used_at is null or last_used_at < now() - interval 1 minute)`
+
+	_, err := a.Db.ExecContext(ctx, qry, keyID)
+
+	return err
+}
+
+// dbRevokeAPIKey revokes one of the user's active keys
+func (a *App) dbRevokeAPIKey(ctx context.Context, userID, keyID string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update api_keys set revoked_at=now() where id=? and user_id=? and revoked_at is null`, keyID, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errAPIKeyNotFound
+	}
+
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row scanner) (*model.APIKey, error) {
+
+	var k model.APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &lastUsed, &revoked); err != nil {
+		return nil, err
+	}
+
+	k.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		k.RevokedAt = &revoked.Time
+	}
+
+	return &k, nil
+}
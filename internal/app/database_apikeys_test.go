@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbCreateAPIKeyLimit(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select count\(\*\) from api_keys where user_id=\? and revoked_at is null for update`).WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(apikey_max_per_user))
+	mock.ExpectRollback()
+
+	key := model.APIKey{ID: "key1", UserID: "user1", Name: "machine 1", Prefix: "vmk_abcdefgh", Scopes: []string{scope_deposit}}
+	if err := NewApp("", db).dbCreateAPIKey(context.Background(), key, "hash"); err == nil {
+		t.Error("should fail over the limit")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbCreateAPIKey(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	created := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select count\(\*\) from api_keys`).WithArgs("user1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectExec(`insert into api_keys`).WithArgs("key1", "user1", "machine 1", "vmk_abcdefgh", "hash", "deposit,buy", created).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	key := model.APIKey{ID: "key1", UserID: "user1", Name: "machine 1", Prefix: "vmk_abcdefgh", Scopes: []string{scope_deposit, scope_buy}, CreatedAt: created}
+	if err := NewApp("", db).dbCreateAPIKey(context.Background(), key, "hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbAPIKeys(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	created := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	used := created.Add(time.Hour)
+
+	mock.ExpectQuery(`select id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at from api_keys where user_id=\?`).WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "last_used_at", "revoked_at"}).
+			AddRow("key2", "user1", "script", "vmk_12345678", "read", created, nil, nil).
+			AddRow("key1", "user1", "machine 1", "vmk_abcdefgh", "deposit,buy", created, used, used))
+
+	keys, err := NewApp("", db).dbAPIKeys(context.Background(), "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("wrong number of keys. expected: 2, got: %d", len(keys))
+	}
+
+	if keys[0].LastUsedAt != nil || keys[0].RevokedAt != nil {
+		t.Errorf("unused key should have no times: %+v", keys[0])
+	}
+
+	if len(keys[1].Scopes) != 2 || keys[1].Scopes[1] != scope_buy || keys[1].LastUsedAt == nil || !keys[1].RevokedAt.Equal(used) {
+		t.Errorf("wrong key: %+v", keys[1])
+	}
+}
+
+func TestDbRevokeAPIKeyNotFound(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`update api_keys set revoked_at=now\(\) where id=\? and user_id=\? and revoked_at is null`).WithArgs("key1", "other").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := NewApp("", db).dbRevokeAPIKey(context.Background(), "other", "key1"); !errors.Is(err, errAPIKeyNotFound) {
+		t.Errorf("wrong error. expected: %v, got: %v", errAPIKeyNotFound, err)
+	}
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// dbAddAudit appends an entry to the audit log. The log is never updated
+func (a *App) dbAddAudit(ctx context.Context, e model.AuditEntry) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	return addAudit(ctx, a.Db, e)
+}
+
+// addAudit appends an entry to the audit log, in the transaction of the change it records
+func addAudit(ctx context.Context, ex execer, e model.AuditEntry) error {
+
+	qry := `insert into audit_log (id, actor_id, action, target_type, target_id, before_value, after_value, ip, request_id, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := ex.ExecContext(ctx, qry, e.ID, nullString(e.ActorID), e.Action, e.TargetType, e.TargetID, nullString(string(e.Before)), nullString(string(e.After)), e.IP, e.RequestID, e.CreatedAt)
+
+	return err
+}
+
+// auditFilter selects audit entries. Empty fields don't filter
+type auditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+// dbAuditLog lists the audit entries matching the filter, newest first
+func (a *App) dbAuditLog(ctx context.Context, f auditFilter) ([]model.AuditEntry, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, actor_id, action, target_type, target_id, before_value, after_value, ip, request_id, created_at from audit_log
+	where (?='' or actor_id=?) and (?='' or action=?) and (?='' or target_type=?) and (?='' or target_id=?) and created_at >= ? and created_at < ?
+	order by created_at desc limit ?`
+
+	rows, err := conn.QueryContext(ctx, qry, f.ActorID, f.ActorID, f.Action, f.Action, f.TargetType, f.TargetType, f.TargetID, f.TargetID, f.From, f.To, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]model.AuditEntry, 0)
+
+	for rows.Next() {
+		var e model.AuditEntry
+		var actorID, before, after sql.NullString
+		if err := rows.Scan(&e.ID, &actorID, &e.Action, &e.TargetType, &e.TargetID, &before, &after, &e.IP, &e.RequestID, &e.CreatedAt); err != nil {
+			fmt.Println("audit record error", err)
+			continue
+		}
+		e.ActorID = actorID.String
+		if before.Valid {
+			e.Before = []byte(before.String)
+		}
+		if after.Valid {
+			e.After = []byte(after.String)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbAddAudit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := model.AuditEntry{
+		ID:         "entry",
+		Action:     model.AUDIT_PRODUCT_UPDATE,
+		TargetType: "product",
+		TargetID:   "prod",
+		Before:     []byte(`{"cost":50}`),
+		IP:         "10.0.0.1",
+		RequestID:  "req-1",
+		CreatedAt:  time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	// no actor and no after value are saved as NULL
+	mock.ExpectExec(`insert into audit_log \(id, actor_id, action, target_type, target_id, before_value, after_value, ip, request_id, created_at\)`).
+		WithArgs("entry", nil, model.AUDIT_PRODUCT_UPDATE, "product", "prod", `{"cost":50}`, nil, "10.0.0.1", "req-1", e.CreatedAt).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := NewApp("", db).dbAddAudit(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbAuditLog(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	from := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 10, 2, 0, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"id", "actor_id", "action", "target_type", "target_id", "before_value", "after_value", "ip", "request_id", "created_at"}).
+		AddRow("e2", "admin", model.AUDIT_REFUND, "purchase", "p1", nil, `{"amount":50}`, "10.0.0.1", "req-2", to.Add(-time.Hour)).
+		AddRow("e1", nil, model.AUDIT_LOGIN_FAILED, "username", "admin", nil, nil, "10.0.0.2", "req-1", from)
+
+	mock.ExpectQuery(`select .* from audit_log`).
+		WithArgs("", "", "", "", "purchase", "purchase", "", "", from, to, 10).
+		WillReturnRows(rows)
+
+	entries, err := NewApp("", db).dbAuditLog(context.Background(), auditFilter{TargetType: "purchase", From: from, To: to, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of entries. expected: 2, got: %d", len(entries))
+	}
+
+	if entries[0].ActorID != "admin" || string(entries[0].After) != `{"amount":50}` || entries[0].Before != nil {
+		t.Errorf("wrong first entry. expected: actor admin, after {\"amount\":50}, got: %+v", entries[0])
+	}
+
+	if entries[1].ActorID != "" || entries[1].After != nil {
+		t.Errorf("wrong second entry. expected: no actor and no values, got: %+v", entries[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,277 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// dbCoinInventory returns the coins currently in the machine's coin box
+func (a *App) dbCoinInventory(ctx context.Context) ([]coinCount, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select coin_value, amount from coin_inventory order by coin_value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inventory := make([]coinCount, 0)
+
+	for rows.Next() {
+		var c coinCount
+		if err := rows.Scan(&c.Coin, &c.Amount); err != nil {
+			fmt.Println("coin inventory record error", err)
+			continue
+		}
+		inventory = append(inventory, c)
+	}
+
+	return inventory, rows.Err()
+}
+
+// dbDepositCoins adds the coins to the user's deposit and to the coin box, and records each coin in the deposit history.
+// Everything happens in one transaction. The deposit is incremented in place, so deposits made at the same time all count.
+// Returns the new deposit.
+func (a *App) dbDepositCoins(ctx context.Context, userID string, coins []int64) (newDeposit int64, err error) {
+
+	if a.Db == nil {
+		return 0, errors.New("no database configured")
+	}
+
+	var total int64
+	for _, coin := range coins {
+		total += coin
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, `update users set deposit = deposit + ? where id=?`, total, userID); err != nil {
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `select deposit from users where id=?`, userID).Scan(&newDeposit); err != nil {
+		return
+	}
+
+	for _, coin := range coins {
+		if _, err = tx.ExecContext(ctx, qryAddCoins, coin, 1, 1); err != nil {
+			return
+		}
+
+		if _, err = tx.ExecContext(ctx, `insert into deposit_history (id, user_id, coin_value, created_at) values (?, ?, ?, now())`, uuid.New().String(), userID, coin); err != nil {
+			return
+		}
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_DEPOSIT_CREATED, depositEvent{UserID: userID, Coins: coins, Deposit: newDeposit})
+
+	return
+}
+
+const qryAddCoins = `insert into coin_inventory (coin_value, amount) values (?, ?) on duplicate key update amount = amount + ?`
+
+// dbRefillCoins adds coins to the coin box
+func (a *App) dbRefillCoins(ctx context.Context, coins []coinCount) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	for _, c := range coins {
+		if _, err = tx.ExecContext(ctx, qryAddCoins, c.Coin, c.Amount, c.Amount); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// dbResetDeposit sets the user's deposit to 0, takes the change out of the coin box and returns any notes held in escrow.
+// The deposit is locked while the change is counted from `inventory`, so a deposit made meanwhile is paid out too.
+// Fails if the coin box doesn't hold the coins anymore. Returns the amount paid out and its change.
+func (a *App) dbResetDeposit(ctx context.Context, userID string, inventory []coinCount) (reset resetEvent, err error) {
+
+	if a.Db == nil {
+		return reset, errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	reset.UserID = userID
+	if err = tx.QueryRowContext(ctx, `select deposit from users where id=? for update`, userID).Scan(&reset.Amount); err != nil {
+		return
+	}
+
+	change, err := a.Currency.changeFromInventory(reset.Amount, inventory)
+	if err != nil {
+		return
+	}
+	reset.Change = a.Currency.coinCounts(change)
+
+	if _, err = tx.ExecContext(ctx, `update users set deposit=? where id=?`, 0, userID); err != nil {
+		return
+	}
+
+	if err = takeCoins(ctx, tx, reset.Change); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from escrow_notes where user_id=?`, userID); err != nil {
+		return
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_DEPOSIT_RESET, reset)
+
+	return
+}
+
+// takeCoins removes coins from the coin box as part of a running transaction
+func takeCoins(ctx context.Context, tx execer, coins []coinCount) error {
+	for _, c := range coins {
+		res, err := tx.ExecContext(ctx, `update coin_inventory set amount = amount - ? where coin_value=? and amount >= ?`, c.Amount, c.Coin, c.Amount)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return errors.New("not enough coins for change")
+		}
+	}
+
+	return nil
+}
+
+// dbEscrowNotes returns the notes a user has in escrow
+func (a *App) dbEscrowNotes(ctx context.Context, userID string) ([]int64, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select note_value from escrow_notes where user_id=? order by created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]int64, 0)
+
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			fmt.Println("escrow record error", err)
+			continue
+		}
+		notes = append(notes, n)
+	}
+
+	return notes, rows.Err()
+}
+
+func (a *App) dbInsertEscrowNote(ctx context.Context, userID string, note int64) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `insert into escrow_notes (id, user_id, note_value, created_at) values (?, ?, ?, now())`, uuid.New().String(), userID, note)
+
+	return
+}
+
+// dbReleaseEscrow removes all the notes a user has in escrow, meaning they were given back
+func (a *App) dbReleaseEscrow(ctx context.Context, userID string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `delete from escrow_notes where user_id=?`, userID)
+
+	return
+}
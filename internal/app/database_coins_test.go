@@ -0,0 +1,296 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbCoinInventoryNoDb(t *testing.T) {
+	if _, err := NewApp("", nil).dbCoinInventory(context.Background()); err == nil {
+		t.Fatal("should fail if no database")
+	}
+}
+
+func TestDbCoinInventorySuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(5, 10).AddRow(50, 2))
+
+	inventory, err := NewApp("", db).dbCoinInventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []coinCount{{5, 10}, {50, 2}}
+	if !reflect.DeepEqual(inventory, expected) {
+		t.Errorf("wrong inventory. expected: %v, got: %v", expected, inventory)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbDepositCoinsIncrements(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// another deposit of 100 was saved since the user was read
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(50, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(170))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(50, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WithArgs(sqlmock.AnyArg(), "userid", 50).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	deposit, err := NewApp("", db).dbDepositCoins(context.Background(), "userid", []int64{50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deposit != 170 {
+		t.Errorf("wrong deposit. expected: %d, got: %d", 170, deposit)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbDepositCoinsFailInventoryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(10, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(20))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(10, 1, 1).WillReturnError(errors.New("inventory error"))
+	mock.ExpectRollback()
+
+	if _, err := NewApp("", db).dbDepositCoins(context.Background(), "userid", []int64{10}); err == nil {
+		t.Fatal("should fail if the coin box is not updated")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbDepositCoinsRollbackOnHistoryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(30, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(30))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(10, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WithArgs(sqlmock.AnyArg(), "userid", 10).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(20, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WithArgs(sqlmock.AnyArg(), "userid", 20).WillReturnError(errors.New("history error"))
+	mock.ExpectRollback()
+
+	if _, err := NewApp("", db).dbDepositCoins(context.Background(), "userid", []int64{10, 20}); err == nil {
+		t.Fatal("should fail if a coin can't be recorded")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbRefillCoinsSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(5, 20, 20).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(100, 3, 3).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewApp("", db).dbRefillCoins(context.Background(), []coinCount{{5, 20}, {100, 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbResetDepositFailCoinsGone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select deposit from users where id=\? for update`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(100))
+	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(0, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory set amount = amount - \?`).WithArgs(2, 50, 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err = NewApp("", db).dbResetDeposit(context.Background(), "userid", []coinCount{{50, 2}})
+	if err == nil {
+		t.Fatal("should fail if the coins are not in the box anymore")
+	}
+
+	if err.Error() != "not enough coins for change" {
+		t.Errorf("wrong error message. expected: %s, got: %s", "not enough coins for change", err.Error())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbResetDepositPaysDepositMadeMeanwhile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the buyer had 50 when they asked for the reset, a coin of 20 was deposited since
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select deposit from users where id=\? for update`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(70))
+	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(0, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory set amount = amount - \?`).WithArgs(1, 20, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory set amount = amount - \?`).WithArgs(1, 50, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`delete from escrow_notes where user_id=\?`).WithArgs("userid").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into outbox`).WithArgs(sqlmock.AnyArg(), model.EVENT_DEPOSIT_RESET, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	reset, err := NewApp("", db).dbResetDeposit(context.Background(), "userid", []coinCount{{20, 5}, {50, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reset.Amount != 70 || !reflect.DeepEqual(reset.Change, []coinCount{{20, 1}, {50, 1}}) {
+		t.Errorf("wrong reset. expected: 70 as 20 and 50, got: %+v", reset)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbEscrowNotesSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select note_value from escrow_notes where user_id=\?`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(500).AddRow(1000))
+
+	notes, err := NewApp("", db).dbEscrowNotes(context.Background(), "userid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(notes, []int64{500, 1000}) {
+		t.Errorf("wrong notes. expected: %v, got: %v", []int64{500, 1000}, notes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbInsertEscrowNoteFailNoTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin().WillReturnError(errors.New("no tx"))
+
+	if err := NewApp("", db).dbInsertEscrowNote(context.Background(), "userid", 500); err == nil {
+		t.Fatal("should fail if no transaction")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbBuyCollectsEscrow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select id, note_value from escrow_notes where user_id=\? for update`).WithArgs("user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "note_value"}).AddRow("note1", 500))
+	mock.ExpectExec(`delete from escrow_notes where id in \(\?\)`).WithArgs("note1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \?`).WithArgs(500, "user").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(150, "user", 150).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	p := &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 150}
+	if _, err := NewApp("", db).dbBuy(context.Background(), p, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbBuyEscrowGivenBackMeanwhile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the buyer cancelled one of the notes after Buy counted them
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select id, note_value from escrow_notes where user_id=\? for update`).WithArgs("user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "note_value"}).AddRow("note1", 100))
+	mock.ExpectExec(`delete from escrow_notes where id in \(\?\)`).WithArgs("note1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \?`).WithArgs(100, "user").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	p := &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 150}
+	if _, err := NewApp("", db).dbBuy(context.Background(), p, 150); !errors.Is(err, errNotEnoughDeposit) {
+		t.Fatalf("expected: %v, got: %v", errNotEnoughDeposit, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
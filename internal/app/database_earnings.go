@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// seller ledger entry types. Sales are positive, commissions and payouts negative. Refunded sales are entered again with the opposite sign
+const (
+	ledger_sale       = "SALE"
+	ledger_commission = "COMMISSION"
+	ledger_payout     = "PAYOUT"
+)
+
+// addLedgerEntry writes to the seller's earnings ledger as part of a running transaction
+func addLedgerEntry(ctx context.Context, tx execer, sellerID, entryType string, amount int64, purchaseID, payoutID string) error {
+
+	qryLedger := `insert into seller_ledger (id, seller_id, entry_type, amount, purchase_id, payout_id, created_at) values (?, ?, ?, ?, ?, ?, now())`
+
+	_, err := tx.ExecContext(ctx, qryLedger, uuid.New().String(), sellerID, entryType, amount, nullString(purchaseID), nullString(payoutID))
+
+	return err
+}
+
+// creditSale credits the seller with a purchase, minus the platform commission
+func creditSale(ctx context.Context, tx execer, p *model.Purchase) error {
+
+	if err := addLedgerEntry(ctx, tx, p.SellerID, ledger_sale, p.TotalPrice, p.ID, ""); err != nil {
+		return err
+	}
+
+	if p.Commission > 0 {
+		return addLedgerEntry(ctx, tx, p.SellerID, ledger_commission, -p.Commission, p.ID, "")
+	}
+
+	return nil
+}
+
+// saleBalance is what the seller still has from a purchase: the sale and the commission taken on it, net of refunds
+func saleBalance(ctx context.Context, db queryRower, purchaseID string) (sale, commission int64, err error) {
+
+	qry := `select coalesce(sum(case when entry_type=? then amount else 0 end), 0), coalesce(sum(case when entry_type=? then -amount else 0 end), 0)
+	from seller_ledger where purchase_id=?`
+
+	err = db.QueryRowContext(ctx, qry, ledger_sale, ledger_commission, purchaseID).Scan(&sale, &commission)
+
+	return
+}
+
+// reverseSale takes `amount` of a purchase back out of the seller's earnings, and gives back the commission taken on it in proportion
+func reverseSale(ctx context.Context, tx *sql.Tx, sellerID, purchaseID string, amount int64) error {
+
+	sale, commission, err := saleBalance(ctx, tx, purchaseID)
+	if err != nil {
+		return err
+	}
+
+	if amount > sale {
+		return errors.New("amount is more than what is left to refund")
+	}
+
+	if amount < sale {
+		commission = commission * amount / sale
+	}
+
+	if err := addLedgerEntry(ctx, tx, sellerID, ledger_sale, -amount, purchaseID, ""); err != nil {
+		return err
+	}
+
+	if commission > 0 {
+		return addLedgerEntry(ctx, tx, sellerID, ledger_commission, commission, purchaseID, "")
+	}
+
+	return nil
+}
+
+type sellerBalance struct {
+	Sales      int64 `json:"sales"`
+	Commission int64 `json:"commission"`
+	PaidOut    int64 `json:"paid_out"`
+	Pending    int64 `json:"pending"`   // requested or approved payouts, not paid yet
+	Available  int64 `json:"available"` // what can still be requested
+}
+
+func (a *App) dbSellerBalance(ctx context.Context, sellerID string) (*sellerBalance, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return sellerBalanceQuery(ctx, conn, sellerID)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+const qryLedgerTotals = `select
+	coalesce(sum(case when entry_type=? then amount else 0 end), 0),
+	coalesce(sum(case when entry_type=? then -amount else 0 end), 0),
+	coalesce(sum(case when entry_type=? then -amount else 0 end), 0)
+	from seller_ledger where seller_id=?`
+
+const qryPendingPayouts = `select coalesce(sum(amount), 0) from payouts where seller_id=? and status in (?, ?)`
+
+func sellerBalanceQuery(ctx context.Context, db queryRower, sellerID string) (*sellerBalance, error) {
+
+	var b sellerBalance
+
+	row := db.QueryRowContext(ctx, qryLedgerTotals, ledger_sale, ledger_commission, ledger_payout, sellerID)
+	if err := row.Scan(&b.Sales, &b.Commission, &b.PaidOut); err != nil {
+		return nil, err
+	}
+
+	row = db.QueryRowContext(ctx, qryPendingPayouts, sellerID, model.PAYOUT_REQUESTED, model.PAYOUT_APPROVED)
+	if err := row.Scan(&b.Pending); err != nil {
+		return nil, err
+	}
+
+	b.Available = b.Sales - b.Commission - b.PaidOut - b.Pending
+
+	return &b, nil
+}
+
+// dbRequestPayout creates a payout request if the seller's available balance covers it
+func (a *App) dbRequestPayout(ctx context.Context, sellerID string, amount int64) (payout *model.Payout, err error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+			payout = nil
+		}
+	}()
+
+	// concurrent requests from the same seller wait here
+	var id string
+	if err = tx.QueryRowContext(ctx, `select id from users where id=? for update`, sellerID).Scan(&id); err != nil {
+		return
+	}
+
+	b, err := sellerBalanceQuery(ctx, tx, sellerID)
+	if err != nil {
+		return
+	}
+
+	if amount > b.Available {
+		err = errors.New("amount is more than the available balance")
+		return
+	}
+
+	payout = &model.Payout{ID: uuid.New().String(), SellerID: sellerID, Amount: amount, Status: model.PAYOUT_REQUESTED}
+
+	_, err = tx.ExecContext(ctx, `insert into payouts (id, seller_id, amount, status, created_at, updated_at) values (?, ?, ?, ?, now(), now())`,
+		payout.ID, payout.SellerID, payout.Amount, payout.Status)
+
+	return
+}
+
+// dbPayouts lists payouts, of one seller if `sellerID` is not empty, with the given status if `status` is not empty
+func (a *App) dbPayouts(ctx context.Context, sellerID, status string) ([]model.Payout, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, seller_id, amount, status, created_at, updated_at from payouts where (?='' or seller_id=?) and (?='' or status=?) order by created_at desc`
+
+	rows, err := conn.QueryContext(ctx, qry, sellerID, sellerID, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := make([]model.Payout, 0)
+
+	for rows.Next() {
+		var p model.Payout
+		if err := rows.Scan(&p.ID, &p.SellerID, &p.Amount, &p.Status, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			fmt.Println("payout record error", err)
+			continue
+		}
+		payouts = append(payouts, p)
+	}
+
+	return payouts, rows.Err()
+}
+
+// dbSetPayoutStatus moves a payout from status `from` to status `to`.
+// When a payout is paid, it is also taken out of the seller's ledger.
+func (a *App) dbSetPayoutStatus(ctx context.Context, payoutID, from, to string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	var sellerID string
+	var amount int64
+	row := tx.QueryRowContext(ctx, `select seller_id, amount from payouts where id=? and status=? for update`, payoutID, from)
+	if err = row.Scan(&sellerID, &amount); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errors.New("payout not found")
+		}
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `update payouts set status=?, updated_at=now() where id=?`, to, payoutID); err != nil {
+		return
+	}
+
+	if to == model.PAYOUT_PAID {
+		err = addLedgerEntry(ctx, tx, sellerID, ledger_payout, -amount, "", payoutID)
+	}
+
+	return
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbBuyCreditsSellerMinusCommission(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(2, "prod", 2).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(200, "user", 200).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "SALE", 200, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "COMMISSION", -20, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	p := &model.Purchase{UserID: "user", ProductID: "prod", SellerID: "seller", Amount: 2, TotalPrice: 200, Commission: 20}
+	if _, err := NewApp("", db).dbBuy(context.Background(), p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbSellerBalance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from seller_ledger where seller_id=\?`).WithArgs("SALE", "COMMISSION", "PAYOUT", "seller").
+		WillReturnRows(sqlmock.NewRows([]string{"sales", "commission", "paid_out"}).AddRow(1000, 100, 300))
+	mock.ExpectQuery(`select coalesce\(sum\(amount\), 0\) from payouts`).WithArgs("seller", "REQUESTED", "APPROVED").
+		WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(200))
+
+	b, err := NewApp("", db).dbSellerBalance(context.Background(), "seller")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sellerBalance{Sales: 1000, Commission: 100, PaidOut: 300, Pending: 200, Available: 400}
+	if *b != expected {
+		t.Errorf("wrong balance. expected: %+v, got: %+v", expected, *b)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectPayoutBalance(mock sqlmock.Sqlmock, available int64) {
+	mock.ExpectQuery(`select id from users where id=\? for update`).WithArgs("seller").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("seller"))
+	mock.ExpectQuery(`from seller_ledger`).
+		WillReturnRows(sqlmock.NewRows([]string{"sales", "commission", "paid_out"}).AddRow(available, 0, 0))
+	mock.ExpectQuery(`from payouts`).
+		WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(0))
+}
+
+func TestDbRequestPayoutFailNotEnoughBalance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectPayoutBalance(mock, 100)
+	mock.ExpectRollback()
+
+	payout, err := NewApp("", db).dbRequestPayout(context.Background(), "seller", 150)
+	if err == nil {
+		t.Fatal("should not pay out more than the balance")
+	}
+
+	if payout != nil {
+		t.Errorf("no payout should be returned, got: %v", payout)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbRequestPayoutSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectPayoutBalance(mock, 100)
+	mock.ExpectExec(`insert into payouts`).WithArgs(sqlmock.AnyArg(), "seller", 100, "REQUESTED").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	payout, err := NewApp("", db).dbRequestPayout(context.Background(), "seller", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payout.Amount != 100 || payout.Status != model.PAYOUT_REQUESTED || payout.ID == "" {
+		t.Errorf("wrong payout: %+v", payout)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbSetPayoutStatusPaid(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select seller_id, amount from payouts where id=\? and status=\? for update`).WithArgs("payout", "APPROVED").
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "amount"}).AddRow("seller", 300))
+	mock.ExpectExec(`update payouts set status=\?`).WithArgs("PAID", "payout").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "PAYOUT", -300, nil, "payout").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewApp("", db).dbSetPayoutStatus(context.Background(), "payout", model.PAYOUT_APPROVED, model.PAYOUT_PAID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbSetPayoutStatusFailWrongStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select seller_id, amount from payouts`).WithArgs("payout", "REQUESTED").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	err = NewApp("", db).dbSetPayoutStatus(context.Background(), "payout", model.PAYOUT_REQUESTED, model.PAYOUT_APPROVED)
+	if err == nil {
+		t.Fatal("should fail if the payout is not in the expected status")
+	}
+
+	if err.Error() != "payout not found" {
+		t.Errorf("wrong error. expected: %s, got: %s", "payout not found", err.Error())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
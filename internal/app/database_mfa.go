@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// mfaState is the TOTP setup of a user. A secret that is not enabled is waiting for its first code
+type mfaState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64 // last accepted step, codes of this step or older are refused
+}
+
+// dbMFA returns the TOTP setup of the user, sql.ErrNoRows if there is none
+func (a *App) dbMFA(ctx context.Context, userID string) (*mfaState, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var s mfaState
+
+	row := conn.QueryRowContext(ctx, `select secret, enabled, last_step from user_mfa where user_id=?`, userID)
+	if err := row.Scan(&s.Secret, &s.Enabled, &s.LastStep); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// dbMFALoginState tells if the user has MFA enabled and if its role requires it
+func (a *App) dbMFALoginState(ctx context.Context, userID string, role model.TypeRole) (enabled, required bool, err error) {
+
+	if a.Db == nil {
+		return false, false, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	qry := `select coalesce((select enabled from user_mfa where user_id=?), false), coalesce((select required from mfa_policies where role=?), false)`
+
+	err = conn.QueryRowContext(ctx, qry, userID, role).Scan(&enabled, &required)
+
+	return
+}
+
+// dbSaveMFASecret starts an enrollment, replacing a previous one that was not confirmed.
+// Fails if the user already has MFA enabled.
+func (a *App) dbSaveMFASecret(ctx context.Context, userID, secret string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	var enabled bool
+
+	err = tx.QueryRowContext(ctx, `select enabled from user_mfa where user_id=? for update`, userID).Scan(&enabled)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.ExecContext(ctx, `insert into user_mfa (user_id, secret, enabled, last_step, created_at) values (?, ?, false, 0, now())`, userID, secret)
+	case err != nil:
+	case enabled:
+		err = errors.New("mfa is already enabled")
+	default:
+		_, err = tx.ExecContext(ctx, `update user_mfa set secret=?, created_at=now() where user_id=?`, secret, userID)
+	}
+
+	return
+}
+
+// dbEnableMFA turns MFA on with the step of the confirming code, and replaces the recovery codes
+func (a *App) dbEnableMFA(ctx context.Context, userID string, step int64, codeHashes []string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `update user_mfa set enabled=true, last_step=?, enabled_at=now() where user_id=? and enabled=false`, step, userID)
+	if err != nil {
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		err = errors.New("no enrollment waiting for confirmation")
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id=?`, userID); err != nil {
+		return
+	}
+
+	for _, h := range codeHashes {
+		if _, err = tx.ExecContext(ctx, `insert into mfa_recovery_codes (id, user_id, code_hash, created_at) values (?, ?, ?, now())`, uuid.New().String(), userID, h); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// dbUseMFAStep records the step of an accepted code. Fails if a code of the same or a later step was already used
+func (a *App) dbUseMFAStep(ctx context.Context, userID string, step int64) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update user_mfa set last_step=? where user_id=? and enabled=true and last_step<?`, step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errMFACode
+	}
+
+	return nil
+}
+
+// dbUseRecoveryCode marks the recovery code as used. Fails if it doesn't exist or was used before
+func (a *App) dbUseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update mfa_recovery_codes set used_at=now() where user_id=? and code_hash=? and used_at is null`, userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		return errMFACode
+	}
+
+	return nil
+}
+
+// dbDisableMFA removes the TOTP setup and the recovery codes of the user
+func (a *App) dbDisableMFA(ctx context.Context, userID string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id=?`, userID); err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_mfa where user_id=?`, userID)
+
+	return
+}
+
+// dbMFAPolicies lists the roles that have a policy set
+func (a *App) dbMFAPolicies(ctx context.Context) ([]model.MFAPolicy, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select role, required, updated_at from mfa_policies order by role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make([]model.MFAPolicy, 0)
+
+	for rows.Next() {
+		var p model.MFAPolicy
+		if err := rows.Scan(&p.Role, &p.Required, &p.UpdatedAt); err != nil {
+			fmt.Println("mfa policy record error", err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, rows.Err()
+}
+
+func (a *App) dbSetMFARequired(ctx context.Context, role model.TypeRole, required bool) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	qry := `insert into mfa_policies (role, required, updated_at) values (?, ?, now()) on duplicate key update required=values(required), updated_at=values(updated_at)`
+
+	_, err := a.Db.ExecContext(ctx, qry, role, required)
+
+	return err
+}
+
+// dbMFARequired tells if the role has to use MFA
+func (a *App) dbMFARequired(ctx context.Context, role model.TypeRole) (bool, error) {
+
+	if a.Db == nil {
+		return false, errors.New("no database configured")
+	}
+
+	var required bool
+
+	err := a.Db.QueryRowContext(ctx, `select required from mfa_policies where role=?`, role).Scan(&required)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return required, err
+}
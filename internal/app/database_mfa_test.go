@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDbSaveMFASecretAlreadyEnabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select enabled from user_mfa where user_id=\? for update`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+	mock.ExpectRollback()
+
+	if err := NewApp("", db).dbSaveMFASecret(context.Background(), "id1", "SECRET"); err == nil {
+		t.Error("should not replace an enabled secret")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbEnableMFA(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update user_mfa set enabled=true, last_step=\?`).WithArgs(100, "id1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`delete from mfa_recovery_codes where user_id=\?`).WithArgs("id1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into mfa_recovery_codes`).WithArgs(sqlmock.AnyArg(), "id1", "h1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into mfa_recovery_codes`).WithArgs(sqlmock.AnyArg(), "id1", "h2").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewApp("", db).dbEnableMFA(context.Background(), "id1", 100, []string{"h1", "h2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
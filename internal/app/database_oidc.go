@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// dbFindUserByIdentity finds the user linked to the provider's subject. Returns sql.ErrNoRows if there is none
+func (a *App) dbFindUserByIdentity(ctx context.Context, issuer, subject string) (*model.User, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select u.id, u.username, u.password, u.deposit, u.role, u.session_version from user_identities i join users u on u.id=i.user_id where i.issuer=? and i.subject=?`
+
+	var usr model.User
+	var roles string
+
+	row := conn.QueryRowContext(ctx, qry, issuer, subject)
+	if err := row.Scan(&usr.ID, &usr.Username, &usr.Password, &usr.Deposit, &roles, &usr.SessionVersion); err != nil {
+		return nil, err
+	}
+
+	usr.SetRoles(parseRoles(roles))
+
+	return &usr, nil
+}
+
+// dbCreateOIDCUser creates a user with the roles, linked to the provider's subject. Returns the ID of the new user
+func (a *App) dbCreateOIDCUser(ctx context.Context, issuer, subject, username, encPasswd string, roles []model.TypeRole) (userID string, err error) {
+
+	if a.Db == nil {
+		return "", errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	userID = uuid.New().String()
+
+	if _, err = tx.ExecContext(ctx, "insert into users (id, username, password, role) values (?, ?, ?, ?)", userID, username, encPasswd, strings.Join(roles, ",")); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, "insert into user_identities (issuer, subject, user_id) values (?, ?, ?)", issuer, subject, userID); err != nil {
+		return
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_USER_CREATED, userEvent{ID: userID, Username: username, Role: roles[0]})
+
+	return
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbCreateOIDCUserRollback(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into users \(id, username, password, role\) values`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into user_identities \(issuer, subject, user_id\) values`).WillReturnError(errors.New("duplicate key"))
+	mock.ExpectRollback()
+
+	if _, err := NewApp("", db).dbCreateOIDCUser(context.Background(), "https://idp.example.com", "sub-1", "jane.doe", "hash", []model.TypeRole{model.ROLE_BUYER}); err == nil {
+		t.Fatal("database error should be returned")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbFindUserByIdentity(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from user_identities i join users u on u.id=i.user_id where i.issuer=\? and i.subject=\?`).
+		WithArgs("https://idp.example.com", "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "jane.doe", "hash", 15, model.ROLE_BUYER, 0))
+
+	usr, err := NewApp("", db).dbFindUserByIdentity(context.Background(), "https://idp.example.com", "sub-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usr.ID != "id1" || usr.Deposit != 15 {
+		t.Errorf("wrong user: %+v", usr)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
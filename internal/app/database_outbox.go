@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// eventBody is the JSON published for every event
+type eventBody struct {
+	ID        string          `json:"id"`
+	Type      model.TypeEvent `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      any             `json:"data"`
+}
+
+type userEvent struct {
+	ID       string         `json:"id"`
+	Username string         `json:"username"`
+	Role     model.TypeRole `json:"role"`
+}
+
+type depositEvent struct {
+	UserID  string  `json:"user_id"`
+	Coins   []int64 `json:"coins,omitempty"`
+	Deposit int64   `json:"deposit"` // deposit after the coins were added
+}
+
+type resetEvent struct {
+	UserID string      `json:"user_id"`
+	Amount int64       `json:"amount"`
+	Change []coinCount `json:"change"`
+}
+
+type productDeletedEvent struct {
+	ID       string `json:"id"`
+	SellerID string `json:"seller_id"`
+}
+
+// addOutboxEvent saves the event in the outbox as part of a running transaction,
+// so it is only published if the change that caused it is committed
+func addOutboxEvent(ctx context.Context, tx execer, eventType model.TypeEvent, data any) error {
+
+	e := eventBody{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into outbox (id, event_type, payload, created_at) values (?, ?, ?, now())`, e.ID, e.Type, string(payload))
+
+	return err
+}
+
+// dbPendingOutbox returns at most `limit` events not published yet, oldest first
+func (a *App) dbPendingOutbox(ctx context.Context, limit int) ([]model.Event, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id, event_type, payload, created_at from outbox where published_at is null order by created_at limit ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]model.Event, 0)
+
+	for rows.Next() {
+		var e model.Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.Payload, &e.CreatedAt); err != nil {
+			fmt.Println("outbox record error", err)
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (a *App) dbMarkPublished(ctx context.Context, eventID string) error {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	_, err := a.Db.ExecContext(ctx, `update outbox set published_at=now() where id=?`, eventID)
+
+	return err
+}
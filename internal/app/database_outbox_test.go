@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// eventPayloadArg matches the payload of an outbox insert and checks its envelope
+type eventPayloadArg struct {
+	t         *testing.T
+	eventType model.TypeEvent
+}
+
+func (a eventPayloadArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+
+	var body struct {
+		ID   string          `json:"id"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(s), &body); err != nil {
+		a.t.Error(err)
+		return false
+	}
+
+	return body.ID != "" && body.Type == a.eventType && len(body.Data) > 0
+}
+
+func TestDbDepositCoinsWritesOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(20, "user").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("user").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(70))
+	mock.ExpectExec(`insert into coin_inventory`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox \(id, event_type, payload, created_at\)`).
+		WithArgs(sqlmock.AnyArg(), model.EVENT_DEPOSIT_CREATED, eventPayloadArg{t, model.EVENT_DEPOSIT_CREATED}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if _, err := NewApp("", db).dbDepositCoins(context.Background(), "user", []int64{20}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbCreateProductRollsBackWithoutOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into products`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into product_prices`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set price_id=\?`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnError(driver.ErrBadConn)
+	mock.ExpectRollback()
+
+	if _, err := NewApp("", db).dbCreateProduct(context.Background(), "seller", 10, 50, "product"); err == nil {
+		t.Error("should fail if the event cannot be saved")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbPendingOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id, event_type, payload, created_at from outbox where published_at is null order by created_at limit \?`).WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload", "created_at"}).
+			AddRow("e1", model.EVENT_PURCHASE, "{}", time.Now()).
+			AddRow("e2", model.EVENT_DEPOSIT_RESET, "{}", time.Now()))
+
+	events, err := NewApp("", db).dbPendingOutbox(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].ID != "e1" || events[1].Type != model.EVENT_DEPOSIT_RESET {
+		t.Errorf("wrong events: %+v", events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// setPrice records `cost` as the product's current price version, as part of a running transaction
+func setPrice(ctx context.Context, tx execer, productID string, cost int64) error {
+
+	priceID := uuid.New().String()
+
+	qryPrice := `insert into product_prices (id, product_id, cost, effective_from, applied) values (?, ?, ?, now(), true)`
+
+	if _, err := tx.ExecContext(ctx, qryPrice, priceID, productID, cost); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `update products set price_id=? where id=?`, priceID, productID)
+
+	return err
+}
+
+// dbSchedulePrice saves a price change that is applied at `effectiveFrom`
+func (a *App) dbSchedulePrice(ctx context.Context, productID string, cost int64, effectiveFrom time.Time) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	qryPrice := `insert into product_prices (id, product_id, cost, effective_from, applied) values (?, ?, ?, ?, false)`
+
+	_, err = tx.ExecContext(ctx, qryPrice, uuid.New().String(), productID, cost, effectiveFrom)
+
+	return
+}
+
+// dbPriceHistory returns all the price versions of a product, newest first, including the scheduled ones
+func (a *App) dbPriceHistory(ctx context.Context, productID string) ([]model.ProductPrice, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id, product_id, cost, effective_from, applied from product_prices where product_id=? order by effective_from desc`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make([]model.ProductPrice, 0)
+
+	for rows.Next() {
+		var p model.ProductPrice
+		if err := rows.Scan(&p.ID, &p.ProductID, &p.Cost, &p.EffectiveFrom, &p.Applied); err != nil {
+			fmt.Println("price record error", err)
+			continue
+		}
+		prices = append(prices, p)
+	}
+
+	return prices, rows.Err()
+}
+
+// dbApplyDuePrices sets the cost of the products whose scheduled price changes are due.
+// Changes are applied in the order of their effective date, so the latest one wins.
+// Every change is recorded in the audit log, by the source in the context or by the system.
+// Returns the price changes that were applied.
+func (a *App) dbApplyDuePrices(ctx context.Context) (applied []model.ProductPrice, err error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+			applied = nil
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx, `select id, product_id, cost from product_prices where applied = false and effective_from <= now() order by effective_from for update`)
+	if err != nil {
+		return
+	}
+
+	due := make([]model.ProductPrice, 0)
+	for rows.Next() {
+		var p model.ProductPrice
+		if err = rows.Scan(&p.ID, &p.ProductID, &p.Cost); err != nil {
+			rows.Close()
+			return
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, p := range due {
+		var before priceAudit
+		if err = tx.QueryRowContext(ctx, `select cost, coalesce(price_id, '') from products where id=? for update`, p.ProductID).Scan(&before.Cost, &before.PriceID); err != nil {
+			return
+		}
+
+		if _, err = tx.ExecContext(ctx, `update products set cost=?, price_id=? where id=?`, p.Cost, p.ID, p.ProductID); err != nil {
+			return
+		}
+
+		if _, err = tx.ExecContext(ctx, `update product_prices set applied = true where id=?`, p.ID); err != nil {
+			return
+		}
+
+		if err = addAudit(ctx, tx, newAuditEntry(ctx, model.AUDIT_PRICE_APPLY, "product", p.ProductID, before, priceAudit{Cost: p.Cost, PriceID: p.ID})); err != nil {
+			return
+		}
+	}
+
+	return due, nil
+}
+
+type priceAudit struct {
+	Cost    int64  `json:"cost"`
+	PriceID string `json:"price_id,omitempty"`
+}
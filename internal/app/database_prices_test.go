@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbSchedulePriceSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	from := time.Date(2030, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into product_prices`).WithArgs(sqlmock.AnyArg(), "prodid", 45, from).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewApp("", db).dbSchedulePrice(context.Background(), "prodid", 45, from); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbPriceHistorySuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+
+	mock.ExpectQuery(`select .* from product_prices where product_id=\?`).WithArgs("prodid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "cost", "effective_from", "applied"}).
+			AddRow("p2", "prodid", 50, now.Add(time.Hour), false).
+			AddRow("p1", "prodid", 40, now.Add(-time.Hour), true))
+
+	prices, err := NewApp("", db).dbPriceHistory(context.Background(), "prodid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prices) != 2 {
+		t.Fatalf("wrong number of prices. expected: %d, got: %d", 2, len(prices))
+	}
+
+	if prices[0].ID != "p2" || prices[0].Applied || prices[1].Cost != 40 || !prices[1].Applied {
+		t.Errorf("wrong prices: %v", prices)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbApplyDuePricesSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select id, product_id, cost from product_prices where applied = false and effective_from <= now\(\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "cost"}).AddRow("p1", "prod1", 40).AddRow("p2", "prod2", 75))
+	mock.ExpectQuery(`select cost, coalesce\(price_id, ''\) from products where id=\? for update`).WithArgs("prod1").
+		WillReturnRows(sqlmock.NewRows([]string{"cost", "price_id"}).AddRow(35, "p0"))
+	mock.ExpectExec(`update products set cost=\?, price_id=\? where id=\?`).WithArgs(40, "p1", "prod1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update product_prices set applied = true where id=\?`).WithArgs("p1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_PRICE_APPLY, "product", "prod1", `{"cost":35,"price_id":"p0"}`, `{"cost":40,"price_id":"p1"}`, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select cost, coalesce\(price_id, ''\) from products where id=\? for update`).WithArgs("prod2").
+		WillReturnRows(sqlmock.NewRows([]string{"cost", "price_id"}).AddRow(80, ""))
+	mock.ExpectExec(`update products set cost=\?, price_id=\? where id=\?`).WithArgs(75, "p2", "prod2").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update product_prices set applied = true where id=\?`).WithArgs("p2").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_PRICE_APPLY, "product", "prod2", `{"cost":80}`, `{"cost":75,"price_id":"p2"}`, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	applied, err := NewApp("", db).dbApplyDuePrices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 2 {
+		t.Errorf("wrong number of applied changes. expected: %d, got: %d", 2, len(applied))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbApplyDuePricesRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select id, product_id, cost from product_prices`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "cost"}).AddRow("p1", "prod1", 40))
+	mock.ExpectQuery(`select cost, coalesce\(price_id, ''\) from products`).WithArgs("prod1").
+		WillReturnRows(sqlmock.NewRows([]string{"cost", "price_id"}).AddRow(35, "p0"))
+	mock.ExpectExec(`update products set cost=\?, price_id=\? where id=\?`).WithArgs(40, "p1", "prod1").WillReturnError(errors.New("db error"))
+	mock.ExpectRollback()
+
+	applied, err := NewApp("", db).dbApplyDuePrices(context.Background())
+	if err == nil {
+		t.Fatal("should fail")
+	}
+
+	if len(applied) != 0 {
+		t.Errorf("nothing should be applied, got: %d", len(applied))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
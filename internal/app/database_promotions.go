@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func (a *App) dbCreatePromotion(ctx context.Context, p model.Promotion) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	qryPromo := `insert into promotions (id, seller_id, product_id, name, type, value, from_hour, to_hour) values (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.ExecContext(ctx, qryPromo, uuid.New().String(), p.SellerID, nullString(p.ProductID), p.Name, p.Type, p.Value, p.FromHour, p.ToHour)
+
+	return
+}
+
+// dbSellerPromotions returns all the promotions of a seller
+func (a *App) dbSellerPromotions(ctx context.Context, sellerID string) ([]model.Promotion, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id, seller_id, product_id, name, type, value, from_hour, to_hour from promotions where seller_id=?`, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promos := make([]model.Promotion, 0)
+
+	for rows.Next() {
+		var p model.Promotion
+		var productID sql.NullString
+		if err := rows.Scan(&p.ID, &p.SellerID, &productID, &p.Name, &p.Type, &p.Value, &p.FromHour, &p.ToHour); err != nil {
+			fmt.Println("promotion record error", err)
+			continue
+		}
+		p.ProductID = productID.String
+		promos = append(promos, p)
+	}
+
+	return promos, rows.Err()
+}
+
+func (a *App) dbDeletePromotion(ctx context.Context, promotionID, sellerID string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `delete from promotions where id=? and seller_id=?`, promotionID, sellerID)
+
+	return
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbCreatePromotionSellerWide(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into promotions`).WithArgs(sqlmock.AnyArg(), "sellerid", nil, "happy hour", model.PROMO_PERCENT, 20, 16, 18).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	p := model.Promotion{SellerID: "sellerid", Name: "happy hour", Type: model.PROMO_PERCENT, Value: 20, FromHour: 16, ToHour: 18}
+	if err := NewApp("", db).dbCreatePromotion(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbSellerPromotionsSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}
+	mock.ExpectQuery(`select .* from promotions where seller_id=\?`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("p1", "sellerid", nil, "all products", "PERCENT", 10, 0, 0).
+			AddRow("p2", "sellerid", "prodid", "one product", "BUY_N_GET_1", 2, 0, 0))
+
+	promos, err := NewApp("", db).dbSellerPromotions(context.Background(), "sellerid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []model.Promotion{
+		{ID: "p1", SellerID: "sellerid", Name: "all products", Type: model.PROMO_PERCENT, Value: 10},
+		{ID: "p2", SellerID: "sellerid", ProductID: "prodid", Name: "one product", Type: model.PROMO_BUY_N_GET_1, Value: 2},
+	}
+
+	if !reflect.DeepEqual(promos, expected) {
+		t.Errorf("wrong promotions. expected: %v, got: %v", expected, promos)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbDeletePromotionFailQueryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from promotions where id=\? and seller_id=\?`).WithArgs("p1", "sellerid").WillReturnError(errors.New("query error"))
+	mock.ExpectRollback()
+
+	if err := NewApp("", db).dbDeletePromotion(context.Background(), "p1", "sellerid"); err == nil {
+		t.Fatal("should fail")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// dbRefundable is what is left to refund of a purchase
+func (a *App) dbRefundable(ctx context.Context, purchaseID string) (int64, error) {
+
+	if a.Db == nil {
+		return 0, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	sale, _, err := saleBalance(ctx, conn, purchaseID)
+
+	return sale, err
+}
+
+// dbRefundPurchase gives back `r.Amount` of a completed purchase: on the buyer's deposit, or by taking `change` out of the coin box.
+// `r.Restocked` units are put back on sale and the refund is taken out of the seller's earnings.
+// Returns the buyer's deposit and the product's stock after the refund.
+func (a *App) dbRefundPurchase(ctx context.Context, r *model.Refund, change []coinCount) (deposit, stock int64, err error) {
+
+	if a.Db == nil {
+		return 0, 0, errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	var p model.Purchase
+
+	row := tx.QueryRowContext(ctx, `select user_id, product_id, seller_id, amount, status from purchases where id=? for update`, r.PurchaseID)
+	if err = row.Scan(&p.UserID, &p.ProductID, &p.SellerID, &p.Amount, &p.Status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errors.New("purchase not found")
+		}
+		return
+	}
+
+	if p.Status != model.VEND_COMPLETED {
+		err = errors.New("only completed purchases can be refunded")
+		return
+	}
+
+	r.UserID = p.UserID
+	r.ProductID = p.ProductID
+
+	if r.Restocked > 0 {
+		var restocked int
+		if err = tx.QueryRowContext(ctx, `select coalesce(sum(restocked), 0) from refunds where purchase_id=?`, r.PurchaseID).Scan(&restocked); err != nil {
+			return
+		}
+
+		if restocked+r.Restocked > p.Amount {
+			err = fmt.Errorf("only %d units left to restock", p.Amount-restocked)
+			return
+		}
+
+		var res sql.Result
+		if res, err = tx.ExecContext(ctx, `update products set available_amount = available_amount + ? where id=?`, r.Restocked, p.ProductID); err != nil {
+			return
+		}
+
+		if n, _ := res.RowsAffected(); n != 1 {
+			err = errors.New("product does not exist anymore, cannot restock")
+			return
+		}
+	}
+
+	if err = reverseSale(ctx, tx, p.SellerID, r.PurchaseID, r.Amount); err != nil {
+		return
+	}
+
+	switch r.Method {
+	case model.REFUND_COINS:
+		err = takeCoins(ctx, tx, change)
+	default:
+		_, err = tx.ExecContext(ctx, `update users set deposit = deposit + ? where id=?`, r.Amount, p.UserID)
+	}
+	if err != nil {
+		return
+	}
+
+	qryRefund := `insert into refunds (id, purchase_id, admin_id, user_id, product_id, amount, method, restocked, reason, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, now())`
+
+	if _, err = tx.ExecContext(ctx, qryRefund, r.ID, r.PurchaseID, r.AdminID, r.UserID, r.ProductID, r.Amount, r.Method, r.Restocked, r.Reason); err != nil {
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `select deposit from users where id=?`, p.UserID).Scan(&deposit); err != nil {
+		return
+	}
+
+	if r.Restocked > 0 {
+		if err = tx.QueryRowContext(ctx, `select available_amount from products where id=?`, p.ProductID).Scan(&stock); err != nil {
+			return
+		}
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_REFUND, r)
+
+	return
+}
+
+// dbPurchaseRefunds lists the refunds of a purchase, oldest first
+func (a *App) dbPurchaseRefunds(ctx context.Context, purchaseID string) ([]model.Refund, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, purchase_id, admin_id, user_id, product_id, amount, method, restocked, reason, created_at from refunds where purchase_id=? order by created_at`
+
+	rows, err := conn.QueryContext(ctx, qry, purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make([]model.Refund, 0)
+
+	for rows.Next() {
+		var r model.Refund
+		if err := rows.Scan(&r.ID, &r.PurchaseID, &r.AdminID, &r.UserID, &r.ProductID, &r.Amount, &r.Method, &r.Restocked, &r.Reason, &r.CreatedAt); err != nil {
+			fmt.Println("refund record error", err)
+			continue
+		}
+		refunds = append(refunds, r)
+	}
+
+	return refunds, rows.Err()
+}
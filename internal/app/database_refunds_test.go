@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbRefundPurchasePartial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select user_id, product_id, seller_id, amount, status from purchases where id=\? for update`).WithArgs("purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "status"}).AddRow("buyer", "prod", "seller", 3, model.VEND_COMPLETED))
+	mock.ExpectQuery(`select coalesce\(sum\(restocked\), 0\) from refunds`).WithArgs("purchase").WillReturnRows(sqlmock.NewRows([]string{"restocked"}).AddRow(1))
+	mock.ExpectExec(`update products set available_amount = available_amount \+ \?`).WithArgs(1, "prod").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select .* from seller_ledger where purchase_id=\?`).WithArgs("SALE", "COMMISSION", "purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"sale", "commission"}).AddRow(150, 15))
+	// a third of the sale, a third of the commission
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "SALE", -50, "purchase", nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "COMMISSION", 5, "purchase", nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \?`).WithArgs(50, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into refunds`).WithArgs("refund", "purchase", "admin", "buyer", "prod", 50, model.REFUND_DEPOSIT, 1, "wrong price").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(70))
+	mock.ExpectQuery(`select available_amount from products`).WithArgs("prod").WillReturnRows(sqlmock.NewRows([]string{"available_amount"}).AddRow(4))
+	mock.ExpectExec(`insert into outbox`).WithArgs(sqlmock.AnyArg(), model.EVENT_REFUND, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	r := &model.Refund{ID: "refund", PurchaseID: "purchase", AdminID: "admin", Amount: 50, Method: model.REFUND_DEPOSIT, Restocked: 1, Reason: "wrong price"}
+
+	deposit, stock, err := NewApp("", db).dbRefundPurchase(context.Background(), r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deposit != 70 || stock != 4 {
+		t.Errorf("wrong state after refund. expected: deposit 70, stock 4, got: deposit %d, stock %d", deposit, stock)
+	}
+
+	if r.UserID != "buyer" || r.ProductID != "prod" {
+		t.Errorf("refund should link the buyer and product of the sale, got: %+v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbRefundPurchaseFails(t *testing.T) {
+
+	type scenario struct {
+		name      string
+		status    model.TypeVendStatus
+		restocked int
+		restock   int
+		sale      int64
+		amount    int64
+		err       string
+	}
+
+	scenarios := []scenario{
+		{"pending", model.VEND_PENDING, 0, 0, 100, 50, "only completed purchases can be refunded"},
+		{"failed vend", model.VEND_FAILED, 0, 0, 0, 50, "only completed purchases can be refunded"},
+		{"restock too many", model.VEND_COMPLETED, 2, 2, 100, 50, "only 1 units left to restock"},
+		{"refund too much", model.VEND_COMPLETED, 0, 0, 40, 50, "amount is more than what is left to refund"},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`select user_id, product_id, seller_id, amount, status from purchases`).WithArgs("purchase").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "status"}).AddRow("buyer", "prod", "seller", 3, s.status))
+		if s.status == model.VEND_COMPLETED {
+			if s.restock > 0 {
+				mock.ExpectQuery(`select coalesce\(sum\(restocked\), 0\) from refunds`).WillReturnRows(sqlmock.NewRows([]string{"restocked"}).AddRow(s.restocked))
+			} else {
+				mock.ExpectQuery(`select .* from seller_ledger`).WillReturnRows(sqlmock.NewRows([]string{"sale", "commission"}).AddRow(s.sale, 0))
+			}
+		}
+		mock.ExpectRollback()
+
+		r := &model.Refund{ID: "refund", PurchaseID: "purchase", AdminID: "admin", Amount: s.amount, Method: model.REFUND_DEPOSIT, Restocked: s.restock, Reason: "test"}
+
+		_, _, err = NewApp("", db).dbRefundPurchase(context.Background(), r, nil)
+		if err == nil || err.Error() != s.err {
+			t.Errorf("%s: wrong error. expected: %s, got: %v", s.name, s.err, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+
+		db.Close()
+	}
+}
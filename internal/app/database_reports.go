@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// dbSellerPurchases returns the purchases of a seller's products made since `from`, oldest first. Failed vends are left out.
+// Refunds are taken off: the amount from the total price, the units put back on sale from the amount bought.
+func (a *App) dbSellerPurchases(ctx context.Context, sellerID string, from time.Time) ([]model.Purchase, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select p.id, p.user_id, p.product_id, p.seller_id, p.amount - coalesce(r.restocked, 0), p.unit_cost, p.base_price,
+			p.total_price - coalesce(r.amount, 0), p.price_id, p.promotion_id, p.created_at
+		from purchases p
+		left join (select purchase_id, sum(amount) as amount, sum(restocked) as restocked from refunds group by purchase_id) r on r.purchase_id = p.id
+		where p.seller_id=? and p.created_at >= ? and p.status<>? order by p.created_at`
+
+	rows, err := conn.QueryContext(ctx, qry, sellerID, from, model.VEND_FAILED)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	purchases := make([]model.Purchase, 0)
+
+	for rows.Next() {
+		var p model.Purchase
+		var priceID, promotionID sql.NullString
+		if err := rows.Scan(&p.ID, &p.UserID, &p.ProductID, &p.SellerID, &p.Amount, &p.UnitCost, &p.BasePrice, &p.TotalPrice, &priceID, &promotionID, &p.CreatedAt); err != nil {
+			fmt.Println("purchase record error", err)
+			continue
+		}
+		p.PriceID = priceID.String
+		p.PromotionID = promotionID.String
+		purchases = append(purchases, p)
+	}
+
+	return purchases, rows.Err()
+}
+
+// dbSellerProducts returns the products of a seller
+func (a *App) dbSellerProducts(ctx context.Context, sellerID string) ([]model.Product, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id, name, available_amount, cost, seller_id from products where seller_id=?`, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]model.Product, 0)
+
+	for rows.Next() {
+		var p model.Product
+		if err := rows.Scan(&p.ID, &p.Name, &p.AmountAvailable, &p.Cost, &p.SellerID); err != nil {
+			fmt.Println("product record error", err)
+			continue
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
@@ -20,10 +20,11 @@ func TestCreateUserShouldSucceed(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`insert into users \(id, username, password, role\) values`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	vm := NewApp("", db)
-	if err := vm.dbCreateUser(context.Background(), "mihaiuser", "strong23Pass*", model.ROLE_BUYER); err != nil {
+	if _, err := vm.dbCreateUser(context.Background(), "mihaiuser", "strong23Pass*", model.ROLE_BUYER); err != nil {
 		t.Fatal(err)
 	}
 
@@ -45,7 +46,7 @@ func TestDbCreateUserShouldRollbackOnError(t *testing.T) {
 	mock.ExpectRollback()
 
 	vm := NewApp("", db)
-	if err := vm.dbCreateUser(context.Background(), "mihaiuser", "strong23Pass*", model.ROLE_BUYER); err == nil {
+	if _, err := vm.dbCreateUser(context.Background(), "mihaiuser", "strong23Pass*", model.ROLE_BUYER); err == nil {
 		t.Fatal(errors.New("database error should be returned by the function"))
 	}
 
@@ -62,11 +63,11 @@ func TestDbFindUserByUsernameSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where username=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").
 		WithArgs("mihaiusr").WillReturnRows(sqlmock.NewRows(columns).
-		AddRow("id1", "mihaiusr", "bcryptksdafjsafkj", 100, "BUYER"))
+		AddRow("id1", "mihaiusr", "bcryptksdafjsafkj", 100, "BUYER", 0))
 
 	vm := NewApp("", db)
 	usr, err := vm.dbFindUserByUsername(context.Background(), "mihaiusr")
@@ -107,7 +108,7 @@ func TestDbFindUserByUsernameNoMatch(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where username=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").
 		WithArgs("mihaiusr").WillReturnError(errors.New("no records found"))
 
 	vm := NewApp("", db)
@@ -129,11 +130,11 @@ func TestDbFindUserByIDSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where id=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where id=").
 		WithArgs("id1").WillReturnRows(sqlmock.NewRows(columns).
-		AddRow("id1", "mihaiusr", "bcryptksdafjsafkj", 100, "BUYER"))
+		AddRow("id1", "mihaiusr", "bcryptksdafjsafkj", 100, "BUYER", 0))
 
 	vm := NewApp("", db)
 	usr, err := vm.dbFindUserByID(context.Background(), "id1")
@@ -174,7 +175,7 @@ func TestDbFindUserByIDNoMatch(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where id=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where id=").
 		WithArgs("id1").WillReturnError(errors.New("no records found"))
 
 	vm := NewApp("", db)
@@ -192,7 +193,7 @@ func TestDbCreateUserNoDb(t *testing.T) {
 
 	errMsg := "no database configured"
 
-	if err := NewApp("", nil).dbCreateUser(context.Background(), "", "", ""); err == nil {
+	if _, err := NewApp("", nil).dbCreateUser(context.Background(), "", "", ""); err == nil {
 		t.Fatal("should fail if DB cannot open a TX")
 	} else {
 		if err.Error() != errMsg {
@@ -213,7 +214,7 @@ func TestDbCreateUserCannotStartTx(t *testing.T) {
 
 	mock.ExpectBegin().WillReturnError(errors.New(errMsg))
 
-	if err := NewApp("", db).dbCreateUser(context.Background(), "", "", ""); err == nil {
+	if _, err := NewApp("", db).dbCreateUser(context.Background(), "", "", ""); err == nil {
 		t.Fatal("should fail if DB cannot open a TX")
 	} else {
 		if err.Error() != errMsg {
@@ -233,7 +234,7 @@ func TestDbCreateProductFailDbError(t *testing.T) {
 	mock.ExpectExec(`insert into products \(`).WillReturnError(errors.New("duplicate entry - same name"))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbCreateProduct(context.Background(), "sellerid", 10, 10, "product name"); err == nil {
+	if _, err := NewApp("", db).dbCreateProduct(context.Background(), "sellerid", 10, 10, "product name"); err == nil {
 		t.Error("should return error if the insert failed")
 	}
 
@@ -300,9 +301,9 @@ func TestDbFindProductByIDSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
-	columns := []string{"id", "name", "available_amount", "cost", "seller_id"}
+	columns := []string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}
 
-	mock.ExpectQuery(`select .* from products where id=`).WithArgs("productid").WillReturnRows(sqlmock.NewRows(columns).AddRow("productid", "product name", 10, 5, "seller 1"))
+	mock.ExpectQuery(`select .* from products where id=`).WithArgs("productid").WillReturnRows(sqlmock.NewRows(columns).AddRow("productid", "product name", 10, 5, "seller 1", "price-1"))
 
 	prod, err := NewApp("", db).dbFindProductByID(context.Background(), "productid")
 	if err != nil {
@@ -357,6 +358,7 @@ func TestDbDeleteProductNoRowsDeleted(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`delete from products`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	if err := NewApp("", db).dbDeleteProduct(context.Background(), "", ""); err != nil {
@@ -373,7 +375,7 @@ func TestDbUpdateProductFailNoTx(t *testing.T) {
 
 	mock.ExpectBegin().WillReturnError(errors.New("no transaction"))
 
-	if err := NewApp("", db).dbUpdateProduct(context.Background(), model.Product{}); err == nil {
+	if err := NewApp("", db).dbUpdateProduct(context.Background(), model.Product{}, false); err == nil {
 		t.Fatal("should fail if no TX")
 	} else {
 		if err.Error() != "no transaction" {
@@ -406,7 +408,7 @@ func TestDbUpdateProductFailQueryError(t *testing.T) {
 	mock.ExpectExec(`update products set name`).WithArgs(prod.Name, prod.Cost, prod.ID, prod.SellerID).WillReturnError(errors.New("db error"))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbUpdateProduct(context.Background(), prod); err == nil {
+	if err := NewApp("", db).dbUpdateProduct(context.Background(), prod, false); err == nil {
 		t.Fatal("should fail if the query fails")
 	} else {
 		if err.Error() != "db error" {
@@ -437,9 +439,10 @@ func TestDbUpdateProductFailSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`update products set name`).WithArgs(prod.Name, prod.Cost, prod.ID, prod.SellerID).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	if err := NewApp("", db).dbUpdateProduct(context.Background(), prod); err != nil {
+	if err := NewApp("", db).dbUpdateProduct(context.Background(), prod, false); err != nil {
 		t.Errorf("product updated but received error: %s", err.Error())
 	}
 
@@ -449,34 +452,20 @@ func TestDbUpdateProductFailSuccess(t *testing.T) {
 
 }
 
-func TestDbUserUpdateDepositFailNoDb(t *testing.T) {
-	if err := NewApp("", nil).dbUserUpdateDeposit(context.Background(), "", 0); err == nil {
-		t.Fatal("should fail if no database connection")
-	} else {
-		errMsg := "no database configured"
-		if err.Error() != errMsg {
-			t.Fatalf("wrong error message. expected: %s, got: %s", errMsg, err.Error())
-		}
-	}
-}
-
-func TestDbUserUpdateDepositFailNoTx(t *testing.T) {
-
-	errMsg := "no tx"
-
+func TestDbBuyFailTxError(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
 
-	mock.ExpectBegin().WillReturnError(errors.New(errMsg))
+	mock.ExpectBegin().WillReturnError(errors.New("no tx"))
 
-	if err := NewApp("", db).dbUserUpdateDeposit(context.Background(), "", 0); err == nil {
-		t.Fatal("should fail if couldn't open a transaction")
+	if _, err := NewApp("", db).dbBuy(context.Background(), &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 1}, 0); err == nil {
+		t.Error("should fail")
 	} else {
-		if err.Error() != errMsg {
-			t.Fatalf("wrong error message. expected: %s, got: %s", errMsg, err.Error())
+		if err.Error() != "no tx" {
+			t.Errorf("wrong error message. expected: %s, got: %s", "no tx", err.Error())
 		}
 	}
 
@@ -485,10 +474,7 @@ func TestDbUserUpdateDepositFailNoTx(t *testing.T) {
 	}
 }
 
-func TestDbUserUpdateDepositFailQueryError(t *testing.T) {
-
-	errMsg := "update error"
-
+func TestDbBuyFailUpdateProd(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
@@ -496,14 +482,14 @@ func TestDbUserUpdateDepositFailQueryError(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(10, "userid").WillReturnError(errors.New(errMsg))
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod", 1).WillReturnError(errors.New("no prod"))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbUserUpdateDeposit(context.Background(), "userid", 10); err == nil {
-		t.Fatal("should fail if update failed")
+	if _, err := NewApp("", db).dbBuy(context.Background(), &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 1}, 0); err == nil {
+		t.Error("should fail")
 	} else {
-		if err.Error() != errMsg {
-			t.Fatalf("wrong error message. expected: %s, got: %s", errMsg, err.Error())
+		if err.Error() != "no prod" {
+			t.Errorf("wrong error message. expected: %s, got: %s", "no prod", err.Error())
 		}
 	}
 
@@ -512,8 +498,7 @@ func TestDbUserUpdateDepositFailQueryError(t *testing.T) {
 	}
 }
 
-func TestDbUserUpdateDepositSuccess(t *testing.T) {
-
+func TestDbBuyFailUpdateUser(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
@@ -521,11 +506,16 @@ func TestDbUserUpdateDepositSuccess(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(10, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = `).WithArgs(1, "user", 1).WillReturnError(errors.New("no user"))
+	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbUserUpdateDeposit(context.Background(), "userid", 10); err != nil {
-		t.Fatalf("unexpected error: %s", err.Error())
+	if _, err := NewApp("", db).dbBuy(context.Background(), &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 1}, 0); err == nil {
+		t.Error("should fail")
+	} else {
+		if err.Error() != "no user" {
+			t.Errorf("wrong error message. expected: %s, got: %s", "no user", err.Error())
+		}
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -533,21 +523,20 @@ func TestDbUserUpdateDepositSuccess(t *testing.T) {
 	}
 }
 
-func TestDbBuyFailTxError(t *testing.T) {
+func TestDbBuySoldMeanwhile(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
 
-	mock.ExpectBegin().WillReturnError(errors.New("no tx"))
+	// a concurrent buy took the last units
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount = available_amount - \? where id=\? and available_amount >= \?`).WithArgs(2, "prod", 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbBuy(context.Background(), "user", "prod", 1, 1); err == nil {
-		t.Error("should fail")
-	} else {
-		if err.Error() != "no tx" {
-			t.Errorf("wrong error message. expected: %s, got: %s", "no tx", err.Error())
-		}
+	if _, err := NewApp("", db).dbBuy(context.Background(), &model.Purchase{UserID: "user", ProductID: "prod", Amount: 2, TotalPrice: 10}, 0); !errors.Is(err, errNoAvailability) {
+		t.Errorf("wrong error. expected: %v, got: %v", errNoAvailability, err)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -555,23 +544,21 @@ func TestDbBuyFailTxError(t *testing.T) {
 	}
 }
 
-func TestDbBuyFailUpdateProd(t *testing.T) {
+func TestDbBuySpentMeanwhile(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
 
+	// a concurrent buy spent the deposit
 	mock.ExpectBegin()
-	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod").WillReturnError(errors.New("no prod"))
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \? where id=\? and deposit >= \?`).WithArgs(10, "user", 10).WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).dbBuy(context.Background(), "user", "prod", 1, 1); err == nil {
-		t.Error("should fail")
-	} else {
-		if err.Error() != "no prod" {
-			t.Errorf("wrong error message. expected: %s, got: %s", "no prod", err.Error())
-		}
+	if _, err := NewApp("", db).dbBuy(context.Background(), &model.Purchase{UserID: "user", ProductID: "prod", Amount: 1, TotalPrice: 10}, 0); !errors.Is(err, errNotEnoughDeposit) {
+		t.Errorf("wrong error. expected: %v, got: %v", errNotEnoughDeposit, err)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -579,24 +566,17 @@ func TestDbBuyFailUpdateProd(t *testing.T) {
 	}
 }
 
-func TestDbBuyFailUpdateUser(t *testing.T) {
+func TestDbChangePasswordAlreadyChanged(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
 
-	mock.ExpectBegin()
-	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prod").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(`update users set deposit = `).WithArgs(1, "user").WillReturnError(errors.New("no user"))
-	mock.ExpectRollback()
+	mock.ExpectExec(`update users set password=\?, session_version = session_version \+ 1 where id=\? and password=\?`).WithArgs("new", "user", "old").WillReturnResult(sqlmock.NewResult(0, 0))
 
-	if err := NewApp("", db).dbBuy(context.Background(), "user", "prod", 1, 1); err == nil {
-		t.Error("should fail")
-	} else {
-		if err.Error() != "no user" {
-			t.Errorf("wrong error message. expected: %s, got: %s", "no user", err.Error())
-		}
+	if err := NewApp("", db).dbChangePassword(context.Background(), "user", "old", "new"); !errors.Is(err, errResetToken) {
+		t.Errorf("wrong error. expected: %s, got: %v", errResetToken, err)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+var errVendNotPending = errors.New("vend not found or already settled")
+
+// dbConfirmVend completes the buyer's pending purchase
+func (a *App) dbConfirmVend(ctx context.Context, purchaseID, userID string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	res, err := a.Db.ExecContext(ctx, `update purchases set status=? where id=? and user_id=? and status=?`, model.VEND_COMPLETED, purchaseID, userID, model.VEND_PENDING)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = errVendNotPending
+	}
+
+	return
+}
+
+// vendRollback is the outcome of a failed vend: the recorded failure and the buyer's deposit and product stock after the refund
+type vendRollback struct {
+	Failure         model.VendFailure
+	Deposit         int64
+	AvailableAmount int64
+}
+
+// dbFailVend rolls back a pending purchase: the buyer gets the price back on their deposit, the stock is restored
+// and the sale is taken out of the seller's earnings. The failure is recorded for maintenance.
+// If `userID` is not empty, the purchase must be theirs.
+func (a *App) dbFailVend(ctx context.Context, purchaseID, userID, reason string) (rb *vendRollback, err error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+			rb = nil
+		}
+	}()
+
+	p := model.Purchase{ID: purchaseID}
+
+	row := tx.QueryRowContext(ctx, `select user_id, product_id, seller_id, amount, total_price from purchases where id=? and status=? for update`, purchaseID, model.VEND_PENDING)
+	if err = row.Scan(&p.UserID, &p.ProductID, &p.SellerID, &p.Amount, &p.TotalPrice); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errVendNotPending
+		}
+		return
+	}
+
+	if userID != "" && userID != p.UserID {
+		err = errVendNotPending
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `update purchases set status=? where id=?`, model.VEND_FAILED, purchaseID); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `update products set available_amount = available_amount + ? where id=?`, p.Amount, p.ProductID); err != nil {
+		return
+	}
+
+	if _, err = tx.ExecContext(ctx, `update users set deposit = deposit + ? where id=?`, p.TotalPrice, p.UserID); err != nil {
+		return
+	}
+
+	if err = reverseSale(ctx, tx, p.SellerID, p.ID, p.TotalPrice); err != nil {
+		return
+	}
+
+	rb = &vendRollback{
+		Failure: model.VendFailure{
+			ID:         uuid.New().String(),
+			PurchaseID: purchaseID,
+			UserID:     p.UserID,
+			ProductID:  p.ProductID,
+			Amount:     p.Amount,
+			Refunded:   p.TotalPrice,
+			Reason:     reason,
+			CreatedAt:  time.Now(),
+		},
+	}
+
+	qryFailure := `insert into vend_failures (id, purchase_id, user_id, product_id, amount, refunded, reason, created_at) values (?, ?, ?, ?, ?, ?, ?, now())`
+
+	if _, err = tx.ExecContext(ctx, qryFailure, rb.Failure.ID, purchaseID, p.UserID, p.ProductID, p.Amount, p.TotalPrice, reason); err != nil {
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `select deposit from users where id=?`, p.UserID).Scan(&rb.Deposit); err != nil {
+		return
+	}
+
+	if err = tx.QueryRowContext(ctx, `select available_amount from products where id=?`, p.ProductID).Scan(&rb.AvailableAmount); err != nil {
+		return
+	}
+
+	err = addOutboxEvent(ctx, tx, model.EVENT_VEND_FAILED, rb.Failure)
+
+	return
+}
+
+// dbExpiredVends returns the IDs of the purchases pending for longer than `timeout`.
+// The age is computed by the database, with the same clock that set `created_at`.
+func (a *App) dbExpiredVends(ctx context.Context, timeout time.Duration) ([]string, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id from purchases where status=? and created_at < now() - interval ? second order by created_at`, model.VEND_PENDING, int64(timeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			fmt.Println("purchase record error", err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// dbVendFailures lists the latest vend failures, newest first
+func (a *App) dbVendFailures(ctx context.Context, limit int) ([]model.VendFailure, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, purchase_id, user_id, product_id, amount, refunded, reason, created_at from vend_failures order by created_at desc limit ?`
+
+	rows, err := conn.QueryContext(ctx, qry, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := make([]model.VendFailure, 0)
+
+	for rows.Next() {
+		var f model.VendFailure
+		if err := rows.Scan(&f.ID, &f.PurchaseID, &f.UserID, &f.ProductID, &f.Amount, &f.Refunded, &f.Reason, &f.CreatedAt); err != nil {
+			fmt.Println("vend failure record error", err)
+			continue
+		}
+		failures = append(failures, f)
+	}
+
+	return failures, rows.Err()
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// expectFailVend sets the expectations for rolling back `purchaseID`: 2 units of `prod` for 100, with 10 commission
+func expectFailVend(mock sqlmock.Sqlmock, purchaseID any, reason string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select user_id, product_id, seller_id, amount, total_price from purchases where id=\? and status=\? for update`).WithArgs(purchaseID, model.VEND_PENDING).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "total_price"}).AddRow("buyer", "prod", "seller", 2, 100))
+	mock.ExpectExec(`update purchases set status=\?`).WithArgs(model.VEND_FAILED, purchaseID).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set available_amount = available_amount \+ \?`).WithArgs(2, "prod").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \?`).WithArgs(100, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select .* from seller_ledger where purchase_id=\?`).WithArgs("SALE", "COMMISSION", purchaseID).
+		WillReturnRows(sqlmock.NewRows([]string{"sale", "commission"}).AddRow(100, 10))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "SALE", -100, purchaseID, nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "COMMISSION", 10, purchaseID, nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into vend_failures`).WithArgs(sqlmock.AnyArg(), purchaseID, "buyer", "prod", 2, 100, reason).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(120))
+	mock.ExpectQuery(`select available_amount from products`).WithArgs("prod").WillReturnRows(sqlmock.NewRows([]string{"available_amount"}).AddRow(7))
+	mock.ExpectExec(`insert into outbox`).WithArgs(sqlmock.AnyArg(), model.EVENT_VEND_FAILED, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestDbFailVend(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectFailVend(mock, "purchase", "motor jam")
+
+	rb, err := NewApp("", db).dbFailVend(context.Background(), "purchase", "buyer", "motor jam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rb.Failure.Refunded != 100 || rb.Failure.Amount != 2 || rb.Failure.Reason != "motor jam" {
+		t.Errorf("wrong failure. expected: 2 units refunded 100, got: %+v", rb.Failure)
+	}
+
+	if rb.Deposit != 120 || rb.AvailableAmount != 7 {
+		t.Errorf("wrong state after refund. expected: deposit 120, stock 7, got: deposit %d, stock %d", rb.Deposit, rb.AvailableAmount)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbFailVendOtherBuyer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select user_id, product_id, seller_id, amount, total_price from purchases`).WithArgs("purchase", model.VEND_PENDING).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "total_price"}).AddRow("buyer", "prod", "seller", 2, 100))
+	mock.ExpectRollback()
+
+	_, err = NewApp("", db).dbFailVend(context.Background(), "purchase", "someone else", "jam")
+	if !errors.Is(err, errVendNotPending) {
+		t.Errorf("wrong error. expected: %v, got: %v", errVendNotPending, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbConfirmVendNotPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`update purchases set status=\? where id=\? and user_id=\? and status=\?`).WithArgs(model.VEND_COMPLETED, "purchase", "buyer", model.VEND_PENDING).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = NewApp("", db).dbConfirmVend(context.Background(), "purchase", "buyer")
+	if !errors.Is(err, errVendNotPending) {
+		t.Errorf("wrong error. expected: %v, got: %v", errVendNotPending, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbExpiredVends(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id from purchases where status=\? and created_at < now\(\) - interval \? second`).WithArgs(model.VEND_PENDING, 90).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("p1").AddRow("p2"))
+
+	ids, err := NewApp("", db).dbExpiredVends(context.Background(), 90*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 || ids[0] != "p1" || ids[1] != "p2" {
+		t.Errorf("wrong vends. expected: [p1 p2], got: %v", ids)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func (a *App) dbCreateWebhook(ctx context.Context, sub model.WebhookSubscription) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	qry := `insert into webhook_subscriptions (id, url, events, secret, created_at) values (?, ?, ?, ?, now())`
+
+	_, err = tx.ExecContext(ctx, qry, sub.ID, sub.URL, strings.Join(sub.Events, ","), sub.Secret)
+
+	return
+}
+
+// dbWebhooks lists the subscriptions, without their secrets
+func (a *App) dbWebhooks(ctx context.Context) ([]model.WebhookSubscription, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `select id, url, events, created_at from webhook_subscriptions order by created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]model.WebhookSubscription, 0)
+
+	for rows.Next() {
+		var s model.WebhookSubscription
+		var events string
+		if err := rows.Scan(&s.ID, &s.URL, &events, &s.CreatedAt); err != nil {
+			fmt.Println("webhook record error", err)
+			continue
+		}
+		s.Events = strings.Split(events, ",")
+		subs = append(subs, s)
+	}
+
+	return subs, rows.Err()
+}
+
+// dbFindWebhook returns the subscription, including its secret
+func (a *App) dbFindWebhook(ctx context.Context, id string) (*model.WebhookSubscription, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var s model.WebhookSubscription
+	var events string
+
+	err = conn.QueryRowContext(ctx, `select id, url, events, secret, created_at from webhook_subscriptions where id=?`, id).Scan(&s.ID, &s.URL, &events, &s.Secret, &s.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("webhook not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.Events = strings.Split(events, ",")
+
+	return &s, nil
+}
+
+// dbDeleteWebhook removes the subscription. Its deliveries are removed by the database (on delete cascade)
+func (a *App) dbDeleteWebhook(ctx context.Context, id string) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	tx, err := a.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `delete from webhook_subscriptions where id=?`, id)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = errors.New("webhook not found")
+	}
+
+	return
+}
+
+// dbEnqueueEvent queues a delivery of the event for every subscription interested in it
+func (a *App) dbEnqueueEvent(ctx context.Context, eventType model.TypeEvent, payload string) (queued int64, err error) {
+
+	if a.Db == nil {
+		return 0, errors.New("no database configured")
+	}
+
+	qry := `insert into webhook_deliveries (id, subscription_id, event_type, payload, status, attempts, next_attempt_at, created_at)
+	select uuid(), id, ?, ?, ?, 0, now(), now() from webhook_subscriptions where events='*' or find_in_set(?, events)`
+
+	res, err := a.Db.ExecContext(ctx, qry, eventType, payload, model.DELIVERY_PENDING, eventType)
+	if err != nil {
+		return
+	}
+
+	return res.RowsAffected()
+}
+
+func (a *App) dbInsertDelivery(ctx context.Context, d model.WebhookDelivery) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	qry := `insert into webhook_deliveries (id, subscription_id, event_type, payload, status, attempts, next_attempt_at, created_at) values (?, ?, ?, ?, ?, ?, ?, now())`
+
+	_, err = a.Db.ExecContext(ctx, qry, d.ID, d.SubscriptionID, d.EventType, d.Payload, d.Status, d.Attempts, d.NextAttemptAt)
+
+	return
+}
+
+// dbUpdateDelivery records the outcome of a delivery attempt
+func (a *App) dbUpdateDelivery(ctx context.Context, d model.WebhookDelivery) (err error) {
+
+	if a.Db == nil {
+		return errors.New("no database configured")
+	}
+
+	qry := `update webhook_deliveries set status=?, attempts=?, next_attempt_at=?, last_status_code=?, last_error=?, delivered_at=? where id=?`
+
+	_, err = a.Db.ExecContext(ctx, qry, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, nullString(d.LastError), d.DeliveredAt, d.ID)
+
+	return
+}
+
+// dueDelivery is a pending delivery together with where it goes and how it is signed
+type dueDelivery struct {
+	model.WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// dbDueDeliveries returns at most `limit` pending deliveries whose next attempt is due, oldest first
+func (a *App) dbDueDeliveries(ctx context.Context, limit int) ([]dueDelivery, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select d.id, d.subscription_id, d.event_type, d.payload, d.attempts, s.url, s.secret
+	from webhook_deliveries d join webhook_subscriptions s on s.id=d.subscription_id
+	where d.status=? and d.next_attempt_at <= now() order by d.next_attempt_at limit ?`
+
+	rows, err := conn.QueryContext(ctx, qry, model.DELIVERY_PENDING, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	due := make([]dueDelivery, 0)
+
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			fmt.Println("delivery record error", err)
+			continue
+		}
+		d.Status = model.DELIVERY_PENDING
+		due = append(due, d)
+	}
+
+	return due, rows.Err()
+}
+
+// dbWebhookDeliveries lists the latest deliveries of a subscription, newest first
+func (a *App) dbWebhookDeliveries(ctx context.Context, subscriptionID string, limit int) ([]model.WebhookDelivery, error) {
+
+	if a.Db == nil {
+		return nil, errors.New("no database configured")
+	}
+
+	conn, err := a.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	qry := `select id, subscription_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, delivered_at
+	from webhook_deliveries where subscription_id=? order by created_at desc limit ?`
+
+	rows, err := conn.QueryContext(ctx, qry, subscriptionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]model.WebhookDelivery, 0)
+
+	for rows.Next() {
+		var d model.WebhookDelivery
+		var lastErr sql.NullString
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastStatusCode, &lastErr, &d.CreatedAt, &deliveredAt); err != nil {
+			fmt.Println("delivery record error", err)
+			continue
+		}
+		d.LastError = lastErr.String
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestDbWebhooks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id, url, events, created_at from webhook_subscriptions`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "events", "created_at"}).
+			AddRow("sub1", "https://example.com/a", "*", time.Now()).
+			AddRow("sub2", "https://example.com/b", "purchase.created,product.updated", time.Now()))
+
+	subs, err := NewApp("", db).dbWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 2 {
+		t.Fatalf("wrong number of webhooks. expected: %d, got: %d", 2, len(subs))
+	}
+
+	if len(subs[1].Events) != 2 || subs[1].Events[1] != model.EVENT_PRODUCT_UPDATED {
+		t.Errorf("wrong events: %v", subs[1].Events)
+	}
+
+	if subs[0].Secret != "" || subs[1].Secret != "" {
+		t.Error("secrets should not be listed")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbDeleteWebhookNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from webhook_subscriptions where id=\?`).WithArgs("sub").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = NewApp("", db).dbDeleteWebhook(context.Background(), "sub")
+	if err == nil || err.Error() != "webhook not found" {
+		t.Errorf("wrong error. expected: %s, got: %v", "webhook not found", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbWebhookDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+
+	mock.ExpectQuery(`from webhook_deliveries where subscription_id=\?`).WithArgs("sub", 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event_type", "payload", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "created_at", "delivered_at"}).
+			AddRow("d1", "sub", model.EVENT_PURCHASE, "{}", model.DELIVERY_PENDING, 2, now, 502, "Bad Gateway", now, nil).
+			AddRow("d2", "sub", model.EVENT_PURCHASE, "{}", model.DELIVERY_DELIVERED, 1, now, 200, nil, now, now))
+
+	deliveries, err := NewApp("", db).dbWebhookDeliveries(context.Background(), "sub", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 2 {
+		t.Fatalf("wrong number of deliveries. expected: %d, got: %d", 2, len(deliveries))
+	}
+
+	if deliveries[0].LastError != "Bad Gateway" || deliveries[0].DeliveredAt != nil {
+		t.Errorf("wrong pending delivery: %+v", deliveries[0])
+	}
+
+	if deliveries[1].LastError != "" || deliveries[1].DeliveredAt == nil {
+		t.Errorf("wrong delivered delivery: %+v", deliveries[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,11 +2,16 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/mehiX/vending-machine-api/internal/app/model"
 )
@@ -14,6 +19,10 @@ import (
 const (
 	jwtUsernameKey = "username"
 	jwtUserIdKey   = "userID"
+	jwtMFAKey      = "mfa"     // set on the tokens waiting for a one-time code
+	jwtRolesKey    = "roles"   // the roles the login token was given for, e.g. `SELLER,BUYER`
+	jwtSessionKey  = "sv"      // session version of the login and reset tokens, see sessionVersion
+	jwtResetKey    = "pwreset" // set on the password reset tokens
 )
 
 // @Summary 	Get information about current user
@@ -27,12 +36,18 @@ const (
 // @Router 		/user [get]
 func (a *App) handleShowCurrentUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		usr := r.Context().Value(userContextKey).(*model.User)
+		usr, ok := a.liveUser(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
 
 		resp := currentUserResponse{
-			Username: usr.Username,
-			Role:     usr.Role,
-			Deposit:  usr.Deposit,
+			Username:    usr.Username,
+			Role:        usr.Role,
+			Roles:       usr.AllRoles(),
+			Permissions: a.Policy.Permissions(usr),
+			Deposit:     usr.Deposit,
 		}
 
 		returnAsJSON(r.Context(), w, resp)
@@ -41,7 +56,7 @@ func (a *App) handleShowCurrentUser() http.HandlerFunc {
 }
 
 // @Summary 	Add a new user
-// @Description Receive user data in body, validate it and save in the database
+// @Description Receive user data in body, validate it and save in the database. The role is `BUYER` or `SELLER`
 // @Tags		public
 // @Accept		application/json
 // @Produces	application/json
@@ -49,6 +64,7 @@ func (a *App) handleShowCurrentUser() http.HandlerFunc {
 // @Success		201
 // @Failure		500 {string} string "user not created"
 // @Failure		400 {string} string "bad request"
+// @Failure		403 {string} string "role not allowed at registration"
 // @Router 		/user [post]
 func (a *App) handleAddUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -59,12 +75,19 @@ func (a *App) handleAddUser() http.HandlerFunc {
 			return
 		}
 
-		if err := a.CreateUser(r.Context(), data.Username, data.Password, data.Role); err != nil {
+		userID, err := a.RegisterUser(r.Context(), data.Username, data.Password, data.Role)
+		if errors.Is(err, errRoleNotAllowed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
 			fmt.Println("createUser error", err)
 			http.Error(w, "user not created", http.StatusInternalServerError)
 			return
 		}
 
+		a.audit(r, "", model.AUDIT_USER_CREATE, "user", userID, nil, userEvent{ID: userID, Username: data.Username, Role: data.Role})
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -78,6 +101,8 @@ func (a *App) handleAddUser() http.HandlerFunc {
 // @Success		200 {string} string "jwt"
 // @Failure		401 {string} string "not authorized"
 // @Failure		400 {string} string "bad request"
+// @Success		202 {object} mfaChallenge "the password is right, a one-time code is needed next"
+// @Failure		429 {string} string "too many failed logins, see the Retry-After header"
 // @Router 		/login [post]
 func (a *App) handleLogin() http.HandlerFunc {
 
@@ -89,24 +114,148 @@ func (a *App) handleLogin() http.HandlerFunc {
 			return
 		}
 
+		ip := clientIP(r)
+
+		if wait := a.Logins.Wait(body.Username, ip); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+
 		usr, err := a.FindUserByCredentials(r.Context(), body.Username, body.Password)
 		if err != nil {
+			a.audit(r, "", model.AUDIT_LOGIN_FAILED, "username", body.Username, nil, nil)
+			if errors.Is(err, errBadCredentials) && a.Logins.Failed(body.Username, ip) {
+				a.audit(r, "", model.AUDIT_LOGIN_LOCKED, "username", body.Username, nil, nil)
+			}
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
-		tokenString, err := a.getEncTokenString(usr.ID, usr.Username)
+		step, err := a.mfaLoginStep(r.Context(), usr)
+		if err != nil {
+			fmt.Println("mfa login step", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if step != "" {
+			// the failed logins are only forgotten once the code is checked too
+			a.returnMFAChallenge(w, r, usr, step)
+			return
+		}
+
+		a.Logins.Succeeded(usr.Username)
+
+		tokenString, err := a.getEncTokenString(usr)
 		if err != nil {
 			fmt.Printf("Error signing token: %s\n", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		a.audit(r, usr.ID, model.AUDIT_LOGIN, "user", usr.ID, nil, nil)
+
 		w.Write([]byte(tokenString))
 
 	}
 }
 
+// @Summary 	User details
+// @Description Show a user and its failed logins
+// @Tags		private, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		userID path string true "User ID"
+// @Success		200 {object} userDetails
+// @Failure		401 {string} string "not authorized"
+// @Failure		404 {string} string "user not found"
+// @Router 		/admin/users/{userID} [get]
+func (a *App) handleUserDetails() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		details, err := a.UserDetails(r.Context(), chi.URLParam(r, "userID"))
+		if err != nil {
+			a.userDetailsError(w, err)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, details)
+	}
+}
+
+// @Summary 	Unlock a user
+// @Description Forget the failed logins of a user so it can log in again right away
+// @Tags		private, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		userID path string true "User ID"
+// @Success		200 {object} userDetails
+// @Failure		401 {string} string "not authorized"
+// @Failure		404 {string} string "user not found"
+// @Router 		/admin/users/{userID}/unlock [post]
+func (a *App) handleUnlockUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		details, before, err := a.UnlockUser(r.Context(), chi.URLParam(r, "userID"))
+		if err != nil {
+			a.userDetailsError(w, err)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_USER_UNLOCK, "user", details.ID, before, details.Lockout)
+
+		returnAsJSON(r.Context(), w, details)
+	}
+}
+
+// @Summary 	Set the roles of a user
+// @Description A user can hold several roles, e.g. a seller who also buys. The first one is the main role
+// @Tags		private, only admins
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		userID path string true "User ID"
+// @Param 		request body userRoles true "roles"
+// @Success		200 {object} userDetails
+// @Failure		400 {string} string "invalid roles"
+// @Failure		401 {string} string "not authorized"
+// @Failure		404 {string} string "user not found"
+// @Router 		/admin/users/{userID}/roles [put]
+func (a *App) handleSetUserRoles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var body userRoles
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		details, before, err := a.SetUserRoles(r.Context(), chi.URLParam(r, "userID"), body.Roles)
+		if errors.Is(err, errInvalidRoles) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			a.userDetailsError(w, err)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_USER_ROLE, "user", details.ID, userRoles{Roles: before}, userRoles{Roles: details.AllRoles()})
+
+		returnAsJSON(r.Context(), w, details)
+	}
+}
+
+func (a *App) userDetailsError(w http.ResponseWriter, err error) {
+	fmt.Println("user details", err)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "user not found", http.StatusNotFound)
+	} else {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
 // @Summary 	Reset deposit
 // @Description Resets a buyer's deposit to 0
 // @Tags		private, only buyers
@@ -120,18 +269,21 @@ func (a *App) handleReset() http.HandlerFunc {
 
 		ctx := r.Context()
 
-		usr, ok := ctx.Value(userContextKey).(*model.User)
-		if !ok || !usr.IsBuyer() {
+		usr, ok := a.liveUser(ctx)
+		if !ok || a.Authorize(usr, perm_deposit_reset, "") != nil {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
-		if err := a.ResetDeposit(ctx, usr); err != nil {
+		reset, err := a.ResetDeposit(ctx, usr)
+		if err != nil {
 			fmt.Println("resetDeposit error", err)
 			http.Error(w, "reset failed", http.StatusInternalServerError)
 			return
 		}
 
+		a.audit(r, usr.ID, model.AUDIT_DEPOSIT_RESET, "user", usr.ID, depositEvent{UserID: usr.ID, Deposit: reset.Amount}, reset)
+
 		a.returnUserAsJson(ctx, w, usr.ID)
 	}
 }
@@ -141,7 +293,7 @@ func (a *App) handleReset() http.HandlerFunc {
 // @Tags		private, only buyers
 // @Security 	ApiKeyAuth
 // @Produces	application/json
-// @Param 		coin path integer true "Coin value" Enums(5,10,20,50,100)
+// @Param 		coin path integer true "Coin value, one of the configured currency coins"
 // @Success		200 {object} model.User "user with updated deposit"
 // @Failure		500 {string} string "deposit not updated"
 // @Failure		400 {string} string "bad request"
@@ -151,8 +303,8 @@ func (a *App) handleDeposit() http.HandlerFunc {
 
 		ctx := r.Context()
 
-		usr, ok := ctx.Value(userContextKey).(*model.User)
-		if !ok || !usr.IsBuyer() {
+		usr, ok := a.liveUser(ctx)
+		if !ok || a.Authorize(usr, perm_deposit_create, "") != nil {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
@@ -163,12 +315,70 @@ func (a *App) handleDeposit() http.HandlerFunc {
 			return
 		}
 
-		if err := a.UserDepositCoin(ctx, usr, *coinValue); err != nil {
+		deposit, err := a.UserDepositCoin(ctx, usr, *coinValue)
+		if err != nil {
 			fmt.Println("deposit coin", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		a.audit(r, usr.ID, model.AUDIT_DEPOSIT, "user", usr.ID,
+			depositEvent{UserID: usr.ID, Deposit: usr.Deposit},
+			depositEvent{UserID: usr.ID, Coins: []int64{int64(*coinValue)}, Deposit: deposit})
+
+		a.returnUserAsJson(ctx, w, usr.ID)
+	}
+}
+
+// @Summary 	Deposit several coins
+// @Description Deposit a batch of coins at once. Either all coins are accepted or none
+// @Tags		private, only buyers
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		coins body depositRequest true "coin values"
+// @Success		200 {object} model.User "user with updated deposit"
+// @Failure		500 {string} string "deposit failed"
+// @Failure		400 {string} string "bad request"
+// @Router 		/deposit [post]
+func (a *App) handleDepositBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		ctx := r.Context()
+
+		usr, ok := a.liveUser(ctx)
+		if !ok || a.Authorize(usr, perm_deposit_create, "") != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var data depositRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			fmt.Println("deposit coins", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		deposit, err := a.UserDepositCoins(ctx, usr, data.Coins)
+		if err != nil {
+			fmt.Println("deposit coins", err)
+			if errors.Is(err, errDepositFailed) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		coins := make([]int64, len(data.Coins))
+		for i, c := range data.Coins {
+			coins[i] = int64(c)
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_DEPOSIT, "user", usr.ID,
+			depositEvent{UserID: usr.ID, Deposit: usr.Deposit},
+			depositEvent{UserID: usr.ID, Coins: coins, Deposit: deposit})
+
 		a.returnUserAsJson(ctx, w, usr.ID)
 	}
 }
@@ -191,8 +401,8 @@ func (a *App) handleBuy() http.HandlerFunc {
 
 		ctx := r.Context()
 
-		user, ok := ctx.Value(userContextKey).(*model.User)
-		if !ok || !user.IsBuyer() {
+		user, ok := a.liveUser(ctx)
+		if !ok || a.Authorize(user, perm_purchase_create, "") != nil {
 			http.Error(w, "not a buyer", http.StatusUnauthorized)
 			return
 		}
@@ -209,19 +419,25 @@ func (a *App) handleBuy() http.HandlerFunc {
 			return
 		}
 
-		seller, ok := ctx.Value(sellerContextKey).(*model.User)
-		if !ok {
+		seller, _, err := a.Users.Get(ctx, prod.SellerID, a.dbFindUserByID)
+		if err != nil {
 			http.Error(w, "seller data not found", http.StatusNotFound)
 			return
 		}
 
-		if err := a.Buy(r.Context(), user, prod, *amount); err != nil {
+		res, err := a.Vend(withAuditSource(r.Context(), requestAuditSource(r, user.ID)), user, prod, *amount)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		totalSpent := int64(*amount) * prod.Cost
-		change := getChange(user.Deposit - totalSpent)
+		// the coins the remaining deposit would be given back in now, none if the coin box can't make it
+		var change []int64
+		if inventory, err := a.dbCoinInventory(ctx); err != nil {
+			fmt.Println("buy change", err)
+		} else if change, err = a.Currency.changeFromInventory(res.Remaining, inventory); err != nil {
+			fmt.Println("buy change", err)
+		}
 
 		resp := buyResponse{
 			Product: prodBuyerInfo{
@@ -230,14 +446,51 @@ func (a *App) handleBuy() http.HandlerFunc {
 				SellerName: seller.Username,
 			},
 			Amount:     *amount,
-			TotalSpent: totalSpent,
+			BasePrice:  res.BasePrice,
+			TotalSpent: res.TotalCost,
+			Currency:   a.Currency.Code,
+			Coins:      a.Currency.Coins,
 			Change:     change,
 		}
 
+		if res.Promotion != nil {
+			resp.Promotion = &promotionInfo{
+				ID:   res.Promotion.ID,
+				Name: res.Promotion.Name,
+				Type: res.Promotion.Type,
+			}
+		}
+
+		a.audit(r, user.ID, model.AUDIT_BUY, "purchase", res.PurchaseID, depositEvent{UserID: user.ID, Deposit: user.Deposit}, resp)
+
 		returnAsJSON(r.Context(), w, resp)
 	}
 }
 
+// liveUser returns the user of the request with the current deposit. The user put in the context by UserCtx
+// can come from the cache, where the deposit may be behind the changes made by other servers
+func (a *App) liveUser(ctx context.Context) (*model.User, bool) {
+
+	usr, ok := ctx.Value(userContextKey).(*model.User)
+	if !ok {
+		return nil, false
+	}
+
+	if cached, _ := ctx.Value(userCachedContextKey).(bool); !cached {
+		return usr, true
+	}
+
+	a.Users.Invalidate(usr.ID)
+
+	live, _, err := a.Users.Get(ctx, usr.ID, a.dbFindUserByID)
+	if err != nil {
+		fmt.Println("live user", err)
+		return nil, false
+	}
+
+	return live, true
+}
+
 func (a *App) returnUserAsJson(ctx context.Context, w http.ResponseWriter, userID string) {
 	buyer, err := a.FindUserByID(ctx, userID)
 	if err != nil {
@@ -259,12 +512,35 @@ func returnAsJSON(ctx context.Context, w http.ResponseWriter, data any) {
 	}
 }
 
-func (a *App) getEncTokenString(userID, username string) (tokenString string, err error) {
+// getEncTokenString returns a login token. It stops working when the user's password or roles change
+func (a *App) getEncTokenString(usr *model.User) (tokenString string, err error) {
 	t := jwt.New()
 	t.Set(jwt.ExpirationKey, time.Now().Add(30*time.Minute))
 	t.Set(jwt.NotBeforeKey, time.Now())
+	t.Set(jwtUserIdKey, usr.ID)
+	t.Set(jwtUsernameKey, usr.Username)
+	t.Set(jwtRolesKey, strings.Join(usr.AllRoles(), ","))
+	t.Set(jwtSessionKey, sessionVersion(usr))
+
+	claims, err := t.AsMap(context.Background())
+	if err != nil {
+		return
+	}
+
+	_, tokenString, err = a.JwtAuth.Encode(claims)
+
+	return
+
+}
+
+// getMFATokenString returns a short-lived token that only allows the second login step
+func (a *App) getMFATokenString(userID, username, step string) (tokenString string, err error) {
+	t := jwt.New()
+	t.Set(jwt.ExpirationKey, time.Now().Add(mfa_token_ttl))
+	t.Set(jwt.NotBeforeKey, time.Now())
 	t.Set(jwtUserIdKey, userID)
 	t.Set(jwtUsernameKey, username)
+	t.Set(jwtMFAKey, step)
 
 	claims, err := t.AsMap(context.Background())
 	if err != nil {
@@ -274,13 +550,18 @@ func (a *App) getEncTokenString(userID, username string) (tokenString string, er
 	_, tokenString, err = a.JwtAuth.Encode(claims)
 
 	return
-
 }
 
 type currentUserResponse struct {
-	Username string
-	Role     string
-	Deposit  int64
+	Username    string
+	Role        string
+	Roles       []model.TypeRole
+	Permissions []string // e.g. `product:update:own`, the `:own` ones only on the user's own resources
+	Deposit     int64
+}
+
+type userRoles struct {
+	Roles []model.TypeRole `json:"roles"` // the first one is the main role
 }
 type addUserRequest struct {
 	Username string
@@ -293,11 +574,25 @@ type loginRequest struct {
 	Password string
 }
 
+type depositRequest struct {
+	Coins []int `json:"coins"`
+}
+
 type buyResponse struct {
 	Product    prodBuyerInfo
 	Amount     int
+	BasePrice  int64 // price before the promotion
 	TotalSpent int64
-	Change     [5]int64
+	Promotion  *promotionInfo `json:",omitempty"`
+	Currency   string
+	Coins      []int64 // coin denominations, same order as Change
+	Change     []int64 // from the coins in the coin box, empty if it can't give the remaining deposit back
+}
+
+type promotionInfo struct {
+	ID   string
+	Name string
+	Type string
 }
 
 type prodBuyerInfo struct {
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Set low-stock threshold
+// @Description The seller gets an alert when a buy takes the stock to the threshold or below it. 0 turns low-stock alerts off
+// @Tags		private, product, only sellers
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Param 		productID path string true "Product ID"
+// @Param 		threshold body thresholdRequest true "new threshold"
+// @Success		204
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "unauthorized"
+// @Router 		/product/{productID}/threshold [put]
+func (a *App) handleSetLowStockThreshold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok || !a.Can(user, perm_product_update) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		product, ok := r.Context().Value(productContextKey).(*model.Product)
+		if !ok {
+			http.Error(w, "missing product", http.StatusBadRequest)
+			return
+		}
+
+		var req thresholdRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding threshold", err)
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		if err := a.SetLowStockThreshold(r.Context(), user, product, req.LowStockThreshold); err != nil {
+			fmt.Println("set threshold", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary 	Stock alerts
+// @Description Low-stock and sold-out alerts for the seller's products, newest first
+// @Tags		private, alerts, only sellers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		all query bool false "include acknowledged alerts"
+// @Success		200 {object} []model.StockAlert
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/seller/alerts [get]
+func (a *App) handleSellerAlerts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		alerts, err := a.SellerAlerts(r.Context(), seller, r.URL.Query().Get("all") == "true")
+		if err != nil {
+			fmt.Println("seller alerts", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, alerts)
+	}
+}
+
+// @Summary 	Acknowledge an alert
+// @Tags		private, alerts, only sellers
+// @Security 	ApiKeyAuth
+// @Param 		alertID path string true "Alert ID"
+// @Success		204
+// @Failure		400 {string} string "alert not found or already acknowledged"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/seller/alerts/{alertID}/ack [post]
+func (a *App) handleAcknowledgeAlert() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if err := a.AcknowledgeAlert(r.Context(), seller, chi.URLParam(r, "alertID")); err != nil {
+			fmt.Println("acknowledge alert", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type thresholdRequest struct {
+	LowStockThreshold int64 `json:"low_stock_threshold"`
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleSetLowStockThreshold(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "five", http.StatusBadRequest},
+		{"negative", `{"low_stock_threshold":-2}`, http.StatusBadRequest},
+		{"set", `{"low_stock_threshold":5}`, http.StatusNoContent},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.statusCode == http.StatusNoContent {
+			mock.ExpectBegin()
+			mock.ExpectExec(`update products set low_stock_threshold=\?`).WithArgs(5, "prodid").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}
+
+		r, err := http.NewRequest(http.MethodPut, "/product/prodid/threshold", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+		ctx = context.WithValue(ctx, productContextKey, &model.Product{ID: "prodid", SellerID: "sellerid"})
+
+		NewApp("", db).handleSetLowStockThreshold().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestHandleSellerAlerts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from stock_alerts`).WithArgs("sellerid", false).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "alert_type", "stock", "threshold", "created_at", "acknowledged_at"}).
+			AddRow("a1", "sellerid", "prodid", model.ALERT_LOW_STOCK, 2, 3, time.Now(), nil))
+
+	r, err := http.NewRequest(http.MethodGet, "/seller/alerts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+	NewApp("", db).handleSellerAlerts().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var alerts []model.StockAlert
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(alerts) != 1 || alerts[0].Type != model.ALERT_LOW_STOCK {
+		t.Errorf("wrong alerts: %+v", alerts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"` // read, deposit, buy, products:write, seller
+}
+
+type createAPIKeyResponse struct {
+	model.APIKey
+	Key string `json:"key"` // send it as `Authorization: ApiKey <key>` or `X-API-Key: <key>`
+}
+
+// @Summary 	Create an API key
+// @Description The key acts as the user, limited to its scopes. It is only returned here. Needs a login token, API keys can't create keys
+// @Tags		private, api keys
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		key body createAPIKeyRequest true "name and scopes"
+// @Success		201 {object} createAPIKeyResponse
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/user/apikeys [post]
+func (a *App) handleCreateAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var req createAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		key, secret, err := a.CreateAPIKey(r.Context(), usr, req.Name, req.Scopes)
+		if err != nil {
+			fmt.Println("create api key", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_APIKEY_CREATE, "apikey", key.ID, nil, key)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(createAPIKeyResponse{APIKey: *key, Key: secret}); err != nil {
+			fmt.Println("error encoding data", err)
+		}
+	}
+}
+
+// @Summary 	List API keys
+// @Description The user's keys, revoked ones included, newest first
+// @Tags		private, api keys
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.APIKey
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/user/apikeys [get]
+func (a *App) handleListAPIKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		keys, err := a.ListAPIKeys(r.Context(), usr)
+		if err != nil {
+			fmt.Println("list api keys", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, keys)
+	}
+}
+
+// @Summary 	Revoke an API key
+// @Tags		private, api keys
+// @Security 	ApiKeyAuth
+// @Param 		keyID path string true "API key ID"
+// @Success		204
+// @Failure		401 {string} string "not authorized"
+// @Failure		404 {string} string "api key not found"
+// @Router 		/user/apikeys/{keyID} [delete]
+func (a *App) handleRevokeAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		keyID := chi.URLParam(r, "keyID")
+
+		if err := a.RevokeAPIKey(r.Context(), usr, keyID); err != nil {
+			if errors.Is(err, errAPIKeyNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			fmt.Println("revoke api key", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_APIKEY_REVOKE, "apikey", keyID, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
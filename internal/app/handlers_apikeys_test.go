@@ -0,0 +1,72 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestAPIKeyAccess(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	vm := NewApp("", db)
+
+	secret := apikey_prefix + "abcdefghijklmnopqrstuvwxyz234567"
+
+	expectKey := func() {
+		mock.ExpectQuery(`select id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at from api_keys where key_hash=\? and revoked_at is null`).
+			WithArgs(apiKeyHash(secret)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "last_used_at", "revoked_at"}).
+				AddRow("key1", "id1", "machine 1", secret[:apikey_prefix_shown], "read", time.Now(), nil, nil))
+		mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "machine01", "", 100, model.ROLE_BUYER, 0))
+		mock.ExpectExec(`update api_keys set last_used_at=now\(\)`).WithArgs("key1").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	scenarios := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		known  bool
+		status int
+	}{
+		{"scope read", http.MethodGet, "/user", "Authorization", "ApiKey " + secret, true, http.StatusOK},
+		{"key header", http.MethodGet, "/user", "X-API-Key", secret, true, http.StatusOK},
+		{"missing scope", http.MethodPost, "/reset", "X-API-Key", secret, true, http.StatusForbidden},
+		{"route without scopes", http.MethodGet, "/user/apikeys", "Authorization", "ApiKey " + secret, true, http.StatusUnauthorized},
+		{"unknown key", http.MethodGet, "/user", "X-API-Key", apikey_prefix + "unknown", false, http.StatusUnauthorized},
+	}
+
+	for _, s := range scenarios {
+		if s.known {
+			expectKey()
+		} else {
+			mock.ExpectQuery(`select id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at from api_keys`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "last_used_at", "revoked_at"}))
+		}
+
+		r, _ := http.NewRequest(s.method, s.path, nil)
+		r.Header.Set(s.header, s.value)
+		w := httptest.NewRecorder()
+		vm.Router.ServeHTTP(w, r)
+
+		if w.Code != s.status {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.status, w.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
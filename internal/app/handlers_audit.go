@@ -0,0 +1,116 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// audit records an action done through the request, with the client's IP and the request ID.
+// `before` and `after` are saved as JSON if not nil. Failures are only logged, they don't fail the request.
+func (a *App) audit(r *http.Request, actorID string, action model.TypeAuditAction, targetType, targetID string, before, after any) {
+	a.auditAction(withAuditSource(r.Context(), requestAuditSource(r, actorID)), action, targetType, targetID, before, after)
+}
+
+// requestAuditSource is the actor acting through the request
+func requestAuditSource(r *http.Request, actorID string) auditSource {
+	return auditSource{ActorID: actorID, IP: clientIP(r), RequestID: middleware.GetReqID(r.Context())}
+}
+
+// actorID is the ID of the logged in user, if any
+func actorID(r *http.Request) string {
+	if usr, ok := r.Context().Value(userContextKey).(*model.User); ok {
+		return usr.ID
+	}
+
+	return ""
+}
+
+// clientIP is the address set by RealIP, without the port if there is one
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// @Summary 	Audit log
+// @Description Who did what, from where, newest first. All filters are optional
+// @Tags		private, audit, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		actor query string false "ID of the user who acted"
+// @Param 		action query string false "action, e.g. auth.login_failed"
+// @Param 		target_type query string false "e.g. user, product, purchase"
+// @Param 		target_id query string false "ID of the target"
+// @Param 		from query string false "RFC 3339 time, included"
+// @Param 		to query string false "RFC 3339 time, excluded. Defaults to now"
+// @Param 		limit query int false "at most 1000, default 100"
+// @Success		200 {object} []model.AuditEntry
+// @Failure		400 {string} string "bad filters"
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/audit [get]
+func (a *App) handleAuditLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		q := r.URL.Query()
+
+		f := auditFilter{
+			ActorID:    q.Get("actor"),
+			Action:     q.Get("action"),
+			TargetType: q.Get("target_type"),
+			TargetID:   q.Get("target_id"),
+		}
+
+		var err error
+		if v := q.Get("from"); v != "" {
+			if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("to"); v != "" {
+			if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "limit must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := a.AuditLog(r.Context(), f)
+		if err != nil {
+			fmt.Println("audit log", err)
+			if errors.Is(err, errBadAuditFilter) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		returnAsJSON(r.Context(), w, entries)
+	}
+}
+
+type noteAudit struct {
+	Note     int     `json:"note,omitempty"`
+	Returned []int64 `json:"returned,omitempty"`
+}
+
+type payoutActionAudit struct {
+	Action string `json:"action"`
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleAuditLogBadFilters(t *testing.T) {
+
+	type scenario struct {
+		name  string
+		query string
+	}
+
+	scenarios := []scenario{
+		{"bad from", "?from=yesterday"},
+		{"bad to", "?to=2022-10-01"},
+		{"bad limit", "?limit=many"},
+		{"negative limit", "?limit=-5"},
+		{"from after to", "?from=2022-10-02T00:00:00Z&to=2022-10-01T00:00:00Z"},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodGet, "/admin/audit"+s.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		NewApp("", nil).handleAuditLog().ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r, err := http.NewRequest(http.MethodDelete, "/product/prod", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.1:5432"
+	r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, "req-1"))
+
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "seller", model.AUDIT_PRODUCT_DELETE, "product", "prod", `{"id":"prod","seller_id":"seller"}`, nil, "10.0.0.1", "req-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	NewApp("", db).audit(r, "seller", model.AUDIT_PRODUCT_DELETE, "product", "prod", productDeletedEvent{ID: "prod", SellerID: "seller"}, nil)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Insert a banknote
+// @Description Hold 1 banknote in escrow until a buy needs it or the buyer cancels
+// @Tags		private, only buyers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		note path integer true "Note value, one of the configured currency notes"
+// @Success		200 {object} escrowResponse "deposit and notes in escrow"
+// @Failure		400 {string} string "note not accepted"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/deposit/note/{note} [post]
+func (a *App) handleInsertNote() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		ctx := r.Context()
+
+		usr, ok := ctx.Value(userContextKey).(*model.User)
+		if !ok || a.Authorize(usr, perm_deposit_create, "") != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		note, err := strconv.Atoi(chi.URLParam(r, "noteValue"))
+		if err != nil {
+			http.Error(w, "missing note value", http.StatusBadRequest)
+			return
+		}
+
+		if err := a.UserInsertNote(ctx, usr, note); err != nil {
+			fmt.Println("insert note", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_DEPOSIT, "user", usr.ID, nil, noteAudit{Note: note})
+
+		a.returnEscrowAsJson(w, r, usr, nil)
+	}
+}
+
+// @Summary 	Show escrow
+// @Description Show the buyer's deposit and the notes held in escrow
+// @Tags		private, only buyers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} escrowResponse "deposit and notes in escrow"
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "escrow not available"
+// @Router 		/escrow [get]
+func (a *App) handleShowEscrow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok || a.Authorize(usr, perm_deposit_create, "") != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		a.returnEscrowAsJson(w, r, usr, nil)
+	}
+}
+
+// @Summary 	Cancel escrow
+// @Description Give back all the notes held in escrow
+// @Tags		private, only buyers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} escrowResponse "returned notes"
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "cancel failed"
+// @Router 		/escrow/cancel [post]
+func (a *App) handleCancelEscrow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok || a.Authorize(usr, perm_deposit_reset, "") != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		returned, err := a.CancelEscrow(r.Context(), usr)
+		if err != nil {
+			fmt.Println("cancel escrow", err)
+			http.Error(w, "cancel failed", http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_ESCROW_CANCEL, "user", usr.ID, nil, noteAudit{Returned: returned})
+
+		a.returnEscrowAsJson(w, r, usr, returned)
+	}
+}
+
+// @Summary 	Coin box inventory
+// @Description List the coins available in the machine for change
+// @Tags		private, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []coinCount
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "inventory not available"
+// @Router 		/admin/coins [get]
+func (a *App) handleCoinInventory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		inventory, err := a.CoinInventory(r.Context())
+		if err != nil {
+			fmt.Println("coin inventory", err)
+			http.Error(w, "inventory not available", http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, inventory)
+	}
+}
+
+// @Summary 	Refill coin box
+// @Description Add coins to the machine's coin box
+// @Tags		private, only admins
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		coins body []coinCount true "coins to add"
+// @Success		200 {object} []coinCount "inventory after the refill"
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/coins [post]
+func (a *App) handleRefillCoins() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var coins []coinCount
+		if err := json.NewDecoder(r.Body).Decode(&coins); err != nil {
+			fmt.Println("refill coins", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.RefillCoins(r.Context(), coins); err != nil {
+			fmt.Println("refill coins", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_COINS_REFILL, "coins", "", nil, coins)
+
+		a.handleCoinInventory().ServeHTTP(w, r)
+	}
+}
+
+func (a *App) returnEscrowAsJson(w http.ResponseWriter, r *http.Request, usr *model.User, returned []int64) {
+
+	buyer, err := a.FindUserByID(r.Context(), usr.ID)
+	if err != nil {
+		fmt.Println("error find user by id", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	notes, err := a.EscrowNotes(r.Context(), usr)
+	if err != nil {
+		fmt.Println("escrow notes", err)
+		http.Error(w, "escrow not available", http.StatusInternalServerError)
+		return
+	}
+
+	resp := escrowResponse{
+		Deposit:  buyer.Deposit,
+		Notes:    notes,
+		Returned: returned,
+	}
+	for _, n := range notes {
+		resp.EscrowTotal += n
+	}
+
+	returnAsJSON(r.Context(), w, resp)
+}
+
+type escrowResponse struct {
+	Deposit     int64
+	Notes       []int64
+	EscrowTotal int64
+	Returned    []int64 `json:",omitempty"`
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleInsertNoteFailNotBuyer(t *testing.T) {
+
+	r, err := http.NewRequest(http.MethodPost, "/deposit/note/500", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{Role: model.ROLE_SELLER})
+
+	NewApp("", nil).handleInsertNote().ServeHTTP(w, r.WithContext(ctx))
+
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusUnauthorized, w.Result().StatusCode)
+	}
+}
+
+func TestHandleInsertNoteSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into escrow_notes`).WithArgs(sqlmock.AnyArg(), "userid", 1000).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("userid", "", "", 15, "BUYER", 0))
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(1000))
+
+	r, err := http.NewRequest(http.MethodPost, "/deposit/note/1000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "userid", Role: model.ROLE_BUYER, Deposit: 15})
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("noteValue", "1000")
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+
+	vm := NewApp("", db)
+	vm.NoteRules = NoteRules{ChangeCheckAbove: 1000}
+	vm.handleInsertNote().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var data escrowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Deposit != 15 || data.EscrowTotal != 1000 || !reflect.DeepEqual(data.Notes, []int64{1000}) {
+		t.Errorf("wrong escrow response: %v", data)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleCancelEscrowSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(500).AddRow(500))
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from escrow_notes where user_id=\?`).WithArgs("userid").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("userid", "", "", 0, "BUYER", 0))
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}))
+
+	r, err := http.NewRequest(http.MethodPost, "/escrow/cancel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "userid", Role: model.ROLE_BUYER})
+
+	NewApp("", db).handleCancelEscrow().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var data escrowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.EscrowTotal != 0 || !reflect.DeepEqual(data.Returned, []int64{500, 500}) {
+		t.Errorf("wrong escrow response: %v", data)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleRefillCoinsFailBadData(t *testing.T) {
+
+	var buf bytes.Buffer
+	buf.WriteString(`[{"coin": 3, "amount": 10}]`)
+
+	r, err := http.NewRequest(http.MethodPost, "/admin/coins", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	NewApp("", nil).handleRefillCoins().ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
+
+func TestRequireCoinsManage(t *testing.T) {
+
+	type scenario struct {
+		user       *model.User
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{nil, http.StatusUnauthorized},
+		{&model.User{Role: model.ROLE_BUYER}, http.StatusUnauthorized},
+		{&model.User{Role: model.ROLE_SELLER}, http.StatusUnauthorized},
+		{&model.User{Role: model.ROLE_ADMIN}, http.StatusOK},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodGet, "/admin/coins", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := r.Context()
+		if s.user != nil {
+			ctx = context.WithValue(ctx, userContextKey, s.user)
+		}
+
+		NewApp("", nil).Require(perm_coins_manage)(next).ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("wrong status code. expected: %d, got: %d", s.statusCode, w.Result().StatusCode)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Seller balance
+// @Description Earnings from sales, platform commission, payouts and the amount that can still be requested
+// @Tags		private, earnings, only sellers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} sellerBalance
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/seller/balance [get]
+func (a *App) handleSellerBalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		balance, err := a.SellerBalance(r.Context(), seller)
+		if err != nil {
+			fmt.Println("seller balance", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, balance)
+	}
+}
+
+// @Summary 	Request a payout
+// @Tags		private, earnings, only sellers
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		payout body payoutRequest true "amount to be paid out"
+// @Success		201 {object} model.Payout
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/seller/payouts [post]
+func (a *App) handleRequestPayout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var req payoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding payout request", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		payout, err := a.RequestPayout(r.Context(), seller, req.Amount)
+		if err != nil {
+			fmt.Println("request payout", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, seller.ID, model.AUDIT_PAYOUT_REQUEST, "payout", payout.ID, nil, payout)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(payout); err != nil {
+			fmt.Println("error encoding data", err)
+		}
+	}
+}
+
+// @Summary 	Seller payouts
+// @Description List the payouts of the current seller
+// @Tags		private, earnings, only sellers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.Payout
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/seller/payouts [get]
+func (a *App) handleSellerPayouts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		payouts, err := a.SellerPayouts(r.Context(), seller)
+		if err != nil {
+			fmt.Println("seller payouts", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, payouts)
+	}
+}
+
+// @Summary 	All payouts
+// @Tags		private, earnings, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		status query string false "REQUESTED, APPROVED, REJECTED or PAID"
+// @Success		200 {object} []model.Payout
+// @Failure		400 {string} string "unknown status"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/payouts [get]
+func (a *App) handleListPayouts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		payouts, err := a.Payouts(r.Context(), r.URL.Query().Get("status"))
+		if err != nil {
+			fmt.Println("list payouts", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, payouts)
+	}
+}
+
+// @Summary 	Change a payout
+// @Description `approve` and `reject` apply to requested payouts, `paid` to approved ones
+// @Tags		private, earnings, only admins
+// @Security 	ApiKeyAuth
+// @Param 		payoutID path string true "Payout ID"
+// @Param 		action path string true "approve, reject or paid"
+// @Success		204
+// @Failure		400 {string} string "payout not found or not in the right status"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/payouts/{payoutID}/{action} [post]
+func (a *App) handlePayoutAction() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		payoutID := chi.URLParam(r, "payoutID")
+		action := chi.URLParam(r, "action")
+
+		var err error
+		switch action {
+		case "approve":
+			err = a.ApprovePayout(r.Context(), payoutID)
+		case "reject":
+			err = a.RejectPayout(r.Context(), payoutID)
+		case "paid":
+			err = a.MarkPayoutPaid(r.Context(), payoutID)
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			fmt.Println("payout action", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_PAYOUT_UPDATE, "payout", payoutID, nil, payoutActionAudit{Action: action})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type payoutRequest struct {
+	Amount int64 `json:"amount"`
+}
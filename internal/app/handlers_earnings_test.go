@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleRequestPayout(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "all of it", http.StatusBadRequest},
+		{"zero amount", `{"amount":0}`, http.StatusBadRequest},
+		{"no database", `{"amount":100}`, http.StatusBadRequest},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodPost, "/seller/payouts", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "seller", Role: model.ROLE_SELLER})
+
+		NewApp("", nil).handleRequestPayout().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestHandleSellerBalanceSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from seller_ledger`).
+		WillReturnRows(sqlmock.NewRows([]string{"sales", "commission", "paid_out"}).AddRow(500, 50, 0))
+	mock.ExpectQuery(`from payouts`).
+		WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(100))
+
+	r, err := http.NewRequest(http.MethodGet, "/seller/balance", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "seller", Role: model.ROLE_SELLER})
+
+	NewApp("", db).handleSellerBalance().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var b sellerBalance
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Available != 350 {
+		t.Errorf("wrong available balance. expected: %d, got: %d", 350, b.Available)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlePayoutActionApprove(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select seller_id, amount from payouts`).WithArgs("payout-1", "REQUESTED").
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "amount"}).AddRow("seller", 100))
+	mock.ExpectExec(`update payouts set status=\?`).WithArgs("APPROVED", "payout-1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	r, err := http.NewRequest(http.MethodPost, "/admin/payouts/payout-1/approve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("payoutID", "payout-1")
+	chiCtx.URLParams.Add("action", "approve")
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx)
+
+	NewApp("", db).handlePayoutAction().ServeHTTP(w, r.WithContext(ctx))
+
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusNoContent, w.Result().StatusCode)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	sse_heartbeat = 15 * time.Second
+	// the server's WriteTimeout ends every response after 30s. The stream is closed before that and the client reconnects
+	sse_max_duration = 25 * time.Second
+	sse_retry_ms     = 1000
+	sse_buffer       = 32
+)
+
+// @Summary 	Live events
+// @Description Server-Sent Events stream of `balance.changed` (current user only), `stock.changed` and `price.changed`.
+// @Description Buyers get their current balance first. The stream is closed every 25 seconds, clients reconnect automatically.
+// @Tags		private, events
+// @Security 	ApiKeyAuth
+// @Produces	text/event-stream
+// @Success		200 {string} string "event stream"
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "streaming not supported"
+// @Router 		/events [get]
+func (a *App) handleEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, cancel := a.Bus.Subscribe(sse_buffer)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		fmt.Fprintf(w, "retry: %d\n\n", sse_retry_ms)
+
+		if a.Can(usr, perm_deposit_create) {
+			if live, ok := a.liveUser(r.Context()); ok {
+				a.publishLive(r.Context(), model.EVENT_BALANCE_CHANGED, usr.ID, balanceChange{Deposit: live.Deposit})
+			}
+		}
+
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sse_heartbeat)
+		defer heartbeat.Stop()
+
+		closeAfter := time.NewTimer(sse_max_duration)
+		defer closeAfter.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closeAfter.C:
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+
+				if !liveEventFor(e, usr) {
+					continue
+				}
+
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Payload)
+				flusher.Flush()
+			}
+		}
+	}
+}
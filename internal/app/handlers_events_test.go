@@ -0,0 +1,80 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// readSSE returns the next event's type and data from the stream, skipping comments and retry lines
+func readSSE(t *testing.T, rd *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+
+	vm := NewApp("", nil)
+	buyer := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 70}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), userContextKey, buyer)
+		vm.handleEvents().ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("wrong content type. expected: %s, got: %s", "text/event-stream", ct)
+	}
+
+	rd := bufio.NewReader(resp.Body)
+
+	event, data := readSSE(t, rd)
+	if event != model.EVENT_BALANCE_CHANGED || !strings.Contains(data, `"deposit":70`) {
+		t.Errorf("first event should be the current balance, got: %s %s", event, data)
+	}
+
+	vm.publishLive(context.Background(), model.EVENT_BALANCE_CHANGED, "other buyer", balanceChange{Deposit: 500})
+	vm.publishLive(context.Background(), model.EVENT_PURCHASE, "", model.Purchase{})
+	vm.publishLive(context.Background(), model.EVENT_STOCK_CHANGED, "", stockChange{ProductID: "prod", AmountAvailable: 3})
+
+	event, data = readSSE(t, rd)
+	if event != model.EVENT_STOCK_CHANGED || !strings.Contains(data, `"amount_available":3`) {
+		t.Errorf("only the stock change should be streamed, got: %s %s", event, data)
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// the kiosk sends at least a `ping` in this interval, or the connection is closed
+	kiosk_idle_timeout    = 2 * time.Minute
+	kiosk_write_timeout   = 10 * time.Second
+	kiosk_message_timeout = 30 * time.Second
+	kiosk_max_message     = 4096
+)
+
+// @Summary 	Kiosk connection
+// @Description WebSocket for kiosk hardware. The kiosk acts for the logged in buyer: it reports inserted coins, product selections and the outcome of vends,
+// @Description and gets confirmations and change to dispense back. See the README for the protocol.
+// @Tags		private, kiosk, only buyers
+// @Security 	ApiKeyAuth
+// @Success		101 {string} string "switching protocols"
+// @Failure		400 {string} string "not a websocket handshake"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/ws [get]
+func (a *App) handleKiosk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok || a.Authorize(usr, perm_deposit_create, "") != nil || a.Authorize(usr, perm_purchase_create, "") != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		auth := kioskAuth{src: requestAuditSource(r, usr.ID)}
+		if _, ok := r.Context().Value(apiKeyContextKey).(*apiKeyAccess); ok {
+			auth.apiKeyHash = apiKeyHash(apiKeyFromRequest(r))
+		} else if _, claims, err := jwtauth.FromContext(r.Context()); err == nil {
+			auth.session, _ = claims[jwtSessionKey].(string)
+		}
+
+		srv := websocket.Server{
+			// kiosks don't send an Origin header. They are authenticated by their token
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				defer ws.Close()
+				ws.MaxPayloadBytes = kiosk_max_message
+				a.serveKiosk(ws, auth)
+			},
+		}
+
+		srv.ServeHTTP(w, r)
+	}
+}
+
+// kioskAuth is how the kiosk logged in when it connected. It is checked again on every message,
+// so the connection is closed once the login token or the API key is revoked.
+type kioskAuth struct {
+	src        auditSource // the buyer the kiosk acts for, and the request that opened the connection
+	session    string      // session version of the login token
+	apiKeyHash string      // set if the kiosk connected with an API key
+}
+
+var errKioskRevoked = errors.New("session revoked")
+
+// serveKiosk answers the kiosk's messages, one at a time, until the connection is closed, idle for too long or its login revoked
+func (a *App) serveKiosk(ws *websocket.Conn, auth kioskAuth) {
+
+	userID := auth.src.ActorID
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(kiosk_idle_timeout))
+
+		var msg kioskMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				a.sendKiosk(ws, kioskMessage{Type: kiosk_error, Error: "bad message"})
+				continue
+			}
+			fmt.Println("kiosk connection", userID, err)
+			return
+		}
+
+		reply, revoked := a.kioskMessageReply(auth, msg)
+
+		if err := a.sendKiosk(ws, reply); err != nil {
+			fmt.Println("kiosk connection", userID, err)
+			return
+		}
+
+		if revoked != nil {
+			fmt.Println("kiosk connection", userID, revoked)
+			return
+		}
+	}
+}
+
+// kioskMessageReply handles the message for the current state of the buyer.
+// Each message gets its own context, the connection outlives the request's. The actions are audited for the buyer.
+// Returns errKioskRevoked, with the error to send, if the kiosk's login is not valid anymore.
+func (a *App) kioskMessageReply(auth kioskAuth, msg kioskMessage) (kioskMessage, error) {
+
+	ctx, cancel := context.WithTimeout(withAuditSource(context.Background(), auth.src), kiosk_message_timeout)
+	defer cancel()
+
+	usr, err := a.FindUserByID(ctx, auth.src.ActorID)
+	if err != nil {
+		fmt.Println("kiosk user", auth.src.ActorID, err)
+		return kioskMessage{Type: kiosk_error, ReplyTo: msg.ID, Error: "user not found"}, nil
+	}
+
+	if err := a.kioskAuthorized(ctx, auth, usr); err != nil {
+		return kioskMessage{Type: kiosk_error, ReplyTo: msg.ID, Error: err.Error()}, err
+	}
+
+	return a.kioskReply(ctx, usr, msg), nil
+}
+
+// kioskAuthorized checks the kiosk's login token or API key against the buyer's current state
+func (a *App) kioskAuthorized(ctx context.Context, auth kioskAuth, usr *model.User) error {
+
+	if auth.apiKeyHash != "" {
+		key, err := a.dbActiveAPIKey(ctx, auth.apiKeyHash)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			fmt.Println("kiosk api key", usr.ID, err)
+		}
+		if err != nil || key.UserID != usr.ID {
+			return errKioskRevoked
+		}
+	} else if !validSessionVersion(usr, auth.session) {
+		return errKioskRevoked
+	}
+
+	if a.Authorize(usr, perm_deposit_create, "") != nil || a.Authorize(usr, perm_purchase_create, "") != nil {
+		return errKioskRevoked
+	}
+
+	return nil
+}
+
+func (a *App) sendKiosk(ws *websocket.Conn, msg kioskMessage) error {
+	ws.SetWriteDeadline(time.Now().Add(kiosk_write_timeout))
+	return websocket.JSON.Send(ws, msg)
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleKioskNotBuyer(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, &model.User{ID: "seller", Role: model.ROLE_SELLER}))
+	w := httptest.NewRecorder()
+
+	NewApp("", nil).handleKiosk().ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestHandleKiosk(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=\?`).WithArgs("buyer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("buyer", "buyer", "", 20, model.ROLE_BUYER, 0))
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	vm := NewApp("", db)
+	buyer := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 20}
+
+	token, _, err := vm.JwtAuth.Encode(map[string]interface{}{jwtUserIdKey: "buyer", jwtSessionKey: sessionVersion(buyer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := jwtauth.NewContext(r.Context(), token, nil)
+		ctx = context.WithValue(ctx, userContextKey, buyer)
+		vm.handleKiosk().ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := websocket.Message.Send(ws, "not json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply kioskMessage
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Type != "error" || reply.Error != "bad message" {
+		t.Errorf("wrong reply to bad message. expected: error, got: %+v", reply)
+	}
+
+	if err := websocket.JSON.Send(ws, kioskMessage{Type: "ping", ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply = kioskMessage{}
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Type != "pong" || reply.ReplyTo != "p1" {
+		t.Errorf("wrong reply to ping. expected: pong, got: %+v", reply)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleKioskClosedWhenRevoked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the password was changed after the kiosk connected
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=\?`).WithArgs("buyer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("buyer", "buyer", "", 20, model.ROLE_BUYER, 1))
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	vm := NewApp("", db)
+	buyer := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 20}
+
+	token, _, err := vm.JwtAuth.Encode(map[string]interface{}{jwtUserIdKey: "buyer", jwtSessionKey: sessionVersion(buyer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := jwtauth.NewContext(r.Context(), token, nil)
+		ctx = context.WithValue(ctx, userContextKey, buyer)
+		vm.handleKiosk().ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := websocket.JSON.Send(ws, kioskMessage{Type: "ping", ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply kioskMessage
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Type != "error" || reply.Error != errKioskRevoked.Error() {
+		t.Errorf("wrong reply. expected: session revoked, got: %+v", reply)
+	}
+
+	if err := websocket.JSON.Receive(ws, &reply); err == nil {
+		t.Error("the connection should be closed")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
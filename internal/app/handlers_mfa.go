@@ -0,0 +1,360 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type mfaChallenge struct {
+	MFAToken  string `json:"mfa_token"` // send it as bearer token to `/login/mfa`
+	Step      string `json:"step"`      // `verify`: send a code, `enroll`: set up MFA first
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"` // from the authenticator app, or a recovery code
+}
+
+type mfaConfirmResponse struct {
+	Token         string   `json:"token,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type mfaPolicyRequest struct {
+	Required bool `json:"required"`
+}
+
+func (a *App) returnMFAChallenge(w http.ResponseWriter, r *http.Request, usr *model.User, step string) {
+
+	token, err := a.getMFATokenString(usr.ID, usr.Username, step)
+	if err != nil {
+		fmt.Printf("Error signing token: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(mfaChallenge{MFAToken: token, Step: step, ExpiresIn: int(mfa_token_ttl.Seconds())}); err != nil {
+		fmt.Println("error encoding data", err)
+	}
+}
+
+// mfaLoginAllowed checks the user is at the expected login step and not throttled
+func (a *App) mfaLoginAllowed(w http.ResponseWriter, r *http.Request, step string) (*model.User, bool) {
+
+	usr, ok := r.Context().Value(userContextKey).(*model.User)
+	if !ok || r.Context().Value(mfaStepContextKey) != step {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if wait := a.Logins.Wait(usr.Username, clientIP(r)); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	return usr, true
+}
+
+// mfaCodeFailed answers a code that was not accepted. Wrong codes count as failed logins
+func (a *App) mfaCodeFailed(w http.ResponseWriter, r *http.Request, usr *model.User, err error) {
+
+	fmt.Println("mfa code", err)
+
+	if !errors.Is(err, errMFACode) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.audit(r, usr.ID, model.AUDIT_MFA_FAILED, "user", usr.ID, nil, nil)
+	if a.Logins.Failed(usr.Username, clientIP(r)) {
+		a.audit(r, "", model.AUDIT_LOGIN_LOCKED, "username", usr.Username, nil, nil)
+	}
+
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// @Summary 	Login with a one-time code
+// @Description Second login step for users with MFA. Takes the `mfa_token` from `/login` as bearer token
+// @Tags		public, mfa
+// @Accept		application/json
+// @Produces	text/plain
+// @Param 		code body mfaCodeRequest true "code from the authenticator app, or a recovery code"
+// @Success		200 {string} string "jwt"
+// @Failure		401 {string} string "wrong code or token"
+// @Failure		429 {string} string "too many failed logins, see the Retry-After header"
+// @Router 		/login/mfa [post]
+func (a *App) handleMFALogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := a.mfaLoginAllowed(w, r, mfa_verify)
+		if !ok {
+			return
+		}
+
+		var body mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.VerifyMFA(r.Context(), usr, body.Code); err != nil {
+			a.mfaCodeFailed(w, r, usr, err)
+			return
+		}
+
+		a.Logins.Succeeded(usr.Username)
+
+		tokenString, err := a.getEncTokenString(usr)
+		if err != nil {
+			fmt.Printf("Error signing token: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_LOGIN, "user", usr.ID, nil, nil)
+
+		w.Write([]byte(tokenString))
+	}
+}
+
+// @Summary 	Set up MFA to log in
+// @Description For users whose role requires MFA and who don't have it yet. Takes the `mfa_token` from `/login` as bearer token
+// @Tags		public, mfa
+// @Produces	application/json
+// @Success		200 {object} mfaEnrollment "secret and otpauth URI for the authenticator app"
+// @Failure		401 {string} string "wrong token"
+// @Router 		/login/mfa/enroll [post]
+func (a *App) handleMFALoginEnroll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := a.mfaLoginAllowed(w, r, mfa_enroll)
+		if !ok {
+			return
+		}
+
+		a.enrollMFA(w, r, usr)
+	}
+}
+
+// @Summary 	Confirm MFA and log in
+// @Description Enables MFA with the first code from the authenticator app and logs in. Takes the `mfa_token` from `/login` as bearer token
+// @Tags		public, mfa
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		code body mfaCodeRequest true "code from the authenticator app"
+// @Success		200 {object} mfaConfirmResponse "jwt and recovery codes, the codes are not shown again"
+// @Failure		401 {string} string "wrong code or token"
+// @Failure		429 {string} string "too many failed logins, see the Retry-After header"
+// @Router 		/login/mfa/confirm [post]
+func (a *App) handleMFALoginConfirm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := a.mfaLoginAllowed(w, r, mfa_enroll)
+		if !ok {
+			return
+		}
+
+		var body mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		codes, err := a.ConfirmMFA(r.Context(), usr, body.Code)
+		if err != nil {
+			a.mfaCodeFailed(w, r, usr, err)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_MFA_ENABLE, "user", usr.ID, nil, nil)
+
+		a.Logins.Succeeded(usr.Username)
+
+		tokenString, err := a.getEncTokenString(usr)
+		if err != nil {
+			fmt.Printf("Error signing token: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_LOGIN, "user", usr.ID, nil, nil)
+
+		returnAsJSON(r.Context(), w, mfaConfirmResponse{Token: tokenString, RecoveryCodes: codes})
+	}
+}
+
+// @Summary 	Set up MFA
+// @Description Starts the MFA setup of the current user. MFA is enabled once a code is confirmed
+// @Tags		private, mfa
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} mfaEnrollment "secret and otpauth URI for the authenticator app"
+// @Failure		400 {string} string "mfa already enabled"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/user/mfa [post]
+func (a *App) handleEnrollMFA() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		a.enrollMFA(w, r, usr)
+	}
+}
+
+func (a *App) enrollMFA(w http.ResponseWriter, r *http.Request, usr *model.User) {
+
+	enrollment, err := a.EnrollMFA(r.Context(), usr)
+	if err != nil {
+		fmt.Println("enroll mfa", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	returnAsJSON(r.Context(), w, enrollment)
+}
+
+// @Summary 	Confirm MFA
+// @Description Enables MFA with the first code from the authenticator app
+// @Tags		private, mfa
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		code body mfaCodeRequest true "code from the authenticator app"
+// @Success		200 {object} mfaConfirmResponse "recovery codes, they are not shown again"
+// @Failure		400 {string} string "wrong code or nothing to confirm"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/user/mfa/confirm [post]
+func (a *App) handleConfirmMFA() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var body mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		codes, err := a.ConfirmMFA(r.Context(), usr, body.Code)
+		if err != nil {
+			fmt.Println("confirm mfa", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_MFA_ENABLE, "user", usr.ID, nil, nil)
+
+		returnAsJSON(r.Context(), w, mfaConfirmResponse{RecoveryCodes: codes})
+	}
+}
+
+// @Summary 	Turn MFA off
+// @Description Not allowed if the user's role requires MFA
+// @Tags		private, mfa
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Param 		code body mfaCodeRequest true "code from the authenticator app, or a recovery code"
+// @Success		204
+// @Failure		400 {string} string "wrong code, or mfa required"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/user/mfa [delete]
+func (a *App) handleDisableMFA() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usr, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var body mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.DisableMFA(r.Context(), usr, body.Code); err != nil {
+			fmt.Println("disable mfa", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_MFA_DISABLE, "user", usr.ID, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary 	MFA policies
+// @Description The roles that have a policy set. Roles not listed don't require MFA
+// @Tags		private, mfa, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.MFAPolicy
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/mfa [get]
+func (a *App) handleMFAPolicies() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		policies, err := a.MFAPolicies(r.Context())
+		if err != nil {
+			fmt.Println("mfa policies", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, policies)
+	}
+}
+
+// @Summary 	Require MFA for a role
+// @Description Users of the role without MFA have to set it up on their next login
+// @Tags		private, mfa, only admins
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Param 		role path string true "ADMIN, SELLER or BUYER"
+// @Param 		policy body mfaPolicyRequest true "required or not"
+// @Success		204
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/mfa/{role} [put]
+func (a *App) handleSetMFAPolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var body mfaPolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		role := chi.URLParam(r, "role")
+
+		if err := a.SetMFARequired(r.Context(), role, body.Required); err != nil {
+			fmt.Println("set mfa policy", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_MFA_POLICY, "role", role, nil, body)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
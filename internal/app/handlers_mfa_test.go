@@ -0,0 +1,157 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginWithMFA(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	vm := NewApp("", db)
+	vm.Passwords.Scheme = hash_bcrypt
+	vm.Passwords.BcryptCost = bcrypt.MinCost
+
+	encPasswd, _ := bcrypt.GenerateFromPassword([]byte("mh12&^KJlwekJ*"), bcrypt.MinCost)
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", encPasswd, 0, model.ROLE_SELLER, 0)
+	}
+
+	// the password is right, a code is needed
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("mihaiusr").WillReturnRows(userRow())
+	mock.ExpectQuery(`select coalesce\(\(select enabled from user_mfa`).WithArgs("id1", model.ROLE_SELLER).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required"}).AddRow(true, false))
+
+	r, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"mihaiusr","password":"mh12&^KJlwekJ*"}`))
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code after the password. expected: %d, got: %d", http.StatusAccepted, w.Code)
+	}
+
+	var challenge mfaChallenge
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	if challenge.Step != mfa_verify || challenge.MFAToken == "" {
+		t.Fatalf("wrong challenge. expected: verify step with token, got: %+v", challenge)
+	}
+
+	// the pending token doesn't give access to the API
+	r, _ = http.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("pending token should not be accepted. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// nor does it allow enrolling
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow())
+
+	r, _ = http.NewRequest(http.MethodPost, "/login/mfa/enroll", nil)
+	r.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("verify token should not enroll. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// the code completes the login
+	step := totpStep(time.Now())
+	code, _ := totpCode(rfcTOTPSecret, step)
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow())
+	mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled", "last_step"}).AddRow(rfcTOTPSecret, true, 0))
+	mock.ExpectExec(`update user_mfa set last_step=\?`).WithArgs(step, "id1", step).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "id1", model.AUDIT_LOGIN, "user", "id1", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, _ = http.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(`{"code":"`+code+`"}`))
+	r.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code after the code. expected: %d, got: %d", http.StatusOK, w.Code)
+	}
+
+	tkn, err := vm.JwtAuth.Decode(w.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, pending := tkn.PrivateClaims()[jwtMFAKey]; pending {
+		t.Error("the final token should not be pending")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFALoginWrongCodeCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	vm := NewApp("", db)
+
+	token, err := vm.getMFATokenString("id1", "mihaiusr", mfa_verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", "", 0, model.ROLE_SELLER, 0))
+	mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled", "last_step"}).AddRow(rfcTOTPSecret, true, 0))
+	mock.ExpectExec(`update mfa_recovery_codes`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "id1", model.AUDIT_MFA_FAILED, "user", "id1", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, _ := http.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(`{"code":"not-a-code"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if s := vm.Logins.Status("mihaiusr"); s.Failures != 1 {
+		t.Errorf("wrong code should count as a failed login, got: %+v", s)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	oidc_cookie      = "oidc_login"
+	oidc_cookie_path = "/login/oidc"
+
+	jwtOIDCStateKey    = "oidc_state"
+	jwtOIDCNonceKey    = "oidc_nonce"
+	jwtOIDCVerifierKey = "oidc_verifier"
+)
+
+// @Summary 	Login with the identity provider
+// @Description Redirect to the OpenID Connect provider. Once logged in there, the provider sends the user to `/login/oidc/callback`
+// @Tags		public
+// @Success		302
+// @Failure		404 {string} string "oidc login is not configured"
+// @Failure		502 {string} string "the provider can't be reached"
+// @Router 		/login/oidc [get]
+func (a *App) handleOIDCLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if a.OIDC == nil {
+			http.Error(w, errOIDCDisabled.Error(), http.StatusNotFound)
+			return
+		}
+
+		var secrets [3]string
+		for i := range secrets {
+			s, err := newOIDCSecret()
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			secrets[i] = s
+		}
+		state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+		authURL, err := a.OIDC.AuthURL(r.Context(), state, nonce, verifier)
+		if err != nil {
+			fmt.Println("oidc login", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		cookie, err := a.getOIDCLoginTokenString(state, nonce, verifier)
+		if err != nil {
+			fmt.Printf("Error signing token: %s\n", err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidc_cookie,
+			Value:    cookie,
+			Path:     oidc_cookie_path,
+			MaxAge:   int(oidc_login_ttl.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// @Summary 	Identity provider callback
+// @Description The provider sends the user here after the login. Users logging in the first time are created.
+// @Description Returns a login token, or a one-time code challenge for users with MFA, like `/login`
+// @Tags		public
+// @Produces	text/plain
+// @Param 		code query string true "authorization code"
+// @Param 		state query string true "state sent to the provider"
+// @Success		200 {string} string "jwt"
+// @Success		202 {object} mfaChallenge "a one-time code is needed next"
+// @Failure		400 {string} string "the login was not started here, or expired"
+// @Failure		401 {string} string "the provider refused the login"
+// @Failure		404 {string} string "oidc login is not configured"
+// @Router 		/login/oidc/callback [get]
+func (a *App) handleOIDCCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if a.OIDC == nil {
+			http.Error(w, errOIDCDisabled.Error(), http.StatusNotFound)
+			return
+		}
+
+		// the login cookie is used once
+		http.SetCookie(w, &http.Cookie{Name: oidc_cookie, Path: oidc_cookie_path, MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil})
+
+		cookie, err := r.Cookie(oidc_cookie)
+		if err != nil {
+			http.Error(w, "no login in progress", http.StatusBadRequest)
+			return
+		}
+
+		t, err := jwtauth.VerifyToken(a.JwtAuth, cookie.Value)
+		if err != nil {
+			http.Error(w, "no login in progress", http.StatusBadRequest)
+			return
+		}
+
+		claims := t.PrivateClaims()
+		state, _ := claims[jwtOIDCStateKey].(string)
+		nonce, _ := claims[jwtOIDCNonceKey].(string)
+		verifier, _ := claims[jwtOIDCVerifierKey].(string)
+
+		q := r.URL.Query()
+
+		if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+			http.Error(w, "state doesn't match the login in progress", http.StatusBadRequest)
+			return
+		}
+
+		if e := q.Get("error"); e != "" {
+			a.audit(r, "", model.AUDIT_LOGIN_FAILED, "oidc", a.OIDC.Issuer, nil, map[string]string{"error": e})
+			http.Error(w, "login refused by the provider: "+e, http.StatusUnauthorized)
+			return
+		}
+
+		id, err := a.OIDC.Exchange(r.Context(), q.Get("code"), verifier, nonce)
+		if err != nil {
+			fmt.Println("oidc callback", err)
+			a.audit(r, "", model.AUDIT_LOGIN_FAILED, "oidc", a.OIDC.Issuer, nil, nil)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		login, err := a.LoginWithOIDC(r.Context(), id)
+		if err != nil {
+			fmt.Println("oidc login", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		usr := login.User
+
+		if login.Created {
+			a.audit(r, usr.ID, model.AUDIT_USER_CREATE, "user", usr.ID, nil, userEvent{ID: usr.ID, Username: usr.Username, Role: usr.Role})
+		}
+		if login.PreviousRoles != nil {
+			a.audit(r, usr.ID, model.AUDIT_USER_ROLE, "user", usr.ID, userRoles{Roles: login.PreviousRoles}, userRoles{Roles: usr.AllRoles()})
+		}
+
+		// the provider only stands for the password, the one-time code is still asked like on `/login`
+		step, err := a.mfaLoginStep(r.Context(), usr)
+		if err != nil {
+			fmt.Println("mfa login step", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if step != "" {
+			a.returnMFAChallenge(w, r, usr, step)
+			return
+		}
+
+		tokenString, err := a.getEncTokenString(usr)
+		if err != nil {
+			fmt.Printf("Error signing token: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_LOGIN, "user", usr.ID, nil, id)
+
+		w.Write([]byte(tokenString))
+	}
+}
+
+// getOIDCLoginTokenString returns the token kept in a cookie while the user logs in at the provider.
+// It has no user, so it is not accepted as a login token.
+func (a *App) getOIDCLoginTokenString(state, nonce, verifier string) (tokenString string, err error) {
+	t := jwt.New()
+	t.Set(jwt.ExpirationKey, time.Now().Add(oidc_login_ttl))
+	t.Set(jwt.NotBeforeKey, time.Now())
+	t.Set(jwtOIDCStateKey, state)
+	t.Set(jwtOIDCNonceKey, nonce)
+	t.Set(jwtOIDCVerifierKey, verifier)
+
+	claims, err := t.AsMap(context.Background())
+	if err != nil {
+		return
+	}
+
+	_, tokenString, err = a.JwtAuth.Encode(claims)
+
+	return
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestOIDCLoginFlow(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	idp := newMockIdP(t)
+	idp.Claims = map[string]any{"preferred_username": "jane.doe"}
+
+	vm := NewApp("", db)
+	vm.OIDC = NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	r, _ := http.NewRequest(http.MethodGet, "/login/oidc", nil)
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusFound, w.Code)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidc_cookie || !cookies[0].HttpOnly {
+		t.Fatalf("login cookie missing: %v", cookies)
+	}
+	cookie := cookies[0]
+
+	// the login cookie is not a login token
+	r, _ = http.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+cookie.Value)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login cookie should not be accepted. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, "/login/oidc", nil)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+	code, state := idp.login(t, w.Header().Get("Location"))
+
+	callback := func(code, state string, c *http.Cookie) *httptest.ResponseRecorder {
+		q := url.Values{"code": {code}, "state": {state}}
+		r, _ := http.NewRequest(http.MethodGet, "/login/oidc/callback?"+q.Encode(), nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		vm.Router.ServeHTTP(w, r)
+		return w
+	}
+
+	// the cookie of another login
+	if w := callback(code, state, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("state of another login. expected: %d, got: %d", http.StatusBadRequest, w.Code)
+	}
+
+	if w := callback(code, state, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("no login cookie. expected: %d, got: %d", http.StatusBadRequest, w.Code)
+	}
+
+	cookie = w.Result().Cookies()[0]
+
+	mock.ExpectQuery(`from user_identities`).WithArgs(idp.URL, "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "jane.doe", "hash", 0, model.ROLE_BUYER, 0))
+	mock.ExpectQuery(`select coalesce\(\(select enabled from user_mfa`).WithArgs("id1", model.ROLE_BUYER).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required"}).AddRow(false, false))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "id1", model.AUDIT_LOGIN, "user", "id1", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	w = callback(code, state, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	token, err := jwtauth.VerifyToken(vm.JwtAuth, w.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _ := token.Get(jwtUserIdKey); id != "id1" {
+		t.Errorf("wrong user in token. expected: id1, got: %v", id)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCLoginWithMFA(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	idp := newMockIdP(t)
+	idp.Claims = map[string]any{"preferred_username": "jane.doe"}
+
+	vm := NewApp("", db)
+	vm.OIDC = NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	r, _ := http.NewRequest(http.MethodGet, "/login/oidc", nil)
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+	cookie := w.Result().Cookies()[0]
+	code, state := idp.login(t, w.Header().Get("Location"))
+
+	mock.ExpectQuery(`from user_identities`).WithArgs(idp.URL, "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "jane.doe", "hash", 0, model.ROLE_SELLER, 0))
+	mock.ExpectQuery(`select coalesce\(\(select enabled from user_mfa`).WithArgs("id1", model.ROLE_SELLER).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required"}).AddRow(true, false))
+
+	q := url.Values{"code": {code}, "state": {state}}
+	r, _ = http.NewRequest(http.MethodGet, "/login/oidc/callback?"+q.Encode(), nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code. expected: %d, got: %d (%s)", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	var challenge mfaChallenge
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	if challenge.Step != mfa_verify || challenge.MFAToken == "" {
+		t.Fatalf("wrong challenge: %+v", challenge)
+	}
+
+	// the challenge token is no login token
+	r, _ = http.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("the challenge token should not log in. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCCallbackProviderError(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	idp := newMockIdP(t)
+
+	vm := NewApp("", db)
+	vm.OIDC = NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	cookie, err := vm.getOIDCLoginTokenString("state1", "nonce1", "verifier1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_LOGIN_FAILED, "oidc", idp.URL, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, _ := http.NewRequest(http.MethodGet, "/login/oidc/callback?error=access_denied&state=state1", nil)
+	r.AddCookie(&http.Cookie{Name: oidc_cookie, Value: cookie})
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "access_denied") {
+		t.Errorf("wrong answer. expected: %d, got: %d %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+
+	vm := NewApp("", nil)
+
+	for _, path := range []string{"/login/oidc", "/login/oidc/callback"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		vm.Router.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s. expected: %d, got: %d", path, http.StatusNotFound, w.Code)
+		}
+	}
+}
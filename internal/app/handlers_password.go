@@ -0,0 +1,84 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"` // sent to the user by `/password/forgot`
+	Password string `json:"password"`
+}
+
+// @Summary 	Forgot password
+// @Description Send the user a token to set a new password. The answer is the same whether the username exists or not
+// @Tags		public
+// @Accept		application/json
+// @Param 		request body forgotPasswordRequest true "username"
+// @Success		202
+// @Failure		400 {string} string "bad request"
+// @Failure		429 {string} string "too many requests"
+// @Router 		/password/forgot [post]
+func (a *App) handleForgotPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var body forgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.ForgotPassword(r.Context(), body.Username); err != nil {
+			fmt.Println("forgot password", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, "", model.AUDIT_PASSWORD_FORGOT, "username", body.Username, nil, nil)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// @Summary 	Reset password
+// @Description Set a new password with the token from `/password/forgot`. The token works once, and the user is logged out everywhere
+// @Tags		public
+// @Accept		application/json
+// @Param 		request body resetPasswordRequest true "token and new password"
+// @Success		204
+// @Failure		400 {string} string "invalid token or password"
+// @Failure		429 {string} string "too many requests"
+// @Router 		/password/reset [post]
+func (a *App) handleResetPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var body resetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		usr, err := a.ResetPassword(r.Context(), body.Token, body.Password)
+		if err != nil {
+			if errors.Is(err, errResetToken) || errors.Is(err, errInvalidPassword) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Println("reset password", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		a.audit(r, usr.ID, model.AUDIT_PASSWORD_RESET, "user", usr.ID, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordResetRevokesSessions(t *testing.T) {
+
+	vm, mock, n := newPasswordTestApp(t)
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("mh12&^KJlwekJ*"), bcrypt.MinCost)
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("New12&^KJlwek"), bcrypt.MinCost)
+	userRow := func(hash []byte, version int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", hash, 0, model.ROLE_BUYER, version)
+	}
+
+	session, err := vm.getEncTokenString(&model.User{ID: "id1", Username: "mihaiusr", Password: string(oldHash), Role: model.ROLE_BUYER})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("mihaiusr").WillReturnRows(userRow(oldHash, 0))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_PASSWORD_FORGOT, "username", "mihaiusr", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, _ := http.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"username":"mihaiusr"}`))
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code for forgot. expected: %d, got: %d", http.StatusAccepted, w.Code)
+	}
+
+	token := tokenFrom(t, n)
+
+	// the reset token is no login token
+	r, _ = http.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reset token should not log in. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow(oldHash, 0))
+	mock.ExpectExec(`update users set password=`).WithArgs(sqlmock.AnyArg(), "id1", string(oldHash)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "id1", model.AUDIT_PASSWORD_RESET, "user", "id1", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, _ = http.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"token":"`+token+`","password":"New12&^KJlwek"}`))
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code for reset. expected: %d, got: %d", http.StatusNoContent, w.Code)
+	}
+
+	// the session from before the reset is revoked
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow(newHash, 1))
+
+	r, _ = http.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+session)
+	w = httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("old session should be revoked. expected: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetPasswordBadRequest(t *testing.T) {
+
+	vm, _, _ := newPasswordTestApp(t)
+
+	r, _ := http.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"token":"abc","password":"New12&^KJlwek"}`))
+	w := httptest.NewRecorder()
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Schedule a price change
+// @Description The new cost is applied automatically at `effective_from` (RFC3339, must be in the future)
+// @Tags		private, product, only sellers
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Param 		productID path string true "Product ID"
+// @Param 		price body schedulePriceRequest true "new cost and the date it applies from"
+// @Success		201
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "unauthorized"
+// @Router 		/product/{productID}/prices [post]
+func (a *App) handleSchedulePrice() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok || !a.Can(user, perm_product_update) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		product, ok := r.Context().Value(productContextKey).(*model.Product)
+		if !ok {
+			http.Error(w, "missing product", http.StatusBadRequest)
+			return
+		}
+
+		var req schedulePriceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding price data", err)
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		if err := a.SchedulePrice(r.Context(), user, product, req.Cost, req.EffectiveFrom); err != nil {
+			fmt.Println("schedule price", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, user.ID, model.AUDIT_PRICE_SCHEDULE, "product", product.ID, nil, req)
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// @Summary 	Price history
+// @Description All the prices of a product, newest first. Scheduled changes are included with `applied` false
+// @Tags		public, product
+// @Param 		productID path string true "Product ID"
+// @Success		200 {object} []model.ProductPrice
+// @Failure		404 {string} string "product not found"
+// @Failure		500 {string} string "database errors"
+// @Router 		/products/{productID}/prices [get]
+func (a *App) handlePriceHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		prod, ok := r.Context().Value(productContextKey).(*model.Product)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		prices, err := a.PriceHistory(r.Context(), prod)
+		if err != nil {
+			fmt.Println("price history", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, prices)
+	}
+}
+
+type schedulePriceRequest struct {
+	Cost          int64     `json:"cost"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
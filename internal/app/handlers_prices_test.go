@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleSchedulePrice(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "tomorrow", http.StatusBadRequest},
+		{"in the past", `{"cost":50,"effective_from":"2020-01-01T08:00:00Z"}`, http.StatusBadRequest},
+		{"scheduled", `{"cost":50,"effective_from":"2099-01-01T08:00:00Z"}`, http.StatusCreated},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.statusCode == http.StatusCreated {
+			mock.ExpectBegin()
+			mock.ExpectExec(`insert into product_prices`).WithArgs(sqlmock.AnyArg(), "prodid", 50, time.Date(2099, 1, 1, 8, 0, 0, 0, time.UTC)).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}
+
+		r, err := http.NewRequest(http.MethodPost, "/product/prodid/prices", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+		ctx = context.WithValue(ctx, productContextKey, &model.Product{ID: "prodid", SellerID: "sellerid", Cost: 40})
+
+		NewApp("", db).handleSchedulePrice().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestHandlePriceHistorySuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select .* from product_prices where product_id=\?`).WithArgs("prodid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "cost", "effective_from", "applied"}).
+			AddRow("p1", "prodid", 40, time.Now(), true))
+
+	r, err := http.NewRequest(http.MethodGet, "/products/prodid/prices", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), productContextKey, &model.Product{ID: "prodid"})
+
+	NewApp("", db).handlePriceHistory().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var prices []model.ProductPrice
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prices) != 1 || prices[0].Cost != 40 {
+		t.Errorf("wrong price history: %v", prices)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -42,12 +42,15 @@ func (a *App) handleCreateProduct() http.HandlerFunc {
 			return
 		}
 
-		if err := a.CreateProduct(r.Context(), seller, req.AmountAvailable, req.Cost, req.Name); err != nil {
+		productID, err := a.CreateProduct(r.Context(), seller, req.AmountAvailable, req.Cost, req.Name)
+		if err != nil {
 			fmt.Println("creating product", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 
+		a.audit(r, seller.ID, model.AUDIT_PRODUCT_CREATE, "product", productID, nil, req)
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -73,8 +76,8 @@ func (a *App) handleUpdateProduct() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		user, ok := r.Context().Value(userContextKey).(*model.User)
-		if !ok || !user.IsSeller() {
-			fmt.Println("error: no user in context")
+		if !ok || !a.Can(user, perm_product_update) {
+			fmt.Println("error: no seller in context")
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
@@ -99,6 +102,8 @@ func (a *App) handleUpdateProduct() http.HandlerFunc {
 			return
 		}
 
+		a.audit(r, user.ID, model.AUDIT_PRODUCT_UPDATE, "product", product.ID, product, data)
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -135,6 +140,8 @@ func (a *App) handleDeleteProduct() http.HandlerFunc {
 			return
 		}
 
+		a.audit(r, seller.ID, model.AUDIT_PRODUCT_DELETE, "product", product.ID, product, nil)
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
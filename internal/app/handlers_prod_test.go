@@ -101,6 +101,9 @@ func TestHandleCreateProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`insert into products`).WithArgs(sqlmock.AnyArg(), "Product 1", 100, 10, "id123").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into product_prices`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set price_id=\?`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	ctx := context.WithValue(context.Background(), userContextKey, &usr)
@@ -170,6 +173,7 @@ func TestHandleDeleteProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`delete from products where`).WithArgs("product1", "seller1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	NewApp("", db).handleDeleteProduct().ServeHTTP(w, r.WithContext(ctx))
@@ -313,11 +317,11 @@ func TestHandleListProductsSuccessMany(t *testing.T) {
 	}
 	defer db.Close()
 
-	cols := []string{"id", "name", "available_amount", "cost", "seller_id"}
+	cols := []string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}
 	mock.ExpectQuery(`select .* from products`).WillReturnRows(sqlmock.NewRows(cols).
-		AddRow("1", "prod 1", 10, 10, "seller 1").
-		AddRow("2", "prod 2", 10, 10, "seller 1").
-		AddRow("3", nil, 10, 10, "seller 1"))
+		AddRow("1", "prod 1", 10, 10, "seller 1", nil).
+		AddRow("2", "prod 2", 10, 10, "seller 1", nil).
+		AddRow("3", nil, 10, 10, "seller 1", nil))
 
 	NewApp("", db).handleListProducts().ServeHTTP(w, r)
 
@@ -584,6 +588,9 @@ func TestHandleUpdateProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`update products set`).WithArgs("some new name", 135, "product1", "seller2").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into product_prices`).WithArgs(sqlmock.AnyArg(), "product1", 135).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set price_id=\?`).WithArgs(sqlmock.AnyArg(), "product1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	r, err := http.NewRequest(http.MethodPut, "/product", &buf)
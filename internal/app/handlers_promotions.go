@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Create a promotion
+// @Description Percentage or fixed discounts, or "buy N get 1 free", for one product or all the seller's products.
+// @Description Setting from_hour and to_hour limits the promotion to those hours of the day.
+// @Tags		private, promotion, only sellers
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Param 		promotion body createPromotionRequest true "promotion data"
+// @Success		201
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/promotions [post]
+func (a *App) handleCreatePromotion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var req createPromotionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding promotion data", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		p := model.Promotion{
+			ProductID: req.ProductID,
+			Name:      req.Name,
+			Type:      req.Type,
+			Value:     req.Value,
+			FromHour:  req.FromHour,
+			ToHour:    req.ToHour,
+		}
+
+		if err := a.CreatePromotion(r.Context(), seller, p); err != nil {
+			fmt.Println("creating promotion", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// @Summary 	List promotions
+// @Description List the promotions of the current seller
+// @Tags		private, promotion, only sellers
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.Promotion
+// @Failure		500 {string} string "database errors"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/promotions [get]
+func (a *App) handleListPromotions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		promos, err := a.ListPromotions(r.Context(), seller)
+		if err != nil {
+			fmt.Println("list promotions", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, promos)
+	}
+}
+
+// @Summary 	Delete a promotion
+// @Tags		private, promotion, only sellers
+// @Security 	ApiKeyAuth
+// @Param 		promotionID path string true "Promotion ID"
+// @Success		204
+// @Failure		500 {string} string "promotion not deleted"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/promotions/{promotionID} [delete]
+func (a *App) handleDeletePromotion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if err := a.DeletePromotion(r.Context(), seller, chi.URLParam(r, "promotionID")); err != nil {
+			fmt.Println("error: delete promotion", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type createPromotionRequest struct {
+	ProductID string `json:"product_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Value     int64  `json:"value"`
+	FromHour  int    `json:"from_hour"`
+	ToHour    int    `json:"to_hour"`
+}
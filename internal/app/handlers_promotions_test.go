@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleCreatePromotion(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "half price", http.StatusBadRequest},
+		{"bad promotion", `{"name":"promo","type":"PERCENT","value":200}`, http.StatusBadRequest},
+		{"created", `{"name":"promo","type":"PERCENT","value":20,"from_hour":16,"to_hour":18}`, http.StatusCreated},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.statusCode == http.StatusCreated {
+			mock.ExpectBegin()
+			mock.ExpectExec(`insert into promotions`).WithArgs(sqlmock.AnyArg(), "sellerid", nil, "promo", "PERCENT", 20, 16, 18).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}
+
+		r, err := http.NewRequest(http.MethodPost, "/promotions", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+		NewApp("", db).handleCreatePromotion().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestHandleListPromotionsFailNoDb(t *testing.T) {
+
+	r, err := http.NewRequest(http.MethodGet, "/promotions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+	NewApp("", nil).handleListPromotions().ServeHTTP(w, r.WithContext(ctx))
+
+	if w.Result().StatusCode != http.StatusInternalServerError {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusInternalServerError, w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Refund a purchase
+// @Description Gives back part (`amount`) or all (no amount) of a completed purchase, on the buyer's deposit or as coins from the coin box.
+// @Description `restock` units are put back on sale. The refund is taken out of the seller's earnings.
+// @Tags		private, refunds, only admins
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		purchaseID path string true "Purchase ID"
+// @Param 		refund body refundRequest true "amount, method (DEPOSIT or COINS), restock and reason"
+// @Success		201 {object} refundResult
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/purchases/{purchaseID}/refunds [post]
+func (a *App) handleRefundPurchase() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		admin, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var req refundRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding refund", err)
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		res, err := a.RefundPurchase(r.Context(), admin, chi.URLParam(r, "purchaseID"), req)
+		if err != nil {
+			fmt.Println("refund purchase", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, admin.ID, model.AUDIT_REFUND, "purchase", res.Refund.PurchaseID, nil, res.Refund)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			fmt.Println("error encoding data", err)
+		}
+	}
+}
+
+// @Summary 	Refunds of a purchase
+// @Tags		private, refunds, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		purchaseID path string true "Purchase ID"
+// @Success		200 {object} []model.Refund
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/purchases/{purchaseID}/refunds [get]
+func (a *App) handlePurchaseRefunds() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		refunds, err := a.PurchaseRefunds(r.Context(), chi.URLParam(r, "purchaseID"))
+		if err != nil {
+			fmt.Println("purchase refunds", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, refunds)
+	}
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleRefundPurchase(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		user       *model.User
+		body       string
+		statusCode int
+	}
+
+	admin := &model.User{ID: "admin", Role: model.ROLE_ADMIN}
+
+	scenarios := []scenario{
+		{"no user", nil, `{"amount":10,"reason":"x"}`, http.StatusUnauthorized},
+		{"not json", admin, "refund me", http.StatusBadRequest},
+		{"no reason", admin, `{"amount":10}`, http.StatusBadRequest},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodPost, "/admin/purchases/purchase/refunds", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, s.user))
+		}
+		w := httptest.NewRecorder()
+
+		NewApp("", nil).handleRefundPurchase().ServeHTTP(w, r)
+
+		if w.Code != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Code)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const reportDateFormat = "2006-01-02"
+
+// @Summary 	Sales report
+// @Description Units sold, revenue, average basket and sell-through rate by day, week or month, and the top products, for the current seller.
+// @Description With `format=csv` only the rows per period are returned, as CSV.
+// @Tags		private, reports, only sellers
+// @Security 	ApiKeyAuth
+// @Produces	application/json,text/csv
+// @Param 		period query string false "day (default), week or month"
+// @Param 		from query string false "first day, YYYY-MM-DD"
+// @Param 		to query string false "last day, YYYY-MM-DD"
+// @Param 		format query string false "json (default) or csv"
+// @Success		200 {object} salesReport
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/seller/reports [get]
+func (a *App) handleSellerReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		seller, ok := r.Context().Value(userContextKey).(*model.User)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		q := r.URL.Query()
+
+		period := q.Get("period")
+		if period == "" {
+			period = PERIOD_DAY
+		}
+
+		var from, to time.Time
+		var err error
+
+		if s := q.Get("from"); s != "" {
+			if from, err = time.Parse(reportDateFormat, s); err != nil {
+				http.Error(w, "from must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if s := q.Get("to"); s != "" {
+			if to, err = time.Parse(reportDateFormat, s); err != nil {
+				http.Error(w, "to must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+				return
+			}
+		}
+
+		format := q.Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+
+		report, err := a.SellerReport(r.Context(), seller, period, from, to)
+		if err != nil {
+			fmt.Println("seller report", err)
+			if errors.Is(err, errReportFailed) {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		if format == "csv" {
+			returnReportAsCSV(w, report)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, report)
+	}
+}
+
+func returnReportAsCSV(w http.ResponseWriter, report *salesReport) {
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sales-%s-%s.csv\"", report.Period, report.From.Format(reportDateFormat)))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"start", "purchases", "units_sold", "revenue", "average_basket", "sell_through"})
+
+	for _, b := range report.Buckets {
+		cw.Write([]string{
+			b.Start.Format(reportDateFormat),
+			strconv.FormatInt(b.Purchases, 10),
+			strconv.FormatInt(b.UnitsSold, 10),
+			strconv.FormatInt(b.Revenue, 10),
+			strconv.FormatInt(b.AverageBasket, 10),
+			strconv.FormatFloat(b.SellThrough, 'f', 4, 64),
+		})
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		fmt.Println("error writing csv", err)
+	}
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleSellerReportBadRequest(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		query      string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"bad period", "?period=year", http.StatusBadRequest},
+		{"bad from", "?from=yesterday", http.StatusBadRequest},
+		{"bad to", "?to=2022-13-01", http.StatusBadRequest},
+		{"bad format", "?format=xml", http.StatusBadRequest},
+		{"no database", "?period=week", http.StatusInternalServerError},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodGet, "/seller/reports"+s.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+		NewApp("", nil).handleSellerReport().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+	}
+}
+
+func expectReportQueries(mock sqlmock.Sqlmock) {
+	purchaseCols := []string{"id", "user_id", "product_id", "seller_id", "amount", "unit_cost", "base_price", "total_price", "price_id", "promotion_id", "created_at"}
+
+	mock.ExpectQuery(`select .* from purchases p\s+left join \(select purchase_id, sum\(amount\) as amount, sum\(restocked\) as restocked from refunds group by purchase_id\) r on r.purchase_id = p.id\s+where p.seller_id=\? and p.created_at >= \?`).WithArgs("sellerid", time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC), model.VEND_FAILED).
+		WillReturnRows(sqlmock.NewRows(purchaseCols).
+			AddRow("pu1", "buyer", "cola", "sellerid", 2, 50, 100, 100, "pr1", nil, time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)).
+			AddRow("pu2", "buyer", "cola", "sellerid", 1, 50, 50, 45, "pr1", "promo", time.Date(2022, 10, 2, 10, 0, 0, 0, time.UTC)))
+	mock.ExpectQuery(`select .* from products where seller_id=\?`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "available_amount", "cost", "seller_id"}).AddRow("cola", "Cola", 7, 50, "sellerid"))
+}
+
+func TestHandleSellerReportJSON(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectReportQueries(mock)
+
+	r, err := http.NewRequest(http.MethodGet, "/seller/reports?from=2022-10-01&to=2022-10-02", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+	NewApp("", db).handleSellerReport().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	var report salesReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Buckets) != 2 || report.Totals.Revenue != 145 || report.Totals.UnitsSold != 3 {
+		t.Errorf("wrong report: %+v", report)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleSellerReportCSV(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectReportQueries(mock)
+
+	r, err := http.NewRequest(http.MethodGet, "/seller/reports?from=2022-10-01&to=2022-10-02&format=csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "sellerid", Role: model.ROLE_SELLER})
+
+	NewApp("", db).handleSellerReport().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("wrong content type. expected: %s, got: %s", "text/csv", ct)
+	}
+
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "start,purchases,units_sold,revenue,average_basket,sell_through\n" +
+		"2022-10-01,1,2,100,100,0.2000\n" +
+		"2022-10-02,1,1,45,45,0.1250\n"
+
+	if strings.TrimSpace(string(b)) != strings.TrimSpace(expected) {
+		t.Errorf("wrong csv. expected:\n%s\ngot:\n%s", expected, string(b))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
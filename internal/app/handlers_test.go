@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
 	"github.com/mehiX/vending-machine-api/internal/app/model"
 )
 
@@ -44,7 +46,7 @@ func TestHandleAddUserFailDataError(t *testing.T) {
 	data := addUserRequest{
 		Username: "short",
 		Password: "lasdjfasdf",
-		Role:     model.ROLE_ADMIN,
+		Role:     model.ROLE_BUYER,
 	}
 	if err := json.NewEncoder(&buf).Encode(data); err != nil {
 		t.Fatal(err)
@@ -80,7 +82,7 @@ func TestHandleAddUserSuccess(t *testing.T) {
 	data := addUserRequest{
 		Username: "mihaiusr",
 		Password: "la&*jfaS2f",
-		Role:     model.ROLE_ADMIN,
+		Role:     model.ROLE_SELLER,
 	}
 	if err := json.NewEncoder(&buf).Encode(data); err != nil {
 		t.Fatal(err)
@@ -100,6 +102,7 @@ func TestHandleAddUserSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`insert into users`).WithArgs(sqlmock.AnyArg(), data.Username, sqlmock.AnyArg(), data.Role).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	vm := NewApp("", db)
@@ -117,6 +120,32 @@ func TestHandleAddUserSuccess(t *testing.T) {
 
 }
 
+func TestHandleAddUserAdminRefused(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r, err := http.NewRequest(http.MethodPost, "/user", strings.NewReader(`{"Username":"mihaiusr","Password":"la&*jfaS2f","Role":"ADMIN"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	NewApp("", db).Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong status code. Expected: %d, got: %d", http.StatusForbidden, w.Code)
+	}
+
+	// nothing is written
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestHandleLoginFailWrongCredentials(t *testing.T) {
 
 	data := loginRequest{
@@ -140,7 +169,10 @@ func TestHandleLoginFailWrongCredentials(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery(`select id, username, password, deposit, role from users where username=`).WithArgs(data.Username).WillReturnError(errors.New("no rows"))
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs(data.Username).WillReturnError(errors.New("no rows"))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_LOGIN_FAILED, "username", data.Username, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	NewApp("", db).handleLogin().ServeHTTP(w, r)
 
@@ -270,13 +302,18 @@ func TestHandleResetSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(50, 1).AddRow(100, 2))
 	mock.ExpectBegin()
+	mock.ExpectQuery(`select deposit from users where id=\? for update`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(100))
 	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(0, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory set amount = amount - \?`).WithArgs(1, 100, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from escrow_notes where user_id=\?`).WithArgs("userid").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows(columns).AddRow("userid", "", "", 0, "BUYER"))
+	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows(columns).AddRow("userid", "", "", 0, "BUYER", 0))
 
 	r, err := http.NewRequest(http.MethodGet, "", nil)
 	if err != nil {
@@ -429,12 +466,16 @@ func TestHandleDepositSuccess(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`update users set deposit=\? where id=\?`).WithArgs(110, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(10, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(110))
+	mock.ExpectExec(`insert into coin_inventory`).WithArgs(10, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WithArgs(sqlmock.AnyArg(), "userid", 10).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows(columns).AddRow("userid", "", "", 110, "BUYER"))
+	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows(columns).AddRow("userid", "", "", 110, "BUYER", 0))
 
 	r, err := http.NewRequest(http.MethodGet, "", nil)
 	if err != nil {
@@ -524,8 +565,11 @@ func TestOnlyBuyersCanBuy(t *testing.T) {
 			statusCode: http.StatusOK,
 			response: buyResponse{
 				Amount:     5,
+				BasePrice:  25,
 				TotalSpent: 25,
-				Change:     [5]int64{1, 0, 0, 0, 0},
+				Currency:   "EUR",
+				Coins:      []int64{5, 10, 20, 50, 100},
+				Change:     []int64{1, 0, 0, 0, 0},
 				Product: prodBuyerInfo{
 					Name:       "product name",
 					Cost:       5,
@@ -550,12 +594,17 @@ func TestOnlyBuyersCanBuy(t *testing.T) {
 			if s.amount != 0 {
 				ctx = context.WithValue(ctx, amountValueContextKey, &s.amount)
 			}
-			if s.seller != nil {
-				ctx = context.WithValue(ctx, sellerContextKey, s.seller)
+
+			// the seller is found in the user cache, without a database
+			withSeller := func(vm *App) *App {
+				if s.seller != nil {
+					vm.Users.Get(ctx, s.seller.ID, func(context.Context, string) (*model.User, error) { return s.seller, nil })
+				}
+				return vm
 			}
 
 			if s.name != "all good" {
-				NewApp("", nil).handleBuy().ServeHTTP(w, r.WithContext(ctx))
+				withSeller(NewApp("", nil)).handleBuy().ServeHTTP(w, r.WithContext(ctx))
 			} else {
 				// the happy scenario
 				db, mock, err := sqlmock.New()
@@ -564,12 +613,20 @@ func TestOnlyBuyersCanBuy(t *testing.T) {
 				}
 				defer db.Close()
 
+				mock.ExpectQuery(`select .* from promotions`).WithArgs(s.product.SellerID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
 				mock.ExpectBegin()
-				mock.ExpectExec(`update products set available_amount`).WithArgs(s.amount, s.product.ID).WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec(`update users set deposit `).WithArgs(int64(s.amount)*s.product.Cost, s.user.ID).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`update products set available_amount`).WithArgs(s.amount, s.product.ID, s.amount).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`update users set deposit `).WithArgs(int64(s.amount)*s.product.Cost, s.user.ID, int64(s.amount)*s.product.Cost).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), s.product.SellerID, "SALE", 25, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+				mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 				mock.ExpectCommit()
+				mock.ExpectExec(`update purchases set status=\?`).WithArgs(model.VEND_COMPLETED, sqlmock.AnyArg(), s.user.ID, model.VEND_PENDING).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`select coin_value, amount from coin_inventory`).WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(5, 1).AddRow(10, 3))
 
-				NewApp("", db).handleBuy().ServeHTTP(w, r.WithContext(ctx))
+				withSeller(NewApp("", db)).handleBuy().ServeHTTP(w, r.WithContext(ctx))
 
 				if err := mock.ExpectationsWereMet(); err != nil {
 					t.Error(err)
@@ -587,10 +644,22 @@ func TestOnlyBuyersCanBuy(t *testing.T) {
 				if data.Amount != s.response.Amount {
 					t.Errorf("wrong amount. expected: %d, got: %d", s.response.Amount, data.Amount)
 				}
+				if data.BasePrice != s.response.BasePrice {
+					t.Errorf("wrong base price. expected: %d, got: %d", s.response.BasePrice, data.BasePrice)
+				}
+				if data.Promotion != nil {
+					t.Errorf("no promotion should be applied, got: %v", data.Promotion)
+				}
 				if data.TotalSpent != s.response.TotalSpent {
 					t.Errorf("wrong total spent. expected: %d, got: %d", s.response.TotalSpent, data.TotalSpent)
 				}
-				if data.Change != s.response.Change {
+				if data.Currency != s.response.Currency {
+					t.Errorf("wrong currency. expected: %s, got: %s", s.response.Currency, data.Currency)
+				}
+				if !reflect.DeepEqual(data.Coins, s.response.Coins) {
+					t.Errorf("wrong coins. expected: %v, got: %v", s.response.Coins, data.Coins)
+				}
+				if !reflect.DeepEqual(data.Change, s.response.Change) {
 					t.Errorf("wrong change. expected: %v, got: %v", s.response.Change, data.Change)
 				}
 				if !reflect.DeepEqual(data.Product, s.response.Product) {
@@ -604,3 +673,260 @@ func TestOnlyBuyersCanBuy(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleDepositBatch(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "some coins", http.StatusBadRequest},
+		{"no coins", `{"coins":[]}`, http.StatusBadRequest},
+		{"wrong coin", `{"coins":[50,25]}`, http.StatusBadRequest},
+		{"no database", `{"coins":[50,20]}`, http.StatusInternalServerError},
+	}
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodPost, "/deposit", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, &model.User{ID: "userid", Role: model.ROLE_BUYER})
+
+		NewApp("", nil).handleDepositBatch().ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Result().StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestHandleDepositBatchSuccess(t *testing.T) {
+
+	usr := model.User{
+		ID:      "userid",
+		Role:    model.ROLE_BUYER,
+		Deposit: 100,
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(95, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(195))
+	for _, c := range []int{50, 20, 20, 5} {
+		mock.ExpectExec(`insert into coin_inventory`).WithArgs(c, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`insert into deposit_history`).WithArgs(sqlmock.AnyArg(), "userid", c).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "userid", model.AUDIT_DEPOSIT, "user", "userid", `{"user_id":"userid","deposit":100}`, `{"user_id":"userid","coins":[50,20,20,5],"deposit":195}`, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
+
+	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("userid").WillReturnRows(sqlmock.NewRows(columns).AddRow("userid", "", "", 195, "BUYER", 0))
+
+	r, err := http.NewRequest(http.MethodPost, "/deposit", strings.NewReader(`{"coins":[50,20,20,5]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	ctx := context.WithValue(r.Context(), userContextKey, &usr)
+
+	NewApp("", db).handleDepositBatch().ServeHTTP(w, r.WithContext(ctx))
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&usr); err != nil {
+		t.Fatal(err)
+	}
+
+	if usr.Deposit != 195 {
+		t.Fatalf("wrong deposit in response. expected: %d, got: %d", 195, usr.Deposit)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleLoginLockedOut(t *testing.T) {
+
+	vm := NewApp("", nil)
+	for i := 0; i < vm.Logins.Limits.MaxFailures; i++ {
+		vm.Logins.Failed("mihaiusr", "10.0.0.1")
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"mihaiusr","password":"doesnotmatter"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.2:4321"
+	w := httptest.NewRecorder()
+
+	// the credentials are not even checked, there is no database
+	vm.handleLogin().ServeHTTP(w, r)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestHandleLoginSpoofedForwardedFor(t *testing.T) {
+
+	vm := NewApp("", nil)
+
+	// a different username every time, only the IP gets locked
+	for i := 0; i < vm.Logins.Limits.MaxFailuresPerIP; i++ {
+		vm.Logins.Failed("user"+strconv.Itoa(i), "203.0.113.5")
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"mihaiusr","password":"doesnotmatter"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "203.0.113.5:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.Header.Set("X-Real-IP", "198.51.100.7")
+	w := httptest.NewRecorder()
+
+	vm.Router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("the forwarding headers of a client that is not a proxy should be ignored. expected: %d, got: %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestHandleUnlockUser(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	vm := NewApp("", db)
+	for i := 0; i < vm.Logins.Limits.MaxFailures; i++ {
+		vm.Logins.Failed("mihaiusr", "10.0.0.1")
+	}
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", "hash", 0, model.ROLE_BUYER, 0))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "admin", model.AUDIT_USER_UNLOCK, "user", "id1", sqlmock.AnyArg(), `{"failures":0}`, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r, err := http.NewRequest(http.MethodPost, "/admin/users/id1/unlock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("userID", "id1")
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, userContextKey, &model.User{ID: "admin", Role: model.ROLE_ADMIN})
+	w := httptest.NewRecorder()
+
+	vm.handleUnlockUser().ServeHTTP(w, r.WithContext(ctx))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, w.Code)
+	}
+
+	var details userDetails
+	if err := json.NewDecoder(w.Body).Decode(&details); err != nil {
+		t.Fatal(err)
+	}
+
+	if details.ID != "id1" || details.Lockout.Failures != 0 || details.Lockout.LockedUntil != nil {
+		t.Errorf("wrong details. expected: id1 unlocked, got: %+v", details)
+	}
+
+	if wait := vm.Logins.Wait("mihaiusr", ""); wait != 0 {
+		t.Errorf("user should be able to log in. got wait: %s", wait)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleSetUserRoles(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	vm := NewApp("", db)
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", "hash", 0, model.ROLE_SELLER, 0))
+	mock.ExpectExec(`update users set role=\?, session_version = session_version \+ 1 where id=\?`).WithArgs("SELLER,BUYER", "id1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "admin", model.AUDIT_USER_ROLE, "user", "id1", `{"roles":["SELLER"]}`, `{"roles":["SELLER","BUYER"]}`, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(http.MethodPut, "/admin/users/id1/roles", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("userID", "id1")
+		ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+		ctx = context.WithValue(ctx, userContextKey, &model.User{ID: "admin", Role: model.ROLE_ADMIN})
+		w := httptest.NewRecorder()
+
+		vm.handleSetUserRoles().ServeHTTP(w, r.WithContext(ctx))
+
+		return w
+	}
+
+	w := serve(`{"roles":["SELLER","BUYER"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code. expected: %d, got: %d", http.StatusOK, w.Code)
+	}
+
+	var details userDetails
+	if err := json.NewDecoder(w.Body).Decode(&details); err != nil {
+		t.Fatal(err)
+	}
+
+	if details.Role != model.ROLE_SELLER || !details.IsBuyer() || details.Password != "" {
+		t.Errorf("wrong user details: %+v", details.User)
+	}
+
+	for _, body := range []string{`{"roles":[]}`, `{"roles":["BUYER","BUYER"]}`, `{"roles":["GUEST"]}`} {
+		if w := serve(body); w.Code != http.StatusBadRequest {
+			t.Errorf("wrong status code for %s. expected: %d, got: %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
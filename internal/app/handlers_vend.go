@@ -0,0 +1,29 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// @Summary 	Vend failures
+// @Description The last 100 vends the machine could not complete, newest first. The buyers were refunded
+// @Tags		private, maintenance, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.VendFailure
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/vend-failures [get]
+func (a *App) handleVendFailures() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		failures, err := a.VendFailures(r.Context())
+		if err != nil {
+			fmt.Println("vend failures", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, failures)
+	}
+}
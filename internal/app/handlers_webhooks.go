@@ -0,0 +1,151 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// @Summary 	Subscribe a webhook
+// @Description Events are posted as JSON, signed with HMAC-SHA256 in the `X-Webhook-Signature` header. The secret is only returned here
+// @Tags		private, webhooks, only admins
+// @Security 	ApiKeyAuth
+// @Accept		application/json
+// @Produces	application/json
+// @Param 		webhook body createWebhookRequest true "url, events (or `*` for all) and an optional secret"
+// @Success		201 {object} model.WebhookSubscription
+// @Failure		400 {string} string "bad request"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/webhooks [post]
+func (a *App) handleCreateWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var req createWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Println("decoding webhook", err)
+			http.Error(w, "bad data in body", http.StatusBadRequest)
+			return
+		}
+
+		sub, err := a.CreateWebhook(r.Context(), req.URL, req.Events, req.Secret)
+		if err != nil {
+			fmt.Println("create webhook", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the secret stays out of the audit log
+		a.audit(r, actorID(r), model.AUDIT_WEBHOOK_CREATE, "webhook", sub.ID, nil, model.WebhookSubscription{ID: sub.ID, URL: sub.URL, Events: sub.Events, CreatedAt: sub.CreatedAt})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(sub); err != nil {
+			fmt.Println("error encoding data", err)
+		}
+	}
+}
+
+// @Summary 	List webhooks
+// @Tags		private, webhooks, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Success		200 {object} []model.WebhookSubscription
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/webhooks [get]
+func (a *App) handleListWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		subs, err := a.ListWebhooks(r.Context())
+		if err != nil {
+			fmt.Println("list webhooks", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, subs)
+	}
+}
+
+// @Summary 	Delete a webhook
+// @Description The pending deliveries of the webhook are dropped
+// @Tags		private, webhooks, only admins
+// @Security 	ApiKeyAuth
+// @Param 		webhookID path string true "Webhook ID"
+// @Success		204
+// @Failure		400 {string} string "webhook not found"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/webhooks/{webhookID} [delete]
+func (a *App) handleDeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		webhookID := chi.URLParam(r, "webhookID")
+
+		if err := a.DeleteWebhook(r.Context(), webhookID); err != nil {
+			fmt.Println("delete webhook", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, actorID(r), model.AUDIT_WEBHOOK_DELETE, "webhook", webhookID, nil, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary 	Webhook deliveries
+// @Description The last 100 deliveries of the webhook, with the outcome of their last attempt
+// @Tags		private, webhooks, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		webhookID path string true "Webhook ID"
+// @Success		200 {object} []model.WebhookDelivery
+// @Failure		401 {string} string "not authorized"
+// @Failure		500 {string} string "database errors"
+// @Router 		/admin/webhooks/{webhookID}/deliveries [get]
+func (a *App) handleWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		deliveries, err := a.WebhookDeliveries(r.Context(), chi.URLParam(r, "webhookID"))
+		if err != nil {
+			fmt.Println("webhook deliveries", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, deliveries)
+	}
+}
+
+// @Summary 	Ping a webhook
+// @Description Sends a `ping` event right away and returns the delivery. Failed pings are not retried
+// @Tags		private, webhooks, only admins
+// @Security 	ApiKeyAuth
+// @Produces	application/json
+// @Param 		webhookID path string true "Webhook ID"
+// @Success		200 {object} model.WebhookDelivery
+// @Failure		400 {string} string "webhook not found"
+// @Failure		401 {string} string "not authorized"
+// @Router 		/admin/webhooks/{webhookID}/ping [post]
+func (a *App) handlePingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		delivery, err := a.PingWebhook(r.Context(), chi.URLParam(r, "webhookID"))
+		if err != nil {
+			fmt.Println("ping webhook", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		returnAsJSON(r.Context(), w, delivery)
+	}
+}
+
+type createWebhookRequest struct {
+	URL    string            `json:"url"`
+	Events []model.TypeEvent `json:"events"`
+	Secret string            `json:"secret"`
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestHandleCreateWebhook(t *testing.T) {
+
+	type scenario struct {
+		name       string
+		body       string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{"not json", "hook me", http.StatusBadRequest},
+		{"unknown event", `{"url":"https://example.com","events":["coin.lost"]}`, http.StatusBadRequest},
+		{"created", `{"url":"https://example.com","events":["*"],"secret":"s3cret"}`, http.StatusCreated},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.statusCode == http.StatusCreated {
+			mock.ExpectBegin()
+			mock.ExpectExec(`insert into webhook_subscriptions`).WithArgs(sqlmock.AnyArg(), "https://example.com", "*", "s3cret").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}
+
+		r, err := http.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		NewApp("", db).handleCreateWebhook().ServeHTTP(w, r)
+
+		resp := w.Result()
+		if resp.StatusCode != s.statusCode {
+			t.Errorf("%s: wrong status code. expected: %d, got: %d", s.name, s.statusCode, resp.StatusCode)
+		}
+
+		if s.statusCode == http.StatusCreated {
+			var sub model.WebhookSubscription
+			if err := json.NewDecoder(resp.Body).Decode(&sub); err != nil {
+				t.Fatal(err)
+			}
+
+			if sub.ID == "" || sub.Secret != "s3cret" {
+				t.Errorf("%s: wrong subscription: %+v", s.name, sub)
+			}
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
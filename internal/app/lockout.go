@@ -0,0 +1,258 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entries not touched for longer than the lockout are dropped once a map grows past this size
+const login_guard_prune_size = 1000
+
+// LoginLimits sets how failed logins are throttled
+type LoginLimits struct {
+	MaxFailures      int           // failures of one username before it is locked
+	MaxFailuresPerIP int           // failures from one IP, on any username, before it is locked
+	Lockout          time.Duration // how long a lock lasts, and how long failures are remembered
+	Delay            time.Duration // wait after the first failure, doubled after every other one
+}
+
+var defaultLoginLimits = LoginLimits{
+	MaxFailures:      5,
+	MaxFailuresPerIP: 20,
+	Lockout:          15 * time.Minute,
+	Delay:            time.Second,
+}
+
+func loginLimitsFromEnv() (LoginLimits, error) {
+
+	limits := defaultLoginLimits
+
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"LOGIN_MAX_FAILURES", &limits.MaxFailures},
+		{"LOGIN_MAX_FAILURES_PER_IP", &limits.MaxFailuresPerIP},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return defaultLoginLimits, fmt.Errorf("%s: %w", v.name, err)
+		}
+		if n < 1 {
+			return defaultLoginLimits, fmt.Errorf("%s must be at least 1", v.name)
+		}
+		*v.dst = n
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"LOGIN_LOCKOUT", &limits.Lockout},
+		{"LOGIN_DELAY", &limits.Delay},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return defaultLoginLimits, fmt.Errorf("%s: %w", v.name, err)
+		}
+		if d < 0 {
+			return defaultLoginLimits, fmt.Errorf("%s cannot be negative", v.name)
+		}
+		*v.dst = d
+	}
+
+	return limits, nil
+}
+
+// LockoutStatus is the failed logins of a username
+type LockoutStatus struct {
+	Failures    int        `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard counts failed logins per username and per IP. After every failure the next attempt has to wait
+// longer, and after too many failures the username or IP is locked out for a while.
+// The counts are kept in memory, so they are reset when the server restarts.
+type LoginGuard struct {
+	Limits LoginLimits
+
+	mu    sync.Mutex
+	users map[string]*loginFailures
+	ips   map[string]*loginFailures
+	now   func() time.Time
+}
+
+func NewLoginGuard(limits LoginLimits) *LoginGuard {
+	return &LoginGuard{
+		Limits: limits,
+		users:  make(map[string]*loginFailures),
+		ips:    make(map[string]*loginFailures),
+		now:    time.Now,
+	}
+}
+
+// Wait returns how long the username and IP have to wait before they can try to log in again. 0 allows the attempt
+func (g *LoginGuard) Wait(username, ip string) time.Duration {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+
+	wait := g.waitFor(g.entry(g.users, userKey(username), now), now)
+	if w := g.waitFor(g.entry(g.ips, ip, now), now); w > wait {
+		wait = w
+	}
+
+	return wait
+}
+
+// Failed records a failed login. Returns true if the username or the IP got locked by it
+func (g *LoginGuard) Failed(username, ip string) (locked bool) {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+
+	if g.fail(g.users, userKey(username), g.Limits.MaxFailures, now) {
+		locked = true
+	}
+
+	if ip != "" && g.fail(g.ips, ip, g.Limits.MaxFailuresPerIP, now) {
+		locked = true
+	}
+
+	return
+}
+
+// Succeeded forgets the failed logins of the username. Those of the IP are kept
+func (g *LoginGuard) Succeeded(username string) {
+	g.Unlock(username)
+}
+
+// Unlock forgets the failed logins of the username, lifting its lock if there is one
+func (g *LoginGuard) Unlock(username string) {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.users, userKey(username))
+}
+
+// Status shows the failed logins of the username
+func (g *LoginGuard) Status(username string) LockoutStatus {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+
+	f := g.entry(g.users, userKey(username), now)
+	if f == nil {
+		return LockoutStatus{}
+	}
+
+	s := LockoutStatus{Failures: f.count}
+	if f.lockedUntil.After(now) {
+		until := f.lockedUntil
+		s.LockedUntil = &until
+	}
+
+	return s
+}
+
+// entry returns the failures recorded for the key, dropping them if they are too old to count
+func (g *LoginGuard) entry(m map[string]*loginFailures, key string, now time.Time) *loginFailures {
+
+	f, ok := m[key]
+	if !ok {
+		return nil
+	}
+
+	if g.expired(f, now) {
+		delete(m, key)
+		return nil
+	}
+
+	return f
+}
+
+func (g *LoginGuard) expired(f *loginFailures, now time.Time) bool {
+	return !f.lockedUntil.After(now) && now.Sub(f.last) > g.Limits.Lockout
+}
+
+func (g *LoginGuard) waitFor(f *loginFailures, now time.Time) time.Duration {
+
+	if f == nil {
+		return 0
+	}
+
+	if f.lockedUntil.After(now) {
+		return f.lockedUntil.Sub(now)
+	}
+
+	delay := g.Limits.Delay
+	for i := 1; i < f.count && delay < g.Limits.Lockout; i++ {
+		delay *= 2
+	}
+	if delay > g.Limits.Lockout {
+		delay = g.Limits.Lockout
+	}
+
+	if next := f.last.Add(delay); next.After(now) {
+		return next.Sub(now)
+	}
+
+	return 0
+}
+
+func (g *LoginGuard) fail(m map[string]*loginFailures, key string, max int, now time.Time) (locked bool) {
+
+	if len(m) > login_guard_prune_size {
+		for k, f := range m {
+			if g.expired(f, now) {
+				delete(m, k)
+			}
+		}
+	}
+
+	f := g.entry(m, key, now)
+	if f == nil {
+		f = &loginFailures{}
+		m[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if f.count >= max && !f.lockedUntil.After(now) {
+		f.lockedUntil = now.Add(g.Limits.Lockout)
+		return true
+	}
+
+	return false
+}
+
+// userKey matches usernames the way the database does, ignoring the case
+func userKey(username string) string {
+	return strings.ToLower(username)
+}
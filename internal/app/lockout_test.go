@@ -0,0 +1,155 @@
+package app
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestLoginGuard(now *time.Time) *LoginGuard {
+	g := NewLoginGuard(LoginLimits{MaxFailures: 3, MaxFailuresPerIP: 5, Lockout: time.Minute, Delay: time.Second})
+	g.now = func() time.Time { return *now }
+	return g
+}
+
+func TestLoginGuardProgressiveDelay(t *testing.T) {
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	g := newTestLoginGuard(&now)
+
+	if wait := g.Wait("mihai", "10.0.0.1"); wait != 0 {
+		t.Fatalf("wrong wait before any failure. expected: 0, got: %s", wait)
+	}
+
+	g.Failed("mihai", "10.0.0.1")
+	if wait := g.Wait("mihai", "10.0.0.1"); wait != time.Second {
+		t.Errorf("wrong wait after 1 failure. expected: 1s, got: %s", wait)
+	}
+
+	now = now.Add(time.Second)
+	if wait := g.Wait("mihai", "10.0.0.1"); wait != 0 {
+		t.Errorf("wrong wait after the delay. expected: 0, got: %s", wait)
+	}
+
+	g.Failed("mihai", "10.0.0.1")
+	if wait := g.Wait("mihai", "10.0.0.1"); wait != 2*time.Second {
+		t.Errorf("wrong wait after 2 failures. expected: 2s, got: %s", wait)
+	}
+
+	// the IP is delayed on any username
+	if wait := g.Wait("other", "10.0.0.1"); wait != 2*time.Second {
+		t.Errorf("wrong wait for the IP. expected: 2s, got: %s", wait)
+	}
+
+	if wait := g.Wait("other", "10.0.0.2"); wait != 0 {
+		t.Errorf("wrong wait for another username and IP. expected: 0, got: %s", wait)
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	g := newTestLoginGuard(&now)
+
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if locked := g.Failed("Mihai", ip); locked != (i == 2) {
+			t.Errorf("failure %d: wrong lock. expected: %v, got: %v", i+1, i == 2, locked)
+		}
+	}
+
+	// the username is locked from any IP, whatever the case
+	if wait := g.Wait("mihai", "10.0.0.9"); wait != time.Minute {
+		t.Errorf("wrong wait when locked. expected: 1m, got: %s", wait)
+	}
+
+	s := g.Status("mihai")
+	if s.Failures != 3 || s.LockedUntil == nil || !s.LockedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("wrong status. expected: 3 failures, locked until %s, got: %+v", now.Add(time.Minute), s)
+	}
+
+	now = now.Add(time.Minute + time.Second)
+
+	if wait := g.Wait("mihai", "10.0.0.9"); wait != 0 {
+		t.Errorf("wrong wait after the lockout. expected: 0, got: %s", wait)
+	}
+
+	if s := g.Status("mihai"); s.Failures != 0 || s.LockedUntil != nil {
+		t.Errorf("failures should be forgotten after the lockout, got: %+v", s)
+	}
+}
+
+func TestLoginGuardIPLockout(t *testing.T) {
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	g := newTestLoginGuard(&now)
+
+	locked := false
+	for _, u := range []string{"a", "b", "c", "d", "e"} {
+		locked = g.Failed(u, "10.0.0.1")
+	}
+
+	if !locked {
+		t.Fatal("the IP should be locked after 5 failures")
+	}
+
+	if wait := g.Wait("f", "10.0.0.1"); wait != time.Minute {
+		t.Errorf("wrong wait for the locked IP. expected: 1m, got: %s", wait)
+	}
+}
+
+func TestLoginGuardUnlock(t *testing.T) {
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	g := newTestLoginGuard(&now)
+
+	for i := 0; i < 3; i++ {
+		g.Failed("mihai", "")
+	}
+
+	g.Unlock("mihai")
+
+	if wait := g.Wait("mihai", ""); wait != 0 {
+		t.Errorf("wrong wait after unlock. expected: 0, got: %s", wait)
+	}
+}
+
+func TestLoginLimitsFromEnv(t *testing.T) {
+
+	type scenario struct {
+		name     string
+		env      map[string]string
+		expected LoginLimits
+		fail     bool
+	}
+
+	scenarios := []scenario{
+		{"defaults", map[string]string{}, defaultLoginLimits, false},
+		{"all set", map[string]string{"LOGIN_MAX_FAILURES": "3", "LOGIN_MAX_FAILURES_PER_IP": "10", "LOGIN_LOCKOUT": "5m", "LOGIN_DELAY": "500ms"},
+			LoginLimits{MaxFailures: 3, MaxFailuresPerIP: 10, Lockout: 5 * time.Minute, Delay: 500 * time.Millisecond}, false},
+		{"zero failures", map[string]string{"LOGIN_MAX_FAILURES": "0"}, defaultLoginLimits, true},
+		{"bad duration", map[string]string{"LOGIN_LOCKOUT": "15"}, defaultLoginLimits, true},
+		{"negative delay", map[string]string{"LOGIN_DELAY": "-1s"}, defaultLoginLimits, true},
+	}
+
+	for _, s := range scenarios {
+		for _, k := range []string{"LOGIN_MAX_FAILURES", "LOGIN_MAX_FAILURES_PER_IP", "LOGIN_LOCKOUT", "LOGIN_DELAY"} {
+			os.Unsetenv(k)
+		}
+		for k, v := range s.env {
+			os.Setenv(k, v)
+		}
+
+		limits, err := loginLimitsFromEnv()
+		if (err != nil) != s.fail {
+			t.Errorf("%s: wrong error. expected fail: %v, got: %v", s.name, s.fail, err)
+		}
+
+		if limits != s.expected {
+			t.Errorf("%s: wrong limits. expected: %+v, got: %+v", s.name, s.expected, limits)
+		}
+	}
+
+	for _, k := range []string{"LOGIN_MAX_FAILURES", "LOGIN_MAX_FAILURES_PER_IP", "LOGIN_LOCKOUT", "LOGIN_DELAY"} {
+		os.Unsetenv(k)
+	}
+}
@@ -1,11 +1,27 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Product struct {
 	ID              string `json:"id"`
 	AmountAvailable int64  `json:"amount_available"`
 	Cost            int64  `json:"cost"`
 	Name            string `json:"name"`
 	SellerID        string `json:"seller_id"`
+	PriceID         string `json:"price_id,omitempty"` // current price version
+}
+
+// ProductPrice is one version of a product's cost.
+// Versions with EffectiveFrom in the future are scheduled price changes, they are applied once the time comes.
+type ProductPrice struct {
+	ID            string    `json:"id"`
+	ProductID     string    `json:"product_id"`
+	Cost          int64     `json:"cost"`
+	EffectiveFrom time.Time `json:"effective_from"`
+	Applied       bool      `json:"applied"`
 }
 
 type User struct {
@@ -13,15 +29,48 @@ type User struct {
 	Username string
 	Password string `json:"-"`
 	Deposit  int64
-	Role     TypeRole
+	Role     TypeRole   // main role
+	Roles    []TypeRole `json:",omitempty"` // all the roles, e.g. a seller who also buys. Empty if the user only has Role
+
+	SessionVersion int64 `json:"-"` // changes with the password or the roles, the tokens given before are refused
+}
+
+// AllRoles returns the roles the user holds
+func (u *User) AllRoles() []TypeRole {
+	if len(u.Roles) == 0 && u.Role != "" {
+		return []TypeRole{u.Role}
+	}
+	return u.Roles
+}
+
+// SetRoles gives the user the roles, the first one is the main role
+func (u *User) SetRoles(roles []TypeRole) {
+	u.Roles = roles
+	u.Role = ""
+	if len(roles) > 0 {
+		u.Role = roles[0]
+	}
+}
+
+func (u *User) HasRole(role TypeRole) bool {
+	for _, r := range u.AllRoles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 func (u *User) IsSeller() bool {
-	return u.Role == ROLE_SELLER
+	return u.HasRole(ROLE_SELLER)
 }
 
 func (u *User) IsBuyer() bool {
-	return u.Role == ROLE_BUYER
+	return u.HasRole(ROLE_BUYER)
+}
+
+func (u *User) IsAdmin() bool {
+	return u.HasRole(ROLE_ADMIN)
 }
 
 type TypeRole = string
@@ -31,3 +80,298 @@ const (
 	ROLE_BUYER  TypeRole = "BUYER"
 	ROLE_SELLER TypeRole = "SELLER"
 )
+
+// Promotion is a discount a seller offers on one product or, if ProductID is empty, on all of their products
+type Promotion struct {
+	ID        string        `json:"id"`
+	SellerID  string        `json:"seller_id"`
+	ProductID string        `json:"product_id,omitempty"`
+	Name      string        `json:"name"`
+	Type      TypePromotion `json:"type"`
+	Value     int64         `json:"value"`
+	FromHour  int           `json:"from_hour"`
+	ToHour    int           `json:"to_hour"`
+}
+
+// ActiveAt checks the happy hours of the promotion. The interval is [FromHour, ToHour) and can go past midnight.
+// If FromHour equals ToHour the promotion is active all day.
+func (p *Promotion) ActiveAt(t time.Time) bool {
+	if p.FromHour == p.ToHour {
+		return true
+	}
+
+	h := t.Hour()
+	if p.FromHour < p.ToHour {
+		return h >= p.FromHour && h < p.ToHour
+	}
+
+	return h >= p.FromHour || h < p.ToHour
+}
+
+// AppliesTo checks if the promotion is for this product
+func (p *Promotion) AppliesTo(prod *Product) bool {
+	return p.SellerID == prod.SellerID && (p.ProductID == "" || p.ProductID == prod.ID)
+}
+
+type TypePromotion = string
+
+const (
+	PROMO_PERCENT     TypePromotion = "PERCENT"     // Value is the discount in percent
+	PROMO_FIXED       TypePromotion = "FIXED"       // Value is taken off the cost of each item
+	PROMO_BUY_N_GET_1 TypePromotion = "BUY_N_GET_1" // Value is N, for every N items bought the next one is free
+)
+
+// Purchase records one buy, with the price before and after the promotion
+type Purchase struct {
+	ID          string         `json:"id"`
+	UserID      string         `json:"user_id"`
+	ProductID   string         `json:"product_id"`
+	SellerID    string         `json:"seller_id"`
+	Amount      int            `json:"amount"`
+	UnitCost    int64          `json:"unit_cost"`
+	BasePrice   int64          `json:"base_price"`
+	TotalPrice  int64          `json:"total_price"`
+	PriceID     string         `json:"price_id,omitempty"` // price version UnitCost comes from
+	PromotionID string         `json:"promotion_id,omitempty"`
+	Commission  int64          `json:"commission"` // platform commission, taken from what the seller earns
+	Status      TypeVendStatus `json:"status"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+type TypeVendStatus = string
+
+// A purchase is pending from the buy until the dispenser confirms the products dropped.
+// Failed purchases were refunded.
+const (
+	VEND_PENDING   TypeVendStatus = "PENDING"
+	VEND_COMPLETED TypeVendStatus = "COMPLETED"
+	VEND_FAILED    TypeVendStatus = "FAILED"
+)
+
+// VendFailure records a vend the machine could not complete (jam, timeout), for maintenance.
+// The buyer got Refunded back on their deposit.
+type VendFailure struct {
+	ID         string    `json:"id"`
+	PurchaseID string    `json:"purchase_id"`
+	UserID     string    `json:"user_id"`
+	ProductID  string    `json:"product_id"`
+	Amount     int       `json:"amount"`
+	Refunded   int64     `json:"refunded"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Refund gives back part or all of a completed purchase, on the buyer's deposit or as coins from the coin box.
+// Restocked units went back on sale.
+type Refund struct {
+	ID         string           `json:"id"`
+	PurchaseID string           `json:"purchase_id"`
+	AdminID    string           `json:"admin_id"`
+	UserID     string           `json:"user_id"`
+	ProductID  string           `json:"product_id"`
+	Amount     int64            `json:"amount"`
+	Method     TypeRefundMethod `json:"method"`
+	Restocked  int              `json:"restocked"`
+	Reason     string           `json:"reason"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+type TypeRefundMethod = string
+
+const (
+	REFUND_DEPOSIT TypeRefundMethod = "DEPOSIT"
+	REFUND_COINS   TypeRefundMethod = "COINS"
+)
+
+// Payout is a seller's request to be paid their earnings
+type Payout struct {
+	ID        string           `json:"id"`
+	SellerID  string           `json:"seller_id"`
+	Amount    int64            `json:"amount"`
+	Status    TypePayoutStatus `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type TypePayoutStatus = string
+
+// A payout is requested by the seller, then approved or rejected by an admin. Approved payouts are marked as paid once the money is sent.
+const (
+	PAYOUT_REQUESTED TypePayoutStatus = "REQUESTED"
+	PAYOUT_APPROVED  TypePayoutStatus = "APPROVED"
+	PAYOUT_REJECTED  TypePayoutStatus = "REJECTED"
+	PAYOUT_PAID      TypePayoutStatus = "PAID"
+)
+
+// StockAlert tells a seller that one of their products is running low or sold out
+type StockAlert struct {
+	ID             string         `json:"id"`
+	SellerID       string         `json:"seller_id"`
+	ProductID      string         `json:"product_id"`
+	Type           TypeStockAlert `json:"type"`
+	Stock          int64          `json:"stock"`     // amount left after the buy
+	Threshold      int64          `json:"threshold"` // low-stock threshold of the product at the time
+	CreatedAt      time.Time      `json:"created_at"`
+	AcknowledgedAt *time.Time     `json:"acknowledged_at,omitempty"`
+}
+
+type TypeStockAlert = string
+
+const (
+	ALERT_LOW_STOCK TypeStockAlert = "LOW_STOCK"
+	ALERT_SOLD_OUT  TypeStockAlert = "SOLD_OUT"
+)
+
+// StockAlertFor returns the alert raised when the stock of a product goes from `before` to `after`.
+// A product sells out when nothing is left, it runs low when the stock drops to the threshold or below it. A threshold of 0 turns off low-stock alerts.
+func StockAlertFor(before, after, threshold int64) (TypeStockAlert, bool) {
+
+	if after <= 0 && before > 0 {
+		return ALERT_SOLD_OUT, true
+	}
+
+	if threshold > 0 && before > threshold && after <= threshold {
+		return ALERT_LOW_STOCK, true
+	}
+
+	return "", false
+}
+
+type TypeEvent = string
+
+// Events sent to webhook subscribers. PING is only sent on request, to test a subscription
+const (
+	EVENT_USER_CREATED    TypeEvent = "user.created"
+	EVENT_DEPOSIT_CREATED TypeEvent = "deposit.created"
+	EVENT_DEPOSIT_RESET   TypeEvent = "deposit.reset"
+	EVENT_PURCHASE        TypeEvent = "purchase.created"
+	EVENT_VEND_FAILED     TypeEvent = "vend.failed"
+	EVENT_REFUND          TypeEvent = "purchase.refunded"
+	EVENT_PRODUCT_CREATED TypeEvent = "product.created"
+	EVENT_PRODUCT_UPDATED TypeEvent = "product.updated"
+	EVENT_PRODUCT_DELETED TypeEvent = "product.deleted"
+	EVENT_STOCK_LOW       TypeEvent = "stock.low"
+	EVENT_STOCK_SOLD_OUT  TypeEvent = "stock.sold_out"
+	EVENT_PING            TypeEvent = "ping"
+)
+
+// Live events only go to the clients connected to this server (e.g. the kiosk UI), they are not saved in the outbox
+const (
+	EVENT_BALANCE_CHANGED TypeEvent = "balance.changed"
+	EVENT_STOCK_CHANGED   TypeEvent = "stock.changed"
+	EVENT_PRICE_CHANGED   TypeEvent = "price.changed"
+)
+
+// Event is a change to be published. Payload is the JSON sent to the consumers.
+// Events with a UserID are private to that user.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      TypeEvent `json:"type"`
+	Payload   string    `json:"payload"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MFAPolicy tells if the users of a role have to log in with a one-time code
+type MFAPolicy struct {
+	Role      TypeRole  `json:"role"`
+	Required  bool      `json:"required"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIKey is a long-lived credential of a user, for machines and scripts. It is limited to its scopes.
+// Only a hash of the key is stored, the key itself is shown once.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // start of the key, to tell the keys apart
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// WebhookSubscription receives the events it subscribed to as signed JSON posts. `*` subscribes to all events.
+// The secret is only shown when the subscription is created.
+type WebhookSubscription struct {
+	ID        string      `json:"id"`
+	URL       string      `json:"url"`
+	Events    []TypeEvent `json:"events"`
+	Secret    string      `json:"secret,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription, and the outcome of the last attempt to deliver it
+type WebhookDelivery struct {
+	ID             string             `json:"id"`
+	SubscriptionID string             `json:"subscription_id"`
+	EventType      TypeEvent          `json:"event_type"`
+	Payload        string             `json:"payload"`
+	Status         TypeDeliveryStatus `json:"status"`
+	Attempts       int                `json:"attempts"`
+	NextAttemptAt  time.Time          `json:"next_attempt_at"`
+	LastStatusCode int                `json:"last_status_code,omitempty"`
+	LastError      string             `json:"last_error,omitempty"`
+	CreatedAt      time.Time          `json:"created_at"`
+	DeliveredAt    *time.Time         `json:"delivered_at,omitempty"`
+}
+
+type TypeDeliveryStatus = string
+
+// Deliveries are retried while PENDING, until they are DELIVERED or run out of attempts and are marked FAILED
+const (
+	DELIVERY_PENDING   TypeDeliveryStatus = "PENDING"
+	DELIVERY_DELIVERED TypeDeliveryStatus = "DELIVERED"
+	DELIVERY_FAILED    TypeDeliveryStatus = "FAILED"
+)
+
+// AuditEntry records who did what, from where. Before and After are JSON snapshots of the target, when they apply.
+// Entries are never changed or deleted.
+type AuditEntry struct {
+	ID         string          `json:"id"`
+	ActorID    string          `json:"actor_id,omitempty"` // empty if nobody was logged in, e.g. failed logins
+	Action     TypeAuditAction `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"request_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type TypeAuditAction = string
+
+const (
+	AUDIT_LOGIN           TypeAuditAction = "auth.login"
+	AUDIT_LOGIN_FAILED    TypeAuditAction = "auth.login_failed"
+	AUDIT_LOGIN_LOCKED    TypeAuditAction = "auth.locked"
+	AUDIT_MFA_FAILED      TypeAuditAction = "auth.mfa_failed"
+	AUDIT_MFA_ENABLE      TypeAuditAction = "auth.mfa_enable"
+	AUDIT_MFA_DISABLE     TypeAuditAction = "auth.mfa_disable"
+	AUDIT_MFA_POLICY      TypeAuditAction = "auth.mfa_policy"
+	AUDIT_PASSWORD_FORGOT TypeAuditAction = "auth.password_forgot"
+	AUDIT_PASSWORD_RESET  TypeAuditAction = "auth.password_reset"
+	AUDIT_USER_CREATE     TypeAuditAction = "user.create"
+	AUDIT_USER_UNLOCK     TypeAuditAction = "user.unlock"
+	AUDIT_USER_ROLE       TypeAuditAction = "user.role"
+	AUDIT_PRODUCT_CREATE  TypeAuditAction = "product.create"
+	AUDIT_PRODUCT_UPDATE  TypeAuditAction = "product.update"
+	AUDIT_PRODUCT_DELETE  TypeAuditAction = "product.delete"
+	AUDIT_PRICE_SCHEDULE  TypeAuditAction = "product.price_schedule"
+	AUDIT_PRICE_APPLY     TypeAuditAction = "product.price_apply"
+	AUDIT_DEPOSIT         TypeAuditAction = "deposit.add"
+	AUDIT_DEPOSIT_RESET   TypeAuditAction = "deposit.reset"
+	AUDIT_ESCROW_CANCEL   TypeAuditAction = "escrow.cancel"
+	AUDIT_BUY             TypeAuditAction = "purchase.buy"
+	AUDIT_REFUND          TypeAuditAction = "purchase.refund"
+	AUDIT_VEND_FAILED     TypeAuditAction = "purchase.vend_failed"
+	AUDIT_PAYOUT_REQUEST  TypeAuditAction = "payout.request"
+	AUDIT_PAYOUT_UPDATE   TypeAuditAction = "payout.update"
+	AUDIT_COINS_REFILL    TypeAuditAction = "coins.refill"
+	AUDIT_WEBHOOK_CREATE  TypeAuditAction = "webhook.create"
+	AUDIT_WEBHOOK_DELETE  TypeAuditAction = "webhook.delete"
+	AUDIT_APIKEY_CREATE   TypeAuditAction = "apikey.create"
+	AUDIT_APIKEY_REVOKE   TypeAuditAction = "apikey.revoke"
+)
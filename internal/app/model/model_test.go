@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestUser(t *testing.T) {
@@ -20,6 +21,10 @@ func TestUser(t *testing.T) {
 	if !buyer.IsBuyer() || seller.IsBuyer() || admin.IsBuyer() {
 		t.Error("IsBuyer doesn't work")
 	}
+
+	if !admin.IsAdmin() || seller.IsAdmin() || buyer.IsAdmin() {
+		t.Error("IsAdmin doesn't work")
+	}
 }
 
 func TestUserAsJsonDoesNotExposePassword(t *testing.T) {
@@ -37,3 +42,78 @@ func TestUserAsJsonDoesNotExposePassword(t *testing.T) {
 		t.Fatal("encoded string contains the password")
 	}
 }
+
+func TestPromotionActiveAt(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		promo  Promotion
+		hour   int
+		active bool
+	}
+
+	scenarios := []scenario{
+		{"all day", Promotion{}, 3, true},
+		{"inside", Promotion{FromHour: 15, ToHour: 17}, 16, true},
+		{"start is included", Promotion{FromHour: 15, ToHour: 17}, 15, true},
+		{"end is excluded", Promotion{FromHour: 15, ToHour: 17}, 17, false},
+		{"past midnight, late", Promotion{FromHour: 22, ToHour: 2}, 23, true},
+		{"past midnight, early", Promotion{FromHour: 22, ToHour: 2}, 1, true},
+		{"past midnight, outside", Promotion{FromHour: 22, ToHour: 2}, 12, false},
+	}
+
+	for _, s := range scenarios {
+		at := time.Date(2022, 10, 1, s.hour, 30, 0, 0, time.Local)
+		if s.promo.ActiveAt(at) != s.active {
+			t.Errorf("%s: expected active: %v", s.name, s.active)
+		}
+	}
+}
+
+func TestPromotionAppliesTo(t *testing.T) {
+
+	prod := &Product{ID: "prod", SellerID: "seller"}
+
+	if !(&Promotion{SellerID: "seller"}).AppliesTo(prod) {
+		t.Error("seller wide promotion should apply")
+	}
+
+	if !(&Promotion{SellerID: "seller", ProductID: "prod"}).AppliesTo(prod) {
+		t.Error("product promotion should apply")
+	}
+
+	if (&Promotion{SellerID: "seller", ProductID: "other"}).AppliesTo(prod) {
+		t.Error("promotion for another product should not apply")
+	}
+
+	if (&Promotion{SellerID: "other"}).AppliesTo(prod) {
+		t.Error("promotion from another seller should not apply")
+	}
+}
+
+func TestStockAlertFor(t *testing.T) {
+
+	type scenario struct {
+		before, after, threshold int64
+		alert                    TypeStockAlert
+		raised                   bool
+	}
+
+	scenarios := []scenario{
+		{10, 8, 5, "", false},
+		{10, 5, 5, ALERT_LOW_STOCK, true},
+		{6, 2, 5, ALERT_LOW_STOCK, true},
+		{5, 4, 5, "", false},
+		{3, 0, 5, ALERT_SOLD_OUT, true},
+		{10, 0, 5, ALERT_SOLD_OUT, true},
+		{10, 1, 0, "", false},
+		{2, 0, 0, ALERT_SOLD_OUT, true},
+	}
+
+	for _, s := range scenarios {
+		alert, raised := StockAlertFor(s.before, s.after, s.threshold)
+		if alert != s.alert || raised != s.raised {
+			t.Errorf("%d -> %d (threshold %d): expected: %q %v, got: %q %v", s.before, s.after, s.threshold, s.alert, s.raised, alert, raised)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// Notifier delivers messages to the users, e.g. password reset tokens.
+// Users only have a username, a notifier that sends emails or texts looks up where to send them.
+type Notifier interface {
+	Notify(ctx context.Context, usr model.User, subject, message string) error
+}
+
+// LogNotifier prints the messages, for local development
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, usr model.User, subject, message string) error {
+	fmt.Printf("notify %s (%s) %s: %s\n", usr.Username, usr.ID, subject, message)
+	return nil
+}
+
+type notification struct {
+	Time     time.Time `json:"time"`
+	UserID   string    `json:"user_id"`
+	Username string    `json:"username"`
+	Subject  string    `json:"subject"`
+	Message  string    `json:"message"`
+}
+
+// FileNotifier appends the messages to a file, one JSON object per line
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (n *FileNotifier) Notify(ctx context.Context, usr model.User, subject, message string) error {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// the messages can hold secrets, only the owner reads them
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(notification{
+		Time:     time.Now().UTC(),
+		UserID:   usr.ID,
+		Username: usr.Username,
+		Subject:  subject,
+		Message:  message,
+	})
+}
+
+const default_notifier_file = "notifications.log"
+
+// notifierFromEnv reads `NOTIFIER`: `log` (default) or `file`, which writes to `NOTIFIER_FILE`
+func notifierFromEnv() (Notifier, error) {
+
+	switch v := os.Getenv("NOTIFIER"); v {
+	case "", "log":
+		return LogNotifier{}, nil
+	case "file":
+		path := os.Getenv("NOTIFIER_FILE")
+		if path == "" {
+			path = default_notifier_file
+		}
+		return &FileNotifier{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("NOTIFIER: unknown notifier %q", v)
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// chanNotifier hands the messages to the test
+type chanNotifier chan notification
+
+func (n chanNotifier) Notify(ctx context.Context, usr model.User, subject, message string) error {
+	n <- notification{UserID: usr.ID, Username: usr.Username, Subject: subject, Message: message}
+	return nil
+}
+
+func TestFileNotifier(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "notifications.log")
+	n := &FileNotifier{Path: path}
+
+	usr := model.User{ID: "id1", Username: "mihaiusr"}
+
+	for _, msg := range []string{"first", "second"} {
+		if err := n.Notify(context.Background(), usr, "Subject", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if fi, _ := f.Stat(); fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong file mode. expected: 0600, got: %s", fi.Mode().Perm())
+	}
+
+	var got []notification
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var m notification
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+
+	if len(got) != 2 || got[0].Message != "first" || got[1].Message != "second" || got[1].Username != "mihaiusr" {
+		t.Errorf("wrong notifications: %+v", got)
+	}
+}
+
+func TestNotifierFromEnv(t *testing.T) {
+
+	defer func() {
+		os.Unsetenv("NOTIFIER")
+		os.Unsetenv("NOTIFIER_FILE")
+	}()
+
+	os.Unsetenv("NOTIFIER")
+	if n, err := notifierFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := n.(LogNotifier); !ok {
+		t.Errorf("wrong default notifier: %T", n)
+	}
+
+	os.Setenv("NOTIFIER", "file")
+	os.Setenv("NOTIFIER_FILE", "/tmp/reset.log")
+	if n, err := notifierFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if f, ok := n.(*FileNotifier); !ok || f.Path != "/tmp/reset.log" {
+		t.Errorf("wrong file notifier: %#v", n)
+	}
+
+	os.Setenv("NOTIFIER", "pigeon")
+	if _, err := notifierFromEnv(); err == nil {
+		t.Error("unknown notifier should fail")
+	}
+}
@@ -0,0 +1,371 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	oidc_login_ttl      = 10 * time.Minute // to log in at the provider and come back
+	oidc_keys_ttl       = time.Hour        // the provider's signing keys are fetched again after this
+	oidc_keys_min_age   = time.Minute
+	oidc_clock_skew     = time.Minute
+	oidc_default_scopes = "openid profile email"
+)
+
+// OIDCConfig is the OpenID Connect provider users log in with, and how its claims map to roles
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients, PKCE protects the code either way
+	RedirectURL  string // our `/login/oidc/callback`, as registered with the provider
+	RoleClaim    string // claim holding the user's groups or roles, e.g. `groups`
+	RoleMap      map[string]model.TypeRole
+}
+
+// oidcConfigFromEnv reads `OIDC_ISSUER`, `OIDC_CLIENT_ID`, `OIDC_CLIENT_SECRET`, `OIDC_REDIRECT_URL`, `OIDC_ROLE_CLAIM`
+// and `OIDC_ROLE_MAP` (e.g. `vm-admins=ADMIN,vm-sellers=SELLER`). Returns nil if no issuer is set.
+func oidcConfigFromEnv() (*OIDCConfig, error) {
+
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	c := OIDCConfig{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		RoleClaim:    os.Getenv("OIDC_ROLE_CLAIM"),
+		RoleMap:      make(map[string]model.TypeRole),
+	}
+
+	if c.ClientID == "" || c.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are needed with OIDC_ISSUER")
+	}
+
+	if v := os.Getenv("OIDC_ROLE_MAP"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			value, role, ok := strings.Cut(strings.TrimSpace(s), "=")
+			if !ok {
+				return nil, fmt.Errorf("OIDC_ROLE_MAP: %q is not value=ROLE", s)
+			}
+			if err := validateRole(role); err != nil {
+				return nil, fmt.Errorf("OIDC_ROLE_MAP: %w", err)
+			}
+			c.RoleMap[value] = role
+		}
+	}
+
+	return &c, nil
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcIdentity is the user as the provider knows it
+type oidcIdentity struct {
+	Issuer   string   `json:"issuer"`
+	Subject  string   `json:"subject"`
+	Username string   `json:"username"`         // preferred_username, or else the email
+	Groups   []string `json:"groups,omitempty"` // values of the role claim
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against the provider.
+// The discovery document and the signing keys are fetched on first use.
+type OIDCProvider struct {
+	OIDCConfig
+	Client *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        jwk.Set
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(c OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{OIDCConfig: c, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var m oidcMetadata
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if strings.TrimSuffix(m.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q doesn't match %q", m.Issuer, p.Issuer)
+	}
+
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JwksURI == "" {
+		return nil, errors.New("oidc discovery: endpoints missing")
+	}
+
+	p.meta = &m
+
+	return p.meta, nil
+}
+
+// AuthURL is where the user is sent to log in. The provider sends the user back to RedirectURL with a code
+func (p *OIDCProvider) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", oidc_default_scopes)
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", pkceChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return m.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the code for the tokens, and returns the verified identity of the user
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*oidcIdentity, error) {
+
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token endpoint: %s %s", resp.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("oidc token endpoint: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, errors.New("oidc token endpoint: no id_token")
+	}
+
+	return p.verify(ctx, tokens.IDToken, nonce)
+}
+
+// verify checks the ID token's signature, issuer, audience, times and nonce
+func (p *OIDCProvider) verify(ctx context.Context, idToken, nonce string) (*oidcIdentity, error) {
+
+	keys, err := p.signingKeys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.parse(idToken, keys)
+	if err != nil {
+		// the provider may have rotated its keys
+		if keys, err = p.signingKeys(ctx, true); err != nil {
+			return nil, err
+		}
+		if t, err = p.parse(idToken, keys); err != nil {
+			return nil, fmt.Errorf("oidc id_token: %w", err)
+		}
+	}
+
+	if n, _ := t.Get("nonce"); n != nonce {
+		return nil, errors.New("oidc id_token: wrong nonce")
+	}
+
+	if t.Subject() == "" {
+		return nil, errors.New("oidc id_token: no subject")
+	}
+
+	id := oidcIdentity{Issuer: p.Issuer, Subject: t.Subject()}
+
+	claims := t.PrivateClaims()
+	if u, ok := claims["preferred_username"].(string); ok && u != "" {
+		id.Username = u
+	} else if e, ok := claims["email"].(string); ok {
+		id.Username = e
+	}
+
+	if p.RoleClaim != "" {
+		switch v := claims[p.RoleClaim].(type) {
+		case string:
+			id.Groups = []string{v}
+		case []interface{}:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					id.Groups = append(id.Groups, s)
+				}
+			}
+		}
+	}
+
+	return &id, nil
+}
+
+func (p *OIDCProvider) parse(idToken string, keys jwk.Set) (jwt.Token, error) {
+	return jwt.Parse([]byte(idToken),
+		jwt.WithKeySet(keys),
+		jwt.UseDefaultKey(true),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithAcceptableSkew(oidc_clock_skew),
+	)
+}
+
+// signingKeys returns the provider's keys, fetched again when they are old or `refresh` is asked.
+// Refreshes are limited to one a minute, so bad tokens can't make us hammer the provider.
+func (p *OIDCProvider) signingKeys(ctx context.Context, refresh bool) (jwk.Set, error) {
+
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := time.Since(p.keysFetched)
+	if p.keys != nil && age < oidc_keys_ttl && (!refresh || age < oidc_keys_min_age) {
+		return p.keys, nil
+	}
+
+	keys, err := jwk.Fetch(ctx, m.JwksURI, jwk.WithHTTPClient(p.Client))
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+
+	// keys are only used with their algorithm, providers often leave out the RSA one
+	for it := keys.Iterate(ctx); it.Next(ctx); {
+		k := it.Pair().Value.(jwk.Key)
+		if k.Algorithm() == "" && k.KeyType() == jwa.RSA {
+			k.Set(jwk.AlgorithmKey, jwa.RS256)
+		}
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	return p.keys, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, dst any) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
+
+// mapRoles returns the roles the provider's groups give, the highest first: ADMIN, SELLER, BUYER. Empty if none matches
+func (c OIDCConfig) mapRoles(groups []string) []model.TypeRole {
+
+	mapped := make(map[model.TypeRole]bool)
+	for _, g := range groups {
+		if r, ok := c.RoleMap[g]; ok {
+			mapped[r] = true
+		}
+	}
+
+	roles := make([]model.TypeRole, 0, len(mapped))
+	for _, r := range []model.TypeRole{model.ROLE_ADMIN, model.ROLE_SELLER, model.ROLE_BUYER} {
+		if mapped[r] {
+			roles = append(roles, r)
+		}
+	}
+
+	return roles
+}
+
+// newOIDCSecret returns a random value for the state, the nonce or the PKCE verifier
+func newOIDCSecret() (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge is the S256 challenge of the verifier, RFC 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
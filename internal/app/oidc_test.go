@@ -0,0 +1,374 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// mockIdP is an OpenID Connect provider that logs in anybody as `Subject`, with `Claims` in the ID token
+type mockIdP struct {
+	*httptest.Server
+	ClientID string
+	Subject  string
+	Claims   map[string]any
+
+	mu     sync.Mutex
+	key    jwk.Key
+	grants map[string]url.Values // the authorization requests, by code
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+
+	idp := &mockIdP{ClientID: "vending", Subject: "sub-1", grants: make(map[string]url.Values)}
+	idp.rotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JwksURI:               idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		pub, _ := jwk.PublicKeyOf(idp.key)
+		idp.mu.Unlock()
+		pub.Remove(jwk.AlgorithmKey) // like most providers
+		set := jwk.NewSet()
+		set.Add(pub)
+		json.NewEncoder(w).Encode(set)
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+// rotateKey makes the provider sign with a new key
+func (idp *mockIdP) rotateKey(t *testing.T) {
+
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := jwk.New(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Set(jwk.KeyIDKey, time.Now().Format(time.RFC3339Nano))
+
+	idp.mu.Lock()
+	idp.key = key
+	idp.mu.Unlock()
+}
+
+// authorize logs in the user right away and sends them back with a code
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+	if q.Get("client_id") != idp.ClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := newOIDCSecret()
+
+	idp.mu.Lock()
+	idp.grants[code] = q
+	idp.mu.Unlock()
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// token gives the ID token for a code, once, if the PKCE verifier matches the challenge
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostForm.Get("code")]
+	delete(idp.grants, r.PostForm.Get("code"))
+	key := idp.key
+	idp.mu.Unlock()
+
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri") {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.Get("code_challenge") {
+		http.Error(w, `{"error":"invalid_grant","error_description":"pkce"}`, http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := idp.idToken(key, grant.Get("nonce"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+}
+
+func (idp *mockIdP) idToken(key jwk.Key, nonce string) (string, error) {
+
+	t := jwt.New()
+	t.Set(jwt.IssuerKey, idp.URL)
+	t.Set(jwt.SubjectKey, idp.Subject)
+	t.Set(jwt.AudienceKey, idp.ClientID)
+	t.Set(jwt.IssuedAtKey, time.Now())
+	t.Set(jwt.ExpirationKey, time.Now().Add(5*time.Minute))
+	t.Set("nonce", nonce)
+	for k, v := range idp.Claims {
+		t.Set(k, v)
+	}
+
+	signed, err := jwt.Sign(t, jwa.RS256, key)
+
+	return string(signed), err
+}
+
+func (idp *mockIdP) config(redirectURL string) OIDCConfig {
+	return OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    idp.ClientID,
+		RedirectURL: redirectURL,
+		RoleClaim:   "groups",
+		RoleMap:     map[string]model.TypeRole{"vm-admins": model.ROLE_ADMIN, "vm-sellers": model.ROLE_SELLER},
+	}
+}
+
+// login runs the browser's part of the flow: returns the code and state the provider sends back
+func (idp *mockIdP) login(t *testing.T, authURL string) (code, state string) {
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("provider refused the login: %s", resp.Status)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func TestOIDCConfigFromEnv(t *testing.T) {
+
+	defer func() {
+		for _, k := range []string{"OIDC_ISSUER", "OIDC_CLIENT_ID", "OIDC_REDIRECT_URL", "OIDC_ROLE_MAP"} {
+			os.Unsetenv(k)
+		}
+	}()
+
+	if c, err := oidcConfigFromEnv(); c != nil || err != nil {
+		t.Fatalf("no issuer should disable oidc. got: %v, %v", c, err)
+	}
+
+	os.Setenv("OIDC_ISSUER", "https://idp.example.com/")
+	if _, err := oidcConfigFromEnv(); err == nil {
+		t.Error("should fail without client ID and redirect URL")
+	}
+
+	os.Setenv("OIDC_CLIENT_ID", "vending")
+	os.Setenv("OIDC_REDIRECT_URL", "https://vm.example.com/login/oidc/callback")
+	os.Setenv("OIDC_ROLE_MAP", "vm-admins=ADMIN, vm-sellers=SELLER")
+
+	c, err := oidcConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Issuer != "https://idp.example.com" {
+		t.Errorf("wrong issuer. got: %s", c.Issuer)
+	}
+
+	if c.RoleMap["vm-admins"] != model.ROLE_ADMIN || c.RoleMap["vm-sellers"] != model.ROLE_SELLER {
+		t.Errorf("wrong role map. got: %v", c.RoleMap)
+	}
+
+	os.Setenv("OIDC_ROLE_MAP", "vm-admins=ROOT")
+	if _, err := oidcConfigFromEnv(); err == nil {
+		t.Error("should fail for unknown roles")
+	}
+}
+
+func TestOIDCMapRoles(t *testing.T) {
+
+	c := OIDCConfig{RoleMap: map[string]model.TypeRole{"a": model.ROLE_ADMIN, "s": model.ROLE_SELLER, "b": model.ROLE_BUYER, "b2": model.ROLE_BUYER}}
+
+	tests := []struct {
+		groups []string
+		roles  string
+	}{
+		{nil, ""},
+		{[]string{"other"}, ""},
+		{[]string{"b"}, "BUYER"},
+		{[]string{"b", "s", "b2"}, "SELLER,BUYER"},
+		{[]string{"b", "a", "other"}, "ADMIN,BUYER"},
+	}
+
+	for _, tc := range tests {
+		if roles := strings.Join(c.mapRoles(tc.groups), ","); roles != tc.roles {
+			t.Errorf("groups %v. expected: %q, got: %q", tc.groups, tc.roles, roles)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+
+	idp := newMockIdP(t)
+	idp.Claims = map[string]any{"preferred_username": "jane.doe", "groups": []string{"staff", "vm-sellers"}}
+
+	p := NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	authURL, err := p.AuthURL(context.Background(), "state1", "nonce1", "verifier1-long-enough-to-be-a-real-pkce-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authURL, idp.URL+"/authorize?") {
+		t.Fatalf("wrong authorization URL: %s", authURL)
+	}
+
+	code, state := idp.login(t, authURL)
+	if state != "state1" {
+		t.Fatalf("wrong state. got: %s", state)
+	}
+
+	id, err := p.Exchange(context.Background(), code, "verifier1-long-enough-to-be-a-real-pkce-verifier", "nonce1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.Issuer != idp.URL || id.Subject != "sub-1" || id.Username != "jane.doe" {
+		t.Errorf("wrong identity: %+v", id)
+	}
+
+	if len(id.Groups) != 2 || id.Groups[1] != "vm-sellers" {
+		t.Errorf("wrong groups: %v", id.Groups)
+	}
+
+	// a code is used once
+	if _, err := p.Exchange(context.Background(), code, "verifier1-long-enough-to-be-a-real-pkce-verifier", "nonce1"); err == nil {
+		t.Error("code should not be accepted twice")
+	}
+}
+
+func TestOIDCExchangeRefused(t *testing.T) {
+
+	idp := newMockIdP(t)
+	p := NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	verifier := "verifier1-long-enough-to-be-a-real-pkce-verifier"
+
+	login := func() string {
+		authURL, err := p.AuthURL(context.Background(), "state1", "nonce1", verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := idp.login(t, authURL)
+		return code
+	}
+
+	if _, err := p.Exchange(context.Background(), login(), "another-verifier", "nonce1"); err == nil {
+		t.Error("wrong PKCE verifier should fail")
+	}
+
+	if _, err := p.Exchange(context.Background(), login(), verifier, "another-nonce"); err == nil {
+		t.Error("wrong nonce should fail")
+	}
+
+	// a token for another client
+	other := NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+	other.ClientID = "other"
+	if _, err := other.Exchange(context.Background(), login(), verifier, "nonce1"); err == nil {
+		t.Error("wrong audience should fail")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+
+	idp := newMockIdP(t)
+	p := NewOIDCProvider(idp.config("http://vm.local/login/oidc/callback"))
+
+	exchange := func() error {
+		authURL, err := p.AuthURL(context.Background(), "s", "n", "verifier1-long-enough-to-be-a-real-pkce-verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := idp.login(t, authURL)
+		_, err = p.Exchange(context.Background(), code, "verifier1-long-enough-to-be-a-real-pkce-verifier", "n")
+		return err
+	}
+
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.rotateKey(t)
+
+	// the keys were just fetched, they are not fetched again yet
+	if err := exchange(); err == nil {
+		t.Fatal("unknown key should fail while the keys are fresh")
+	}
+
+	p.mu.Lock()
+	p.keysFetched = p.keysFetched.Add(-2 * oidc_keys_min_age)
+	p.mu.Unlock()
+
+	if err := exchange(); err != nil {
+		t.Fatalf("rotated key should be fetched: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryWrongIssuer(t *testing.T) {
+
+	idp := newMockIdP(t)
+
+	// serves the provider's discovery document, which names the provider as issuer
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, idp.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	c := idp.config("http://vm.local/login/oidc/callback")
+	c.Issuer = srv.URL
+
+	if _, err := NewOIDCProvider(c).AuthURL(context.Background(), "s", "n", "v"); err == nil {
+		t.Error("should refuse a discovery document for another issuer")
+	}
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hashing schemes. The stored hashes start with their scheme: `$argon2id$...` or `$2a$...` for bcrypt
+const (
+	hash_argon2id = "argon2id"
+	hash_bcrypt   = "bcrypt"
+)
+
+// Argon2Params are the argon2id settings, see RFC 9106
+type Argon2Params struct {
+	Time    uint32 // passes over the memory
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32 // bytes
+	SaltLen uint32 // bytes
+}
+
+// PasswordHashing is how new passwords are hashed. Hashes made with other settings are still checked,
+// and replaced on the user's next login.
+type PasswordHashing struct {
+	Scheme     string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+var defaultPasswordHashing = PasswordHashing{
+	Scheme:     hash_argon2id,
+	BcryptCost: 12,
+	Argon2:     Argon2Params{Time: 2, Memory: 19 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16},
+}
+
+// passwordHashingFromEnv reads `PASSWORD_HASH` (`argon2id` or `bcrypt`), `PASSWORD_BCRYPT_COST`
+// and `PASSWORD_ARGON2_TIME`, `PASSWORD_ARGON2_MEMORY` (KiB), `PASSWORD_ARGON2_THREADS`
+func passwordHashingFromEnv() (PasswordHashing, error) {
+
+	h := defaultPasswordHashing
+
+	switch v := os.Getenv("PASSWORD_HASH"); v {
+	case "":
+	case hash_argon2id, hash_bcrypt:
+		h.Scheme = v
+	default:
+		return defaultPasswordHashing, fmt.Errorf("PASSWORD_HASH: unknown scheme %q", v)
+	}
+
+	if s := os.Getenv("PASSWORD_BCRYPT_COST"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return defaultPasswordHashing, fmt.Errorf("PASSWORD_BCRYPT_COST: %w", err)
+		}
+		if n < bcrypt.MinCost || n > bcrypt.MaxCost {
+			return defaultPasswordHashing, fmt.Errorf("PASSWORD_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		h.BcryptCost = n
+	}
+
+	for _, v := range []struct {
+		name string
+		max  uint64
+		set  func(uint64)
+	}{
+		{"PASSWORD_ARGON2_TIME", 1 << 16, func(n uint64) { h.Argon2.Time = uint32(n) }},
+		{"PASSWORD_ARGON2_MEMORY", 1 << 22, func(n uint64) { h.Argon2.Memory = uint32(n) }},
+		{"PASSWORD_ARGON2_THREADS", 255, func(n uint64) { h.Argon2.Threads = uint8(n) }},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return defaultPasswordHashing, fmt.Errorf("%s: %w", v.name, err)
+		}
+		if n < 1 || n > v.max {
+			return defaultPasswordHashing, fmt.Errorf("%s must be between 1 and %d", v.name, v.max)
+		}
+		v.set(n)
+	}
+
+	if h.Argon2.Memory < 8*uint32(h.Argon2.Threads) {
+		return defaultPasswordHashing, fmt.Errorf("PASSWORD_ARGON2_MEMORY must be at least 8 KiB per thread")
+	}
+
+	return h, nil
+}
+
+// Hash hashes the password with the configured scheme
+func (h PasswordHashing) Hash(password string) (string, error) {
+
+	if h.Scheme == hash_bcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(b), err
+	}
+
+	p := h.Argon2
+
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash tells if the hash was made with another scheme or weaker settings than the configured ones
+func (h PasswordHashing) NeedsRehash(hash string) bool {
+
+	if h.Scheme == hash_bcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.BcryptCost
+	}
+
+	p, _, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return p.Time < h.Argon2.Time || p.Memory < h.Argon2.Memory || p.Threads != h.Argon2.Threads || uint32(len(key)) < h.Argon2.KeyLen
+}
+
+// checkPassword compares the password with a hash of any scheme
+func checkPassword(hash, password string) bool {
+
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	p, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// parseArgon2Hash reads a hash like `$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>`
+func parseArgon2Hash(hash string) (p Argon2Params, salt, key []byte, err error) {
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hash_argon2id {
+		return p, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return
+	}
+
+	if p.Time < 1 || p.Threads < 1 || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+
+	return
+}
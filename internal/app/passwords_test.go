@@ -0,0 +1,142 @@
+package app
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2 = Argon2Params{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+func TestPasswordHashing(t *testing.T) {
+
+	for _, h := range []PasswordHashing{
+		{Scheme: hash_argon2id, Argon2: testArgon2},
+		{Scheme: hash_bcrypt, BcryptCost: bcrypt.MinCost},
+	} {
+		t.Run(h.Scheme, func(t *testing.T) {
+			hash, err := h.Hash("mh12&^KJlwekJ*")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !checkPassword(hash, "mh12&^KJlwekJ*") {
+				t.Error("password should match")
+			}
+
+			if checkPassword(hash, "mh12&^KJlwekJ") {
+				t.Error("other password should not match")
+			}
+
+			if h.NeedsRehash(hash) {
+				t.Error("fresh hash should not need a rehash")
+			}
+
+			if other, _ := h.Hash("mh12&^KJlwekJ*"); other == hash {
+				t.Error("hashes should be salted")
+			}
+		})
+	}
+}
+
+func TestArgon2HashFormat(t *testing.T) {
+
+	hash, err := PasswordHashing{Scheme: hash_argon2id, Argon2: testArgon2}.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("wrong hash format: %s", hash)
+	}
+
+	p, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Memory != 64 || p.Time != 1 || p.Threads != 1 || len(salt) != 16 || len(key) != 32 {
+		t.Errorf("wrong parsed hash: %+v, salt %d, key %d", p, len(salt), len(key))
+	}
+
+	for _, bad := range []string{"", "$argon2id$v=19$m=64,t=1,p=1$salt", "$argon2id$v=18$m=64,t=1,p=1$AAAA$AAAA", "$argon2id$v=19$m=64,t=0,p=1$AAAA$AAAA"} {
+		if checkPassword(bad, "secret") {
+			t.Errorf("%q should not match", bad)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+
+	weakBcrypt, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	weakArgon2, _ := PasswordHashing{Scheme: hash_argon2id, Argon2: testArgon2}.Hash("secret")
+
+	argon2 := PasswordHashing{Scheme: hash_argon2id, Argon2: Argon2Params{Time: 2, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16}}
+	bcryptCost := PasswordHashing{Scheme: hash_bcrypt, BcryptCost: bcrypt.MinCost + 1}
+
+	cases := []struct {
+		name string
+		h    PasswordHashing
+		hash string
+		want bool
+	}{
+		{"bcrypt to argon2id", argon2, string(weakBcrypt), true},
+		{"argon2id with fewer passes", argon2, weakArgon2, true},
+		{"argon2id to bcrypt", bcryptCost, weakArgon2, true},
+		{"bcrypt with lower cost", bcryptCost, string(weakBcrypt), true},
+		{"bcrypt with the same cost", PasswordHashing{Scheme: hash_bcrypt, BcryptCost: bcrypt.MinCost}, string(weakBcrypt), false},
+	}
+
+	for _, c := range cases {
+		if got := c.h.NeedsRehash(c.hash); got != c.want {
+			t.Errorf("%s: expected: %v, got: %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestPasswordHashingFromEnv(t *testing.T) {
+
+	vars := []string{"PASSWORD_HASH", "PASSWORD_BCRYPT_COST", "PASSWORD_ARGON2_TIME", "PASSWORD_ARGON2_MEMORY", "PASSWORD_ARGON2_THREADS"}
+	defer func() {
+		for _, v := range vars {
+			os.Unsetenv(v)
+		}
+	}()
+
+	h, err := passwordHashingFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != defaultPasswordHashing {
+		t.Errorf("wrong defaults: %+v", h)
+	}
+
+	os.Setenv("PASSWORD_HASH", "bcrypt")
+	os.Setenv("PASSWORD_BCRYPT_COST", "11")
+	os.Setenv("PASSWORD_ARGON2_TIME", "3")
+	os.Setenv("PASSWORD_ARGON2_MEMORY", "65536")
+	os.Setenv("PASSWORD_ARGON2_THREADS", "4")
+
+	h, err = passwordHashingFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Scheme != hash_bcrypt || h.BcryptCost != 11 || h.Argon2.Time != 3 || h.Argon2.Memory != 65536 || h.Argon2.Threads != 4 {
+		t.Errorf("wrong settings: %+v", h)
+	}
+
+	for name, value := range map[string]string{
+		"PASSWORD_HASH":           "md5",
+		"PASSWORD_BCRYPT_COST":    "2",
+		"PASSWORD_ARGON2_TIME":    "0",
+		"PASSWORD_ARGON2_THREADS": "300",
+	} {
+		os.Setenv(name, value)
+		if _, err := passwordHashingFromEnv(); err == nil {
+			t.Errorf("%s=%s should fail", name, value)
+		}
+		os.Unsetenv(name)
+	}
+}
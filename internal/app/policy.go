@@ -0,0 +1,183 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// Permissions are what the roles allow. A permission with the `:own` suffix, e.g. `product:update:own`,
+// only allows the action on the user's own resources, the one without it on anybody's.
+const (
+	perm_product_create   = "product:create"
+	perm_product_update   = "product:update" // name, cost, scheduled prices and stock alerts
+	perm_product_delete   = "product:delete"
+	perm_promotion_manage = "promotion:manage"
+	perm_sales_read       = "sales:read" // reports, earnings, payouts and stock alerts
+	perm_payout_create    = "payout:create"
+	perm_alert_ack        = "alert:ack"
+	perm_deposit_create   = "deposit:create" // coins, notes and the escrow
+	perm_deposit_reset    = "deposit:reset"  // give back the deposit, cancel the escrow
+	perm_purchase_create  = "purchase:create"
+	perm_purchase_refund  = "purchase:refund"
+	perm_payout_manage    = "payout:manage"
+	perm_coins_manage     = "coins:manage"
+	perm_user_manage      = "user:manage" // user details, unlock, roles and MFA policies
+	perm_audit_read       = "audit:read"
+	perm_webhook_manage   = "webhook:manage"
+	perm_vend_read        = "vend:read"
+)
+
+const perm_own_suffix = ":own"
+
+var errForbidden = errors.New("not allowed")
+
+// own is the permission limited to the user's own resources
+func own(perm string) string {
+	return perm + perm_own_suffix
+}
+
+// Policy gives every role its permissions. Users holding several roles get the permissions of all of them.
+type Policy map[model.TypeRole][]string
+
+var defaultPolicy = Policy{
+	model.ROLE_BUYER: {
+		perm_deposit_create,
+		perm_deposit_reset,
+		perm_purchase_create,
+	},
+	model.ROLE_SELLER: {
+		perm_product_create,
+		own(perm_product_update),
+		own(perm_product_delete),
+		own(perm_promotion_manage),
+		own(perm_sales_read),
+		perm_payout_create,
+		own(perm_alert_ack),
+	},
+	model.ROLE_ADMIN: {
+		perm_purchase_refund,
+		perm_payout_manage,
+		perm_coins_manage,
+		perm_user_manage,
+		perm_audit_read,
+		perm_webhook_manage,
+		perm_vend_read,
+	},
+}
+
+// has tells if any of the roles has the permission
+func (p Policy) has(roles []model.TypeRole, perm string) bool {
+
+	for _, r := range roles {
+		for _, rp := range p[r] {
+			if rp == perm {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Permissions lists what the user is allowed, sorted
+func (p Policy) Permissions(usr *model.User) []string {
+
+	seen := make(map[string]bool)
+	perms := make([]string, 0)
+
+	for _, r := range usr.AllRoles() {
+		for _, rp := range p[r] {
+			if !seen[rp] {
+				seen[rp] = true
+				perms = append(perms, rp)
+			}
+		}
+	}
+
+	sort.Strings(perms)
+
+	return perms
+}
+
+// Authorize tells if the user may do the action. For actions on a resource, ownerID is the ID of the user owning it:
+// then the `:own` permission is enough if it is the user's. Returns errForbidden if the user is not allowed.
+func (a *App) Authorize(usr *model.User, perm string, ownerID string) error {
+
+	if usr == nil {
+		return errForbidden
+	}
+
+	roles := usr.AllRoles()
+
+	if a.Policy.has(roles, perm) {
+		return nil
+	}
+
+	if ownerID != "" && ownerID == usr.ID && a.Policy.has(roles, own(perm)) {
+		return nil
+	}
+
+	return errForbidden
+}
+
+// Can tells if the user has the permission, for any resource or only their own
+func (a *App) Can(usr *model.User, perm string) bool {
+
+	if usr == nil {
+		return false
+	}
+
+	roles := usr.AllRoles()
+
+	return a.Policy.has(roles, perm) || a.Policy.has(roles, own(perm))
+}
+
+// ownerOf is the owner ID of the user's own resources, e.g. their sales reports
+func ownerOf(usr *model.User) string {
+	if usr == nil {
+		return ""
+	}
+	return usr.ID
+}
+
+// Require lets the request through if the user has all the permissions, for any resource or only their own.
+// The handlers check the owner of the resource with Authorize.
+// Requires a "user" object in current request context
+func (a *App) Require(perms ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			usr, ok := r.Context().Value(userContextKey).(*model.User)
+			if !ok {
+				http.Error(w, "authentication error", http.StatusUnauthorized)
+				return
+			}
+
+			for _, perm := range perms {
+				if !a.Can(usr, perm) {
+					http.Error(w, "authentication error", http.StatusUnauthorized)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseRoles reads the roles as stored, e.g. `SELLER,BUYER`. The first one is the user's main role
+func parseRoles(s string) []model.TypeRole {
+
+	roles := make([]model.TypeRole, 0)
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+
+	return roles
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestAuthorize(t *testing.T) {
+
+	seller := &model.User{ID: "seller1", Role: model.ROLE_SELLER}
+	admin := &model.User{ID: "admin1", Role: model.ROLE_ADMIN}
+
+	both := &model.User{ID: "both1"}
+	both.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER})
+
+	type scenario struct {
+		name    string
+		user    *model.User
+		perm    string
+		ownerID string
+		allowed bool
+	}
+
+	scenarios := []scenario{
+		{"no user", nil, perm_product_create, "", false},
+		{"seller creates", seller, perm_product_create, "", true},
+		{"seller updates own", seller, perm_product_update, "seller1", true},
+		{"seller updates other's", seller, perm_product_update, "seller2", false},
+		{"seller updates without owner", seller, perm_product_update, "", false},
+		{"seller buys", seller, perm_purchase_create, "", false},
+		{"admin refunds", admin, perm_purchase_refund, "", true},
+		{"admin updates product", admin, perm_product_update, "seller1", false},
+		{"seller and buyer buys", both, perm_purchase_create, "", true},
+		{"seller and buyer updates own", both, perm_product_update, "both1", true},
+		{"seller and buyer refunds", both, perm_purchase_refund, "", false},
+	}
+
+	vm := NewApp("", nil)
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := vm.Authorize(s.user, s.perm, s.ownerID)
+			if s.allowed && err != nil {
+				t.Errorf("should be allowed, got: %v", err)
+			}
+			if !s.allowed && err != errForbidden {
+				t.Errorf("should be forbidden, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+
+	vm := NewApp("", nil)
+	seller := &model.User{ID: "seller1", Role: model.ROLE_SELLER}
+
+	if !vm.Can(seller, perm_product_update) {
+		t.Error("seller should be able to update their own products")
+	}
+
+	if vm.Can(seller, perm_coins_manage) {
+		t.Error("seller should not manage the coins")
+	}
+
+	if vm.Can(nil, perm_product_create) {
+		t.Error("no user should not be able to do anything")
+	}
+}
+
+func TestPolicyPermissions(t *testing.T) {
+
+	usr := &model.User{}
+	usr.SetRoles([]model.TypeRole{model.ROLE_BUYER, model.ROLE_SELLER})
+
+	perms := defaultPolicy.Permissions(usr)
+
+	expected := len(defaultPolicy[model.ROLE_BUYER]) + len(defaultPolicy[model.ROLE_SELLER])
+	if len(perms) != expected {
+		t.Fatalf("wrong number of permissions. expected: %d, got: %d (%v)", expected, len(perms), perms)
+	}
+
+	for i := 1; i < len(perms); i++ {
+		if perms[i-1] >= perms[i] {
+			t.Fatalf("permissions should be sorted and unique: %v", perms)
+		}
+	}
+
+	if len(defaultPolicy.Permissions(&model.User{})) != 0 {
+		t.Error("a user without roles should have no permissions")
+	}
+}
+
+func TestRequireMultipleRoles(t *testing.T) {
+
+	both := &model.User{ID: "both1"}
+	both.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER})
+
+	type scenario struct {
+		perms      []string
+		statusCode int
+	}
+
+	scenarios := []scenario{
+		{[]string{perm_purchase_create}, http.StatusOK},
+		{[]string{perm_product_update}, http.StatusOK},
+		{[]string{perm_purchase_create, perm_product_create}, http.StatusOK},
+		{[]string{perm_purchase_create, perm_audit_read}, http.StatusUnauthorized},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	vm := NewApp("", nil)
+
+	for _, s := range scenarios {
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		ctx := context.WithValue(r.Context(), userContextKey, both)
+		vm.Require(s.perms...)(next).ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Code != s.statusCode {
+			t.Errorf("wrong status code for %v. expected: %d, got: %d", s.perms, s.statusCode, w.Code)
+		}
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+
+	type scenario struct {
+		input    string
+		expected []model.TypeRole
+	}
+
+	scenarios := []scenario{
+		{"", []model.TypeRole{}},
+		{"BUYER", []model.TypeRole{model.ROLE_BUYER}},
+		{"SELLER,BUYER", []model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER}},
+		{" SELLER , ADMIN,", []model.TypeRole{model.ROLE_SELLER, model.ROLE_ADMIN}},
+	}
+
+	for _, s := range scenarios {
+		if roles := parseRoles(s.input); !reflect.DeepEqual(roles, s.expected) {
+			t.Errorf("wrong roles for %q. expected: %v, got: %v", s.input, s.expected, roles)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// price is the result of running the promotions on a buy
+type price struct {
+	Base      int64            // cost * amount, before any discount
+	Total     int64            // what the buyer pays
+	Promotion *model.Promotion // the promotion that was applied, if any
+}
+
+// priceFor evaluates the promotions that apply to `amount` items of the product at time `t`.
+// Promotions don't add up, the one giving the lowest total wins.
+// Discounted totals are rounded down to a multiple of the smallest coin, so they can always be paid.
+func (c Currency) priceFor(prod *model.Product, amount int, promos []model.Promotion, t time.Time) price {
+
+	p := price{
+		Base:  prod.Cost * int64(amount),
+		Total: prod.Cost * int64(amount),
+	}
+
+	for i := range promos {
+		promo := &promos[i]
+		if !promo.AppliesTo(prod) || !promo.ActiveAt(t) {
+			continue
+		}
+
+		total := c.roundDown(discounted(promo, prod.Cost, amount))
+		if total < p.Total {
+			p.Total = total
+			p.Promotion = promo
+		}
+	}
+
+	return p
+}
+
+// discounted calculates the total for `amount` items with the promotion applied
+func discounted(promo *model.Promotion, cost int64, amount int) int64 {
+
+	base := cost * int64(amount)
+
+	var total int64
+	switch promo.Type {
+	case model.PROMO_PERCENT:
+		total = base * (100 - promo.Value) / 100
+	case model.PROMO_FIXED:
+		total = (cost - promo.Value) * int64(amount)
+	case model.PROMO_BUY_N_GET_1:
+		free := int64(amount) / (promo.Value + 1)
+		total = cost * (int64(amount) - free)
+	default:
+		return base
+	}
+
+	if total < 0 {
+		return 0
+	}
+
+	return total
+}
+
+// roundDown returns the biggest multiple of the smallest coin not bigger than `n`
+func (c Currency) roundDown(n int64) int64 {
+	if len(c.Coins) == 0 {
+		return n
+	}
+
+	return n - n%c.Coins[0]
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestPriceFor(t *testing.T) {
+
+	prod := &model.Product{ID: "prod", SellerID: "seller", Cost: 65}
+	noon := time.Date(2022, 10, 1, 12, 0, 0, 0, time.Local)
+
+	type scenario struct {
+		name      string
+		amount    int
+		promos    []model.Promotion
+		total     int64
+		promotion string
+	}
+
+	scenarios := []scenario{
+		{"no promotions", 2, nil, 130, ""},
+		{"percent", 2, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_PERCENT, Value: 10}}, 115, "p1"},
+		{"fixed per item", 3, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_FIXED, Value: 15}}, 150, "p1"},
+		{"fixed bigger than cost", 1, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_FIXED, Value: 100}}, 0, "p1"},
+		{"buy 2 get 1", 7, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_BUY_N_GET_1, Value: 2}}, 325, "p1"},
+		{"buy 2 get 1, not enough items", 2, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_BUY_N_GET_1, Value: 2}}, 130, ""},
+		{"other product", 2, []model.Promotion{{ID: "p1", SellerID: "seller", ProductID: "other", Type: model.PROMO_PERCENT, Value: 50}}, 130, ""},
+		{"other seller", 2, []model.Promotion{{ID: "p1", SellerID: "other", Type: model.PROMO_PERCENT, Value: 50}}, 130, ""},
+		{"outside happy hour", 2, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_PERCENT, Value: 50, FromHour: 16, ToHour: 18}}, 130, ""},
+		{"inside happy hour", 2, []model.Promotion{{ID: "p1", SellerID: "seller", Type: model.PROMO_PERCENT, Value: 50, FromHour: 11, ToHour: 13}}, 65, "p1"},
+		{
+			name:   "best promotion wins",
+			amount: 3,
+			promos: []model.Promotion{
+				{ID: "p1", SellerID: "seller", Type: model.PROMO_PERCENT, Value: 20},
+				{ID: "p2", SellerID: "seller", ProductID: "prod", Type: model.PROMO_BUY_N_GET_1, Value: 2},
+				{ID: "p3", SellerID: "seller", Type: model.PROMO_FIXED, Value: 5},
+			},
+			total:     130,
+			promotion: "p2",
+		},
+	}
+
+	for _, s := range scenarios {
+		p := defaultCurrency.priceFor(prod, s.amount, s.promos, noon)
+
+		if p.Base != prod.Cost*int64(s.amount) {
+			t.Errorf("%s: wrong base price. expected: %d, got: %d", s.name, prod.Cost*int64(s.amount), p.Base)
+		}
+
+		if p.Total != s.total {
+			t.Errorf("%s: wrong total. expected: %d, got: %d", s.name, s.total, p.Total)
+		}
+
+		var applied string
+		if p.Promotion != nil {
+			applied = p.Promotion.ID
+		}
+		if applied != s.promotion {
+			t.Errorf("%s: wrong promotion. expected: %q, got: %q", s.name, s.promotion, applied)
+		}
+	}
+}
+
+func TestPriceForRoundsToSmallestCoin(t *testing.T) {
+
+	c, err := NewCurrency("CHF", []int64{10, 20, 50}, nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prod := &model.Product{ID: "prod", SellerID: "seller", Cost: 95}
+	promos := []model.Promotion{{SellerID: "seller", Type: model.PROMO_PERCENT, Value: 10}}
+
+	// 95 - 10% = 85.5, paid as 80
+	if p := c.priceFor(prod, 1, promos, time.Now()); p.Total != 80 {
+		t.Errorf("wrong total. expected: %d, got: %d", 80, p.Total)
+	}
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TrustedProxies are the load balancers and reverse proxies in front of the API.
+// Only they can tell the address of the client, in the X-Forwarded-For or X-Real-IP headers.
+// Anybody else could put any address there, and get around the login lockout and the rate limits.
+type TrustedProxies []*net.IPNet
+
+// trustedProxiesFromEnv reads TRUSTED_PROXIES, a list of IPs or CIDR ranges, e.g. `10.0.0.0/8, 192.168.1.10`
+func trustedProxiesFromEnv() (TrustedProxies, error) {
+
+	var proxies TrustedProxies
+
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: not an IP: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		proxies = append(proxies, n)
+	}
+
+	return proxies, nil
+}
+
+func (p TrustedProxies) trusts(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer is the address of the direct peer of the request, and if it is a trusted proxy
+func (p TrustedProxies) peer(r *http.Request) (string, bool) {
+
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	ip := net.ParseIP(remote)
+	return remote, ip != nil && p.trusts(ip)
+}
+
+// isHTTPS tells if the client made the request over HTTPS, to this server or to a trusted proxy in front of it.
+// X-Forwarded-Proto is only read when the request comes from a trusted proxy, like the client's address
+func (p TrustedProxies) isHTTPS(r *http.Request) bool {
+
+	if r.TLS != nil {
+		return true
+	}
+
+	_, fromProxy := p.peer(r)
+	return fromProxy && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// clientAddr is the address of the client who sent the request. Forwarding headers are only read
+// when the request comes from a trusted proxy. X-Forwarded-For is read from the right, skipping the
+// trusted proxies, because the addresses on the left are set by the client.
+func (p TrustedProxies) clientAddr(r *http.Request) string {
+
+	remote, fromProxy := p.peer(r)
+	if !fromProxy {
+		return remote
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// garbage from the client, the last good hop is the best we know
+				return remote
+			}
+			remote = hop.String()
+			if !p.trusts(hop) {
+				return remote
+			}
+		}
+		return remote
+	}
+
+	if xrip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xrip != nil {
+		return xrip.String()
+	}
+
+	return remote
+}
+
+// RealIP sets the RemoteAddr of the request to the address of the client, see TrustedProxies
+func (a *App) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = a.TrustedProxies.clientAddr(r)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestTrustedProxiesFromEnv(t *testing.T) {
+
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	os.Setenv("TRUSTED_PROXIES", "")
+	if p, err := trustedProxiesFromEnv(); err != nil || len(p) != 0 {
+		t.Errorf("no proxies should be trusted by default, got: %v (%v)", p, err)
+	}
+
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.10, ::1")
+	p, err := trustedProxiesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 3 {
+		t.Fatalf("wrong proxies. expected 3, got: %v", p)
+	}
+
+	for _, s := range []string{"proxy.example.com", "10.0.0.0/33", "192.168.1"} {
+		os.Setenv("TRUSTED_PROXIES", s)
+		if _, err := trustedProxiesFromEnv(); err == nil {
+			t.Errorf("%q should not be valid", s)
+		}
+	}
+}
+
+func TestTrustedProxiesClientAddr(t *testing.T) {
+
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.10")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type scenario struct {
+		name     string
+		remote   string
+		xff      []string
+		realIP   string
+		expected string
+	}
+
+	scenarios := []scenario{
+		{"direct", "203.0.113.5:1234", nil, "", "203.0.113.5"},
+		{"spoofed by a client", "203.0.113.5:1234", []string{"1.2.3.4"}, "1.2.3.4", "203.0.113.5"},
+		{"through a proxy", "10.0.0.2:1234", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"spoofed through a proxy", "10.0.0.2:1234", []string{"1.2.3.4, 203.0.113.5"}, "", "203.0.113.5"},
+		{"through two proxies", "10.0.0.2:1234", []string{"1.2.3.4, 203.0.113.5", "192.168.1.10"}, "", "203.0.113.5"},
+		{"only proxies", "10.0.0.2:1234", []string{"10.0.0.3"}, "", "10.0.0.3"},
+		{"garbage", "10.0.0.2:1234", []string{"nonsense"}, "", "10.0.0.2"},
+		{"real ip header", "192.168.1.10:1234", nil, "203.0.113.5", "203.0.113.5"},
+	}
+
+	for _, s := range scenarios {
+		r, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		r.RemoteAddr = s.remote
+		for _, v := range s.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if s.realIP != "" {
+			r.Header.Set("X-Real-IP", s.realIP)
+		}
+
+		if got := proxies.clientAddr(r); got != s.expected {
+			t.Errorf("%s: wrong client. expected: %s, got: %s", s.name, s.expected, got)
+		}
+	}
+}
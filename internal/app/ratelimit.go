@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// rate limit policies, see defaultRatePolicies
+const (
+	rate_default  = "default"
+	rate_login    = "login"
+	rate_register = "register"
+	rate_deposit  = "deposit"
+	rate_buy      = "buy"
+	rate_password = "password"
+)
+
+// buckets that filled up again are dropped once the memory store grows past this size
+const rate_store_prune_size = 10000
+
+// RatePolicy lets `Requests` requests through per `Period`, in bursts of up to `Requests`
+type RatePolicy struct {
+	Requests int
+	Period   time.Duration
+}
+
+var defaultRatePolicies = map[string]RatePolicy{
+	rate_default:  {Requests: 120, Period: time.Minute},
+	rate_login:    {Requests: 10, Period: time.Minute},
+	rate_register: {Requests: 5, Period: time.Hour},
+	rate_deposit:  {Requests: 60, Period: time.Minute},
+	rate_buy:      {Requests: 30, Period: time.Minute},
+	rate_password: {Requests: 5, Period: time.Hour},
+}
+
+// ratePoliciesFromEnv reads `RATE_LIMITS`, a comma separated list of `policy=requests/period` (e.g. `login=10/1m`)
+// or `policy=off`. Policies not in the list keep their default.
+func ratePoliciesFromEnv() (map[string]RatePolicy, error) {
+
+	policies := make(map[string]RatePolicy, len(defaultRatePolicies))
+	for name, p := range defaultRatePolicies {
+		policies[name] = p
+	}
+
+	v := os.Getenv("RATE_LIMITS")
+	if v == "" {
+		return policies, nil
+	}
+
+	for _, s := range strings.Split(v, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok {
+			return defaultRatePolicies, fmt.Errorf("RATE_LIMITS: %q is not policy=requests/period", s)
+		}
+
+		if _, ok := defaultRatePolicies[name]; !ok {
+			return defaultRatePolicies, fmt.Errorf("RATE_LIMITS: unknown policy %q", name)
+		}
+
+		if limit == "off" {
+			delete(policies, name)
+			continue
+		}
+
+		requests, period, ok := strings.Cut(limit, "/")
+		if !ok {
+			return defaultRatePolicies, fmt.Errorf("RATE_LIMITS: %q is not requests/period", limit)
+		}
+
+		n, err := strconv.Atoi(requests)
+		if err != nil || n < 1 {
+			return defaultRatePolicies, fmt.Errorf("RATE_LIMITS: %s requests must be a positive number", name)
+		}
+
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return defaultRatePolicies, fmt.Errorf("RATE_LIMITS: %s period must be a positive duration", name)
+		}
+
+		policies[name] = RatePolicy{Requests: n, Period: d}
+	}
+
+	return policies, nil
+}
+
+// RateDecision is the outcome of taking a request out of a bucket
+type RateDecision struct {
+	Allowed    bool
+	Remaining  int           // requests left in the bucket
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request is allowed, if this one was not
+}
+
+// RateLimitStore keeps the token buckets. The memory store is enough for one server,
+// several servers behind a load balancer need a store they share.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, p RatePolicy) (RateDecision, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket is full again, and can be dropped
+}
+
+// MemoryRateStore keeps the buckets in memory
+type MemoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryRateStore) Take(ctx context.Context, key string, p RatePolicy) (RateDecision, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	capacity := float64(p.Requests)
+	perToken := p.Period / time.Duration(p.Requests)
+
+	if len(s.buckets) > rate_store_prune_size {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	var d RateDecision
+
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+
+	d.Remaining = int(b.tokens)
+	d.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	b.full = now.Add(d.Reset)
+
+	return d, nil
+}
+
+// RateLimit throttles the requests with the named policy. Requests are counted per logged in user
+// (API keys count for their user), or per client IP before the login. Unknown or disabled policies don't throttle.
+func (a *App) RateLimit(policy string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			p, ok := a.RateLimits[policy]
+			if !ok || a.RateStore == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := policy + ":ip:" + clientIP(r)
+			if usr, ok := r.Context().Value(userContextKey).(*model.User); ok {
+				key = policy + ":user:" + usr.ID
+			} else if access, ok := r.Context().Value(apiKeyContextKey).(*apiKeyAccess); ok {
+				key = policy + ":user:" + access.User.ID
+			}
+
+			d, err := a.RateStore.Take(r.Context(), key, p)
+			if err != nil {
+				// the store being down should not take the API down with it
+				fmt.Println("rate limit", policy, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(p.Requests))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+
+			if !d.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds rounds up to whole seconds, for the headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestMemoryRateStore(t *testing.T) {
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryRateStore()
+	s.now = func() time.Time { return now }
+
+	p := RatePolicy{Requests: 3, Period: 3 * time.Second}
+
+	for i := 0; i < 3; i++ {
+		d, _ := s.Take(context.Background(), "k", p)
+		if !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("request %d: expected allowed with %d remaining, got: %+v", i+1, 2-i, d)
+		}
+	}
+
+	d, _ := s.Take(context.Background(), "k", p)
+	if d.Allowed || d.RetryAfter != time.Second || d.Reset != 3*time.Second {
+		t.Errorf("wrong decision on empty bucket. expected: retry after 1s, reset in 3s, got: %+v", d)
+	}
+
+	// other keys have their own bucket
+	if d, _ := s.Take(context.Background(), "other", p); !d.Allowed {
+		t.Error("other key should be allowed")
+	}
+
+	now = now.Add(time.Second)
+	if d, _ := s.Take(context.Background(), "k", p); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("one token should be back after 1s, got: %+v", d)
+	}
+}
+
+func TestRatePoliciesFromEnv(t *testing.T) {
+
+	type scenario struct {
+		name  string
+		value string
+		check func(map[string]RatePolicy) bool
+		fail  bool
+	}
+
+	scenarios := []scenario{
+		{"defaults", "", func(p map[string]RatePolicy) bool { return p[rate_login] == defaultRatePolicies[rate_login] }, false},
+		{"override", "login=3/1m, buy=off", func(p map[string]RatePolicy) bool {
+			_, buy := p[rate_buy]
+			return p[rate_login] == RatePolicy{Requests: 3, Period: time.Minute} && !buy && p[rate_deposit] == defaultRatePolicies[rate_deposit]
+		}, false},
+		{"unknown policy", "upload=1/1m", nil, true},
+		{"no period", "login=3", nil, true},
+		{"zero requests", "login=0/1m", nil, true},
+		{"bad period", "login=3/minute", nil, true},
+	}
+
+	for _, s := range scenarios {
+		os.Setenv("RATE_LIMITS", s.value)
+
+		policies, err := ratePoliciesFromEnv()
+		if (err != nil) != s.fail {
+			t.Errorf("%s: wrong error. expected fail: %v, got: %v", s.name, s.fail, err)
+			continue
+		}
+
+		if s.check != nil && !s.check(policies) {
+			t.Errorf("%s: wrong policies, got: %v", s.name, policies)
+		}
+	}
+
+	os.Unsetenv("RATE_LIMITS")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+
+	a := NewApp("", nil)
+	a.RateLimits = map[string]RatePolicy{"test": {Requests: 2, Period: time.Minute}}
+
+	h := a.RateLimit("test")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(ip string, usr *model.User) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		if usr != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, usr))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	send("10.0.0.1", nil)
+	w := send("10.0.0.1", nil)
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("second request should pass with 0 remaining, got: %d %v", w.Code, w.Header())
+	}
+
+	w = send("10.0.0.1", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("third request should be throttled for 30s, got: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// a logged in user is counted apart from the IP
+	if w := send("10.0.0.1", &model.User{ID: "id1"}); w.Code != http.StatusOK {
+		t.Errorf("user should have own bucket, got: %d", w.Code)
+	}
+
+	// unknown policies don't throttle
+	h = a.RateLimit("missing")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if w := send("10.0.0.1", nil); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("missing policy should not throttle, got: %d %v", w.Code, w.Header())
+	}
+}
+
+type brokenRateStore struct{}
+
+func (brokenRateStore) Take(ctx context.Context, key string, p RatePolicy) (RateDecision, error) {
+	return RateDecision{}, errors.New("store down")
+}
+
+func TestRateLimitStoreDown(t *testing.T) {
+
+	a := NewApp("", nil)
+	a.RateLimits = map[string]RatePolicy{"test": {Requests: 1, Period: time.Minute}}
+	a.RateStore = brokenRateStore{}
+
+	h := a.RateLimit("test")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("request %d: should pass when the store is down, got: %d", i+1, w.Code)
+		}
+	}
+}
+
+func TestRegisterRateLimited(t *testing.T) {
+
+	a := NewApp("", nil)
+
+	var code int
+	for i := 0; i <= a.RateLimits[rate_register].Requests; i++ {
+		r, _ := http.NewRequest(http.MethodPost, "/user", strings.NewReader(`{}`))
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, r)
+		code = w.Code
+	}
+
+	if code != http.StatusTooManyRequests {
+		t.Errorf("wrong status code after %d registrations. expected: %d, got: %d", a.RateLimits[rate_register].Requests+1, http.StatusTooManyRequests, code)
+	}
+}
+
+func TestRateLimitSpoofedForwardedFor(t *testing.T) {
+
+	a := NewApp("", nil)
+	limit := a.RateLimits[rate_password].Requests
+
+	reset := func(remote, forwardedFor string) int {
+		r, _ := http.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{}`))
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// a new address in the header every time doesn't give a new bucket
+	var code int
+	for i := 0; i <= limit; i++ {
+		code = reset("203.0.113.5:1234", "198.51.100."+strconv.Itoa(i))
+	}
+
+	if code != http.StatusTooManyRequests {
+		t.Errorf("wrong status code after %d resets. expected: %d, got: %d", limit+1, http.StatusTooManyRequests, code)
+	}
+
+	// behind a trusted proxy every client has its own bucket
+	a.TrustedProxies = TrustedProxies{{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)}}
+	for i := 0; i <= limit; i++ {
+		if code = reset("10.0.0.1:1234", "198.51.100."+strconv.Itoa(i)); code == http.StatusTooManyRequests {
+			t.Fatalf("client %d behind the proxy should not be throttled", i)
+		}
+	}
+}
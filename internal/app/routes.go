@@ -2,9 +2,11 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -25,7 +27,10 @@ var (
 	productContextKey     = &contextKey{"product"} // holds a reference to the current product (based on the productID in path)
 	coinValueContextKey   = &contextKey{"coinValue"}
 	amountValueContextKey = &contextKey{"amountProduct"}
-	sellerContextKey      = &contextKey{"seller"}
+	userCachedContextKey  = &contextKey{"userCached"}  // set if the current user was taken from the cache
+	mfaStepContextKey     = &contextKey{"mfaStep"}     // the login step of a pending token
+	apiKeyContextKey      = &contextKey{"apiKey"}      // holds the API key of the request, if it was made with one
+	auditSourceContextKey = &contextKey{"auditSource"} // who acts, for the audit log, see auditSource
 )
 
 func (a *App) SetupRoutes() {
@@ -35,49 +40,148 @@ func (a *App) SetupRoutes() {
 	}
 
 	a.Router.Use(middleware.RequestID)
-	a.Router.Use(middleware.RealIP)
+	// before RealIP, it checks that X-Forwarded-Proto comes from a trusted proxy
+	a.Router.Use(a.SecurityHeaders)
+	a.Router.Use(a.RealIP)
 	a.Router.Use(middleware.Logger)
-	a.Router.Use(middleware.Timeout(60 * time.Second))
+	a.Router.Use(a.CrossOrigin)
 
-	//protected routes
+	// cancels the requests that take too long. Not for the streams, they stay open
+	timeout := middleware.Timeout(60 * time.Second)
+
+	// streams, with a login token or an API key
 	a.Router.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(a.JwtAuth))
-		r.Use(jwtauth.Authenticator)
-		r.Use(a.UserCtx)
-		r.Get("/user", a.handleShowCurrentUser())
+		r.Use(a.Authenticate)
+		r.Use(a.RateLimit(rate_default))
+		r.With(a.Scope(scope_read)).Get("/events", a.handleEvents())
+		r.With(a.Scope(scope_deposit, scope_buy), a.Require(perm_deposit_create, perm_purchase_create)).Get("/ws", a.handleKiosk())
+	})
+
+	//protected routes, with a login token or an API key
+	a.Router.Group(func(r chi.Router) {
+		r.Use(timeout)
+		r.Use(a.Authenticate)
+		r.Use(a.RateLimit(rate_default))
+		r.With(a.Scope(scope_read)).Get("/user", a.handleShowCurrentUser())
+		r.Post("/user/mfa", a.handleEnrollMFA())
+		r.Post("/user/mfa/confirm", a.handleConfirmMFA())
+		r.Delete("/user/mfa", a.handleDisableMFA())
+		r.Get("/user/apikeys", a.handleListAPIKeys())
+		r.Post("/user/apikeys", a.handleCreateAPIKey())
+		r.Delete("/user/apikeys/{keyID:[a-zA-Z0-9-]+}", a.handleRevokeAPIKey())
 		r.Route("/product", func(r chi.Router) {
-			r.Use(a.SellerCtx)
-			r.Post("/", a.handleCreateProduct())
+			r.Use(a.Scope(scope_products_write))
+			r.With(a.Require(perm_product_create)).Post("/", a.handleCreateProduct())
 			r.Route("/{productID:[a-zA-Z0-9-]+}", func(r chi.Router) {
 				r.Use(a.ProductCtx)
-				r.Put("/", a.handleUpdateProduct())
-				r.Delete("/", a.handleDeleteProduct())
+				r.With(a.Require(perm_product_update)).Put("/", a.handleUpdateProduct())
+				r.With(a.Require(perm_product_delete)).Delete("/", a.handleDeleteProduct())
+				r.With(a.Require(perm_product_update)).Post("/prices", a.handleSchedulePrice())
+				r.With(a.Require(perm_product_update)).Put("/threshold", a.handleSetLowStockThreshold())
 			})
 		})
+		r.Route("/seller", func(r chi.Router) {
+			r.Use(a.Scope(scope_seller))
+			r.Use(a.Require(perm_sales_read))
+			r.Get("/reports", a.handleSellerReport())
+			r.Get("/balance", a.handleSellerBalance())
+			r.Get("/payouts", a.handleSellerPayouts())
+			r.With(a.Require(perm_payout_create)).Post("/payouts", a.handleRequestPayout())
+			r.Get("/alerts", a.handleSellerAlerts())
+			r.With(a.Require(perm_alert_ack)).Post("/alerts/{alertID:[a-zA-Z0-9-]+}/ack", a.handleAcknowledgeAlert())
+		})
+		r.Route("/promotions", func(r chi.Router) {
+			r.Use(a.Scope(scope_products_write))
+			r.Use(a.Require(perm_promotion_manage))
+			r.Get("/", a.handleListPromotions())
+			r.Post("/", a.handleCreatePromotion())
+			r.Delete("/{promotionID:[a-zA-Z0-9-]+}", a.handleDeletePromotion())
+		})
 		r.Group(func(r chi.Router) {
-			r.Use(a.BuyerCtx)
-			r.Post("/reset", a.handleReset())
-			r.Post("/deposit/{coinValue:(5|10|20|50|100)}", a.handleDeposit())
+			r.Use(a.Scope(scope_deposit))
+			r.With(a.Require(perm_deposit_reset)).Post("/reset", a.handleReset())
 			r.Group(func(r chi.Router) {
-				r.Use(a.ProductCtx)
-				r.Get("/buy/product/{productID:[a-zA-Z0-9-]+}/amount/{amount:[1-9]{1}[0-9]?}", a.handleBuy())
+				r.Use(a.Require(perm_deposit_create))
+				r.Use(a.RateLimit(rate_deposit))
+				r.Post("/deposit", a.handleDepositBatch())
+				r.With(a.CoinCtx).Post("/deposit/{coinValue:"+a.Currency.coinRoutePattern()+"}", a.handleDeposit())
+				if len(a.Currency.Notes) > 0 {
+					r.Post("/deposit/note/{noteValue:"+a.Currency.noteRoutePattern()+"}", a.handleInsertNote())
+				}
+			})
+			r.With(a.Require(perm_deposit_create)).Get("/escrow", a.handleShowEscrow())
+			r.With(a.Require(perm_deposit_reset)).Post("/escrow/cancel", a.handleCancelEscrow())
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(a.Scope(scope_buy))
+			r.Use(a.Require(perm_purchase_create))
+			r.Use(a.RateLimit(rate_buy))
+			r.Use(a.ProductCtx)
+			r.Get("/buy/product/{productID:[a-zA-Z0-9-]+}/amount/{amount:[1-9]{1}[0-9]?}", a.handleBuy())
+		})
+		r.Route("/admin", func(r chi.Router) {
+			r.With(a.Require(perm_coins_manage)).Get("/coins", a.handleCoinInventory())
+			r.With(a.Require(perm_coins_manage)).Post("/coins", a.handleRefillCoins())
+			r.With(a.Require(perm_payout_manage)).Get("/payouts", a.handleListPayouts())
+			r.With(a.Require(perm_payout_manage)).Post("/payouts/{payoutID:[a-zA-Z0-9-]+}/{action:(approve|reject|paid)}", a.handlePayoutAction())
+			r.With(a.Require(perm_vend_read)).Get("/vend-failures", a.handleVendFailures())
+			r.With(a.Require(perm_audit_read)).Get("/audit", a.handleAuditLog())
+			r.Route("/users/{userID:[a-zA-Z0-9-]+}", func(r chi.Router) {
+				r.Use(a.Require(perm_user_manage))
+				r.Get("/", a.handleUserDetails())
+				r.Post("/unlock", a.handleUnlockUser())
+				r.Put("/roles", a.handleSetUserRoles())
+			})
+			r.With(a.Require(perm_user_manage)).Get("/mfa", a.handleMFAPolicies())
+			r.With(a.Require(perm_user_manage)).Put("/mfa/{role:(ADMIN|SELLER|BUYER)}", a.handleSetMFAPolicy())
+			r.With(a.Require(perm_purchase_refund)).Get("/purchases/{purchaseID:[a-zA-Z0-9-]+}/refunds", a.handlePurchaseRefunds())
+			r.With(a.Require(perm_purchase_refund)).Post("/purchases/{purchaseID:[a-zA-Z0-9-]+}/refunds", a.handleRefundPurchase())
+			r.Route("/webhooks", func(r chi.Router) {
+				r.Use(a.Require(perm_webhook_manage))
+				r.Get("/", a.handleListWebhooks())
+				r.Post("/", a.handleCreateWebhook())
+				r.Route("/{webhookID:[a-zA-Z0-9-]+}", func(r chi.Router) {
+					r.Delete("/", a.handleDeleteWebhook())
+					r.Get("/deliveries", a.handleWebhookDeliveries())
+					r.Post("/ping", a.handlePingWebhook())
+				})
 			})
 		})
 	})
 
+	// second login step, with the token given after the password
+	a.Router.Route("/login/mfa", func(r chi.Router) {
+		r.Use(timeout)
+		r.Use(jwtauth.Verifier(a.JwtAuth))
+		r.Use(jwtauth.Authenticator)
+		r.Use(a.MFAPendingCtx)
+		r.Use(a.RateLimit(rate_login))
+		r.Post("/", a.handleMFALogin())
+		r.Post("/enroll", a.handleMFALoginEnroll())
+		r.Post("/confirm", a.handleMFALoginConfirm())
+	})
+
 	// public routes
 	a.Router.Group(func(r chi.Router) {
+		r.Use(timeout)
+		r.Use(a.RateLimit(rate_default))
 		r.Get("/health", a.handleHealth)
-		r.Post("/login", a.handleLogin())
-		r.Post("/user", a.handleAddUser())
+		r.Get("/currency", a.handleCurrency)
+		r.With(a.RateLimit(rate_login)).Post("/login", a.handleLogin())
+		r.With(a.RateLimit(rate_login)).Get("/login/oidc", a.handleOIDCLogin())
+		r.With(a.RateLimit(rate_login)).Get("/login/oidc/callback", a.handleOIDCCallback())
+		r.With(a.RateLimit(rate_register)).Post("/user", a.handleAddUser())
+		r.With(a.RateLimit(rate_password)).Post("/password/forgot", a.handleForgotPassword())
+		r.With(a.RateLimit(rate_password)).Post("/password/reset", a.handleResetPassword())
 		r.Get("/products/list", a.handleListProducts())
 		r.Route("/products/{productID:[a-zA-Z0-9-]+}", func(r chi.Router) {
 			r.Use(a.ProductCtx)
 			r.Get("/", a.handleProductDetails())
+			r.Get("/prices", a.handlePriceHistory())
 		})
 	})
 
-	a.Router.Mount("/swagger", swg.WrapHandler)
+	a.Router.With(timeout).Mount("/swagger", swg.WrapHandler)
 }
 
 // @Summary 	Health endpoing
@@ -96,6 +200,84 @@ func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// @Summary 	Currency
+// @Description Show the currency, accepted coins and price step configured for this machine
+// @Tags		public
+// @Produces	application/json
+// @Success		200 {object} Currency
+// @Router 		/currency [get]
+func (a *App) handleCurrency(w http.ResponseWriter, r *http.Request) {
+	returnAsJSON(r.Context(), w, a.Currency)
+}
+
+// Authenticate checks the API key of the request, if it has one, or else its login token.
+// Requests with a login token get their user in the context. Requests with an API key only get it from Scope,
+// so they are refused on the routes that don't take API keys.
+func (a *App) Authenticate(next http.Handler) http.Handler {
+
+	withToken := jwtauth.Verifier(a.JwtAuth)(jwtauth.Authenticator(a.UserCtx(next)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		secret := apiKeyFromRequest(r)
+		if secret == "" {
+			withToken.ServeHTTP(w, r)
+			return
+		}
+
+		access, err := a.AuthenticateAPIKey(r.Context(), secret)
+		if err != nil {
+			if !errors.Is(err, errAPIKeyNotFound) {
+				fmt.Println("api key", err)
+			}
+			http.Error(w, "authentication error (api key)", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, access)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiKeyFromRequest reads the key from `Authorization: ApiKey <key>` or the `X-API-Key` header
+func apiKeyFromRequest(r *http.Request) string {
+
+	if scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "ApiKey") {
+		return strings.TrimSpace(key)
+	}
+
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// Scope lets the requests made with an API key through if the key has all the scopes, as the key's user.
+// Requests with a login token are not limited.
+func (a *App) Scope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			if _, ok := r.Context().Value(userContextKey).(*model.User); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			access, ok := r.Context().Value(apiKeyContextKey).(*apiKeyAccess)
+			if !ok {
+				http.Error(w, "authentication error", http.StatusUnauthorized)
+				return
+			}
+
+			if !access.hasScopes(scopes...) {
+				http.Error(w, "api key needs the scopes: "+strings.Join(scopes, ", "), http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userContextKey, access.User)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// UserCtx puts the user of the login token in the context. The user can come from the cache, see liveUser
 func (a *App) UserCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, claims, err := jwtauth.FromContext(r.Context())
@@ -104,48 +286,90 @@ func (a *App) UserCtx(next http.Handler) http.Handler {
 			return
 		}
 
+		if _, pending := claims[jwtMFAKey]; pending {
+			http.Error(w, "authentication error (one-time code missing)", http.StatusUnauthorized)
+			return
+		}
+
+		if _, reset := claims[jwtResetKey]; reset {
+			http.Error(w, "authentication error (password reset token)", http.StatusUnauthorized)
+			return
+		}
+
 		userID, ok := claims[jwtUserIdKey].(string)
 		if !ok {
 			http.Error(w, "authentication error (no user id)", http.StatusUnauthorized)
 			return
 		}
 
-		usr, err := a.dbFindUserByID(r.Context(), userID)
+		usr, cached, err := a.Users.Get(r.Context(), userID, a.dbFindUserByID)
 		if err != nil {
 			http.Error(w, "authentication error", http.StatusUnauthorized)
 			return
 		}
 
+		// tokens given before the password or the roles changed are revoked.
+		// The change could have been made by another server, after the user was cached
+		version, _ := claims[jwtSessionKey].(string)
+		if !validSessionVersion(usr, version) && cached {
+			a.Users.Invalidate(userID)
+			usr, cached, err = a.Users.Get(r.Context(), userID, a.dbFindUserByID)
+			if err != nil {
+				http.Error(w, "authentication error", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if !validSessionVersion(usr, version) {
+			http.Error(w, "authentication error (session revoked)", http.StatusUnauthorized)
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), userContextKey, usr)
+		if cached {
+			ctx = context.WithValue(ctx, userCachedContextKey, true)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// SellerCtx only allows seller accounts to access successive endpoints
-// Requires a "user" object in current request context
-func (a *App) SellerCtx(next http.Handler) http.Handler {
+// MFAPendingCtx only allows the tokens given after the password, when a one-time code is needed.
+// Puts the user and the step it is at in the context.
+func (a *App) MFAPendingCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		usr, ok := r.Context().Value(userContextKey).(*model.User)
-		if !ok || !usr.IsSeller() {
-			http.Error(w, "authentication error", http.StatusUnauthorized)
+		_, claims, err := jwtauth.FromContext(r.Context())
+		if err != nil {
+			http.Error(w, "authentication error (no claims)", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
-	})
-}
+		step, ok := claims[jwtMFAKey].(string)
+		if !ok {
+			http.Error(w, "authentication error (no login pending)", http.StatusUnauthorized)
+			return
+		}
 
-// BuyerCtx only allows buyer accounts to access successive endpoints
-// Requires a "user" object in current request context
-// If there is a coinValue on the request path, it will set it as a context vlaue. No validation is performed at this stage
-func (a *App) BuyerCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		usr, ok := r.Context().Value(userContextKey).(*model.User)
-		if !ok || !usr.IsBuyer() {
+		userID, ok := claims[jwtUserIdKey].(string)
+		if !ok {
+			http.Error(w, "authentication error (no user id)", http.StatusUnauthorized)
+			return
+		}
+
+		usr, err := a.dbFindUserByID(r.Context(), userID)
+		if err != nil {
 			http.Error(w, "authentication error", http.StatusUnauthorized)
 			return
 		}
 
+		ctx := context.WithValue(r.Context(), userContextKey, usr)
+		ctx = context.WithValue(ctx, mfaStepContextKey, step)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CoinCtx sets the coinValue on the request path as a context value. No validation is performed at this stage
+func (a *App) CoinCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		coinValue, err := strconv.Atoi(chi.URLParam(r, "coinValue"))
 		if err != nil {
 			fmt.Println("coin value must be a number")
@@ -154,7 +378,6 @@ func (a *App) BuyerCtx(next http.Handler) http.Handler {
 			ctx := context.WithValue(r.Context(), coinValueContextKey, &coinValue)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
-
 	})
 }
 
@@ -171,13 +394,6 @@ func (a *App) ProductCtx(next http.Handler) http.Handler {
 		}
 		ctx := context.WithValue(r.Context(), productContextKey, product)
 
-		usr, err := a.FindUserByID(r.Context(), product.SellerID)
-		if err != nil {
-			http.Error(w, "seller not found", http.StatusNotFound)
-			return
-		}
-		ctx = context.WithValue(ctx, sellerContextKey, usr)
-
 		amount, err := strconv.Atoi(chi.URLParam(r, "amount"))
 		if err != nil {
 			fmt.Println("amount must be a number")
@@ -113,12 +113,56 @@ func TestProtectedRoutes(t *testing.T) {
 			path:               "/user",
 			expectedStatusCode: http.StatusUnauthorized,
 		},
+		{method: http.MethodGet, path: "/events", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodPost, path: "/product", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodPut, path: "/product/abc-123-def", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodDelete, path: "/product/abc-123-def", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/product/abc-123-def/prices", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodPost, path: "/reset", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/ws", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodPost, path: "/deposit/10", expectedStatusCode: http.StatusUnauthorized},
 		{method: http.MethodGet, path: "/buy/product/abc-123-def/amount/2", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/deposit", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/deposit/note/500", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/escrow", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/escrow/cancel", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/coins", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/coins", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/seller/reports", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/seller/balance", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/seller/payouts", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/seller/payouts", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/seller/alerts", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/seller/alerts/abc-123/ack", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/product/abc-123/threshold", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/payouts", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/payouts/abc-123/approve", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/vend-failures", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/audit", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/users/abc-123", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/users/abc-123/unlock", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/admin/users/abc-123/roles", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/mfa", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/admin/mfa/SELLER", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/user/mfa", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/user/mfa/confirm", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodDelete, path: "/user/mfa", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/user/apikeys", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/user/apikeys", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodDelete, path: "/user/apikeys/abc-123-def", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/login/mfa", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/login/mfa/enroll", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/login/mfa/confirm", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/purchases/abc-123/refunds", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/purchases/abc-123/refunds", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/webhooks", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/webhooks", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodDelete, path: "/admin/webhooks/abc-123", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/admin/webhooks/abc-123/deliveries", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/admin/webhooks/abc-123/ping", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/promotions", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/promotions", expectedStatusCode: http.StatusUnauthorized},
+		{method: http.MethodDelete, path: "/promotions/abc-123", expectedStatusCode: http.StatusUnauthorized},
 	}
 
 	router := NewApp("", nil).Router
@@ -182,13 +226,20 @@ func TestLoginSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
 	encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where username=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").
 		WithArgs(testUser).WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(testID, testUser, encPasswd, 100, testRole))
+		AddRow(testID, testUser, encPasswd, 100, testRole, 0))
+	// the bcrypt hash is outdated, it is replaced on login. The sessions stay valid
+	mock.ExpectExec(`update users set password=\? where id=\? and password=\?`).WithArgs(sqlmock.AnyArg(), testID, string(encPasswd)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`select coalesce\(\(select enabled from user_mfa`).WithArgs(testID, testRole).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required"}).AddRow(false, false))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), testID, model.AUDIT_LOGIN, "user", testID, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	vm := NewApp("", db)
 	router := vm.Router
@@ -234,6 +285,10 @@ func TestLoginSuccess(t *testing.T) {
 	if usrID, ok := claims[jwtUserIdKey]; !ok || usrID != testID {
 		t.Errorf("Wrong or missing claim 'userID'. Expected: %s, got: %s", testID, usrID)
 	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestGetCurrentUserData(t *testing.T) {
@@ -259,17 +314,17 @@ func TestGetCurrentUserData(t *testing.T) {
 	testPassword := "mh12&^KJlwekJ*"
 	testRole := model.ROLE_BUYER
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
 	encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where id=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where id=").
 		WithArgs(testUserID).WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(testUserID, testUser, encPasswd, 100, testRole))
+		AddRow(testUserID, testUser, encPasswd, 100, testRole, 0))
 
 	vm := NewApp("", db)
 
-	tknStr, err := vm.getEncTokenString(testUserID, testUser)
+	tknStr, err := vm.getEncTokenString(&model.User{ID: testUserID, Username: testUser, Password: string(encPasswd), Role: testRole})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -337,17 +392,17 @@ func TestSellersCanCreateProducts(t *testing.T) {
 	testPassword := "mh12&^KJlwekJ*"
 	testRole := model.ROLE_SELLER
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
 	encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where id=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where id=").
 		WithArgs(testUserID).WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(testUserID, testUser, encPasswd, 100, testRole))
+		AddRow(testUserID, testUser, encPasswd, 100, testRole, 0))
 
 	vm := NewApp("", db)
 
-	tknStr, err := vm.getEncTokenString(testUserID, testUser)
+	tknStr, err := vm.getEncTokenString(&model.User{ID: testUserID, Username: testUser, Password: string(encPasswd), Role: testRole})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -368,6 +423,7 @@ func TestNonSellersCannotCreateProducts(t *testing.T) {
 	accounttypes := []model.TypeRole{model.ROLE_ADMIN, model.ROLE_BUYER}
 
 	for _, a := range accounttypes {
+		a := a
 		t.Run(a, func(t *testing.T) {
 			t.Parallel()
 			r, err := http.NewRequest(http.MethodPost, "/product", nil)
@@ -391,17 +447,17 @@ func TestNonSellersCannotCreateProducts(t *testing.T) {
 			testPassword := "mh12&^KJlwekJ*"
 			testRole := a
 
-			columns := []string{"id", "username", "password", "deposit", "role"}
+			columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
 			encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
 
-			mock.ExpectQuery("select id, username, password, deposit, role from users where id=").
+			mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where id=").
 				WithArgs(testUserID).WillReturnRows(sqlmock.NewRows(columns).
-				AddRow(testUserID, testUser, encPasswd, 100, testRole))
+				AddRow(testUserID, testUser, encPasswd, 100, testRole, 0))
 
 			vm := NewApp("", db)
 
-			tknStr, err := vm.getEncTokenString(testUserID, testUser)
+			tknStr, err := vm.getEncTokenString(&model.User{ID: testUserID, Username: testUser, Password: string(encPasswd), Role: testRole})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -605,15 +661,13 @@ func TestRouteProductDetailsSuccess(t *testing.T) {
 		AmountAvailable: 5,
 		Cost:            15,
 		SellerID:        "seller-id-12",
+		PriceID:         "price-id-1",
 	}
 
-	cols := []string{"id", "name", "amount_available", "cost", "seller_id"}
-	colsUser := []string{"id", "username", "password", "deposit", "role"}
+	cols := []string{"id", "name", "amount_available", "cost", "seller_id", "price_id"}
 
 	mock.ExpectQuery(`select .* from products where id=`).WithArgs("product-id-1234").
-		WillReturnRows(sqlmock.NewRows(cols).AddRow(prod.ID, prod.Name, prod.AmountAvailable, prod.Cost, prod.SellerID))
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs(prod.SellerID).WillReturnRows(sqlmock.NewRows(colsUser).
-		AddRow(prod.SellerID, "username", "asdjfdalfj", 100, "SELLER"))
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(prod.ID, prod.Name, prod.AmountAvailable, prod.Cost, prod.SellerID, prod.PriceID))
 
 	r, err := http.NewRequest(http.MethodGet, "/products/product-id-1234", nil)
 	if err != nil {
@@ -662,7 +716,7 @@ func TestRouteProductDetailsSuccess(t *testing.T) {
 	}
 }
 
-func TestBuyerCtxFailNoUser(t *testing.T) {
+func TestRequireFailNoUser(t *testing.T) {
 	r, err := http.NewRequest(http.MethodGet, "/buy", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -671,7 +725,7 @@ func TestBuyerCtxFailNoUser(t *testing.T) {
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
-	NewApp("", nil).BuyerCtx(next).ServeHTTP(w, r)
+	NewApp("", nil).Require(perm_purchase_create)(next).ServeHTTP(w, r)
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusUnauthorized {
@@ -689,7 +743,7 @@ func TestBuyerCtxFailNoUser(t *testing.T) {
 	}
 }
 
-func TestBuyerCtxSuccessNoCoin(t *testing.T) {
+func TestCoinCtxNoCoin(t *testing.T) {
 	r, err := http.NewRequest(http.MethodGet, "/buy", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -703,8 +757,7 @@ func TestBuyerCtxSuccessNoCoin(t *testing.T) {
 		}
 	})
 
-	ctx := context.WithValue(r.Context(), userContextKey, &model.User{Role: model.ROLE_BUYER})
-	NewApp("", nil).BuyerCtx(next).ServeHTTP(w, r.WithContext(ctx))
+	NewApp("", nil).CoinCtx(next).ServeHTTP(w, r)
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusOK {
@@ -712,7 +765,7 @@ func TestBuyerCtxSuccessNoCoin(t *testing.T) {
 	}
 }
 
-func TestBuyerCtxSuccessWithCoin(t *testing.T) {
+func TestCoinCtxWithCoin(t *testing.T) {
 	r, err := http.NewRequest(http.MethodGet, "/buy", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -730,14 +783,12 @@ func TestBuyerCtxSuccessWithCoin(t *testing.T) {
 		}
 	})
 
-	ctx := context.WithValue(r.Context(), userContextKey, &model.User{Role: model.ROLE_BUYER})
-
 	// Make Chi believe there is a URL parameter set
 	routerCtx := chi.NewRouteContext()
 	routerCtx.URLParams.Add("coinValue", "5")
-	ctxWithChi := context.WithValue(ctx, chi.RouteCtxKey, routerCtx)
+	ctxWithChi := context.WithValue(r.Context(), chi.RouteCtxKey, routerCtx)
 
-	NewApp("", nil).BuyerCtx(next).ServeHTTP(w, r.WithContext(ctxWithChi))
+	NewApp("", nil).CoinCtx(next).ServeHTTP(w, r.WithContext(ctxWithChi))
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusOK {
@@ -745,20 +796,131 @@ func TestBuyerCtxSuccessWithCoin(t *testing.T) {
 	}
 }
 
-func TestProductCtxFailProductDoesnotExist(t *testing.T) {
-
+// userCtxHandler authenticates with the token like the protected routes, and tells if the user came from the cache
+func userCtxHandler(vm *App, cached *bool) http.Handler {
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		p, ok := r.Context().Value(productContextKey).(*model.Product)
-		if ok || p != nil {
-			t.Error("there should be no product in context")
-		}
+		*cached, _ = r.Context().Value(userCachedContextKey).(bool)
 	})
+	return jwtauth.Verifier(vm.JwtAuth)(jwtauth.Authenticator(vm.UserCtx(next)))
+}
 
-	r, err := http.NewRequest(http.MethodGet, "/product", nil)
+func TestUserCtxCache(t *testing.T) {
+
+	os.Setenv("JWT_SIGNKEY", "some key")
+	os.Setenv("JWT_ALG", "HS256")
+
+	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
-	w := httptest.NewRecorder()
+	defer db.Close()
+
+	vm := NewApp("", db)
+
+	usr := &model.User{ID: "id1", Username: "mihaiusr", Password: "hash"}
+	usr.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER})
+
+	token, err := vm.getEncTokenString(usr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userRow := func(hash, roles string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", hash, 0, roles, 0)
+	}
+
+	serve := func() (int, bool) {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		var cached bool
+		userCtxHandler(vm, &cached).ServeHTTP(w, r)
+		return w.Code, cached
+	}
+
+	// read once, then from the cache
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow("hash", "SELLER,BUYER"))
+
+	if code, cached := serve(); code != http.StatusOK || cached {
+		t.Fatalf("first request should read the user. got: %d, cached: %v", code, cached)
+	}
+	if code, cached := serve(); code != http.StatusOK || !cached {
+		t.Fatalf("second request should use the cache. got: %d, cached: %v", code, cached)
+	}
+
+	// another server changed the password: the cached user is read again before the token is refused
+	vm.Users.Invalidate("id1")
+	vm.Users.Get(context.Background(), "id1", func(context.Context, string) (*model.User, error) {
+		return &model.User{ID: "id1", Username: "mihaiusr", Password: "old hash", Role: model.ROLE_SELLER}, nil
+	})
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow("hash", "SELLER,BUYER"))
+
+	if code, cached := serve(); code != http.StatusOK || cached {
+		t.Fatalf("stale cached user should be read again. got: %d, cached: %v", code, cached)
+	}
+
+	// the roles changed, the token was given for others
+	vm.Users.Invalidate("id1")
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow("hash", "SELLER"))
+
+	if code, _ := serve(); code != http.StatusUnauthorized {
+		t.Errorf("token given for other roles should be revoked. got: %d", code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginTokenClaims(t *testing.T) {
+
+	os.Setenv("JWT_SIGNKEY", "some key")
+	os.Setenv("JWT_ALG", "HS256")
+
+	vm := NewApp("", nil)
+
+	usr := &model.User{ID: "id1", Username: "mihaiusr", Password: "hash"}
+	usr.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER})
+
+	token, err := vm.getEncTokenString(usr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tkn, err := jwtauth.VerifyToken(vm.JwtAuth, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := tkn.PrivateClaims()
+
+	if roles, _ := claims[jwtRolesKey].(string); roles != "SELLER,BUYER" {
+		t.Errorf("wrong roles claim. expected: %s, got: %s", "SELLER,BUYER", roles)
+	}
+
+	version, _ := claims[jwtSessionKey].(string)
+	if !validSessionVersion(usr, version) {
+		t.Error("session version should be valid for the user")
+	}
+
+	usr.SetRoles([]model.TypeRole{model.ROLE_SELLER})
+	if validSessionVersion(usr, version) {
+		t.Error("session version should change with the roles")
+	}
+
+	usr.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_BUYER})
+	usr.Password = "rehashed"
+	if !validSessionVersion(usr, version) {
+		t.Error("a new hash of the same password should keep the session")
+	}
+
+	usr.SessionVersion++
+	if validSessionVersion(usr, version) {
+		t.Error("session version should change with the password")
+	}
+}
+
+func TestLiveUser(t *testing.T) {
 
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -766,41 +928,40 @@ func TestProductCtxFailProductDoesnotExist(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnError(errors.New("no rows"))
+	vm := NewApp("", db)
 
-	chiCtx := chi.NewRouteContext()
-	chiCtx.URLParams.Add("productID", "product-id")
+	usr := &model.User{ID: "id1", Role: model.ROLE_BUYER, Deposit: 10}
+	ctx := context.WithValue(context.Background(), userContextKey, usr)
 
-	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx)
+	// read in this request, it is current
+	if live, ok := vm.liveUser(ctx); !ok || live != usr {
+		t.Errorf("the user read by the request should be used. got: %+v", live)
+	}
 
-	NewApp("", db).ProductCtx(next).ServeHTTP(w, r.WithContext(ctx))
+	// from the cache, the deposit is read again
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", "hash", 50, model.ROLE_BUYER, 0))
 
-	resp := w.Result()
+	live, ok := vm.liveUser(context.WithValue(ctx, userCachedContextKey, true))
+	if !ok || live.Deposit != 50 {
+		t.Errorf("the live deposit should be read. got: %+v", live)
+	}
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusNotFound, resp.StatusCode)
+	if _, ok := vm.liveUser(context.Background()); ok {
+		t.Error("no user in the request")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestProductCtxSuccess(t *testing.T) {
+func TestProductCtxFailProductDoesnotExist(t *testing.T) {
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		p, ok := r.Context().Value(productContextKey).(*model.Product)
-		if !ok || p == nil {
-			t.Error("there should be a product in context")
-		} else {
-			if p.ID != "product-id" {
-				t.Errorf("wrong product in context. expected ID: %s, got: %s", "product-id", p.ID)
-			}
-		}
-
-		u, ok := r.Context().Value(sellerContextKey).(*model.User)
-		if !ok || u == nil {
-			t.Error("there should be a seller for the product")
-		} else {
-			if u.ID != "seller-id-1" {
-				t.Errorf("wrong seller. expected ID: %s, got: %s", "seller-id-1", u.ID)
-			}
+		if ok || p != nil {
+			t.Error("there should be no product in context")
 		}
 	})
 
@@ -816,13 +977,7 @@ func TestProductCtxSuccess(t *testing.T) {
 	}
 	defer db.Close()
 
-	colsProd := []string{"id", "name", "available_amount", "cost", "seller_id"}
-	colsUser := []string{"id", "username", "password", "deposit", "role"}
-
-	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnRows(sqlmock.NewRows(colsProd).
-		AddRow("product-id", "name", 10, 5, "seller-id-1"))
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("seller-id-1").WillReturnRows(sqlmock.NewRows(colsUser).
-		AddRow("seller-id-1", "username", "asdjfdalfj", 100, "SELLER"))
+	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnError(errors.New("no rows"))
 
 	chiCtx := chi.NewRouteContext()
 	chiCtx.URLParams.Add("productID", "product-id")
@@ -833,16 +988,12 @@ func TestProductCtxSuccess(t *testing.T) {
 
 	resp := w.Result()
 
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
-	}
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Fatal(err)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusNotFound, resp.StatusCode)
 	}
 }
 
-func TestProductCtxFailNoSeller(t *testing.T) {
+func TestProductCtxSuccess(t *testing.T) {
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		p, ok := r.Context().Value(productContextKey).(*model.Product)
@@ -867,11 +1018,10 @@ func TestProductCtxFailNoSeller(t *testing.T) {
 	}
 	defer db.Close()
 
-	cols := []string{"id", "name", "available_amount", "cost", "seller_id"}
+	colsProd := []string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}
 
-	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnRows(sqlmock.NewRows(cols).
-		AddRow("product-id", "name", 10, 5, "seller-id-1"))
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("seller-id-1").WillReturnError(errors.New("no rows"))
+	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnRows(sqlmock.NewRows(colsProd).
+		AddRow("product-id", "name", 10, 5, "seller-id-1", nil))
 
 	chiCtx := chi.NewRouteContext()
 	chiCtx.URLParams.Add("productID", "product-id")
@@ -882,8 +1032,12 @@ func TestProductCtxFailNoSeller(t *testing.T) {
 
 	resp := w.Result()
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusNotFound, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code. expected: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -917,13 +1071,10 @@ func TestProductCtxSuccessWithBadAmount(t *testing.T) {
 	}
 	defer db.Close()
 
-	cols := []string{"id", "name", "available_amount", "cost", "seller_id"}
-	colsUser := []string{"id", "username", "password", "deposit", "role"}
+	cols := []string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}
 
 	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnRows(sqlmock.NewRows(cols).
-		AddRow("product-id", "name", 10, 5, "seller-id-1"))
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("seller-id-1").WillReturnRows(sqlmock.NewRows(colsUser).
-		AddRow("seller-id-1", "user", "dksajfjadf", 100, "SELLER"))
+		AddRow("product-id", "name", 10, 5, "seller-id-1", nil))
 
 	chiCtx := chi.NewRouteContext()
 	chiCtx.URLParams.Add("productID", "product-id")
@@ -974,13 +1125,10 @@ func TestProductCtxSuccessWithGoodAmount(t *testing.T) {
 	}
 	defer db.Close()
 
-	cols := []string{"id", "name", "available_amount", "cost", "seller_id"}
-	colsUser := []string{"id", "username", "password", "deposit", "role"}
+	cols := []string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}
 
 	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("product-id").WillReturnRows(sqlmock.NewRows(cols).
-		AddRow("product-id", "name", 10, 5, "seller-id-1"))
-	mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("seller-id-1").WillReturnRows(sqlmock.NewRows(colsUser).
-		AddRow("seller-id-1", "user", "dksajfjadf", 100, "SELLER"))
+		AddRow("product-id", "name", 10, 5, "seller-id-1", nil))
 
 	chiCtx := chi.NewRouteContext()
 	chiCtx.URLParams.Add("productID", "product-id")
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	default_hsts_max_age = 365 * 24 * time.Hour
+
+	// the certificate files are checked for changes at most this often, on new connections
+	cert_check_interval = 10 * time.Second
+)
+
+func hstsFromEnv() (time.Duration, error) {
+
+	s := os.Getenv("HSTS_MAX_AGE")
+	if s == "" {
+		return default_hsts_max_age, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return default_hsts_max_age, fmt.Errorf("HSTS_MAX_AGE: %w", err)
+	}
+	if d < 0 {
+		return default_hsts_max_age, errors.New("HSTS_MAX_AGE cannot be negative")
+	}
+
+	return d, nil
+}
+
+// SecurityHeaders adds the headers that keep browsers from sniffing content types, framing the API and sending referrers.
+// Requests made over HTTPS also get Strict-Transport-Security, unless the max age is 0
+func (a *App) SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+
+		if a.HSTSMaxAge > 0 && a.TrustedProxies.isHTTPS(r) {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(a.HSTSMaxAge.Seconds())))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UseTLS makes the server talk HTTPS with the certificate and key files. The files are read again when they change,
+// e.g. after the certificate is renewed. Fails if they can't be loaded now
+func (a *App) UseTLS(certFile, keyFile string) error {
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	a.certs = certs
+
+	return nil
+}
+
+// RedirectServer listens for plain HTTP and sends the clients to the same URL over HTTPS, on the port of the API
+func (a *App) RedirectServer(addr string) http.Server {
+	return http.Server{
+		Addr:              addr,
+		Handler:           http.HandlerFunc(a.redirectToHTTPS),
+		ReadHeaderTimeout: 3 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+func (a *App) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if _, port, err := net.SplitHostPort(a.Addr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	// 308 keeps the method and the body
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// certReloader gives the TLS handshakes the current certificate. It reloads the files when they were changed,
+// and keeps the old certificate while the new files don't load (e.g. only one of them was replaced yet)
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // of the files the certificate was loaded from
+	checked time.Time
+	now     func() time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: cert_check_interval,
+		now:      time.Now,
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.checked = c.now()
+
+	return c, nil
+}
+
+// modified is the last change to any of the files
+func (c *certReloader) modified() (time.Time, error) {
+
+	var latest time.Time
+
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+
+	mod, err := c.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = mod
+
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := c.now(); now.Sub(c.checked) >= c.interval {
+		c.checked = now
+
+		if mod, err := c.modified(); err != nil {
+			fmt.Println("tls certificate check", err)
+		} else if !mod.Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				fmt.Println("tls certificate reload, keeping the old one", err)
+			} else {
+				fmt.Println("tls certificate reloaded")
+			}
+		}
+	}
+
+	return c.cert, nil
+}
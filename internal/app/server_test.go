@@ -0,0 +1,239 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key for the name
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certName(t *testing.T, cert *tls.Certificate) string {
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "old.example.com")
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	cert, _ := c.GetCertificate(nil)
+	if name := certName(t, cert); name != "old.example.com" {
+		t.Fatalf("wrong certificate: %s", name)
+	}
+
+	// renewed, the files are checked on the next connection after the interval
+	writeTestCert(t, certFile, keyFile, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	if cert, _ = c.GetCertificate(nil); certName(t, cert) != "old.example.com" {
+		t.Error("files should not be checked before the interval")
+	}
+
+	now = now.Add(cert_check_interval)
+	if cert, _ = c.GetCertificate(nil); certName(t, cert) != "new.example.com" {
+		t.Errorf("certificate should be reloaded, got: %s", certName(t, cert))
+	}
+
+	// a broken file keeps the certificate that works
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+
+	now = now.Add(cert_check_interval)
+	if cert, _ = c.GetCertificate(nil); certName(t, cert) != "new.example.com" {
+		t.Errorf("old certificate should be kept, got: %s", certName(t, cert))
+	}
+}
+
+func TestUseTLS(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	vm := NewApp("127.0.0.1:8443", nil)
+
+	if err := vm.UseTLS(certFile, keyFile); err == nil {
+		t.Error("missing files should fail")
+	}
+
+	if srvr := vm.HttpServer(); srvr.TLSConfig != nil {
+		t.Error("server should not have TLS")
+	}
+
+	writeTestCert(t, certFile, keyFile, "localhost")
+
+	if err := vm.UseTLS(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	srvr := vm.HttpServer()
+	if srvr.TLSConfig == nil || srvr.TLSConfig.GetCertificate == nil {
+		t.Fatal("server should have TLS")
+	}
+	if srvr.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wrong minimum TLS version: %x", srvr.TLSConfig.MinVersion)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+
+	vm := NewApp("", nil)
+	vm.HSTSMaxAge = time.Hour
+
+	serve := func(r *http.Request) http.Header {
+		w := httptest.NewRecorder()
+		vm.SecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/products", nil)
+	h := serve(r)
+
+	for name, value := range map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer"} {
+		if h.Get(name) != value {
+			t.Errorf("wrong %s. expected: %s, got: %s", name, value, h.Get(name))
+		}
+	}
+
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Error("no HSTS over plain HTTP")
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	if got := serve(r).Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("wrong HSTS over HTTPS: %q", got)
+	}
+
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	vm.TrustedProxies = TrustedProxies{proxy}
+
+	r, _ = http.NewRequest(http.MethodGet, "/products", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.RemoteAddr = "203.0.113.7:4000"
+	if got := serve(r).Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("X-Forwarded-Proto from a client should be ignored, got HSTS: %q", got)
+	}
+
+	r.RemoteAddr = "10.0.0.2:4000"
+	if got := serve(r).Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("wrong HSTS behind a proxy: %q", got)
+	}
+
+	vm.HSTSMaxAge = 0
+	if got := serve(r).Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS should be off, got: %q", got)
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+
+	type scenario struct {
+		addr     string
+		host     string
+		target   string
+		expected string
+	}
+
+	scenarios := []scenario{
+		{":443", "api.example.com", "/products?x=1", "https://api.example.com/products?x=1"},
+		{":8443", "api.example.com:8080", "/buy/product/abc/amount/1", "https://api.example.com:8443/buy/product/abc/amount/1"},
+		{"localhost:7777", "localhost", "/", "https://localhost:7777/"},
+	}
+
+	for _, s := range scenarios {
+		srvr := NewApp(s.addr, nil).RedirectServer(":80")
+
+		r := httptest.NewRequest(http.MethodPost, s.target, nil)
+		r.Host = s.host
+		w := httptest.NewRecorder()
+
+		srvr.Handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("wrong status code. expected: %d, got: %d", http.StatusPermanentRedirect, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != s.expected {
+			t.Errorf("wrong location. expected: %s, got: %s", s.expected, got)
+		}
+	}
+}
+
+func TestHSTSFromEnv(t *testing.T) {
+
+	defer os.Unsetenv("HSTS_MAX_AGE")
+
+	for value, expected := range map[string]time.Duration{"": default_hsts_max_age, "0": 0, "24h": 24 * time.Hour} {
+		os.Setenv("HSTS_MAX_AGE", value)
+		if d, err := hstsFromEnv(); err != nil || d != expected {
+			t.Errorf("wrong max age for %q. expected: %s, got: %s (%v)", value, expected, d, err)
+		}
+	}
+
+	for _, value := range []string{"-1h", "a year"} {
+		os.Setenv("HSTS_MAX_AGE", value)
+		if _, err := hstsFromEnv(); err == nil {
+			t.Errorf("%q should not be valid", value)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// SetLowStockThreshold sets the stock level under which the seller is alerted. 0 turns low-stock alerts off, sold-out alerts are always raised.
+func (a *App) SetLowStockThreshold(ctx context.Context, seller *model.User, prod *model.Product, threshold int64) error {
+
+	if seller == nil || prod == nil {
+		return errors.New("seller and product must exist")
+	}
+
+	if a.Authorize(seller, perm_product_update, prod.SellerID) != nil {
+		return errors.New("seller can only modify own products")
+	}
+
+	if threshold < 0 {
+		return errors.New("threshold cannot be negative")
+	}
+
+	return a.dbSetLowStockThreshold(ctx, prod.ID, threshold)
+}
+
+// SellerAlerts lists the seller's alerts that were not acknowledged yet, or all of them if `all` is true
+func (a *App) SellerAlerts(ctx context.Context, seller *model.User, all bool) ([]model.StockAlert, error) {
+
+	if seller == nil {
+		return nil, errors.New("missing seller")
+	}
+
+	return a.dbSellerAlerts(ctx, seller.ID, all)
+}
+
+func (a *App) AcknowledgeAlert(ctx context.Context, seller *model.User, alertID string) error {
+
+	if seller == nil {
+		return errors.New("missing seller")
+	}
+
+	return a.dbAcknowledgeAlert(ctx, alertID, seller.ID)
+}
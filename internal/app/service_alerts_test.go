@@ -0,0 +1,22 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestSetLowStockThresholdValidation(t *testing.T) {
+
+	vm := NewApp("", nil)
+	seller := &model.User{ID: "seller", Role: model.ROLE_SELLER}
+
+	if err := vm.SetLowStockThreshold(context.Background(), seller, &model.Product{ID: "prod", SellerID: "other"}, 5); err == nil {
+		t.Error("should not change products of other sellers")
+	}
+
+	if err := vm.SetLowStockThreshold(context.Background(), seller, &model.Product{ID: "prod", SellerID: "seller"}, -1); err == nil {
+		t.Error("should not accept a negative threshold")
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// API key scopes, see the routes that require them
+const (
+	scope_read           = "read"           // the user, live events
+	scope_deposit        = "deposit"        // deposits, escrow and reset
+	scope_buy            = "buy"            // buy products
+	scope_products_write = "products:write" // the seller's products, prices and promotions
+	scope_seller         = "seller"         // the seller's reports, earnings, payouts and alerts
+)
+
+var apiKeyScopes = []string{scope_read, scope_deposit, scope_buy, scope_products_write, scope_seller}
+
+const (
+	apikey_prefix       = "vmk_"
+	apikey_prefix_shown = 12 // characters of the key kept to tell it apart
+	apikey_name_max     = 64
+	apikey_max_per_user = 20
+)
+
+// newAPIKey returns a random key like `vmk_<32 characters>`
+func newAPIKey() (string, error) {
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return apikey_prefix + strings.ToLower(totpEncoding.EncodeToString(b)), nil
+}
+
+// apiKeyHash is what is stored of a key. The keys are random, so a plain hash is enough
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateScopes(scopes []string) error {
+
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is needed")
+	}
+
+	for _, s := range scopes {
+		known := false
+		for _, k := range apiKeyScopes {
+			known = known || s == k
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q, accepted: %s", s, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// CreateAPIKey makes a key that acts as the user, limited to the scopes. Returns the key, which is not shown again
+func (a *App) CreateAPIKey(ctx context.Context, usr *model.User, name string, scopes []string) (*model.APIKey, string, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > apikey_name_max {
+		return nil, "", fmt.Errorf("name is needed, at most %d characters", apikey_name_max)
+	}
+
+	if err := validateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := model.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    usr.ID,
+		Name:      name,
+		Prefix:    secret[:apikey_prefix_shown],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	if err := a.dbCreateAPIKey(ctx, key, apiKeyHash(secret)); err != nil {
+		return nil, "", err
+	}
+
+	return &key, secret, nil
+}
+
+func (a *App) ListAPIKeys(ctx context.Context, usr *model.User) ([]model.APIKey, error) {
+	return a.dbAPIKeys(ctx, usr.ID)
+}
+
+func (a *App) RevokeAPIKey(ctx context.Context, usr *model.User, keyID string) error {
+	return a.dbRevokeAPIKey(ctx, usr.ID, keyID)
+}
+
+// apiKeyAccess is a request made with an API key, and the user owning the key
+type apiKeyAccess struct {
+	Key  *model.APIKey
+	User *model.User
+}
+
+// AuthenticateAPIKey finds the active key and its owner, and records the key was used
+func (a *App) AuthenticateAPIKey(ctx context.Context, secret string) (*apiKeyAccess, error) {
+
+	if !strings.HasPrefix(secret, apikey_prefix) {
+		return nil, errAPIKeyNotFound
+	}
+
+	key, err := a.dbActiveAPIKey(ctx, apiKeyHash(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	usr, err := a.dbFindUserByID(ctx, key.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.dbTouchAPIKey(ctx, key.ID); err != nil {
+		fmt.Println("api key last used", key.ID, err)
+	}
+
+	return &apiKeyAccess{Key: key, User: usr}, nil
+}
+
+// hasScopes tells if the key has all the scopes
+func (k *apiKeyAccess) hasScopes(scopes ...string) bool {
+
+	for _, s := range scopes {
+		found := false
+		for _, ks := range k.Key.Scopes {
+			found = found || ks == s
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestValidateScopes(t *testing.T) {
+
+	if err := validateScopes([]string{scope_deposit, scope_buy}); err != nil {
+		t.Error(err)
+	}
+
+	for _, scopes := range [][]string{nil, {"admin"}, {scope_read, "products:delete"}} {
+		if err := validateScopes(scopes); err == nil {
+			t.Errorf("%v should be refused", scopes)
+		}
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var storedHash string
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select count\(\*\) from api_keys`).WithArgs("user1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`insert into api_keys`).
+		WithArgs(sqlmock.AnyArg(), "user1", "machine 1", sqlmock.AnyArg(), hashCapture{&storedHash}, "deposit,buy", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	key, secret, err := NewApp("", db).CreateAPIKey(context.Background(), &model.User{ID: "user1"}, " machine 1 ", []string{scope_deposit, scope_buy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(secret, apikey_prefix) || len(secret) != len(apikey_prefix)+32 {
+		t.Errorf("wrong key format: %s", secret)
+	}
+
+	if key.Prefix != secret[:apikey_prefix_shown] || key.Name != "machine 1" {
+		t.Errorf("wrong key: %+v", key)
+	}
+
+	if storedHash != apiKeyHash(secret) || strings.Contains(storedHash, secret) {
+		t.Errorf("only the hash of the key should be stored, got: %s", storedHash)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hashCapture matches any string argument and keeps it
+type hashCapture struct {
+	v *string
+}
+
+func (c hashCapture) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.v = s
+	return ok
+}
+
+func TestAuthenticateAPIKeyWrongFormat(t *testing.T) {
+
+	// no database lookup for keys that can't be ours
+	if _, err := NewApp("", nil).AuthenticateAPIKey(context.Background(), "Bearer abc"); !errors.Is(err, errAPIKeyNotFound) {
+		t.Errorf("wrong error. expected: %v, got: %v", errAPIKeyNotFound, err)
+	}
+}
+
+func TestAPIKeyHasScopes(t *testing.T) {
+
+	k := &apiKeyAccess{Key: &model.APIKey{Scopes: []string{scope_deposit, scope_buy}}}
+
+	if !k.hasScopes(scope_deposit) || !k.hasScopes(scope_deposit, scope_buy) {
+		t.Error("key should have its scopes")
+	}
+
+	if k.hasScopes(scope_buy, scope_read) {
+		t.Error("key should not have the read scope")
+	}
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	audit_list_default = 100
+	audit_list_max     = 1000
+)
+
+// auditSource is who acted, from which IP and in which request. It travels in the context, so actions can be
+// recorded where they happen, in a handler, a service or the database layer. Without one the system acted, e.g. a background job
+type auditSource struct {
+	ActorID   string
+	IP        string
+	RequestID string
+}
+
+func withAuditSource(ctx context.Context, src auditSource) context.Context {
+	return context.WithValue(ctx, auditSourceContextKey, src)
+}
+
+func auditSourceFrom(ctx context.Context) auditSource {
+	src, _ := ctx.Value(auditSourceContextKey).(auditSource)
+	return src
+}
+
+// newAuditEntry is the entry of an action done by the source in the context.
+// `before` and `after` are saved as JSON if not nil
+func newAuditEntry(ctx context.Context, action model.TypeAuditAction, targetType, targetID string, before, after any) model.AuditEntry {
+
+	src := auditSourceFrom(ctx)
+
+	e := model.AuditEntry{
+		ID:         uuid.New().String(),
+		ActorID:    src.ActorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         src.IP,
+		RequestID:  src.RequestID,
+		CreatedAt:  time.Now(),
+	}
+
+	var err error
+	if before != nil {
+		if e.Before, err = json.Marshal(before); err != nil {
+			fmt.Println("audit", action, err)
+		}
+	}
+	if after != nil {
+		if e.After, err = json.Marshal(after); err != nil {
+			fmt.Println("audit", action, err)
+		}
+	}
+
+	return e
+}
+
+// auditAction records an action done by the source in the context. Failures are only logged, they don't fail the action
+func (a *App) auditAction(ctx context.Context, action model.TypeAuditAction, targetType, targetID string, before, after any) {
+
+	if a.Db == nil {
+		return
+	}
+
+	if err := a.dbAddAudit(ctx, newAuditEntry(ctx, action, targetType, targetID, before, after)); err != nil {
+		fmt.Println("audit", action, err)
+	}
+}
+
+// errBadAuditFilter is returned for filters that can't match anything
+var errBadAuditFilter = errors.New("bad filter")
+
+// AuditLog lists the audit entries matching the filter, newest first.
+// Without `To` it lists up to now, without `Limit` the last 100 entries.
+func (a *App) AuditLog(ctx context.Context, f auditFilter) ([]model.AuditEntry, error) {
+
+	if f.To.IsZero() {
+		f.To = time.Now().Add(time.Second)
+	}
+
+	if f.From.After(f.To) {
+		return nil, fmt.Errorf("%w: from must be before to", errBadAuditFilter)
+	}
+
+	if f.Limit < 0 {
+		return nil, fmt.Errorf("%w: limit cannot be negative", errBadAuditFilter)
+	}
+
+	if f.Limit == 0 {
+		f.Limit = audit_list_default
+	}
+
+	if f.Limit > audit_list_max {
+		f.Limit = audit_list_max
+	}
+
+	return a.dbAuditLog(ctx, f)
+}
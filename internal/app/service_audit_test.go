@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuditLogValidation(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		filter auditFilter
+	}
+
+	now := time.Now()
+
+	scenarios := []scenario{
+		{"from after to", auditFilter{From: now, To: now.Add(-time.Hour)}},
+		{"from in the future", auditFilter{From: now.Add(time.Hour)}},
+		{"negative limit", auditFilter{Limit: -1}},
+	}
+
+	for _, s := range scenarios {
+		if _, err := NewApp("", nil).AuditLog(context.Background(), s.filter); err == nil {
+			t.Errorf("%s: should fail", s.name)
+		}
+	}
+}
+
+func TestAuditLogLimit(t *testing.T) {
+
+	type scenario struct {
+		name     string
+		limit    int
+		expected int
+	}
+
+	scenarios := []scenario{
+		{"default", 0, audit_list_default},
+		{"as asked", 20, 20},
+		{"capped", 5000, audit_list_max},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectQuery(`select .* from audit_log`).
+			WithArgs("", "", "", "", "", "", "", "", sqlmock.AnyArg(), sqlmock.AnyArg(), s.expected).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		if _, err := NewApp("", db).AuditLog(context.Background(), auditFilter{Limit: s.limit}); err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+
+		db.Close()
+	}
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type coinCount struct {
+	Coin   int64 `json:"coin"`
+	Amount int64 `json:"amount"`
+}
+
+// NoteRules decide if a banknote can be taken into escrow
+type NoteRules struct {
+	MaxValue         int64 // notes bigger than this are refused. 0 means no limit, negative refuses all notes
+	ChangeCheckAbove int64 // notes bigger than this are only accepted if the coin box can give their full value back in coins
+}
+
+// noteRulesFromEnv reads NOTE_MAX_VALUE and NOTE_CHANGE_CHECK_ABOVE. Missing values default to 0
+func noteRulesFromEnv() (NoteRules, error) {
+	var rules NoteRules
+
+	if v := os.Getenv("NOTE_MAX_VALUE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return NoteRules{}, fmt.Errorf("NOTE_MAX_VALUE: %w", err)
+		}
+		rules.MaxValue = n
+	}
+
+	if v := os.Getenv("NOTE_CHANGE_CHECK_ABOVE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return NoteRules{}, fmt.Errorf("NOTE_CHANGE_CHECK_ABOVE: %w", err)
+		}
+		rules.ChangeCheckAbove = n
+	}
+
+	return rules, nil
+}
+
+// CoinInventory lists the coins in the coin box
+func (a *App) CoinInventory(ctx context.Context) ([]coinCount, error) {
+	return a.dbCoinInventory(ctx)
+}
+
+// RefillCoins adds coins to the coin box. Only coins of the configured currency are accepted
+func (a *App) RefillCoins(ctx context.Context, coins []coinCount) error {
+
+	if len(coins) == 0 {
+		return errors.New("no coins to add")
+	}
+
+	for _, c := range coins {
+		if err := a.Currency.validateDepositCoin(int(c.Coin)); err != nil {
+			return err
+		}
+
+		if c.Amount <= 0 {
+			return errors.New("amount of coins must be positive")
+		}
+	}
+
+	return a.dbRefillCoins(ctx, coins)
+}
+
+// UserInsertNote holds a banknote in escrow for the buyer. The note is only accepted if it passes the NoteRules.
+// Notes stay in escrow until a buy needs them or the buyer cancels.
+func (a *App) UserInsertNote(ctx context.Context, usr *model.User, note int) error {
+
+	if err := a.Currency.validateNote(note); err != nil {
+		return errors.New("note value not allowed")
+	}
+
+	if a.NoteRules.MaxValue != 0 && int64(note) > a.NoteRules.MaxValue {
+		return errors.New("note value too big")
+	}
+
+	if int64(note) > a.NoteRules.ChangeCheckAbove {
+		inventory, err := a.dbCoinInventory(ctx)
+		if err != nil {
+			fmt.Println("coin inventory", err)
+			return errors.New("note not accepted")
+		}
+
+		if _, err := a.Currency.changeFromInventory(int64(note), inventory); err != nil {
+			return errors.New("note not accepted, no change available")
+		}
+	}
+
+	if err := a.dbInsertEscrowNote(ctx, usr.ID, int64(note)); err != nil {
+		fmt.Println("insert note", err)
+		return errors.New("note not accepted")
+	}
+
+	return nil
+}
+
+// EscrowNotes lists the notes the buyer has in escrow
+func (a *App) EscrowNotes(ctx context.Context, usr *model.User) ([]int64, error) {
+	return a.dbEscrowNotes(ctx, usr.ID)
+}
+
+// CancelEscrow gives back all the notes in escrow and returns them
+func (a *App) CancelEscrow(ctx context.Context, usr *model.User) ([]int64, error) {
+
+	notes, err := a.dbEscrowNotes(ctx, usr.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(notes) == 0 {
+		return notes, nil
+	}
+
+	if err := a.dbReleaseEscrow(ctx, usr.ID); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestNoteRulesFromEnv(t *testing.T) {
+
+	os.Setenv("NOTE_MAX_VALUE", "2000")
+	os.Setenv("NOTE_CHANGE_CHECK_ABOVE", "500")
+	defer func() {
+		os.Unsetenv("NOTE_MAX_VALUE")
+		os.Unsetenv("NOTE_CHANGE_CHECK_ABOVE")
+	}()
+
+	rules, err := noteRulesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules.MaxValue != 2000 || rules.ChangeCheckAbove != 500 {
+		t.Errorf("wrong rules: %v", rules)
+	}
+
+	os.Setenv("NOTE_MAX_VALUE", "lots")
+	if _, err := noteRulesFromEnv(); err == nil {
+		t.Error("should fail for non numeric values")
+	}
+}
+
+func TestUserInsertNoteRules(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		rules  NoteRules
+		note   int
+		errMsg string
+	}
+
+	scenarios := []scenario{
+		{"unknown note", NoteRules{}, 700, "note value not allowed"},
+		{"note too big", NoteRules{MaxValue: 1000}, 2000, "note value too big"},
+		{"all notes refused", NoteRules{MaxValue: -1}, 500, "note value too big"},
+	}
+
+	for _, s := range scenarios {
+		vm := NewApp("", nil)
+		vm.NoteRules = s.rules
+
+		err := vm.UserInsertNote(context.Background(), &model.User{ID: "userid"}, s.note)
+		if err == nil {
+			t.Errorf("%s: note should be refused", s.name)
+			continue
+		}
+
+		if err.Error() != s.errMsg {
+			t.Errorf("%s: wrong error. expected: %s, got: %s", s.name, s.errMsg, err.Error())
+		}
+	}
+}
+
+func TestUserInsertNoteFailNoChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(100, 4))
+
+	vm := NewApp("", db)
+	vm.NoteRules = NoteRules{ChangeCheckAbove: 0}
+
+	err = vm.UserInsertNote(context.Background(), &model.User{ID: "userid"}, 500)
+	if err == nil {
+		t.Fatal("note should be refused if there are not enough coins for change")
+	}
+
+	if err.Error() != "note not accepted, no change available" {
+		t.Errorf("wrong error. expected: %s, got: %s", "note not accepted, no change available", err.Error())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserInsertNoteSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(100, 5))
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into escrow_notes`).WithArgs(sqlmock.AnyArg(), "userid", 500).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewApp("", db).UserInsertNote(context.Background(), &model.User{ID: "userid"}, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserInsertNoteSkipsChangeCheckForSmallNotes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into escrow_notes`).WithArgs(sqlmock.AnyArg(), "userid", 500).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	vm := NewApp("", db)
+	vm.NoteRules = NoteRules{ChangeCheckAbove: 500}
+
+	if err := vm.UserInsertNote(context.Background(), &model.User{ID: "userid"}, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelEscrowSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(1000))
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from escrow_notes where user_id=\?`).WithArgs("userid").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	notes, err := NewApp("", db).CancelEscrow(context.Background(), &model.User{ID: "userid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(notes, []int64{1000}) {
+		t.Errorf("wrong returned notes. expected: %v, got: %v", []int64{1000}, notes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefillCoinsValidation(t *testing.T) {
+
+	vm := NewApp("", nil)
+
+	if err := vm.RefillCoins(context.Background(), nil); err == nil {
+		t.Error("should fail if no coins")
+	}
+
+	if err := vm.RefillCoins(context.Background(), []coinCount{{25, 1}}); err == nil {
+		t.Error("should fail for coins not in the currency")
+	}
+
+	if err := vm.RefillCoins(context.Background(), []coinCount{{50, 0}}); err == nil {
+		t.Error("should fail for non positive amounts")
+	}
+}
+
+func TestBuyWithEscrow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := &model.User{ID: "userid", Role: model.ROLE_BUYER, Deposit: 20}
+	prod := &model.Product{ID: "prodid", SellerID: "sellerid", AmountAvailable: 10, Cost: 150}
+
+	mock.ExpectQuery(`select .* from promotions where seller_id=\?`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(500))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prodid", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select id, note_value from escrow_notes where user_id=\? for update`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "note_value"}).AddRow("note1", 500))
+	mock.ExpectExec(`delete from escrow_notes where id in \(\?\)`).WithArgs("note1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`update users set deposit = deposit \+ \?`).WithArgs(500, "userid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(150, "userid", 150).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WithArgs(sqlmock.AnyArg(), "userid", "prodid", "sellerid", 1, 150, 150, 150, nil, nil, model.VEND_PENDING).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "sellerid", "SALE", 150, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	res, err := NewApp("", db).Buy(context.Background(), usr, prod, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.TotalCost != 150 || res.Remaining != 370 {
+		t.Errorf("wrong result. expected cost: %d, remaining: %d, got: %v", 150, 370, res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuyFailNotEnoughWithEscrow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := &model.User{ID: "userid", Role: model.ROLE_BUYER, Deposit: 20}
+	prod := &model.Product{ID: "prodid", SellerID: "sellerid", AmountAvailable: 10, Cost: 600}
+
+	mock.ExpectQuery(`select .* from promotions where seller_id=\?`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("userid").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(500))
+
+	if _, err := NewApp("", db).Buy(context.Background(), usr, prod, 1); err == nil {
+		t.Fatal("should fail if deposit and escrow are not enough")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
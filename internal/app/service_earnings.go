@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// commissionFromEnv reads the platform commission, in percent of each sale
+func commissionFromEnv() (int64, error) {
+
+	v := os.Getenv("PLATFORM_COMMISSION_PERCENT")
+	if v == "" {
+		return 0, nil
+	}
+
+	pct, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("PLATFORM_COMMISSION_PERCENT: %w", err)
+	}
+
+	if pct < 0 || pct > 100 {
+		return 0, errors.New("PLATFORM_COMMISSION_PERCENT must be between 0 and 100")
+	}
+
+	return pct, nil
+}
+
+func (a *App) SellerBalance(ctx context.Context, seller *model.User) (*sellerBalance, error) {
+
+	if a.Authorize(seller, perm_sales_read, ownerOf(seller)) != nil {
+		return nil, errors.New("user is not a seller")
+	}
+
+	return a.dbSellerBalance(ctx, seller.ID)
+}
+
+// RequestPayout asks for `amount` of the seller's earnings to be paid out. The amount is held until the request is rejected or paid.
+func (a *App) RequestPayout(ctx context.Context, seller *model.User, amount int64) (*model.Payout, error) {
+
+	if a.Authorize(seller, perm_payout_create, "") != nil {
+		return nil, errors.New("user is not a seller")
+	}
+
+	if amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+
+	return a.dbRequestPayout(ctx, seller.ID, amount)
+}
+
+func (a *App) SellerPayouts(ctx context.Context, seller *model.User) ([]model.Payout, error) {
+
+	if seller == nil {
+		return nil, errors.New("missing seller")
+	}
+
+	return a.dbPayouts(ctx, seller.ID, "")
+}
+
+// Payouts lists the payouts of all sellers, optionally only the ones with `status`
+func (a *App) Payouts(ctx context.Context, status string) ([]model.Payout, error) {
+
+	switch status {
+	case "", model.PAYOUT_REQUESTED, model.PAYOUT_APPROVED, model.PAYOUT_REJECTED, model.PAYOUT_PAID:
+	default:
+		return nil, errors.New("unknown payout status")
+	}
+
+	return a.dbPayouts(ctx, "", status)
+}
+
+func (a *App) ApprovePayout(ctx context.Context, payoutID string) error {
+	return a.dbSetPayoutStatus(ctx, payoutID, model.PAYOUT_REQUESTED, model.PAYOUT_APPROVED)
+}
+
+func (a *App) RejectPayout(ctx context.Context, payoutID string) error {
+	return a.dbSetPayoutStatus(ctx, payoutID, model.PAYOUT_REQUESTED, model.PAYOUT_REJECTED)
+}
+
+// MarkPayoutPaid records that the money for an approved payout was sent to the seller
+func (a *App) MarkPayoutPaid(ctx context.Context, payoutID string) error {
+	return a.dbSetPayoutStatus(ctx, payoutID, model.PAYOUT_APPROVED, model.PAYOUT_PAID)
+}
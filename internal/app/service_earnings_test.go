@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestCommissionFromEnv(t *testing.T) {
+
+	defer os.Unsetenv("PLATFORM_COMMISSION_PERCENT")
+
+	type scenario struct {
+		value   string
+		pct     int64
+		isValid bool
+	}
+
+	scenarios := []scenario{
+		{"", 0, true},
+		{"15", 15, true},
+		{"100", 100, true},
+		{"101", 0, false},
+		{"-1", 0, false},
+		{"ten", 0, false},
+	}
+
+	for _, s := range scenarios {
+		os.Setenv("PLATFORM_COMMISSION_PERCENT", s.value)
+
+		pct, err := commissionFromEnv()
+		if s.isValid && (err != nil || pct != s.pct) {
+			t.Errorf("%q: expected: %d, got: %d, %v", s.value, s.pct, pct, err)
+		}
+
+		if !s.isValid && err == nil {
+			t.Errorf("%q: should fail", s.value)
+		}
+	}
+}
+
+func TestRequestPayoutValidation(t *testing.T) {
+
+	vm := NewApp("", nil)
+
+	if _, err := vm.RequestPayout(context.Background(), &model.User{Role: model.ROLE_BUYER}, 100); err == nil {
+		t.Error("only sellers can request payouts")
+	}
+
+	if _, err := vm.RequestPayout(context.Background(), &model.User{Role: model.ROLE_SELLER}, 0); err == nil {
+		t.Error("amount must be positive")
+	}
+}
+
+func TestPayoutsUnknownStatus(t *testing.T) {
+	if _, err := NewApp("", nil).Payouts(context.Background(), "LOST"); err == nil || err.Error() != "unknown payout status" {
+		t.Errorf("should fail for unknown status, got: %v", err)
+	}
+}
+
+func TestBuyTakesCommission(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := &model.User{ID: "userid", Role: model.ROLE_BUYER, Deposit: 100}
+	prod := &model.Product{ID: "prodid", SellerID: "sellerid", AmountAvailable: 10, Cost: 35}
+
+	mock.ExpectQuery(`select .* from promotions`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(1, "prodid", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(35, "userid", 35).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "sellerid", "SALE", 35, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	// 10% of 35, rounded down
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "sellerid", "COMMISSION", -3, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	vm := NewApp("", db)
+	vm.CommissionPercent = 10
+
+	if _, err := vm.Buy(context.Background(), usr, prod, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type balanceChange struct {
+	Deposit int64 `json:"deposit"`
+}
+
+type stockChange struct {
+	ProductID       string `json:"product_id"`
+	AmountAvailable int64  `json:"amount_available"`
+}
+
+type priceChange struct {
+	ProductID string `json:"product_id"`
+	Cost      int64  `json:"cost"`
+}
+
+// publishLive sends a live event to the clients connected to this server. If `userID` is set only that user gets it
+func (a *App) publishLive(ctx context.Context, eventType model.TypeEvent, userID string, data any) {
+
+	if a.Bus == nil {
+		return
+	}
+
+	e := eventBody{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println("encoding live event", eventType, err)
+		return
+	}
+
+	a.Bus.Publish(ctx, model.Event{ID: e.ID, Type: e.Type, Payload: string(payload), UserID: userID, CreatedAt: e.CreatedAt})
+}
+
+// liveEventFor decides if the event goes to the user's live stream.
+// Stock and price changes go to everyone, balance changes only to their owner. Other events on the bus are not streamed.
+func liveEventFor(e model.Event, usr *model.User) bool {
+
+	switch e.Type {
+	case model.EVENT_STOCK_CHANGED, model.EVENT_PRICE_CHANGED:
+		return true
+	case model.EVENT_BALANCE_CHANGED:
+		return usr != nil && e.UserID == usr.ID
+	}
+
+	return false
+}
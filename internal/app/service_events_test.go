@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestLiveEventFor(t *testing.T) {
+
+	usr := &model.User{ID: "buyer"}
+
+	type scenario struct {
+		event    model.Event
+		streamed bool
+	}
+
+	scenarios := []scenario{
+		{model.Event{Type: model.EVENT_STOCK_CHANGED}, true},
+		{model.Event{Type: model.EVENT_PRICE_CHANGED}, true},
+		{model.Event{Type: model.EVENT_BALANCE_CHANGED, UserID: "buyer"}, true},
+		{model.Event{Type: model.EVENT_BALANCE_CHANGED, UserID: "someone else"}, false},
+		{model.Event{Type: model.EVENT_PURCHASE}, false},
+		{model.Event{Type: model.EVENT_USER_CREATED}, false},
+	}
+
+	for _, s := range scenarios {
+		if liveEventFor(s.event, usr) != s.streamed {
+			t.Errorf("%s for %q: expected streamed: %v", s.event.Type, s.event.UserID, s.streamed)
+		}
+	}
+}
+
+func TestDepositPublishesBalance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(50, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(60))
+	mock.ExpectExec(`insert into coin_inventory`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	vm := NewApp("", db)
+
+	events, cancel := vm.Bus.Subscribe(1)
+	defer cancel()
+
+	if _, err := vm.UserDepositCoin(context.Background(), &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 10}, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != model.EVENT_BALANCE_CHANGED || e.UserID != "buyer" || !strings.Contains(e.Payload, `"deposit":60`) {
+			t.Errorf("wrong event: %+v", e)
+		}
+	default:
+		t.Error("no balance event published")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
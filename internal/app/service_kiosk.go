@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// messages sent by the kiosk
+const (
+	kiosk_coin_inserted  = "coin_inserted"
+	kiosk_select_product = "select_product"
+	kiosk_vend_ok        = "vend_ok"
+	kiosk_vend_failed    = "vend_failed"
+	kiosk_cancel         = "cancel"
+	kiosk_ping           = "ping"
+)
+
+// messages sent to the kiosk
+const (
+	kiosk_deposit_ok      = "deposit_ok"
+	kiosk_vend            = "vend"
+	kiosk_vend_confirmed  = "vend_confirmed"
+	kiosk_vend_refunded   = "vend_refunded"
+	kiosk_dispense_change = "dispense_change"
+	kiosk_pong            = "pong"
+	kiosk_error           = "error"
+)
+
+// kioskMessage is a message of the kiosk protocol, in either direction.
+// Only the fields used by the message type are set.
+type kioskMessage struct {
+	Type      string      `json:"type"`
+	ID        string      `json:"id,omitempty"`       // set by the kiosk, echoed back as `reply_to`
+	ReplyTo   string      `json:"reply_to,omitempty"` // ID of the kiosk message this answers
+	Coin      int         `json:"coin,omitempty"`
+	ProductID string      `json:"product_id,omitempty"`
+	Amount    int         `json:"amount,omitempty"`
+	VendID    string      `json:"vend_id,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	TotalCost int64       `json:"total_cost,omitempty"`
+	Refunded  int64       `json:"refunded,omitempty"`
+	Deposit   *int64      `json:"deposit,omitempty"` // buyer's deposit after the message was handled
+	Coins     []coinCount `json:"coins,omitempty"`   // coins to dispense
+	Notes     []int64     `json:"notes,omitempty"`   // notes to give back from escrow
+	Error     string      `json:"error,omitempty"`
+}
+
+// kioskReply answers a kiosk message. `usr` must be the buyer's current state, the kiosk talks on their behalf.
+// Errors are answered with an `error` message, the connection stays open.
+func (a *App) kioskReply(ctx context.Context, usr *model.User, msg kioskMessage) kioskMessage {
+
+	reply, err := a.kioskHandle(ctx, usr, msg)
+	if err != nil {
+		reply = kioskMessage{Type: kiosk_error, Error: err.Error()}
+	}
+
+	reply.ReplyTo = msg.ID
+
+	return reply
+}
+
+func (a *App) kioskHandle(ctx context.Context, usr *model.User, msg kioskMessage) (kioskMessage, error) {
+
+	switch msg.Type {
+	case kiosk_ping:
+		return kioskMessage{Type: kiosk_pong}, nil
+
+	case kiosk_coin_inserted:
+		deposit, err := a.UserDepositCoins(ctx, usr, []int{msg.Coin})
+		if err != nil {
+			return kioskMessage{}, err
+		}
+
+		a.auditAction(ctx, model.AUDIT_DEPOSIT, "user", usr.ID,
+			depositEvent{UserID: usr.ID, Deposit: usr.Deposit},
+			depositEvent{UserID: usr.ID, Coins: []int64{int64(msg.Coin)}, Deposit: deposit})
+
+		return kioskMessage{Type: kiosk_deposit_ok, Deposit: &deposit}, nil
+
+	case kiosk_select_product:
+		if msg.Amount < 1 || msg.Amount > 99 {
+			return kioskMessage{}, errors.New("amount must be between 1 and 99")
+		}
+
+		if a.Db == nil {
+			return kioskMessage{}, errors.New("no database configured")
+		}
+
+		prod, err := a.dbFindProductByID(ctx, msg.ProductID)
+		if err != nil {
+			fmt.Println("kiosk product", msg.ProductID, err)
+			return kioskMessage{}, errors.New("product not found")
+		}
+
+		res, err := a.Buy(ctx, usr, prod, msg.Amount)
+		if err != nil {
+			return kioskMessage{}, err
+		}
+
+		reply := kioskMessage{
+			Type:      kiosk_vend,
+			VendID:    res.PurchaseID,
+			ProductID: prod.ID,
+			Amount:    msg.Amount,
+			TotalCost: res.TotalCost,
+			Deposit:   &res.Remaining,
+		}
+
+		a.auditAction(ctx, model.AUDIT_BUY, "purchase", res.PurchaseID, depositEvent{UserID: usr.ID, Deposit: usr.Deposit}, reply)
+
+		return reply, nil
+
+	case kiosk_vend_ok:
+		if err := a.ConfirmVend(ctx, usr, msg.VendID); err != nil {
+			return kioskMessage{}, err
+		}
+
+		return kioskMessage{Type: kiosk_vend_confirmed, VendID: msg.VendID}, nil
+
+	case kiosk_vend_failed:
+		rb, err := a.FailVend(ctx, usr, msg.VendID, msg.Reason)
+		if err != nil {
+			return kioskMessage{}, err
+		}
+
+		return kioskMessage{Type: kiosk_vend_refunded, VendID: msg.VendID, Refunded: rb.Failure.Refunded, Deposit: &rb.Deposit}, nil
+
+	case kiosk_cancel:
+		notes, err := a.EscrowNotes(ctx, usr)
+		if err != nil {
+			return kioskMessage{}, err
+		}
+
+		reset, err := a.ResetDeposit(ctx, usr)
+		if err != nil {
+			fmt.Println("kiosk cancel", err)
+			return kioskMessage{}, errors.New("reset failed")
+		}
+
+		if len(notes) > 0 {
+			a.auditAction(ctx, model.AUDIT_ESCROW_CANCEL, "user", usr.ID, nil, noteAudit{Returned: notes})
+		}
+		a.auditAction(ctx, model.AUDIT_DEPOSIT_RESET, "user", usr.ID, depositEvent{UserID: usr.ID, Deposit: reset.Amount}, reset)
+
+		var deposit int64
+
+		return kioskMessage{Type: kiosk_dispense_change, Coins: reset.Change, Notes: notes, Deposit: &deposit}, nil
+	}
+
+	return kioskMessage{}, fmt.Errorf("unknown message type: %s", msg.Type)
+}
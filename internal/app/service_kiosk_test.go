@@ -0,0 +1,235 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestKioskReplyErrors(t *testing.T) {
+
+	vm := NewApp("", nil)
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 20}
+
+	type scenario struct {
+		name     string
+		msg      kioskMessage
+		expected kioskMessage
+	}
+
+	scenarios := []scenario{
+		{"ping", kioskMessage{Type: "ping", ID: "1"}, kioskMessage{Type: "pong", ReplyTo: "1"}},
+		{"unknown type", kioskMessage{Type: "dance", ID: "2"}, kioskMessage{Type: "error", ReplyTo: "2", Error: "unknown message type: dance"}},
+		{"wrong coin", kioskMessage{Type: "coin_inserted", ID: "3", Coin: 3}, kioskMessage{Type: "error", ReplyTo: "3", Error: "coin value not allowed"}},
+		{"no amount", kioskMessage{Type: "select_product", ID: "4", ProductID: "prod"}, kioskMessage{Type: "error", ReplyTo: "4", Error: "amount must be between 1 and 99"}},
+		{"amount too big", kioskMessage{Type: "select_product", ID: "5", ProductID: "prod", Amount: 100}, kioskMessage{Type: "error", ReplyTo: "5", Error: "amount must be between 1 and 99"}},
+		{"vend ok without vend", kioskMessage{Type: "vend_ok", ID: "6"}, kioskMessage{Type: "error", ReplyTo: "6", Error: "missing vend_id"}},
+		{"vend failed without vend", kioskMessage{Type: "vend_failed", ID: "7"}, kioskMessage{Type: "error", ReplyTo: "7", Error: "missing vend_id"}},
+	}
+
+	for _, s := range scenarios {
+		reply := vm.kioskReply(context.Background(), usr, s.msg)
+		if !reflect.DeepEqual(reply, s.expected) {
+			t.Errorf("%s: wrong reply. expected: %+v, got: %+v", s.name, s.expected, reply)
+		}
+	}
+}
+
+func TestKioskCoinInserted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(50, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(70))
+	mock.ExpectExec(`insert into coin_inventory`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_DEPOSIT, "user", "buyer", `{"user_id":"buyer","deposit":20}`, `{"user_id":"buyer","coins":[50],"deposit":70}`, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 20}
+
+	reply := NewApp("", db).kioskReply(context.Background(), usr, kioskMessage{Type: "coin_inserted", ID: "c1", Coin: 50})
+
+	if reply.Type != "deposit_ok" || reply.ReplyTo != "c1" || reply.Deposit == nil || *reply.Deposit != 70 {
+		t.Errorf("wrong reply. expected: deposit_ok with deposit 70, got: %+v", reply)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKioskCancelDispensesChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select note_value from escrow_notes`).WithArgs("buyer").
+		WillReturnRows(sqlmock.NewRows([]string{"note_value"}).AddRow(500))
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(5, 10).AddRow(20, 10).AddRow(50, 10))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select deposit from users where id=\? for update`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(75))
+	mock.ExpectExec(`update users set deposit=\?`).WithArgs(0, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory`).WithArgs(1, 5, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory`).WithArgs(1, 20, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory`).WithArgs(1, 50, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`delete from escrow_notes`).WithArgs("buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_ESCROW_CANCEL, "user", "buyer", nil, `{"returned":[500]}`, "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_DEPOSIT_RESET, "user", "buyer", sqlmock.AnyArg(), sqlmock.AnyArg(), "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 75}
+
+	reply := NewApp("", db).kioskReply(context.Background(), usr, kioskMessage{Type: "cancel", ID: "x"})
+
+	var zero int64
+	expected := kioskMessage{
+		Type:    "dispense_change",
+		ReplyTo: "x",
+		Coins:   []coinCount{{5, 1}, {20, 1}, {50, 1}},
+		Notes:   []int64{500},
+		Deposit: &zero,
+	}
+
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("wrong reply. expected: %+v, got: %+v", expected, reply)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKioskVendFailedRefunds(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectFailVend(mock, "v1", "motor jam")
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_VEND_FAILED, "purchase", "v1", nil, sqlmock.AnyArg(), "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 20}
+
+	reply := NewApp("", db).kioskReply(context.Background(), usr, kioskMessage{Type: "vend_failed", ID: "f1", VendID: "v1", Reason: "motor jam"})
+
+	deposit := int64(120)
+	expected := kioskMessage{Type: "vend_refunded", ReplyTo: "f1", VendID: "v1", Refunded: 100, Deposit: &deposit}
+
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("wrong reply. expected: %+v, got: %+v", expected, reply)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKioskMessageAudited(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=\?`).WithArgs("buyer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("buyer", "buyer", "", 20, model.ROLE_BUYER, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set deposit = deposit \+ \? where id=\?`).WithArgs(50, "buyer").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(70))
+	mock.ExpectExec(`insert into coin_inventory`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into deposit_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	// the buyer the kiosk acts for, from where the kiosk connected
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), "buyer", model.AUDIT_DEPOSIT, "user", "buyer", sqlmock.AnyArg(), sqlmock.AnyArg(), "203.0.113.5", "req-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	auth := kioskAuth{
+		src:     auditSource{ActorID: "buyer", IP: "203.0.113.5", RequestID: "req-1"},
+		session: sessionVersion(&model.User{ID: "buyer", Role: model.ROLE_BUYER}),
+	}
+
+	reply, err := NewApp("", db).kioskMessageReply(auth, kioskMessage{Type: "coin_inserted", ID: "c1", Coin: 50})
+	if err != nil || reply.Type != "deposit_ok" {
+		t.Errorf("wrong reply. expected: deposit_ok, got: %+v (%v)", reply, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKioskMessageLoginRevoked(t *testing.T) {
+
+	userCols := []string{"id", "username", "password", "deposit", "role", "session_version"}
+	keyCols := []string{"id", "user_id", "name", "prefix", "scopes", "created_at", "last_used_at", "revoked_at"}
+
+	// the token was given for session version 0
+	session := sessionVersion(&model.User{ID: "buyer", Role: model.ROLE_BUYER})
+
+	type scenario struct {
+		name   string
+		auth   kioskAuth
+		expect func(sqlmock.Sqlmock)
+	}
+
+	scenarios := []scenario{
+		{"password changed", kioskAuth{src: auditSource{ActorID: "buyer"}, session: session}, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows(userCols).AddRow("buyer", "buyer", "", 20, model.ROLE_BUYER, 1))
+		}},
+		{"not a buyer anymore", kioskAuth{src: auditSource{ActorID: "buyer"}, apiKeyHash: "hash"}, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows(userCols).AddRow("buyer", "buyer", "", 20, model.ROLE_SELLER, 1))
+			mock.ExpectQuery(`select .* from api_keys where key_hash=\? and revoked_at is null`).WithArgs("hash").
+				WillReturnRows(sqlmock.NewRows(keyCols).AddRow("key", "buyer", "kiosk", "vmk_abcdefgh", "deposit,buy", time.Now(), nil, nil))
+		}},
+		{"api key revoked", kioskAuth{src: auditSource{ActorID: "buyer"}, apiKeyHash: "hash"}, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select .* from users where id=\?`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows(userCols).AddRow("buyer", "buyer", "", 20, model.ROLE_BUYER, 0))
+			mock.ExpectQuery(`select .* from api_keys where key_hash=\? and revoked_at is null`).WithArgs("hash").WillReturnRows(sqlmock.NewRows(keyCols))
+		}},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.expect(mock)
+
+		reply, err := NewApp("", db).kioskMessageReply(s.auth, kioskMessage{Type: "coin_inserted", ID: "c1", Coin: 50})
+		if !errors.Is(err, errKioskRevoked) || reply.Type != "error" || reply.ReplyTo != "c1" {
+			t.Errorf("%s: the kiosk should be refused, got: %+v (%v)", s.name, reply, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+
+		db.Close()
+	}
+}
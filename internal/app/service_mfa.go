@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	mfa_issuer         = "Vending Machine" // shown by the authenticator apps
+	mfa_token_ttl      = 5 * time.Minute   // time to enter the code after the password
+	mfa_recovery_count = 10
+)
+
+// second login steps, set in the `mfa` claim of the pending token
+const (
+	mfa_verify = "verify" // enter a code
+	mfa_enroll = "enroll" // the role requires MFA, set it up first
+)
+
+var errMFACode = errors.New("invalid code")
+
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth URI, to show as a QR code
+}
+
+// mfaLoginStep tells what the user has to do after the password: `mfa_verify`, `mfa_enroll` or nothing
+func (a *App) mfaLoginStep(ctx context.Context, usr *model.User) (string, error) {
+
+	enabled, required, err := a.dbMFALoginState(ctx, usr.ID, usr.Role)
+	if err != nil {
+		return "", err
+	}
+
+	if !enabled && !required {
+		if required, err = a.mfaRequiredByOtherRoles(ctx, usr); err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case enabled:
+		return mfa_verify, nil
+	case required:
+		return mfa_enroll, nil
+	default:
+		return "", nil
+	}
+}
+
+// EnrollMFA starts the MFA setup with a new secret. It is only enabled once ConfirmMFA gets a code for it
+func (a *App) EnrollMFA(ctx context.Context, usr *model.User) (*mfaEnrollment, error) {
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.dbSaveMFASecret(ctx, usr.ID, secret); err != nil {
+		return nil, err
+	}
+
+	return &mfaEnrollment{Secret: secret, URI: totpURI(mfa_issuer, usr.Username, secret)}, nil
+}
+
+// ConfirmMFA enables MFA if the code matches the enrolled secret.
+// Returns the recovery codes, they are not shown again.
+func (a *App) ConfirmMFA(ctx context.Context, usr *model.User, code string) ([]string, error) {
+
+	s, err := a.dbMFA(ctx, usr.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("no enrollment waiting for confirmation")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Enabled {
+		return nil, errors.New("mfa is already enabled")
+	}
+
+	step, ok := totpMatch(s.Secret, strings.TrimSpace(code), time.Now(), 0)
+	if !ok {
+		return nil, errMFACode
+	}
+
+	codes := make([]string, mfa_recovery_count)
+	hashes := make([]string, mfa_recovery_count)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = recoveryCodeHash(codes[i])
+	}
+
+	if err := a.dbEnableMFA(ctx, usr.ID, step, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyMFA checks a code from the authenticator app, or a recovery code. Each code is only accepted once
+func (a *App) VerifyMFA(ctx context.Context, usr *model.User, code string) error {
+
+	s, err := a.dbMFA(ctx, usr.ID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !s.Enabled) {
+		return errors.New("mfa is not enabled")
+	}
+	if err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+
+	if len(code) == totp_digits {
+		step, ok := totpMatch(s.Secret, code, time.Now(), s.LastStep)
+		if !ok {
+			return errMFACode
+		}
+		return a.dbUseMFAStep(ctx, usr.ID, step)
+	}
+
+	return a.dbUseRecoveryCode(ctx, usr.ID, recoveryCodeHash(code))
+}
+
+// mfaRequiredByOtherRoles tells if any role of the user, besides the main one, requires MFA
+func (a *App) mfaRequiredByOtherRoles(ctx context.Context, usr *model.User) (bool, error) {
+
+	for _, role := range usr.AllRoles() {
+		if role == usr.Role {
+			continue
+		}
+		required, err := a.dbMFARequired(ctx, role)
+		if err != nil || required {
+			return required, err
+		}
+	}
+
+	return false, nil
+}
+
+// DisableMFA turns MFA off, after checking a code. Not allowed if any of the user's roles requires MFA
+func (a *App) DisableMFA(ctx context.Context, usr *model.User, code string) error {
+
+	for _, role := range usr.AllRoles() {
+		required, err := a.dbMFARequired(ctx, role)
+		if err != nil {
+			return err
+		}
+
+		if required {
+			return errors.New("mfa is required for " + role)
+		}
+	}
+
+	if err := a.VerifyMFA(ctx, usr, code); err != nil {
+		return err
+	}
+
+	return a.dbDisableMFA(ctx, usr.ID)
+}
+
+func (a *App) MFAPolicies(ctx context.Context) ([]model.MFAPolicy, error) {
+	return a.dbMFAPolicies(ctx)
+}
+
+// SetMFARequired makes MFA required, or optional, for the role. Users of the role without MFA have to set it up on their next login
+func (a *App) SetMFARequired(ctx context.Context, role model.TypeRole, required bool) error {
+
+	if err := validateRole(role); err != nil {
+		return err
+	}
+
+	return a.dbSetMFARequired(ctx, role, required)
+}
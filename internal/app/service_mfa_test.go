@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestVerifyMFA(t *testing.T) {
+
+	type scenario struct {
+		name     string
+		code     string
+		expect   func(mock sqlmock.Sqlmock)
+		expected error
+	}
+
+	step := totpStep(time.Now())
+	current, _ := totpCode(rfcTOTPSecret, step)
+
+	mfaRow := func(lastStep int64) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"secret", "enabled", "last_step"}).AddRow(rfcTOTPSecret, true, lastStep)
+	}
+
+	scenarios := []scenario{
+		{"totp code", current, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").WillReturnRows(mfaRow(0))
+			mock.ExpectExec(`update user_mfa set last_step=\?`).WithArgs(step, "id1", step).WillReturnResult(sqlmock.NewResult(1, 1))
+		}, nil},
+		{"used totp code", current, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").WillReturnRows(mfaRow(step + 1))
+		}, errMFACode},
+		{"recovery code", "abcde-fghij", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").WillReturnRows(mfaRow(0))
+			mock.ExpectExec(`update mfa_recovery_codes set used_at=now\(\)`).WithArgs("id1", recoveryCodeHash("abcdefghij")).WillReturnResult(sqlmock.NewResult(1, 1))
+		}, nil},
+		{"used recovery code", "abcde-fghij", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").WillReturnRows(mfaRow(0))
+			mock.ExpectExec(`update mfa_recovery_codes set used_at=now\(\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+		}, errMFACode},
+	}
+
+	for _, s := range scenarios {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.expect(mock)
+
+		err = NewApp("", db).VerifyMFA(context.Background(), &model.User{ID: "id1"}, s.code)
+		if !errors.Is(err, s.expected) {
+			t.Errorf("%s: wrong error. expected: %v, got: %v", s.name, s.expected, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestConfirmMFA(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	step := totpStep(time.Now())
+	code, _ := totpCode(rfcTOTPSecret, step)
+
+	mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled", "last_step"}).AddRow(rfcTOTPSecret, false, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update user_mfa set enabled=true`).WithArgs(step, "id1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`delete from mfa_recovery_codes`).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < mfa_recovery_count; i++ {
+		mock.ExpectExec(`insert into mfa_recovery_codes`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	codes, err := NewApp("", db).ConfirmMFA(context.Background(), &model.User{ID: "id1"}, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != mfa_recovery_count {
+		t.Errorf("wrong number of recovery codes. expected: %d, got: %d", mfa_recovery_count, len(codes))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfirmMFAWrongCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select secret, enabled, last_step from user_mfa`).WithArgs("id1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled", "last_step"}).AddRow(rfcTOTPSecret, false, 0))
+
+	if _, err := NewApp("", db).ConfirmMFA(context.Background(), &model.User{ID: "id1"}, "000000x"); !errors.Is(err, errMFACode) {
+		t.Errorf("wrong error. expected: %v, got: %v", errMFACode, err)
+	}
+}
+
+func TestDisableMFARequired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select required from mfa_policies where role=\?`).WithArgs(model.ROLE_ADMIN).
+		WillReturnRows(sqlmock.NewRows([]string{"required"}).AddRow(true))
+
+	if err := NewApp("", db).DisableMFA(context.Background(), &model.User{ID: "id1", Role: model.ROLE_ADMIN}, "123456"); err == nil {
+		t.Error("should not turn off mfa required by the role")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFARequiredByOtherRole(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := &model.User{ID: "id1"}
+	usr.SetRoles([]model.TypeRole{model.ROLE_SELLER, model.ROLE_ADMIN})
+
+	mock.ExpectQuery(`select coalesce\(\(select enabled from user_mfa`).WithArgs("id1", model.ROLE_SELLER).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required"}).AddRow(false, false))
+	mock.ExpectQuery(`select required from mfa_policies where role=\?`).WithArgs(model.ROLE_ADMIN).
+		WillReturnRows(sqlmock.NewRows([]string{"required"}).AddRow(true))
+
+	vm := NewApp("", db)
+
+	step, err := vm.mfaLoginStep(context.Background(), usr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != mfa_enroll {
+		t.Errorf("wrong step. expected: %s, got: %s", mfa_enroll, step)
+	}
+
+	mock.ExpectQuery(`select required from mfa_policies where role=\?`).WithArgs(model.ROLE_SELLER).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`select required from mfa_policies where role=\?`).WithArgs(model.ROLE_ADMIN).
+		WillReturnRows(sqlmock.NewRows([]string{"required"}).AddRow(true))
+
+	if err := vm.DisableMFA(context.Background(), usr, "123456"); err == nil {
+		t.Error("should not turn off mfa required by any of the roles")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetMFARequiredUnknownRole(t *testing.T) {
+	if err := NewApp("", nil).SetMFARequired(context.Background(), "GUEST", true); err == nil {
+		t.Error("should refuse unknown roles")
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+var errOIDCDisabled = errors.New("oidc login is not configured")
+
+// oidcLogin is the local user an OIDC login resolved to
+type oidcLogin struct {
+	User          *model.User
+	Created       bool             // the user was provisioned by this login
+	PreviousRoles []model.TypeRole // set if the provider's claims changed the user's roles
+}
+
+// LoginWithOIDC finds the local user linked to the provider's identity. Users logging in the first time are created,
+// as buyers unless the role claim maps to other roles. For known users, the mapped roles replace the current ones.
+func (a *App) LoginWithOIDC(ctx context.Context, id *oidcIdentity) (*oidcLogin, error) {
+
+	if a.OIDC == nil {
+		return nil, errOIDCDisabled
+	}
+
+	roles := a.OIDC.mapRoles(id.Groups)
+
+	usr, err := a.dbFindUserByIdentity(ctx, id.Issuer, id.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a.provisionOIDCUser(ctx, id, roles)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	login := oidcLogin{User: usr}
+
+	if len(roles) > 0 && strings.Join(roles, ",") != strings.Join(usr.AllRoles(), ",") {
+		if err := a.dbSetUserRoles(ctx, usr.ID, roles); err != nil {
+			return nil, err
+		}
+		a.Users.Invalidate(usr.ID)
+		login.PreviousRoles = usr.AllRoles()
+		usr.SetRoles(roles)
+		// bumped with the roles, the login token is given for the new version
+		usr.SessionVersion++
+	}
+
+	return &login, nil
+}
+
+func (a *App) provisionOIDCUser(ctx context.Context, id *oidcIdentity, roles []model.TypeRole) (*oidcLogin, error) {
+
+	if len(roles) == 0 {
+		roles = []model.TypeRole{model.ROLE_BUYER}
+	}
+
+	username, err := a.oidcUsername(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// nobody knows the password, the user logs in through the provider
+	secret, err := newOIDCSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	encPasswd, err := a.Passwords.Hash(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := a.dbCreateOIDCUser(ctx, id.Issuer, id.Subject, username, encPasswd, roles)
+	if err != nil {
+		return nil, err
+	}
+
+	usr := model.User{ID: userID, Username: username, Password: encPasswd}
+	usr.SetRoles(roles)
+
+	return &oidcLogin{User: &usr, Created: true}, nil
+}
+
+// oidcUsername is the provider's username if it is a valid one and not taken, or else one made from the subject
+func (a *App) oidcUsername(ctx context.Context, id *oidcIdentity) (string, error) {
+
+	if validateUsername(id.Username) == nil {
+		_, err := a.dbFindUserByUsername(ctx, id.Username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return id.Username, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sum := sha256.Sum256([]byte(id.Issuer + " " + id.Subject))
+
+	return fmt.Sprintf("oidc_%s", hex.EncodeToString(sum[:8])), nil
+}
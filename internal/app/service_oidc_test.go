@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func newOIDCTestApp(t *testing.T) (*App, sqlmock.Sqlmock) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	vm := NewApp("", db)
+	vm.Passwords.Argon2 = testArgon2
+	vm.OIDC = NewOIDCProvider(OIDCConfig{
+		Issuer:   "https://idp.example.com",
+		ClientID: "vending",
+		RoleMap:  map[string]model.TypeRole{"vm-admins": model.ROLE_ADMIN, "vm-sellers": model.ROLE_SELLER},
+	})
+
+	return vm, mock
+}
+
+func TestLoginWithOIDCProvisions(t *testing.T) {
+
+	vm, mock := newOIDCTestApp(t)
+
+	mock.ExpectQuery(`select u.id, u.username, u.password, u.deposit, u.role, u.session_version from user_identities i join users u`).
+		WithArgs("https://idp.example.com", "sub-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("jane.doe@example.com").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into users`).WithArgs(sqlmock.AnyArg(), "jane.doe@example.com", sqlmock.AnyArg(), model.ROLE_BUYER).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into user_identities`).WithArgs("https://idp.example.com", "sub-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	id := oidcIdentity{Issuer: "https://idp.example.com", Subject: "sub-1", Username: "jane.doe@example.com", Groups: []string{"staff"}}
+
+	login, err := vm.LoginWithOIDC(context.Background(), &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !login.Created || login.User.ID == "" || login.User.Role != model.ROLE_BUYER || login.User.Username != "jane.doe@example.com" {
+		t.Errorf("wrong login: %+v %+v", login, login.User)
+	}
+
+	if !strings.HasPrefix(login.User.Password, "$argon2id$") {
+		t.Error("the user should get a random password hash, the login token is stamped with it")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginWithOIDCProvisionsMappedRole(t *testing.T) {
+
+	vm, mock := newOIDCTestApp(t)
+
+	mock.ExpectQuery(`from user_identities`).WillReturnError(sql.ErrNoRows)
+	// the provider's username is taken, another one is made from the subject
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("jane.doe@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("other", "jane.doe@example.com", "x", 0, model.ROLE_BUYER, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into users`).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), model.ROLE_SELLER).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into user_identities`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	id := oidcIdentity{Issuer: "https://idp.example.com", Subject: "sub-1", Username: "jane.doe@example.com", Groups: []string{"vm-sellers"}}
+
+	login, err := vm.LoginWithOIDC(context.Background(), &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if login.User.Role != model.ROLE_SELLER {
+		t.Errorf("wrong role. expected: %s, got: %s", model.ROLE_SELLER, login.User.Role)
+	}
+
+	if !strings.HasPrefix(login.User.Username, "oidc_") || validateUsername(login.User.Username) != nil {
+		t.Errorf("wrong username: %s", login.User.Username)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginWithOIDCExistingUser(t *testing.T) {
+
+	vm, mock := newOIDCTestApp(t)
+
+	userRow := func(role model.TypeRole) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "jane.doe", "hash", 20, role, 0)
+	}
+
+	// no mapped role, the local one stays
+	mock.ExpectQuery(`from user_identities`).WithArgs("https://idp.example.com", "sub-1").WillReturnRows(userRow(model.ROLE_SELLER))
+
+	login, err := vm.LoginWithOIDC(context.Background(), &oidcIdentity{Issuer: "https://idp.example.com", Subject: "sub-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if login.Created || login.PreviousRoles != nil || login.User.Role != model.ROLE_SELLER {
+		t.Errorf("wrong login: %+v %+v", login, login.User)
+	}
+
+	// the mapped roles replace it
+	mock.ExpectQuery(`from user_identities`).WithArgs("https://idp.example.com", "sub-1").WillReturnRows(userRow(model.ROLE_SELLER))
+	mock.ExpectExec(`update users set role=\?, session_version = session_version \+ 1 where id=\?`).WithArgs("ADMIN,SELLER", "id1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	id := oidcIdentity{Issuer: "https://idp.example.com", Subject: "sub-1", Groups: []string{"vm-sellers", "vm-admins"}}
+
+	login, err = vm.LoginWithOIDC(context.Background(), &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(login.PreviousRoles) != 1 || login.PreviousRoles[0] != model.ROLE_SELLER || login.User.Role != model.ROLE_ADMIN || !login.User.IsSeller() {
+		t.Errorf("wrong role change: %+v %+v", login, login.User)
+	}
+
+	if login.User.SessionVersion != 1 {
+		t.Errorf("the token should be given for the new session version, got: %d", login.User.SessionVersion)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginWithOIDCDisabled(t *testing.T) {
+
+	vm := NewApp("", nil)
+
+	if _, err := vm.LoginWithOIDC(context.Background(), &oidcIdentity{}); !errors.Is(err, errOIDCDisabled) {
+		t.Errorf("expected: %v, got: %v", errOIDCDisabled, err)
+	}
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// Publisher sends the events saved in the outbox to their consumers.
+// An event can be published more than once (e.g. after a restart), consumers should use the event ID to drop duplicates.
+type Publisher interface {
+	Publish(ctx context.Context, e model.Event) error
+}
+
+// LogPublisher prints the events
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(ctx context.Context, e model.Event) error {
+	fmt.Printf("event %s %s: %s\n", e.Type, e.ID, e.Payload)
+	return nil
+}
+
+// WebhookPublisher queues the events for the webhooks subscribed to them
+type WebhookPublisher struct {
+	App *App
+}
+
+func (p WebhookPublisher) Publish(ctx context.Context, e model.Event) error {
+	_, err := p.App.dbEnqueueEvent(ctx, e.Type, e.Payload)
+	return err
+}
+
+const outbox_batch_size = 100
+
+// publishersFromEnv reads the comma separated list of publishers the outbox events go to: `webhook` (default), `log` and `bus`
+func (a *App) publishersFromEnv() ([]Publisher, error) {
+
+	v := os.Getenv("OUTBOX_PUBLISHERS")
+	if v == "" {
+		v = "webhook"
+	}
+
+	publishers := make([]Publisher, 0)
+
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "webhook":
+			publishers = append(publishers, WebhookPublisher{App: a})
+		case "log":
+			publishers = append(publishers, LogPublisher{})
+		case "bus":
+			publishers = append(publishers, a.Bus)
+		default:
+			return nil, fmt.Errorf("OUTBOX_PUBLISHERS: unknown publisher %q", name)
+		}
+	}
+
+	return publishers, nil
+}
+
+// RunOutboxRelay publishes the events saved in the outbox.
+// Checks every `interval` until `done` is cancelled. Should be run in a separate goroutine.
+func (a *App) RunOutboxRelay(done context.Context, interval time.Duration) {
+
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-done.Done():
+			return
+		case <-tkr.C:
+			if a.Db == nil {
+				continue
+			}
+
+			if _, err := a.relayOutbox(done); err != nil {
+				fmt.Println("outbox:", err)
+			}
+		}
+	}
+}
+
+// relayOutbox hands the pending events to every publisher, in the order they were saved.
+// An event is marked as published only after all the publishers took it. On the first failure the relay stops
+// and tries again from that event next time, so publishers that already took it get it again.
+func (a *App) relayOutbox(ctx context.Context) (published int, err error) {
+
+	events, err := a.dbPendingOutbox(ctx, outbox_batch_size)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range events {
+		for _, p := range a.Publishers {
+			if err := p.Publish(ctx, e); err != nil {
+				return published, fmt.Errorf("publishing %s: %w", e.ID, err)
+			}
+		}
+
+		if err := a.dbMarkPublished(ctx, e.ID); err != nil {
+			return published, err
+		}
+
+		published++
+	}
+
+	return published, nil
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// recordingPublisher keeps the IDs of the events it got and fails for the ones in `fail`
+type recordingPublisher struct {
+	published []string
+	fail      map[string]bool
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e model.Event) error {
+	if p.fail[e.ID] {
+		return errors.New("publisher down")
+	}
+	p.published = append(p.published, e.ID)
+	return nil
+}
+
+func pendingEvents(ids ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "event_type", "payload", "created_at"})
+	for _, id := range ids {
+		rows.AddRow(id, model.EVENT_PURCHASE, "{}", time.Now())
+	}
+	return rows
+}
+
+func TestRelayOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from outbox where published_at is null`).WillReturnRows(pendingEvents("e1", "e2"))
+	mock.ExpectExec(`update outbox set published_at=now\(\) where id=\?`).WithArgs("e1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update outbox set published_at=now\(\) where id=\?`).WithArgs("e2").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	first, second := &recordingPublisher{}, &recordingPublisher{}
+
+	vm := NewApp("", db)
+	vm.Publishers = []Publisher{first, second}
+
+	n, err := vm.relayOutbox(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("wrong number of published events. expected: %d, got: %d", 2, n)
+	}
+
+	for _, p := range []*recordingPublisher{first, second} {
+		if len(p.published) != 2 || p.published[0] != "e1" || p.published[1] != "e2" {
+			t.Errorf("wrong events published: %v", p.published)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayOutboxStopsOnFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`from outbox where published_at is null`).WillReturnRows(pendingEvents("e1", "e2", "e3"))
+	mock.ExpectExec(`update outbox set published_at=now\(\)`).WithArgs("e1").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	pub := &recordingPublisher{fail: map[string]bool{"e2": true}}
+
+	vm := NewApp("", db)
+	vm.Publishers = []Publisher{pub}
+
+	n, err := vm.relayOutbox(context.Background())
+	if err == nil {
+		t.Error("should report the failed event")
+	}
+
+	if n != 1 || len(pub.published) != 1 {
+		t.Errorf("only the first event should be published, got: %d, %v", n, pub.published)
+	}
+
+	// e2 stays in the outbox and is published on the next run
+	mock.ExpectQuery(`from outbox where published_at is null`).WillReturnRows(pendingEvents("e2", "e3"))
+	mock.ExpectExec(`update outbox set published_at=now\(\)`).WithArgs("e2").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update outbox set published_at=now\(\)`).WithArgs("e3").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	pub.fail = nil
+
+	if n, err := vm.relayOutbox(context.Background()); err != nil || n != 2 {
+		t.Errorf("second run should publish the rest, got: %d, %v", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookPublisherQueuesDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`insert into webhook_deliveries .* from webhook_subscriptions where events='\*' or find_in_set\(\?, events\)`).
+		WithArgs(model.EVENT_PRODUCT_DELETED, `{"id":"e1"}`, model.DELIVERY_PENDING, model.EVENT_PRODUCT_DELETED).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	p := WebhookPublisher{App: NewApp("", db)}
+
+	if err := p.Publish(context.Background(), model.Event{ID: "e1", Type: model.EVENT_PRODUCT_DELETED, Payload: `{"id":"e1"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishersFromEnv(t *testing.T) {
+
+	defer os.Unsetenv("OUTBOX_PUBLISHERS")
+
+	type scenario struct {
+		value   string
+		count   int
+		isValid bool
+	}
+
+	scenarios := []scenario{
+		{"", 1, true},
+		{"webhook", 1, true},
+		{"log, bus,webhook", 3, true},
+		{"kafka", 0, false},
+	}
+
+	for _, s := range scenarios {
+		os.Setenv("OUTBOX_PUBLISHERS", s.value)
+
+		pubs, err := NewApp("", nil).publishersFromEnv()
+		if s.isValid && (err != nil || len(pubs) != s.count) {
+			t.Errorf("%q: expected %d publishers, got: %d, %v", s.value, s.count, len(pubs), err)
+		}
+
+		if !s.isValid && err == nil {
+			t.Errorf("%q: should fail", s.value)
+		}
+	}
+}
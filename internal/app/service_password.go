@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	password_reset_ttl      = 30 * time.Minute
+	password_notify_timeout = 30 * time.Second
+)
+
+var (
+	errResetToken      = errors.New("invalid or expired reset token")
+	errInvalidPassword = errors.New("invalid password")
+	errPasswordChanged = errors.New("password changed meanwhile")
+)
+
+// sessionVersion ties a token to the user's session version and roles. Changing the password or the roles
+// bumps the version and the token is refused, so the roles in a valid token are the user's
+func sessionVersion(usr *model.User) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(usr.SessionVersion, 10) + "\n" + strings.Join(usr.AllRoles(), ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// validSessionVersion checks the session version of a token against the user
+func validSessionVersion(usr *model.User, version string) bool {
+	return subtle.ConstantTimeCompare([]byte(sessionVersion(usr)), []byte(version)) == 1
+}
+
+// ForgotPassword sends the user a token to set a new password. Unknown usernames are ignored, so they can't be told apart.
+// The token is sent in the background.
+func (a *App) ForgotPassword(ctx context.Context, username string) error {
+
+	usr, err := a.dbFindUserByUsername(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := a.getResetTokenString(usr)
+	if err != nil {
+		return err
+	}
+
+	go func(usr model.User) {
+		ctx, cancel := context.WithTimeout(context.Background(), password_notify_timeout)
+		defer cancel()
+
+		msg := fmt.Sprintf("Use this token to set a new password, within %s: %s", password_reset_ttl, token)
+		if err := a.Notifier.Notify(ctx, usr, "Password reset", msg); err != nil {
+			fmt.Println("password reset notification", usr.ID, err)
+		}
+	}(model.User{ID: usr.ID, Username: usr.Username, Role: usr.Role})
+
+	return nil
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. The token works only once,
+// and all the tokens given before for the user stop working. Returns the user.
+func (a *App) ResetPassword(ctx context.Context, token, password string) (*model.User, error) {
+
+	t, err := jwtauth.VerifyToken(a.JwtAuth, token)
+	if err != nil {
+		return nil, errResetToken
+	}
+
+	claims := t.PrivateClaims()
+
+	if reset, _ := claims[jwtResetKey].(bool); !reset {
+		return nil, errResetToken
+	}
+
+	userID, _ := claims[jwtUserIdKey].(string)
+	version, _ := claims[jwtSessionKey].(string)
+
+	usr, err := a.dbFindUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !validSessionVersion(usr, version) {
+		return nil, errResetToken
+	}
+
+	if err := validatePassword(password); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidPassword, err.Error())
+	}
+
+	encPasswd, err := a.Passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.dbChangePassword(ctx, usr.ID, usr.Password, encPasswd); err != nil {
+		return nil, err
+	}
+	a.Users.Invalidate(usr.ID)
+
+	// the user proved who they are, the failed logins don't matter anymore
+	a.Logins.Unlock(usr.Username)
+
+	usr.Password = ""
+
+	return usr, nil
+}
+
+// getResetTokenString returns a token that only allows setting a new password
+func (a *App) getResetTokenString(usr *model.User) (tokenString string, err error) {
+	t := jwt.New()
+	t.Set(jwt.ExpirationKey, time.Now().Add(password_reset_ttl))
+	t.Set(jwt.NotBeforeKey, time.Now())
+	t.Set(jwtUserIdKey, usr.ID)
+	t.Set(jwtSessionKey, sessionVersion(usr))
+	t.Set(jwtResetKey, true)
+
+	claims, err := t.AsMap(context.Background())
+	if err != nil {
+		return
+	}
+
+	_, tokenString, err = a.JwtAuth.Encode(claims)
+
+	return
+}
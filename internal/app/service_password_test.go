@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newPasswordTestApp(t *testing.T) (*App, sqlmock.Sqlmock, chanNotifier) {
+
+	os.Setenv("JWT_ALG", "HS256")
+	os.Setenv("JWT_SIGNKEY", "somekey")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	n := make(chanNotifier, 1)
+
+	vm := NewApp("", db)
+	vm.Notifier = n
+
+	return vm, mock, n
+}
+
+// tokenFrom takes the token out of the notification message
+func tokenFrom(t *testing.T, n chanNotifier) string {
+
+	select {
+	case m := <-n:
+		return m.Message[strings.LastIndex(m.Message, " ")+1:]
+	case <-time.After(time.Second):
+		t.Fatal("no notification sent")
+		return ""
+	}
+}
+
+func TestForgotPasswordUnknownUser(t *testing.T) {
+
+	vm, mock, n := newPasswordTestApp(t)
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("nobodyusr").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}))
+
+	if err := vm.ForgotPassword(context.Background(), "nobodyusr"); err != nil {
+		t.Fatalf("unknown users should not be told apart, got: %s", err)
+	}
+
+	select {
+	case m := <-n:
+		t.Errorf("nothing should be sent, got: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+
+	vm, mock, n := newPasswordTestApp(t)
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("mh12&^KJlwekJ*"), bcrypt.MinCost)
+	userRow := func(hash []byte, version int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", hash, 0, model.ROLE_BUYER, version)
+	}
+
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where username=`).WithArgs("mihaiusr").WillReturnRows(userRow(oldHash, 0))
+
+	if err := vm.ForgotPassword(context.Background(), "mihaiusr"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := tokenFrom(t, n)
+
+	vm.Logins.Failed("mihaiusr", "10.0.0.1")
+
+	// the new password is checked, the token can still be used
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow(oldHash, 0))
+
+	if _, err := vm.ResetPassword(context.Background(), token, "weak"); !errors.Is(err, errInvalidPassword) {
+		t.Fatalf("weak password should be refused, got: %v", err)
+	}
+
+	// the hash was upgraded on a login meanwhile, the password and the token are the same
+	rehashed := []byte("$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA")
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow(rehashed, 0))
+	mock.ExpectExec(`update users set password=\?, session_version = session_version \+ 1 where id=\? and password=\?`).WithArgs(sqlmock.AnyArg(), "id1", string(rehashed)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	usr, err := vm.ResetPassword(context.Background(), token, "New12&^KJlwek")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usr.ID != "id1" || usr.Password != "" {
+		t.Errorf("wrong user returned: %+v", usr)
+	}
+
+	if s := vm.Logins.Status("mihaiusr"); s.Failures != 0 {
+		t.Errorf("failed logins should be forgotten, got: %+v", s)
+	}
+
+	// the password changed, the token doesn't work anymore
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("New12&^KJlwek"), bcrypt.MinCost)
+	mock.ExpectQuery(`select id, username, password, deposit, role, session_version from users where id=`).WithArgs("id1").WillReturnRows(userRow(newHash, 1))
+
+	if _, err := vm.ResetPassword(context.Background(), token, "Other12&^KJlwek"); !errors.Is(err, errResetToken) {
+		t.Errorf("used token should be refused, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetPasswordWrongToken(t *testing.T) {
+
+	vm, _, _ := newPasswordTestApp(t)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("mh12&^KJlwekJ*"), bcrypt.MinCost)
+	loginToken, err := vm.getEncTokenString(&model.User{ID: "id1", Username: "mihaiusr", Password: string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signed with another key
+	os.Setenv("JWT_SIGNKEY", "otherkey")
+	foreign, err := NewApp("", nil).getResetTokenString(&model.User{ID: "id1", Password: string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"login token": loginToken, "other key": foreign, "garbage": "abc"} {
+		if _, err := vm.ResetPassword(context.Background(), token, "New12&^KJlwek"); !errors.Is(err, errResetToken) {
+			t.Errorf("%s: should be refused, got: %v", name, err)
+		}
+	}
+}
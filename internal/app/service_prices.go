@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// SchedulePrice sets a new cost for the product, starting at `effectiveFrom`.
+// Only the seller of the product can change its price. For immediate changes use `UpdateProduct`.
+func (a *App) SchedulePrice(ctx context.Context, seller *model.User, prod *model.Product, cost int64, effectiveFrom time.Time) error {
+
+	if seller == nil || prod == nil {
+		return errors.New("seller and product must exist")
+	}
+
+	if a.Authorize(seller, perm_product_update, prod.SellerID) != nil {
+		return errors.New("seller can only modify own products")
+	}
+
+	if err := a.Currency.validateCost(cost); err != nil {
+		return err
+	}
+
+	if !effectiveFrom.After(time.Now()) {
+		return errors.New("effective date must be in the future")
+	}
+
+	return a.dbSchedulePrice(ctx, prod.ID, cost, effectiveFrom)
+}
+
+func (a *App) PriceHistory(ctx context.Context, prod *model.Product) ([]model.ProductPrice, error) {
+
+	if prod == nil {
+		return nil, errors.New("missing product")
+	}
+
+	return a.dbPriceHistory(ctx, prod.ID)
+}
+
+// RunPriceScheduler applies the scheduled price changes when they are due.
+// Checks every `interval` until `done` is cancelled. Should be run in a separate goroutine.
+func (a *App) RunPriceScheduler(done context.Context, interval time.Duration) {
+
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-done.Done():
+			return
+		case <-tkr.C:
+			if a.Db == nil {
+				continue
+			}
+
+			applied, err := a.dbApplyDuePrices(done)
+			if err != nil {
+				fmt.Println("price changes:", err)
+				continue
+			}
+
+			if len(applied) > 0 {
+				fmt.Printf("price changes: %d applied\n", len(applied))
+			}
+
+			for _, p := range applied {
+				a.publishLive(done, model.EVENT_PRICE_CHANGED, "", priceChange{ProductID: p.ProductID, Cost: p.Cost})
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestSchedulePriceValidation(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		seller *model.User
+		cost   int64
+		from   time.Time
+		errMsg string
+	}
+
+	seller := &model.User{ID: "sellerid", Role: model.ROLE_SELLER}
+	tomorrow := time.Now().Add(24 * time.Hour)
+
+	scenarios := []scenario{
+		{"no seller", nil, 50, tomorrow, "seller and product must exist"},
+		{"other seller", &model.User{ID: "other", Role: model.ROLE_SELLER}, 50, tomorrow, "seller can only modify own products"},
+		{"bad cost", seller, 52, tomorrow, "cost is not positive or not a multiple of 5"},
+		{"in the past", seller, 50, time.Now().Add(-time.Minute), "effective date must be in the future"},
+		{"no database", seller, 50, tomorrow, "no database configured"},
+	}
+
+	prod := &model.Product{ID: "prodid", SellerID: "sellerid", Cost: 40}
+
+	for _, s := range scenarios {
+		err := NewApp("", nil).SchedulePrice(context.Background(), s.seller, prod, s.cost, s.from)
+		if err == nil {
+			t.Errorf("%s: should fail", s.name)
+			continue
+		}
+
+		if err.Error() != s.errMsg {
+			t.Errorf("%s: wrong error. expected: %s, got: %s", s.name, s.errMsg, err.Error())
+		}
+	}
+}
+
+func TestRunPriceSchedulerStops(t *testing.T) {
+
+	done, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		NewApp("", nil).RunPriceScheduler(done, time.Millisecond)
+		close(stopped)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler should stop when done")
+	}
+}
@@ -10,30 +10,30 @@ import (
 
 // CreateProduct validates the input parameters and calls the repository to store the data in the database
 // Only users with the role `SELLER` can create objects
-func (a *App) CreateProduct(ctx context.Context, seller *model.User, amountAvailable int64, cost int64, name string) (err error) {
+func (a *App) CreateProduct(ctx context.Context, seller *model.User, amountAvailable int64, cost int64, name string) (productID string, err error) {
 
 	if seller == nil {
-		return errors.New("missing seller")
+		return "", errors.New("missing seller")
 	}
 
-	if seller.Role != model.ROLE_SELLER {
-		return errors.New("user is not a seller")
+	if a.Authorize(seller, perm_product_create, "") != nil {
+		return "", errors.New("user is not a seller")
 	}
 
 	if amountAvailable <= 0 {
-		return errors.New("available amount must be positive")
+		return "", errors.New("available amount must be positive")
 	}
 
-	if err = validateCost(cost); err != nil {
+	if err = a.Currency.validateCost(cost); err != nil {
 		return
 	}
 
 	if strings.TrimSpace(name) == "" {
-		return errors.New("missing name for product")
+		return "", errors.New("missing name for product")
 	}
 
 	if a.Db == nil {
-		return errors.New("no database to save the product")
+		return "", errors.New("no database to save the product")
 	}
 
 	return a.dbCreateProduct(ctx, seller.ID, amountAvailable, cost, strings.TrimSpace(name))
@@ -49,11 +49,11 @@ func (a *App) DeleteProduct(ctx context.Context, seller *model.User, product *mo
 		return errors.New("product is nil")
 	}
 
-	if seller.Role != model.ROLE_SELLER {
+	if !a.Can(seller, perm_product_delete) {
 		return errors.New("user is not a seller")
 	}
 
-	if seller.ID != product.SellerID {
+	if a.Authorize(seller, perm_product_delete, product.SellerID) != nil {
 		return errors.New("wrong seller id")
 	}
 
@@ -82,7 +82,7 @@ func (a *App) UpdateProduct(ctx context.Context, seller *model.User, prod *model
 		return errors.New("seller and product must exist")
 	}
 
-	if seller.ID != prod.SellerID {
+	if a.Authorize(seller, perm_product_update, prod.SellerID) != nil {
 		return errors.New("seller can only modify own products")
 	}
 
@@ -99,7 +99,7 @@ func (a *App) UpdateProduct(ctx context.Context, seller *model.User, prod *model
 		p.Name = s
 	}
 
-	if err = validateCost(newCost); err == nil {
+	if err = a.Currency.validateCost(newCost); err == nil {
 		p.Cost = newCost
 	}
 
@@ -107,5 +107,13 @@ func (a *App) UpdateProduct(ctx context.Context, seller *model.User, prod *model
 		return errors.New("no database")
 	}
 
-	return a.dbUpdateProduct(ctx, p)
+	if err = a.dbUpdateProduct(ctx, p, p.Cost != prod.Cost); err != nil {
+		return
+	}
+
+	if p.Cost != prod.Cost {
+		a.publishLive(ctx, model.EVENT_PRICE_CHANGED, "", priceChange{ProductID: p.ID, Cost: p.Cost})
+	}
+
+	return
 }
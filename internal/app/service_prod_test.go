@@ -10,13 +10,13 @@ import (
 )
 
 func TestCreateProductFailNoSeller(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), nil, 0, 0, ""); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), nil, 0, 0, ""); err == nil {
 		t.Fatal("should fail if no seller")
 	}
 }
 
 func TestCreateProductFailUserNotSeller(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_BUYER}, 10, 5, "product name"); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_BUYER}, 10, 5, "product name"); err == nil {
 		t.Fatal("should fail if user is not a seller")
 	} else {
 		if err.Error() != "user is not a seller" {
@@ -27,7 +27,7 @@ func TestCreateProductFailUserNotSeller(t *testing.T) {
 }
 
 func TestCreateProductFaiInvalidAmount(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, -1, 0, ""); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, -1, 0, ""); err == nil {
 		t.Fatal("should fail if invalid amount")
 	} else {
 		if err.Error() != "available amount must be positive" {
@@ -37,19 +37,19 @@ func TestCreateProductFaiInvalidAmount(t *testing.T) {
 }
 
 func TestCreateProductFailInvalidCost(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 0, ""); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 0, ""); err == nil {
 		t.Fatal("should fail if invalid cost")
 	}
 }
 
 func TestCreateProductFailInvalidName(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 10, ""); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 10, ""); err == nil {
 		t.Fatal("should fail if invalid name")
 	}
 }
 
 func TestCreateProductFailIfNoDatabase(t *testing.T) {
-	if err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 10, "kasjdfja"); err == nil {
+	if _, err := NewApp("", nil).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 10, "kasjdfja"); err == nil {
 		t.Fatal("should fail if no database connection")
 	}
 }
@@ -64,9 +64,12 @@ func TestCreateProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`insert into products`).WithArgs(sqlmock.AnyArg(), "kasjdfja", 1, 5, "id1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into product_prices`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set price_id=\?`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	if err := NewApp("", db).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 5, "kasjdfja"); err != nil {
+	if _, err := NewApp("", db).CreateProduct(context.Background(), &model.User{ID: "id1", Role: model.ROLE_SELLER}, 1, 5, "kasjdfja"); err != nil {
 		t.Fatalf("should create product. Received: %s", err)
 	}
 
@@ -87,7 +90,7 @@ func TestCreateProductFailDatabaseError(t *testing.T) {
 	mock.ExpectExec(`insert into products`).WithArgs(sqlmock.AnyArg(), "kasjdfja", 1, 0, "id1").WillReturnError(errors.New("duplicate name"))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).CreateProduct(context.Background(), &model.User{ID: "id1"}, 1, 0, "kasjdfja"); err == nil {
+	if _, err := NewApp("", db).CreateProduct(context.Background(), &model.User{ID: "id1"}, 1, 0, "kasjdfja"); err == nil {
 		t.Fatal("should fail if there are database errors")
 	}
 }
@@ -127,7 +130,7 @@ func TestDeleteProductFailNoProduct(t *testing.T) {
 
 func TestDeleteProductFailNoDatabaseConn(t *testing.T) {
 
-	if err := NewApp("", nil).DeleteProduct(context.Background(), &model.User{Role: model.ROLE_SELLER}, &model.Product{}); err == nil {
+	if err := NewApp("", nil).DeleteProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{SellerID: "sellerid"}); err == nil {
 		t.Fatal("db conn nil, should fail")
 	} else {
 		if err.Error() != "no db conn" {
@@ -182,6 +185,7 @@ func TestDeleteProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`delete from products where id\=`).WithArgs("product 1", "seller 1").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	if err := NewApp("", db).DeleteProduct(context.Background(), &model.User{ID: "seller 1", Role: model.ROLE_SELLER}, &model.Product{ID: "product 1", SellerID: "seller 1"}); err != nil {
@@ -217,7 +221,7 @@ func TestUpdateProductFailNilProduct(t *testing.T) {
 
 func TestUpdateProductFailNotOwnProduct(t *testing.T) {
 
-	if err := NewApp("", nil).UpdateProduct(context.Background(), &model.User{ID: "sellerid"}, &model.Product{SellerID: "other sellerid"}, "good name", 10); err == nil {
+	if err := NewApp("", nil).UpdateProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{SellerID: "other sellerid"}, "good name", 10); err == nil {
 		t.Fatal("should return error if not own product")
 	} else {
 		if err.Error() != "seller can only modify own products" {
@@ -229,7 +233,7 @@ func TestUpdateProductFailNotOwnProduct(t *testing.T) {
 
 func TestUpdateProductFailNoDb(t *testing.T) {
 
-	if err := NewApp("", nil).UpdateProduct(context.Background(), &model.User{ID: "sellerid"}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
+	if err := NewApp("", nil).UpdateProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
 		t.Fatal("should return error if no db configured")
 	} else {
 		if err.Error() != "no database" {
@@ -248,7 +252,7 @@ func TestUpdateProductFailDbError(t *testing.T) {
 
 	mock.ExpectBegin().WillReturnError(errors.New("no transaction"))
 
-	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid"}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
+	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
 		t.Fatal("should return error if there was a database error")
 	} else {
 		if err.Error() != "no transaction" {
@@ -273,7 +277,7 @@ func TestUpdateProductFailQueryError(t *testing.T) {
 	mock.ExpectExec(`update products set name=\?, cost=\? where id=\? and seller_id=/?`).WillReturnError(errors.New("update failed"))
 	mock.ExpectRollback()
 
-	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid"}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
+	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{SellerID: "sellerid"}, "good name", 10); err == nil {
 		t.Fatal("should return error if there was a database error")
 	} else {
 		if err.Error() != "update failed" {
@@ -296,9 +300,12 @@ func TestUpdateProductSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`update products set name=\?, cost=\? where id=\? and seller_id=\?`).WithArgs("good name", 10, "id", "sellerid").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into product_prices`).WithArgs(sqlmock.AnyArg(), "id", 10).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update products set price_id=\? where id=\?`).WithArgs(sqlmock.AnyArg(), "id").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid"}, &model.Product{ID: "id", SellerID: "sellerid"}, "good name", 10); err != nil {
+	if err := NewApp("", db).UpdateProduct(context.Background(), &model.User{ID: "sellerid", Role: model.ROLE_SELLER}, &model.Product{ID: "id", SellerID: "sellerid"}, "good name", 10); err != nil {
 		t.Fatalf("update with good data failed with error: %s", err.Error())
 	}
 
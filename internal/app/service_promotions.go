@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// CreatePromotion validates the promotion and saves it for the seller.
+// If a product is given, it has to belong to the seller.
+func (a *App) CreatePromotion(ctx context.Context, seller *model.User, p model.Promotion) error {
+
+	if a.Authorize(seller, perm_promotion_manage, ownerOf(seller)) != nil {
+		return errors.New("user is not a seller")
+	}
+
+	p.SellerID = seller.ID
+	p.Name = strings.TrimSpace(p.Name)
+	p.ProductID = strings.TrimSpace(p.ProductID)
+
+	if err := a.validatePromotion(p); err != nil {
+		return err
+	}
+
+	if a.Db == nil {
+		return errors.New("no database to save the promotion")
+	}
+
+	if p.ProductID != "" {
+		prod, err := a.dbFindProductByID(ctx, p.ProductID)
+		if err != nil || a.Authorize(seller, perm_promotion_manage, prod.SellerID) != nil {
+			return errors.New("product not found")
+		}
+	}
+
+	return a.dbCreatePromotion(ctx, p)
+}
+
+func (a *App) validatePromotion(p model.Promotion) error {
+
+	if p.Name == "" {
+		return errors.New("missing name for promotion")
+	}
+
+	switch p.Type {
+	case model.PROMO_PERCENT:
+		if p.Value <= 0 || p.Value > 100 {
+			return errors.New("percent must be between 1 and 100")
+		}
+	case model.PROMO_FIXED:
+		if err := a.Currency.validateCost(p.Value); err != nil {
+			return errors.New("discount is not positive or not a multiple of the price step")
+		}
+	case model.PROMO_BUY_N_GET_1:
+		if p.Value <= 0 {
+			return errors.New("number of items must be positive")
+		}
+	default:
+		return errors.New("unknown promotion type")
+	}
+
+	if p.FromHour < 0 || p.FromHour > 23 || p.ToHour < 0 || p.ToHour > 23 {
+		return errors.New("hours must be between 0 and 23")
+	}
+
+	return nil
+}
+
+func (a *App) ListPromotions(ctx context.Context, seller *model.User) ([]model.Promotion, error) {
+
+	if seller == nil {
+		return nil, errors.New("missing seller")
+	}
+
+	return a.dbSellerPromotions(ctx, seller.ID)
+}
+
+// DeletePromotion removes a promotion. Sellers can only delete their own promotions
+func (a *App) DeletePromotion(ctx context.Context, seller *model.User, promotionID string) error {
+
+	if seller == nil {
+		return errors.New("missing seller")
+	}
+
+	return a.dbDeletePromotion(ctx, promotionID, seller.ID)
+}
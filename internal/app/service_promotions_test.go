@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestCreatePromotionValidation(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		promo  model.Promotion
+		errMsg string
+	}
+
+	scenarios := []scenario{
+		{"no name", model.Promotion{Name: " ", Type: model.PROMO_PERCENT, Value: 10}, "missing name for promotion"},
+		{"unknown type", model.Promotion{Name: "promo", Type: "FREE", Value: 10}, "unknown promotion type"},
+		{"percent too big", model.Promotion{Name: "promo", Type: model.PROMO_PERCENT, Value: 101}, "percent must be between 1 and 100"},
+		{"percent zero", model.Promotion{Name: "promo", Type: model.PROMO_PERCENT}, "percent must be between 1 and 100"},
+		{"fixed not a multiple", model.Promotion{Name: "promo", Type: model.PROMO_FIXED, Value: 12}, "discount is not positive or not a multiple of the price step"},
+		{"buy zero get 1", model.Promotion{Name: "promo", Type: model.PROMO_BUY_N_GET_1}, "number of items must be positive"},
+		{"wrong hours", model.Promotion{Name: "promo", Type: model.PROMO_PERCENT, Value: 10, FromHour: 22, ToHour: 24}, "hours must be between 0 and 23"},
+		{"no database", model.Promotion{Name: "promo", Type: model.PROMO_PERCENT, Value: 10}, "no database to save the promotion"},
+	}
+
+	seller := &model.User{ID: "sellerid", Role: model.ROLE_SELLER}
+
+	for _, s := range scenarios {
+		err := NewApp("", nil).CreatePromotion(context.Background(), seller, s.promo)
+		if err == nil {
+			t.Errorf("%s: should fail", s.name)
+			continue
+		}
+
+		if err.Error() != s.errMsg {
+			t.Errorf("%s: wrong error. expected: %s, got: %s", s.name, s.errMsg, err.Error())
+		}
+	}
+}
+
+func TestCreatePromotionFailNotSeller(t *testing.T) {
+	p := model.Promotion{Name: "promo", Type: model.PROMO_PERCENT, Value: 10}
+	if err := NewApp("", nil).CreatePromotion(context.Background(), &model.User{Role: model.ROLE_BUYER}, p); err == nil {
+		t.Fatal("only sellers can create promotions")
+	}
+}
+
+func TestCreatePromotionFailOtherSellersProduct(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select .* from products where id=\?`).WithArgs("prodid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "available_amount", "cost", "seller_id", "price_id"}).AddRow("prodid", "prod", 10, 50, "other", nil))
+
+	seller := &model.User{ID: "sellerid", Role: model.ROLE_SELLER}
+	p := model.Promotion{ProductID: "prodid", Name: "promo", Type: model.PROMO_PERCENT, Value: 10}
+
+	if err := NewApp("", db).CreatePromotion(context.Background(), seller, p); err == nil {
+		t.Fatal("should not create promotions for other sellers' products")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuyWithPromotion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := &model.User{ID: "userid", Role: model.ROLE_BUYER, Deposit: 100}
+	prod := &model.Product{ID: "prodid", SellerID: "sellerid", AmountAvailable: 10, Cost: 40, PriceID: "price-1"}
+
+	mock.ExpectQuery(`select .* from promotions where seller_id=\?`).WithArgs("sellerid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}).
+			AddRow("p1", "sellerid", "prodid", "buy 2 get 1", "BUY_N_GET_1", 2, 0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount =`).WithArgs(3, "prodid", 3).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(80, "userid", 80).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WithArgs(sqlmock.AnyArg(), "userid", "prodid", "sellerid", 3, 40, 120, 80, "price-1", "p1", model.VEND_PENDING).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "sellerid", "SALE", 80, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(9, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// 120 would need notes from the escrow, with the promotion the deposit is enough
+	res, err := NewApp("", db).Buy(context.Background(), usr, prod, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.BasePrice != 120 || res.TotalCost != 80 || res.Remaining != 20 {
+		t.Errorf("wrong result: %v", res)
+	}
+
+	if res.Promotion == nil || res.Promotion.ID != "p1" {
+		t.Errorf("wrong promotion applied: %v", res.Promotion)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const refund_reason_max = 255
+
+type refundRequest struct {
+	Amount  int64                  `json:"amount"`  // 0 refunds what is left of the purchase
+	Method  model.TypeRefundMethod `json:"method"`  // DEPOSIT (default) or COINS
+	Restock int                    `json:"restock"` // units to put back on sale
+	Reason  string                 `json:"reason"`
+}
+
+type refundResult struct {
+	Refund  model.Refund `json:"refund"`
+	Coins   []coinCount  `json:"coins,omitempty"` // coins to hand to the buyer, for COINS refunds
+	Deposit int64        `json:"deposit"`         // buyer's deposit after the refund
+}
+
+// RefundPurchase gives back part or all of a completed purchase. The refund is taken out of the seller's earnings
+// and recorded with the admin who made it.
+func (a *App) RefundPurchase(ctx context.Context, admin *model.User, purchaseID string, req refundRequest) (*refundResult, error) {
+
+	if a.Authorize(admin, perm_purchase_refund, "") != nil {
+		return nil, errors.New("only admins can refund")
+	}
+
+	if req.Method == "" {
+		req.Method = model.REFUND_DEPOSIT
+	}
+
+	if req.Method != model.REFUND_DEPOSIT && req.Method != model.REFUND_COINS {
+		return nil, errors.New("method must be DEPOSIT or COINS")
+	}
+
+	if req.Amount < 0 || req.Restock < 0 {
+		return nil, errors.New("amount and restock cannot be negative")
+	}
+
+	if req.Reason == "" {
+		return nil, errors.New("missing reason")
+	}
+
+	if len(req.Reason) > refund_reason_max {
+		return nil, errors.New("reason is too long")
+	}
+
+	if req.Amount == 0 {
+		left, err := a.dbRefundable(ctx, purchaseID)
+		if err != nil {
+			return nil, err
+		}
+		req.Amount = left
+	}
+
+	if req.Amount == 0 {
+		return nil, errors.New("nothing left to refund")
+	}
+
+	var change []coinCount
+	if req.Method == model.REFUND_COINS {
+		inventory, err := a.dbCoinInventory(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		coins, err := a.Currency.changeFromInventory(req.Amount, inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		change = a.Currency.coinCounts(coins)
+	}
+
+	r := model.Refund{
+		ID:         uuid.New().String(),
+		PurchaseID: purchaseID,
+		AdminID:    admin.ID,
+		Amount:     req.Amount,
+		Method:     req.Method,
+		Restocked:  req.Restock,
+		Reason:     req.Reason,
+		CreatedAt:  time.Now(),
+	}
+
+	deposit, stock, err := a.dbRefundPurchase(ctx, &r, change)
+	if err != nil {
+		return nil, err
+	}
+	a.Users.Invalidate(r.UserID)
+
+	if r.Method == model.REFUND_DEPOSIT {
+		a.publishLive(ctx, model.EVENT_BALANCE_CHANGED, r.UserID, balanceChange{Deposit: deposit})
+	}
+
+	if r.Restocked > 0 {
+		a.publishLive(ctx, model.EVENT_STOCK_CHANGED, "", stockChange{ProductID: r.ProductID, AmountAvailable: stock})
+	}
+
+	return &refundResult{Refund: r, Coins: change, Deposit: deposit}, nil
+}
+
+func (a *App) PurchaseRefunds(ctx context.Context, purchaseID string) ([]model.Refund, error) {
+	return a.dbPurchaseRefunds(ctx, purchaseID)
+}
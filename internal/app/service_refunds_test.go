@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestRefundPurchaseValidation(t *testing.T) {
+
+	vm := NewApp("", nil)
+	admin := &model.User{ID: "admin", Role: model.ROLE_ADMIN}
+
+	type scenario struct {
+		name  string
+		admin *model.User
+		req   refundRequest
+		err   string
+	}
+
+	scenarios := []scenario{
+		{"not admin", &model.User{ID: "buyer", Role: model.ROLE_BUYER}, refundRequest{Amount: 10, Reason: "x"}, "only admins can refund"},
+		{"unknown method", admin, refundRequest{Amount: 10, Method: "CHEQUE", Reason: "x"}, "method must be DEPOSIT or COINS"},
+		{"negative amount", admin, refundRequest{Amount: -10, Reason: "x"}, "amount and restock cannot be negative"},
+		{"negative restock", admin, refundRequest{Amount: 10, Restock: -1, Reason: "x"}, "amount and restock cannot be negative"},
+		{"no reason", admin, refundRequest{Amount: 10}, "missing reason"},
+	}
+
+	for _, s := range scenarios {
+		_, err := vm.RefundPurchase(context.Background(), s.admin, "purchase", s.req)
+		if err == nil || err.Error() != s.err {
+			t.Errorf("%s: wrong error. expected: %s, got: %v", s.name, s.err, err)
+		}
+	}
+}
+
+func TestRefundPurchaseFullInCoins(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select .* from seller_ledger where purchase_id=\?`).WithArgs("SALE", "COMMISSION", "purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"sale", "commission"}).AddRow(70, 0))
+	mock.ExpectQuery(`select coin_value, amount from coin_inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"coin_value", "amount"}).AddRow(20, 10).AddRow(50, 10))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select user_id, product_id, seller_id, amount, status from purchases`).WithArgs("purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "status"}).AddRow("buyer", "prod", "seller", 1, model.VEND_COMPLETED))
+	mock.ExpectQuery(`select .* from seller_ledger where purchase_id=\?`).WithArgs("SALE", "COMMISSION", "purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"sale", "commission"}).AddRow(70, 0))
+	mock.ExpectExec(`insert into seller_ledger`).WithArgs(sqlmock.AnyArg(), "seller", "SALE", -70, "purchase", nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory`).WithArgs(1, 20, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update coin_inventory`).WithArgs(1, 50, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into refunds`).WithArgs(sqlmock.AnyArg(), "purchase", "admin", "buyer", "prod", 70, model.REFUND_COINS, 0, "jammed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select deposit from users`).WithArgs("buyer").WillReturnRows(sqlmock.NewRows([]string{"deposit"}).AddRow(0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	admin := &model.User{ID: "admin", Role: model.ROLE_ADMIN}
+
+	res, err := NewApp("", db).RefundPurchase(context.Background(), admin, "purchase", refundRequest{Method: model.REFUND_COINS, Reason: "jammed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Refund.Amount != 70 {
+		t.Errorf("wrong amount. expected: %d, got: %d", 70, res.Refund.Amount)
+	}
+
+	expectedCoins := []coinCount{{20, 1}, {50, 1}}
+	if !reflect.DeepEqual(res.Coins, expectedCoins) {
+		t.Errorf("wrong coins. expected: %v, got: %v", expectedCoins, res.Coins)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
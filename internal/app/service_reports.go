@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type TypePeriod = string
+
+const (
+	PERIOD_DAY   TypePeriod = "day"
+	PERIOD_WEEK  TypePeriod = "week"
+	PERIOD_MONTH TypePeriod = "month"
+)
+
+// max_report_buckets limits the number of days, weeks or months in one report
+const max_report_buckets = 400
+
+// report_top_products is the number of products in the top
+const report_top_products = 5
+
+type salesReport struct {
+	Period      string         `json:"period"`
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"` // exclusive
+	Totals      salesBucket    `json:"totals"`
+	Buckets     []salesBucket  `json:"buckets"`
+	TopProducts []productSales `json:"top_products"`
+}
+
+type salesBucket struct {
+	Start         time.Time `json:"start"`
+	Purchases     int64     `json:"purchases"`
+	UnitsSold     int64     `json:"units_sold"`
+	Revenue       int64     `json:"revenue"`
+	AverageBasket int64     `json:"average_basket"` // revenue per purchase
+	SellThrough   float64   `json:"sell_through"`   // part of the stock at the start that was sold
+}
+
+type productSales struct {
+	ProductID string `json:"product_id"`
+	Name      string `json:"name"`
+	UnitsSold int64  `json:"units_sold"`
+	Revenue   int64  `json:"revenue"`
+}
+
+// errReportFailed is returned when the data for a report can't be read. Other errors are about the request
+var errReportFailed = errors.New("report failed")
+
+// SellerReport aggregates the purchases of the seller's products by day, week or month, for the periods from `from` to `to`, both included.
+// Zero values for `from` or `to` select the last 30 days, 12 weeks or 12 months.
+// Times are in UTC, weeks start on Monday.
+func (a *App) SellerReport(ctx context.Context, seller *model.User, period string, from, to time.Time) (*salesReport, error) {
+
+	if a.Authorize(seller, perm_sales_read, ownerOf(seller)) != nil {
+		return nil, errors.New("user is not a seller")
+	}
+
+	from, to, err := reportRange(period, from, to, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	purchases, err := a.dbSellerPurchases(ctx, seller.ID, from)
+	if err != nil {
+		fmt.Println("report purchases", err)
+		return nil, errReportFailed
+	}
+
+	products, err := a.dbSellerProducts(ctx, seller.ID)
+	if err != nil {
+		fmt.Println("report products", err)
+		return nil, errReportFailed
+	}
+
+	return buildSalesReport(period, from, to, purchases, products), nil
+}
+
+// reportRange aligns the interval to the period and fills in the defaults. The returned `to` is exclusive
+func reportRange(period string, from, to, now time.Time) (time.Time, time.Time, error) {
+
+	switch period {
+	case PERIOD_DAY, PERIOD_WEEK, PERIOD_MONTH:
+	default:
+		return from, to, errors.New("period must be one of: day, week, month")
+	}
+
+	if to.IsZero() {
+		to = now
+	}
+	to = nextPeriod(period, periodStart(period, to))
+
+	if from.IsZero() {
+		from = to
+		n := 30
+		if period != PERIOD_DAY {
+			n = 12
+		}
+		for i := 0; i < n; i++ {
+			from = previousPeriod(period, from)
+		}
+	} else {
+		from = periodStart(period, from)
+	}
+
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+
+	n := 0
+	for t := from; t.Before(to); t = nextPeriod(period, t) {
+		if n++; n > max_report_buckets {
+			return from, to, errors.New("interval too long")
+		}
+	}
+
+	return from, to, nil
+}
+
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case PERIOD_WEEK:
+		offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+		return day.AddDate(0, 0, -offset)
+	case PERIOD_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func nextPeriod(period string, start time.Time) time.Time {
+	switch period {
+	case PERIOD_WEEK:
+		return start.AddDate(0, 0, 7)
+	case PERIOD_MONTH:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func previousPeriod(period string, start time.Time) time.Time {
+	switch period {
+	case PERIOD_WEEK:
+		return start.AddDate(0, 0, -7)
+	case PERIOD_MONTH:
+		return start.AddDate(0, -1, 0)
+	default:
+		return start.AddDate(0, 0, -1)
+	}
+}
+
+// buildSalesReport does the aggregation. `purchases` must contain everything sold since `from`, also after `to`,
+// because the stock at the start of a period is the current stock plus all that was sold since.
+// Refunds must already be taken off the purchases.
+func buildSalesReport(period string, from, to time.Time, purchases []model.Purchase, products []model.Product) *salesReport {
+
+	report := salesReport{
+		Period:      period,
+		From:        from,
+		To:          to,
+		Totals:      salesBucket{Start: from},
+		Buckets:     make([]salesBucket, 0),
+		TopProducts: make([]productSales, 0),
+	}
+
+	var stock int64
+	names := make(map[string]string)
+	for _, p := range products {
+		stock += p.AmountAvailable
+		names[p.ID] = p.Name
+	}
+
+	byProduct := make(map[string]*productSales)
+
+	for start := from; start.Before(to); start = nextPeriod(period, start) {
+		end := nextPeriod(period, start)
+		bucket := salesBucket{Start: start}
+
+		var soldSince int64
+		for _, p := range purchases {
+			created := p.CreatedAt.UTC()
+			if created.Before(start) {
+				continue
+			}
+
+			soldSince += int64(p.Amount)
+
+			if !created.Before(end) {
+				continue
+			}
+
+			// fully refunded, there was no sale
+			if p.TotalPrice > 0 {
+				bucket.Purchases++
+			}
+			bucket.UnitsSold += int64(p.Amount)
+			bucket.Revenue += p.TotalPrice
+
+			ps, ok := byProduct[p.ProductID]
+			if !ok {
+				ps = &productSales{ProductID: p.ProductID, Name: names[p.ProductID]}
+				byProduct[p.ProductID] = ps
+			}
+			ps.UnitsSold += int64(p.Amount)
+			ps.Revenue += p.TotalPrice
+		}
+
+		bucket.finish(stock + soldSince)
+		report.Buckets = append(report.Buckets, bucket)
+
+		report.Totals.Purchases += bucket.Purchases
+		report.Totals.UnitsSold += bucket.UnitsSold
+		report.Totals.Revenue += bucket.Revenue
+	}
+
+	var soldSinceFrom int64
+	for _, p := range purchases {
+		if !p.CreatedAt.UTC().Before(from) {
+			soldSinceFrom += int64(p.Amount)
+		}
+	}
+	report.Totals.finish(stock + soldSinceFrom)
+
+	for _, ps := range byProduct {
+		report.TopProducts = append(report.TopProducts, *ps)
+	}
+
+	sort.Slice(report.TopProducts, func(i, j int) bool {
+		a, b := report.TopProducts[i], report.TopProducts[j]
+		if a.Revenue != b.Revenue {
+			return a.Revenue > b.Revenue
+		}
+		if a.UnitsSold != b.UnitsSold {
+			return a.UnitsSold > b.UnitsSold
+		}
+		return a.ProductID < b.ProductID
+	})
+
+	if len(report.TopProducts) > report_top_products {
+		report.TopProducts = report.TopProducts[:report_top_products]
+	}
+
+	return &report
+}
+
+// finish calculates the averages once the sums are known
+func (b *salesBucket) finish(stockAtStart int64) {
+	if b.Purchases > 0 {
+		b.AverageBasket = b.Revenue / b.Purchases
+	}
+
+	if stockAtStart > 0 {
+		b.SellThrough = float64(b.UnitsSold) / float64(stockAtStart)
+	}
+}
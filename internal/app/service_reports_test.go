@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestReportRange(t *testing.T) {
+
+	// a Wednesday
+	now := time.Date(2022, 10, 12, 15, 4, 5, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	type scenario struct {
+		name     string
+		period   string
+		from, to time.Time
+		expFrom  time.Time
+		expTo    time.Time
+		isValid  bool
+	}
+
+	scenarios := []scenario{
+		{"default days", PERIOD_DAY, time.Time{}, time.Time{}, day(2022, 9, 13), day(2022, 10, 13), true},
+		{"default weeks", PERIOD_WEEK, time.Time{}, time.Time{}, day(2022, 7, 25), day(2022, 10, 17), true},
+		{"default months", PERIOD_MONTH, time.Time{}, time.Time{}, day(2021, 11, 1), day(2022, 11, 1), true},
+		{"given days", PERIOD_DAY, day(2022, 10, 1), day(2022, 10, 3), day(2022, 10, 1), day(2022, 10, 4), true},
+		{"weeks are aligned", PERIOD_WEEK, day(2022, 10, 5), day(2022, 10, 12), day(2022, 10, 3), day(2022, 10, 17), true},
+		{"unknown period", "year", time.Time{}, time.Time{}, time.Time{}, time.Time{}, false},
+		{"from after to", PERIOD_DAY, day(2022, 10, 5), day(2022, 10, 1), time.Time{}, time.Time{}, false},
+		{"too long", PERIOD_DAY, day(2020, 1, 1), day(2022, 1, 1), time.Time{}, time.Time{}, false},
+	}
+
+	for _, s := range scenarios {
+		from, to, err := reportRange(s.period, s.from, s.to, now)
+		if !s.isValid {
+			if err == nil {
+				t.Errorf("%s: should fail", s.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", s.name, err)
+			continue
+		}
+
+		if !from.Equal(s.expFrom) || !to.Equal(s.expTo) {
+			t.Errorf("%s: wrong range. expected: %s - %s, got: %s - %s", s.name, s.expFrom, s.expTo, from, to)
+		}
+	}
+}
+
+func TestBuildSalesReport(t *testing.T) {
+
+	day := func(d, h int) time.Time { return time.Date(2022, 10, d, h, 0, 0, 0, time.UTC) }
+
+	products := []model.Product{
+		{ID: "cola", Name: "Cola", AmountAvailable: 5},
+		{ID: "chips", Name: "Chips", AmountAvailable: 5},
+	}
+
+	purchases := []model.Purchase{
+		{ProductID: "cola", Amount: 2, TotalPrice: 100, CreatedAt: day(1, 10)},
+		{ProductID: "chips", Amount: 1, TotalPrice: 30, CreatedAt: day(1, 18)},
+		{ProductID: "cola", Amount: 3, TotalPrice: 150, CreatedAt: day(2, 9)},
+		// refunded and put back on sale
+		{ProductID: "chips", Amount: 0, TotalPrice: 0, CreatedAt: day(2, 12)},
+		// after the report, still counts for the stock
+		{ProductID: "chips", Amount: 4, TotalPrice: 120, CreatedAt: day(5, 9)},
+	}
+
+	report := buildSalesReport(PERIOD_DAY, day(1, 0), day(3, 0), purchases, products)
+
+	if len(report.Buckets) != 2 {
+		t.Fatalf("wrong number of buckets. expected: %d, got: %d", 2, len(report.Buckets))
+	}
+
+	first := report.Buckets[0]
+	if first.Purchases != 2 || first.UnitsSold != 3 || first.Revenue != 130 || first.AverageBasket != 65 {
+		t.Errorf("wrong first day: %+v", first)
+	}
+
+	// stock at the start of the first day: 10 now + 10 sold since
+	if first.SellThrough != 0.15 {
+		t.Errorf("wrong sell through. expected: %v, got: %v", 0.15, first.SellThrough)
+	}
+
+	second := report.Buckets[1]
+	if second.Purchases != 1 || second.UnitsSold != 3 || second.Revenue != 150 || second.SellThrough != 3.0/17 {
+		t.Errorf("wrong second day: %+v", second)
+	}
+
+	if report.Totals.UnitsSold != 6 || report.Totals.Revenue != 280 || report.Totals.AverageBasket != 93 {
+		t.Errorf("wrong totals: %+v", report.Totals)
+	}
+
+	if len(report.TopProducts) != 2 || report.TopProducts[0].Name != "Cola" || report.TopProducts[0].Revenue != 250 {
+		t.Errorf("wrong top products: %+v", report.TopProducts)
+	}
+}
+
+func TestSellerReportFailNotSeller(t *testing.T) {
+	if _, err := NewApp("", nil).SellerReport(context.Background(), &model.User{Role: model.ROLE_BUYER}, PERIOD_DAY, time.Time{}, time.Time{}); err == nil {
+		t.Fatal("only sellers have reports")
+	}
+}
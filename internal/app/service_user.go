@@ -2,16 +2,47 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/mehiX/vending-machine-api/internal/app/model"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const password_min_length = 8
 
-func (a *App) CreateUser(ctx context.Context, username, password string, role model.TypeRole) (err error) {
+var errBadCredentials = errors.New("credentials don't match")
+
+// dummyPasswordHash is checked against when the username doesn't exist, so unknown users take as long as wrong passwords.
+// It is made with the configured hashing, on first use.
+func (a *App) dummyPasswordHash() string {
+	a.dummyHashOnce.Do(func() {
+		a.dummyHash, _ = a.Passwords.Hash("no user has this password")
+	})
+	return a.dummyHash
+}
+
+// errRoleNotAllowed is returned when somebody registers with a role only given by admins
+var errRoleNotAllowed = errors.New("role not allowed at registration")
+
+// RegisterUser creates the account of somebody signing up. Only buyers and sellers can sign up,
+// admins are created with CreateAdmin, or given the role by another admin
+func (a *App) RegisterUser(ctx context.Context, username, password string, role model.TypeRole) (userID string, err error) {
+
+	if role != model.ROLE_BUYER && role != model.ROLE_SELLER {
+		return "", fmt.Errorf("%w: %s", errRoleNotAllowed, role)
+	}
+
+	return a.CreateUser(ctx, username, password, role)
+}
+
+// CreateAdmin creates an admin. It is not reachable over HTTP, see cmd/createadmin
+func (a *App) CreateAdmin(ctx context.Context, username, password string) (userID string, err error) {
+	return a.CreateUser(ctx, username, password, model.ROLE_ADMIN)
+}
+
+func (a *App) CreateUser(ctx context.Context, username, password string, role model.TypeRole) (userID string, err error) {
 
 	if err = validateUsername(username); err != nil {
 		return
@@ -25,77 +56,276 @@ func (a *App) CreateUser(ctx context.Context, username, password string, role mo
 		return
 	}
 
-	encPasswd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	encPasswd, err := a.Passwords.Hash(password)
 	if err != nil {
 		return
 	}
 
-	return a.dbCreateUser(ctx, username, string(encPasswd), role)
+	return a.dbCreateUser(ctx, username, encPasswd, role)
 }
 
+// FindUserByCredentials returns errBadCredentials for unknown usernames and wrong passwords alike.
+// A hash made with outdated settings is replaced, now that the password is known.
 func (a *App) FindUserByCredentials(ctx context.Context, username, password string) (*model.User, error) {
 
 	usr, err := a.dbFindUserByUsername(ctx, username)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			checkPassword(a.dummyPasswordHash(), password)
+			return nil, errBadCredentials
+		}
 		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(usr.Password), []byte(password)); err != nil {
-		return nil, errors.New("credentials don't match")
+	if !checkPassword(usr.Password, password) {
+		return nil, errBadCredentials
 	}
 
-	usr.Password = ""
+	if a.Passwords.NeedsRehash(usr.Password) {
+		a.rehashPassword(ctx, usr, password)
+	}
 
 	return usr, nil
 }
 
+// rehashPassword replaces the user's hash with one made with the current settings. If it fails the old hash stays,
+// the user still logs in. The password is the same, so the user's other sessions and reset tokens stay valid.
+func (a *App) rehashPassword(ctx context.Context, usr *model.User, password string) {
+
+	hash, err := a.Passwords.Hash(password)
+	if err != nil {
+		fmt.Println("password rehash", usr.ID, err)
+		return
+	}
+
+	if err := a.dbRehashPassword(ctx, usr.ID, usr.Password, hash); err != nil {
+		// changed by another request, nothing left to rehash
+		if !errors.Is(err, errPasswordChanged) {
+			fmt.Println("password rehash", usr.ID, err)
+		}
+		return
+	}
+	a.Users.Invalidate(usr.ID)
+
+	usr.Password = hash
+}
+
 func (a *App) FindUserByID(ctx context.Context, id string) (*model.User, error) {
 	return a.dbFindUserByID(ctx, id)
 }
 
-func (a *App) ResetDeposit(ctx context.Context, usr *model.User) error {
-	return a.dbUserUpdateDeposit(ctx, usr.ID, 0)
+// ResetDeposit gives the buyer's deposit back in coins from the coin box, and any notes held in escrow.
+// Returns the amount given back and the coins taken out of the coin box.
+func (a *App) ResetDeposit(ctx context.Context, usr *model.User) (*resetEvent, error) {
+
+	inventory, err := a.dbCoinInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reset, err := a.dbResetDeposit(ctx, usr.ID, inventory)
+	if err != nil {
+		return nil, err
+	}
+	a.Users.Invalidate(usr.ID)
+
+	a.publishLive(ctx, model.EVENT_BALANCE_CHANGED, usr.ID, balanceChange{Deposit: 0})
+
+	return &reset, nil
 }
 
-func (a *App) UserDepositCoin(ctx context.Context, usr *model.User, coin int) error {
+func (a *App) UserDepositCoin(ctx context.Context, usr *model.User, coin int) (int64, error) {
+	return a.UserDepositCoins(ctx, usr, []int{coin})
+}
+
+var (
+	errCoinNotAllowed = errors.New("coin value not allowed")
+	errDepositFailed  = errors.New("deposit failed") // the coins were fine, the deposit could not be saved
+)
 
-	if err := validateDepositCoin(coin); err != nil {
-		return errors.New("coin value not allowed")
+// max_coins_per_deposit limits how many coins can be deposited in one request
+const max_coins_per_deposit = 100
+
+// UserDepositCoins adds all the coins to the buyer's deposit, or none if any of them is not accepted.
+// Returns the new deposit
+func (a *App) UserDepositCoins(ctx context.Context, usr *model.User, coins []int) (int64, error) {
+
+	if len(coins) == 0 {
+		return 0, errors.New("no coins")
+	}
+
+	if len(coins) > max_coins_per_deposit {
+		return 0, fmt.Errorf("maximum %d coins at a time", max_coins_per_deposit)
+	}
+
+	values := make([]int64, len(coins))
+	for i, coin := range coins {
+		if err := a.Currency.validateDepositCoin(coin); err != nil {
+			return 0, errCoinNotAllowed
+		}
+		values[i] = int64(coin)
 	}
 
-	if err := a.dbUserUpdateDeposit(ctx, usr.ID, usr.Deposit+int64(coin)); err != nil {
+	deposit, err := a.dbDepositCoins(ctx, usr.ID, values)
+	if err != nil {
 		fmt.Println("deposit error", err)
-		return errors.New("deposit failed")
+		return 0, errDepositFailed
 	}
+	a.Users.Invalidate(usr.ID)
+
+	a.publishLive(ctx, model.EVENT_BALANCE_CHANGED, usr.ID, balanceChange{Deposit: deposit})
 
-	return nil
+	return deposit, nil
 }
 
-func (a *App) Buy(ctx context.Context, user *model.User, prod *model.Product, amount int) error {
+// errNotEnoughDeposit is returned when the deposit and the notes in escrow don't pay for a buy
+var errNotEnoughDeposit = errors.New("not enough deposit")
+
+// errNoAvailability is returned when the product doesn't have the units to buy
+var errNoAvailability = errors.New("no availability")
+
+type buyResult struct {
+	PurchaseID string
+	TotalCost  int64
+	BasePrice  int64            // price before the promotion
+	Promotion  *model.Promotion // applied promotion, if any
+	Remaining  int64            // buyer's deposit after the buy
+}
+
+// Buy pays for the products with the buyer's deposit.
+// The price comes from the seller's promotions, if any applies. If they can't be loaded, the list price is used.
+// Notes held in escrow are only collected if the deposit alone is not enough.
+// The purchase stays pending until the vend is confirmed or rolled back.
+func (a *App) Buy(ctx context.Context, user *model.User, prod *model.Product, amount int) (*buyResult, error) {
 	if amount > int(prod.AmountAvailable) {
-		return errors.New("no availability")
+		return nil, errNoAvailability
+	}
+
+	promos, err := a.dbSellerPromotions(ctx, prod.SellerID)
+	if err != nil {
+		fmt.Println("promotions lookup failed, using list price", err)
+	}
+
+	price := a.Currency.priceFor(prod, amount, promos, time.Now())
+	totalCost := price.Total
+
+	// checked again in the transaction, the notes can be given back meanwhile
+	var fromEscrow int64
+	if user.Deposit < totalCost {
+		notes, err := a.dbEscrowNotes(ctx, user.ID)
+		if err != nil {
+			fmt.Println("escrow notes", err)
+			return nil, errNotEnoughDeposit
+		}
+
+		var escrowTotal int64
+		for _, n := range notes {
+			escrowTotal += n
+		}
+
+		if user.Deposit+escrowTotal < totalCost {
+			return nil, errNotEnoughDeposit
+		}
+
+		fromEscrow = totalCost - user.Deposit
+	}
+
+	purchase := model.Purchase{
+		UserID:     user.ID,
+		ProductID:  prod.ID,
+		SellerID:   prod.SellerID,
+		Amount:     amount,
+		UnitCost:   prod.Cost,
+		PriceID:    prod.PriceID,
+		BasePrice:  price.Base,
+		TotalPrice: totalCost,
+	}
+	if price.Promotion != nil {
+		purchase.PromotionID = price.Promotion.ID
+	}
+
+	purchase.Commission = totalCost * a.CommissionPercent / 100
+
+	escrowTotal, err := a.dbBuy(ctx, &purchase, fromEscrow)
+	if err != nil {
+		return nil, err
+	}
+	a.Users.Invalidate(user.ID)
+
+	remaining := user.Deposit + escrowTotal - totalCost
+
+	a.publishLive(ctx, model.EVENT_BALANCE_CHANGED, user.ID, balanceChange{Deposit: remaining})
+	a.publishLive(ctx, model.EVENT_STOCK_CHANGED, "", stockChange{ProductID: prod.ID, AmountAvailable: prod.AmountAvailable - int64(amount)})
+
+	return &buyResult{
+		PurchaseID: purchase.ID,
+		TotalCost:  totalCost,
+		BasePrice:  price.Base,
+		Promotion:  price.Promotion,
+		Remaining:  remaining,
+	}, nil
+}
+
+// userDetails is a user as admins see it, with the state of its logins
+type userDetails struct {
+	model.User
+	Lockout LockoutStatus
+}
+
+// UserDetails shows the user and its failed logins
+func (a *App) UserDetails(ctx context.Context, userID string) (*userDetails, error) {
+
+	usr, err := a.FindUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
 	}
 
-	if user.Deposit < int64(amount)*prod.Cost {
-		return errors.New("not enough deposit")
+	usr.Password = ""
+
+	return &userDetails{User: *usr, Lockout: a.Logins.Status(usr.Username)}, nil
+}
+
+// UnlockUser lets the user log in again right away, forgetting its failed logins.
+// Returns the user and the failed logins it had.
+func (a *App) UnlockUser(ctx context.Context, userID string) (*userDetails, LockoutStatus, error) {
+
+	usr, err := a.FindUserByID(ctx, userID)
+	if err != nil {
+		return nil, LockoutStatus{}, err
 	}
 
-	return a.dbBuy(ctx, user.ID, prod.ID, amount, int64(amount)*prod.Cost)
+	usr.Password = ""
+
+	before := a.Logins.Status(usr.Username)
+	a.Logins.Unlock(usr.Username)
+
+	return &userDetails{User: *usr, Lockout: a.Logins.Status(usr.Username)}, before, nil
 }
 
-// getChange splits the amount `n` in coins of 5, 10, 20, 50, 100
-// It assumes that the vending machine has all types of coins available at any time, in sufficient amounts
-// The amount `n` should be a multiple of 5.
-func getChange(n int64) [5]int64 {
+var errInvalidRoles = errors.New("invalid roles")
 
-	values := []int64{5, 10, 20, 50, 100}
-	coins := [5]int64{}
+// SetUserRoles replaces the user's roles, the first one becomes the main role.
+// Returns the user and the roles it had.
+func (a *App) SetUserRoles(ctx context.Context, userID string, roles []model.TypeRole) (*userDetails, []model.TypeRole, error) {
 
-	remaining := n
-	for i := 4; i >= 0; i-- {
-		coins[i] = remaining / values[i]
-		remaining -= coins[i] * values[i]
+	if err := validateRoles(roles); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errInvalidRoles, err)
+	}
+
+	usr, err := a.FindUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return coins
+	before := usr.AllRoles()
+
+	if err := a.dbSetUserRoles(ctx, usr.ID, roles); err != nil {
+		return nil, nil, err
+	}
+	a.Users.Invalidate(usr.ID)
+
+	usr.Password = ""
+	usr.SetRoles(roles)
+
+	return &userDetails{User: *usr, Lockout: a.Logins.Status(usr.Username)}, before, nil
 }
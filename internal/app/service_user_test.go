@@ -2,8 +2,9 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"errors"
-	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
@@ -28,6 +29,24 @@ func TestFindByCredentialsMissingUsername(t *testing.T) {
 	}
 }
 
+func TestFindByCredentialsUnknownUser(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").
+		WithArgs("nobody").WillReturnError(sql.ErrNoRows)
+
+	// unknown users get the same error as wrong passwords
+	_, err = NewApp("", db).FindUserByCredentials(context.Background(), "nobody", "somepassword")
+	if !errors.Is(err, errBadCredentials) {
+		t.Errorf("wrong error. expected: %v, got: %v", errBadCredentials, err)
+	}
+}
+
 func TestFindByCredentialsPasswordMissmatch(t *testing.T) {
 
 	db, mock, err := sqlmock.New()
@@ -40,21 +59,78 @@ func TestFindByCredentialsPasswordMissmatch(t *testing.T) {
 	testPassword := "mh12&^KJlwekJ*"
 	testRole := model.ROLE_BUYER
 
-	columns := []string{"id", "username", "password", "deposit", "role"}
+	columns := []string{"id", "username", "password", "deposit", "role", "session_version"}
 
 	encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
 
-	mock.ExpectQuery("select id, username, password, deposit, role from users where username=").
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").
 		WithArgs(testUser).WillReturnRows(sqlmock.NewRows(columns).
-		AddRow("id1", testUser, encPasswd, 100, testRole))
+		AddRow("id1", testUser, encPasswd, 100, testRole, 0))
 
 	vm := NewApp("", db)
 	u, err := vm.FindUserByCredentials(context.Background(), testUser, "somepasswordDifferentThanTestPassword")
-	if err == nil || u != nil {
+	if !errors.Is(err, errBadCredentials) || u != nil {
 		t.Error("expect error for wrong password")
 	}
 }
 
+func TestFindByCredentialsRehash(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testPassword := "mh12&^KJlwekJ*"
+	encPasswd, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "password", "deposit", "role", "session_version"}).AddRow("id1", "mihaiusr", encPasswd, 100, model.ROLE_BUYER, 0)
+	}
+
+	vm := NewApp("", db)
+	vm.Passwords = PasswordHashing{Scheme: hash_argon2id, Argon2: testArgon2}
+
+	// the new hash can't be saved, the user logs in with the old one
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").WithArgs("mihaiusr").WillReturnRows(userRow())
+	mock.ExpectExec(`update users set password=\? where id=\? and password=\?`).WithArgs(sqlmock.AnyArg(), "id1", string(encPasswd)).WillReturnError(errors.New("db down"))
+
+	u, err := vm.FindUserByCredentials(context.Background(), "mihaiusr", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Password != string(encPasswd) {
+		t.Errorf("old hash should be kept, got: %s", u.Password)
+	}
+
+	// the hash was changed by another request meanwhile, it is left alone
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").WithArgs("mihaiusr").WillReturnRows(userRow())
+	mock.ExpectExec(`update users set password=\? where id=\? and password=\?`).WithArgs(sqlmock.AnyArg(), "id1", string(encPasswd)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	u, err = vm.FindUserByCredentials(context.Background(), "mihaiusr", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Password != string(encPasswd) {
+		t.Errorf("old hash should be kept, got: %s", u.Password)
+	}
+
+	mock.ExpectQuery("select id, username, password, deposit, role, session_version from users where username=").WithArgs("mihaiusr").WillReturnRows(userRow())
+	mock.ExpectExec(`update users set password=\? where id=\? and password=\?`).WithArgs(sqlmock.AnyArg(), "id1", string(encPasswd)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	u, err = vm.FindUserByCredentials(context.Background(), "mihaiusr", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Password, "$argon2id$") || !checkPassword(u.Password, testPassword) {
+		t.Errorf("wrong new hash: %s", u.Password)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCreateUserSuccess(t *testing.T) {
 
 	db, mock, err := sqlmock.New()
@@ -67,43 +143,75 @@ func TestCreateUserSuccess(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectExec(`insert into users`).WithArgs(sqlmock.AnyArg(), "goodusername", sqlmock.AnyArg(), model.ROLE_ADMIN).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	if err := NewApp("", db).CreateUser(context.Background(), "goodusername", testPassword, model.ROLE_ADMIN); err != nil {
+	if _, err := NewApp("", db).CreateUser(context.Background(), "goodusername", testPassword, model.ROLE_ADMIN); err != nil {
 		t.Errorf("unexpected error when creating a user: %s", err)
 	}
 
 }
 func TestCreateUserFailOnValidateUsername(t *testing.T) {
 
-	if err := NewApp("", nil).CreateUser(context.Background(), "short", "", model.ROLE_ADMIN); err == nil {
+	if _, err := NewApp("", nil).CreateUser(context.Background(), "short", "", model.ROLE_ADMIN); err == nil {
 		t.Error("expect to return error for invalid username")
 	}
 }
 
 func TestCreateUserFailOnValidatePassword(t *testing.T) {
 
-	if err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "wrong", model.ROLE_ADMIN); err == nil {
+	if _, err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "wrong", model.ROLE_ADMIN); err == nil {
 		t.Error("expect to return error for invalid password")
 	}
 }
 
 func TestCreateUserFailOnValidateRole(t *testing.T) {
 
-	if err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "ui&*789SDJA87&", model.TypeRole("anything")); err == nil {
+	if _, err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "ui&*789SDJA87&", model.TypeRole("anything")); err == nil {
 		t.Error("expect to return error for invalid role")
 	}
 }
 
+func TestRegisterUserRoles(t *testing.T) {
+
+	for _, role := range []model.TypeRole{model.ROLE_ADMIN, "", "anything"} {
+		if _, err := NewApp("", nil).RegisterUser(context.Background(), "goodusername", "ui&*789SDJA87&", role); !errors.Is(err, errRoleNotAllowed) {
+			t.Errorf("registering as %q should not be allowed, got: %v", role, err)
+		}
+	}
+}
+
+func TestCreateAdmin(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into users`).WithArgs(sqlmock.AnyArg(), "goodusername", sqlmock.AnyArg(), model.ROLE_ADMIN).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if _, err := NewApp("", db).CreateAdmin(context.Background(), "goodusername", "ui&*789SDJA87&"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCreateUserFailOnNoDatabase(t *testing.T) {
 
-	if err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "ui&*789SDJA87&", model.ROLE_ADMIN); err == nil {
+	if _, err := NewApp("", nil).CreateUser(context.Background(), "goodusername", "ui&*789SDJA87&", model.ROLE_ADMIN); err == nil {
 		t.Error("expect to return error if no database defined")
 	}
 }
 
 func TestUserDepositCoinFailWrongCoin(t *testing.T) {
-	if err := NewApp("", nil).UserDepositCoin(context.Background(), nil, 40); err == nil {
+	if _, err := NewApp("", nil).UserDepositCoin(context.Background(), nil, 40); err == nil {
 		t.Fatal("should not accept wrong coin values")
 	} else {
 		if err.Error() != "coin value not allowed" {
@@ -112,36 +220,24 @@ func TestUserDepositCoinFailWrongCoin(t *testing.T) {
 	}
 }
 
-func TestGetChange(t *testing.T) {
-
-	type scenario struct {
-		n      int64
-		change [5]int64
-	}
-
-	scenarios := []scenario{
-		{5, [5]int64{1, 0, 0, 0, 0}},
-		{10, [5]int64{0, 1, 0, 0, 0}},
-		{15, [5]int64{1, 1, 0, 0, 0}},
-		{20, [5]int64{0, 0, 1, 0, 0}},
-		{25, [5]int64{1, 0, 1, 0, 0}},
-		{30, [5]int64{0, 1, 1, 0, 0}},
-		{35, [5]int64{1, 1, 1, 0, 0}},
-		{40, [5]int64{0, 0, 2, 0, 0}},
-		{45, [5]int64{1, 0, 2, 0, 0}},
-		{50, [5]int64{0, 0, 0, 1, 0}},
-		{100, [5]int64{0, 0, 0, 0, 1}},
-		{105, [5]int64{1, 0, 0, 0, 1}},
-		{385, [5]int64{1, 1, 1, 1, 3}},
-	}
-
-	for _, s := range scenarios {
-		t.Run(fmt.Sprintf("%d", s.n), func(t *testing.T) {
-			t.Parallel()
-			res := getChange(s.n)
-			if res != s.change {
-				t.Errorf("wrong change. expected: %v, got: %v", s.change, res)
-			}
-		})
+func TestUserDepositCoinsValidation(t *testing.T) {
+
+	vm := NewApp("", nil)
+	usr := &model.User{ID: "userid", Role: model.ROLE_BUYER}
+
+	if _, err := vm.UserDepositCoins(context.Background(), usr, nil); err == nil {
+		t.Error("should fail if there are no coins")
+	}
+
+	if _, err := vm.UserDepositCoins(context.Background(), usr, []int{50, 20, 40}); !errors.Is(err, errCoinNotAllowed) {
+		t.Errorf("should refuse the batch if a coin is not accepted, got: %v", err)
+	}
+
+	tooMany := make([]int, max_coins_per_deposit+1)
+	for i := range tooMany {
+		tooMany[i] = 5
+	}
+	if _, err := vm.UserDepositCoins(context.Background(), usr, tooMany); err == nil {
+		t.Error("should fail for too many coins")
 	}
 }
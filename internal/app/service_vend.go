@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	// pending vends older than this are refunded
+	vend_timeout          = 60 * time.Second
+	vend_dispense_timeout = 30 * time.Second
+	// dispensing and confirming take less than the vend timeout, so a delivered vend is never refunded
+	vend_confirm_timeout = 20 * time.Second
+	vend_confirm_retry   = 200 * time.Millisecond
+	vend_failures_list   = 100
+	vend_reason_max      = 255
+	vend_reason_timeout  = "timeout"
+)
+
+// Dispenser drops the products of a purchase. Vend returns once they dropped,
+// or with an error if the machine could not deliver them (jam, empty slot...).
+type Dispenser interface {
+	Vend(ctx context.Context, p model.Purchase) error
+}
+
+// Vend buys the products and has the dispenser deliver them. If the dispenser fails, the buy is rolled back.
+// Without a dispenser attached to the API the products count as delivered right away.
+func (a *App) Vend(ctx context.Context, usr *model.User, prod *model.Product, amount int) (*buyResult, error) {
+
+	res, err := a.Buy(ctx, usr, prod, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Dispenser == nil {
+		if err := a.confirmDelivered(ctx, usr, res.PurchaseID); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, vend_dispense_timeout)
+	defer cancel()
+
+	err = a.Dispenser.Vend(dctx, model.Purchase{
+		ID:         res.PurchaseID,
+		UserID:     usr.ID,
+		ProductID:  prod.ID,
+		SellerID:   prod.SellerID,
+		Amount:     amount,
+		TotalPrice: res.TotalCost,
+	})
+	if err != nil {
+		fmt.Println("dispenser", res.PurchaseID, err)
+		if _, err := a.refundVend(ctx, res.PurchaseID, usr.ID, err.Error()); err != nil {
+			fmt.Println("refund vend", res.PurchaseID, err)
+			return nil, errors.New("vend failed")
+		}
+		return nil, errors.New("vend failed, the deposit was refunded")
+	}
+
+	if err := a.confirmDelivered(ctx, usr, res.PurchaseID); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// confirmDelivered completes a purchase whose products the buyer already has. It goes on when the request is cancelled
+// and retries failures, because a purchase left pending would be refunded by the vend timeouts.
+func (a *App) confirmDelivered(ctx context.Context, usr *model.User, purchaseID string) error {
+
+	ctx, cancel := context.WithTimeout(withoutCancel{ctx}, vend_confirm_timeout)
+	defer cancel()
+
+	wait := vend_confirm_retry
+	for {
+		err := a.ConfirmVend(ctx, usr, purchaseID)
+		if err == nil || errors.Is(err, errVendNotPending) {
+			return err
+		}
+		fmt.Println("confirm vend", purchaseID, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// withoutCancel keeps the values of the parent context, but not its deadline or cancellation
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
+
+// ConfirmVend completes the buyer's pending purchase once the products dropped
+func (a *App) ConfirmVend(ctx context.Context, usr *model.User, purchaseID string) error {
+
+	if purchaseID == "" {
+		return errors.New("missing vend_id")
+	}
+
+	return a.dbConfirmVend(ctx, purchaseID, usr.ID)
+}
+
+// FailVend rolls back the buyer's pending purchase the machine could not deliver
+func (a *App) FailVend(ctx context.Context, usr *model.User, purchaseID, reason string) (*vendRollback, error) {
+
+	if purchaseID == "" {
+		return nil, errors.New("missing vend_id")
+	}
+
+	return a.refundVend(ctx, purchaseID, usr.ID, reason)
+}
+
+func (a *App) VendFailures(ctx context.Context) ([]model.VendFailure, error) {
+	return a.dbVendFailures(ctx, vend_failures_list)
+}
+
+// refundVend rolls back a pending purchase and tells the live clients about the new balance and stock
+func (a *App) refundVend(ctx context.Context, purchaseID, userID, reason string) (*vendRollback, error) {
+
+	if reason == "" {
+		reason = "unknown"
+	}
+	if len(reason) > vend_reason_max {
+		reason = reason[:vend_reason_max]
+	}
+
+	rb, err := a.dbFailVend(ctx, purchaseID, userID, reason)
+	if err != nil {
+		return nil, err
+	}
+	a.Users.Invalidate(rb.Failure.UserID)
+
+	a.auditAction(ctx, model.AUDIT_VEND_FAILED, "purchase", purchaseID, nil, rb.Failure)
+
+	a.publishLive(ctx, model.EVENT_BALANCE_CHANGED, rb.Failure.UserID, balanceChange{Deposit: rb.Deposit})
+	a.publishLive(ctx, model.EVENT_STOCK_CHANGED, "", stockChange{ProductID: rb.Failure.ProductID, AmountAvailable: rb.AvailableAmount})
+
+	return rb, nil
+}
+
+// RunVendTimeouts refunds the vends that were not confirmed in time.
+// Checks every `interval` until `done` is cancelled. Should be run in a separate goroutine.
+func (a *App) RunVendTimeouts(done context.Context, interval time.Duration) {
+
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-done.Done():
+			return
+		case <-tkr.C:
+			if a.Db == nil {
+				continue
+			}
+
+			if err := a.expireVends(done); err != nil {
+				fmt.Println("vend timeouts:", err)
+			}
+		}
+	}
+}
+
+func (a *App) expireVends(ctx context.Context) error {
+
+	ids, err := a.dbExpiredVends(ctx, vend_timeout)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// confirmed or failed in the meantime
+		if _, err := a.refundVend(ctx, id, "", vend_reason_timeout); err != nil && !errors.Is(err, errVendNotPending) {
+			fmt.Println("refund vend", id, err)
+		}
+	}
+
+	return nil
+}
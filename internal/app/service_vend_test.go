@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+type jammedDispenser struct{}
+
+func (jammedDispenser) Vend(ctx context.Context, p model.Purchase) error {
+	return errors.New("motor jam")
+}
+
+// disconnectingDispenser delivers the products, but the buyer hung up meanwhile
+type disconnectingDispenser struct {
+	cancel context.CancelFunc
+}
+
+func (d disconnectingDispenser) Vend(ctx context.Context, p model.Purchase) error {
+	d.cancel()
+	return nil
+}
+
+func TestVendConfirmsDeliveredAfterDisconnect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select .* from promotions`).WithArgs("seller").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount`).WithArgs(1, "prod", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(50, "buyer", 50).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(8, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	// the first confirmation fails, it is retried
+	mock.ExpectExec(`update purchases set status=\?`).WithArgs(model.VEND_COMPLETED, sqlmock.AnyArg(), "buyer", model.VEND_PENDING).WillReturnError(errors.New("connection lost"))
+	mock.ExpectExec(`update purchases set status=\?`).WithArgs(model.VEND_COMPLETED, sqlmock.AnyArg(), "buyer", model.VEND_PENDING).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vm := NewApp("", db)
+	vm.Dispenser = disconnectingDispenser{cancel: cancel}
+
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 100}
+	prod := &model.Product{ID: "prod", SellerID: "seller", Cost: 50, AmountAvailable: 9}
+
+	if _, err := vm.Vend(ctx, usr, prod, 1); err != nil {
+		t.Errorf("delivered vend should be confirmed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVendRefundsWhenDispenserFails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select .* from promotions`).WithArgs("seller").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seller_id", "product_id", "name", "type", "value", "from_hour", "to_hour"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`update products set available_amount`).WithArgs(2, "prod", 2).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update users set deposit = deposit - \?`).WithArgs(100, "buyer", 100).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into purchases`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into seller_ledger`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select available_amount, low_stock_threshold from products`).WillReturnRows(sqlmock.NewRows([]string{"available_amount", "low_stock_threshold"}).AddRow(7, 0))
+	mock.ExpectExec(`insert into outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectFailVend(mock, sqlmock.AnyArg(), "motor jam")
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_VEND_FAILED, "purchase", sqlmock.AnyArg(), nil, sqlmock.AnyArg(), "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	vm := NewApp("", db)
+	vm.CommissionPercent = 10
+	vm.Dispenser = jammedDispenser{}
+
+	events, cancel := vm.Bus.Subscribe(8)
+	defer cancel()
+
+	usr := &model.User{ID: "buyer", Role: model.ROLE_BUYER, Deposit: 120}
+	prod := &model.Product{ID: "prod", SellerID: "seller", Cost: 50, AmountAvailable: 9}
+
+	_, err = vm.Vend(context.Background(), usr, prod, 2)
+	if err == nil || !strings.Contains(err.Error(), "refunded") {
+		t.Errorf("wrong error. expected: the deposit was refunded, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// balance and stock after the buy, then after the refund
+	var last []model.Event
+	for len(events) > 0 {
+		last = append(last, <-events)
+	}
+
+	if len(last) != 4 || !strings.Contains(last[2].Payload, `"deposit":120`) || !strings.Contains(last[3].Payload, `"amount_available":7`) {
+		t.Errorf("wrong live events after the refund: %+v", last)
+	}
+}
+
+func TestExpireVends(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`select id from purchases where status=\?`).WithArgs(model.VEND_PENDING, 60).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("p1").AddRow("p2"))
+	expectFailVend(mock, "p1", "timeout")
+	// refunded by the system, nobody acted
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), nil, model.AUDIT_VEND_FAILED, "purchase", "p1", nil, sqlmock.AnyArg(), "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// p2 was confirmed in the meantime
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select user_id, product_id, seller_id, amount, total_price from purchases`).WithArgs("p2", model.VEND_PENDING).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_id", "seller_id", "amount", "total_price"}))
+	mock.ExpectRollback()
+
+	if err := NewApp("", db).expireVends(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// webhookEvents are the events that can be subscribed to
+var webhookEvents = []model.TypeEvent{
+	model.EVENT_USER_CREATED,
+	model.EVENT_DEPOSIT_CREATED,
+	model.EVENT_DEPOSIT_RESET,
+	model.EVENT_PURCHASE,
+	model.EVENT_VEND_FAILED,
+	model.EVENT_REFUND,
+	model.EVENT_PRODUCT_CREATED,
+	model.EVENT_PRODUCT_UPDATED,
+	model.EVENT_PRODUCT_DELETED,
+	model.EVENT_STOCK_LOW,
+	model.EVENT_STOCK_SOLD_OUT,
+}
+
+const (
+	webhook_max_attempts    = 8
+	webhook_backoff_base    = 30 * time.Second
+	webhook_backoff_max     = time.Hour
+	webhook_batch_size      = 50
+	webhook_deliveries_list = 100
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// CreateWebhook subscribes `hookURL` to the events. A random secret is generated if none is given
+func (a *App) CreateWebhook(ctx context.Context, hookURL string, events []model.TypeEvent, secret string) (*model.WebhookSubscription, error) {
+
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be an http(s) URL")
+	}
+
+	if err := validateEvents(events); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	sub := model.WebhookSubscription{
+		ID:        uuid.New().String(),
+		URL:       hookURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	if err := a.dbCreateWebhook(ctx, sub); err != nil {
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+func validateEvents(events []model.TypeEvent) error {
+
+	if len(events) == 0 {
+		return errors.New("no events")
+	}
+
+	for _, e := range events {
+		if e == "*" {
+			if len(events) > 1 {
+				return errors.New("`*` cannot be combined with other events")
+			}
+			continue
+		}
+
+		known := false
+		for _, w := range webhookEvents {
+			if e == w {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return fmt.Errorf("unknown event: %s", e)
+		}
+	}
+
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (a *App) ListWebhooks(ctx context.Context) ([]model.WebhookSubscription, error) {
+	return a.dbWebhooks(ctx)
+}
+
+func (a *App) DeleteWebhook(ctx context.Context, id string) error {
+	return a.dbDeleteWebhook(ctx, id)
+}
+
+// WebhookDeliveries is the delivery log of a subscription, latest deliveries first
+func (a *App) WebhookDeliveries(ctx context.Context, id string) ([]model.WebhookDelivery, error) {
+	return a.dbWebhookDeliveries(ctx, id, webhook_deliveries_list)
+}
+
+// PingWebhook sends a `ping` event to the subscription right away and returns the outcome.
+// Failed pings are not retried.
+func (a *App) PingWebhook(ctx context.Context, id string) (*model.WebhookDelivery, error) {
+
+	sub, err := a.dbFindWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(eventBody{
+		ID:        uuid.New().String(),
+		Type:      model.EVENT_PING,
+		CreatedAt: time.Now().UTC(),
+		Data:      struct{}{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := dueDelivery{
+		WebhookDelivery: model.WebhookDelivery{
+			ID:             uuid.New().String(),
+			SubscriptionID: sub.ID,
+			EventType:      model.EVENT_PING,
+			Payload:        string(payload),
+			Status:         model.DELIVERY_PENDING,
+			NextAttemptAt:  time.Now(),
+			CreatedAt:      time.Now(),
+		},
+		URL:    sub.URL,
+		Secret: sub.Secret,
+	}
+
+	if err := a.dbInsertDelivery(ctx, d.WebhookDelivery); err != nil {
+		return nil, err
+	}
+
+	attemptDelivery(ctx, &d, time.Now())
+	if d.Status == model.DELIVERY_PENDING {
+		d.Status = model.DELIVERY_FAILED
+	}
+
+	if err := a.dbUpdateDelivery(ctx, d.WebhookDelivery); err != nil {
+		return nil, err
+	}
+
+	return &d.WebhookDelivery, nil
+}
+
+// RunWebhookDispatcher delivers the queued webhook events.
+// Checks every `interval` until `done` is cancelled. Should be run in a separate goroutine.
+func (a *App) RunWebhookDispatcher(done context.Context, interval time.Duration) {
+
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-done.Done():
+			return
+		case <-tkr.C:
+			if a.Db == nil {
+				continue
+			}
+
+			if err := a.dispatchWebhooks(done); err != nil {
+				fmt.Println("webhooks:", err)
+			}
+		}
+	}
+}
+
+// dispatchWebhooks makes one attempt for every due delivery and saves the outcome
+func (a *App) dispatchWebhooks(ctx context.Context) error {
+
+	due, err := a.dbDueDeliveries(ctx, webhook_batch_size)
+	if err != nil {
+		return err
+	}
+
+	for i := range due {
+		attemptDelivery(ctx, &due[i], time.Now())
+
+		if err := a.dbUpdateDelivery(ctx, due[i].WebhookDelivery); err != nil {
+			fmt.Println("saving delivery", due[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// attemptDelivery posts the payload to the subscriber and updates the delivery with the outcome.
+// Any 2xx response counts as delivered. Otherwise the next attempt is scheduled with exponential backoff,
+// until the delivery runs out of attempts.
+func attemptDelivery(ctx context.Context, d *dueDelivery, now time.Time) {
+
+	d.Attempts++
+
+	statusCode, err := postWebhook(ctx, d.URL, d.Secret, d.ID, d.EventType, []byte(d.Payload), now)
+
+	d.LastStatusCode = statusCode
+	d.LastError = ""
+
+	if err == nil && statusCode >= 200 && statusCode < 300 {
+		d.Status = model.DELIVERY_DELIVERED
+		d.DeliveredAt = &now
+		return
+	}
+
+	if err != nil {
+		d.LastError = err.Error()
+	} else {
+		d.LastError = http.StatusText(statusCode)
+	}
+
+	if d.Attempts >= webhook_max_attempts {
+		d.Status = model.DELIVERY_FAILED
+		return
+	}
+
+	d.NextAttemptAt = now.Add(webhookBackoff(d.Attempts))
+}
+
+// webhookBackoff is the wait after the `attempts`-th failed attempt: 30s, 1m, 2m, 4m... up to an hour
+func webhookBackoff(attempts int) time.Duration {
+
+	wait := webhook_backoff_base
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= webhook_backoff_max {
+			return webhook_backoff_max
+		}
+	}
+
+	return wait
+}
+
+// postWebhook sends the payload, signed with the subscription's secret
+func postWebhook(ctx context.Context, hookURL, secret, deliveryID string, eventType model.TypeEvent, payload []byte, now time.Time) (int, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", deliveryID)
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	return resp.StatusCode, nil
+}
+
+// signWebhook is the hex encoded HMAC-SHA256 of `timestamp.payload` with the subscription's secret.
+// Receivers compute the same value to check the event comes from us and was not replayed.
+func signWebhook(secret, timestamp string, payload []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
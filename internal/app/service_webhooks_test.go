@@ -0,0 +1,242 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+// webhookReceiver checks the signature of every request and answers with `statusCode`
+func webhookReceiver(t *testing.T, secret string, statusCode int, received chan<- *http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "." + string(body)))
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		if r.Header.Get("X-Webhook-Signature") != expected {
+			t.Errorf("wrong signature. expected: %s, got: %s", expected, r.Header.Get("X-Webhook-Signature"))
+		}
+
+		received <- r
+		w.WriteHeader(statusCode)
+	}))
+}
+
+func TestAttemptDeliverySuccess(t *testing.T) {
+
+	received := make(chan *http.Request, 1)
+	srv := webhookReceiver(t, "secret", http.StatusOK, received)
+	defer srv.Close()
+
+	d := &dueDelivery{
+		WebhookDelivery: model.WebhookDelivery{ID: "delivery", EventType: model.EVENT_PURCHASE, Payload: `{"type":"purchase.created"}`, Status: model.DELIVERY_PENDING},
+		URL:             srv.URL,
+		Secret:          "secret",
+	}
+
+	now := time.Now()
+	attemptDelivery(context.Background(), d, now)
+
+	if d.Status != model.DELIVERY_DELIVERED || d.Attempts != 1 || d.LastStatusCode != http.StatusOK || d.DeliveredAt == nil {
+		t.Errorf("wrong delivery after success: %+v", d.WebhookDelivery)
+	}
+
+	r := <-received
+	if r.Header.Get("X-Webhook-Event") != model.EVENT_PURCHASE || r.Header.Get("X-Webhook-ID") != "delivery" {
+		t.Errorf("wrong headers: %v", r.Header)
+	}
+}
+
+func TestAttemptDeliveryRetries(t *testing.T) {
+
+	received := make(chan *http.Request, 2)
+	srv := webhookReceiver(t, "secret", http.StatusServiceUnavailable, received)
+	defer srv.Close()
+
+	d := &dueDelivery{
+		WebhookDelivery: model.WebhookDelivery{ID: "delivery", Payload: `{}`, Status: model.DELIVERY_PENDING, Attempts: 2},
+		URL:             srv.URL,
+		Secret:          "secret",
+	}
+
+	now := time.Now()
+	attemptDelivery(context.Background(), d, now)
+
+	if d.Status != model.DELIVERY_PENDING || d.Attempts != 3 || d.LastStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wrong delivery after failure: %+v", d.WebhookDelivery)
+	}
+
+	if !d.NextAttemptAt.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("wrong next attempt. expected: %v, got: %v", now.Add(2*time.Minute), d.NextAttemptAt)
+	}
+
+	d.Attempts = webhook_max_attempts - 1
+	attemptDelivery(context.Background(), d, now)
+
+	if d.Status != model.DELIVERY_FAILED {
+		t.Errorf("should fail after %d attempts, got: %s", webhook_max_attempts, d.Status)
+	}
+}
+
+func TestAttemptDeliveryUnreachable(t *testing.T) {
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	d := &dueDelivery{WebhookDelivery: model.WebhookDelivery{Payload: `{}`, Status: model.DELIVERY_PENDING}, URL: srv.URL}
+
+	attemptDelivery(context.Background(), d, time.Now())
+
+	if d.Status != model.DELIVERY_PENDING || d.LastStatusCode != 0 || d.LastError == "" {
+		t.Errorf("wrong delivery for unreachable receiver: %+v", d.WebhookDelivery)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+
+	expected := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	}
+
+	for attempts, wait := range expected {
+		if got := webhookBackoff(attempts); got != wait {
+			t.Errorf("%d attempts: wrong backoff. expected: %v, got: %v", attempts, wait, got)
+		}
+	}
+}
+
+func TestCreateWebhookValidation(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		url    string
+		events []model.TypeEvent
+	}
+
+	scenarios := []scenario{
+		{"no url", "", []model.TypeEvent{model.EVENT_PURCHASE}},
+		{"not http", "ftp://example.com", []model.TypeEvent{model.EVENT_PURCHASE}},
+		{"no events", "https://example.com", nil},
+		{"unknown event", "https://example.com", []model.TypeEvent{"coin.swallowed"}},
+		{"ping", "https://example.com", []model.TypeEvent{model.EVENT_PING}},
+		{"all and more", "https://example.com", []model.TypeEvent{"*", model.EVENT_PURCHASE}},
+	}
+
+	for _, s := range scenarios {
+		if _, err := NewApp("", nil).CreateWebhook(context.Background(), s.url, s.events, ""); err == nil {
+			t.Errorf("%s: should fail", s.name)
+		}
+	}
+}
+
+func TestCreateWebhookGeneratesSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into webhook_subscriptions`).WithArgs(sqlmock.AnyArg(), "https://example.com/hook", "purchase.created,deposit.created", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	sub, err := NewApp("", db).CreateWebhook(context.Background(), "https://example.com/hook", []model.TypeEvent{model.EVENT_PURCHASE, model.EVENT_DEPOSIT_CREATED}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sub.Secret) != 64 {
+		t.Errorf("wrong secret length. expected: %d, got: %d", 64, len(sub.Secret))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	received := make(chan *http.Request, 1)
+	srv := webhookReceiver(t, "secret", http.StatusNoContent, received)
+	defer srv.Close()
+
+	mock.ExpectQuery(`select .* from webhook_deliveries d join webhook_subscriptions s`).WithArgs(model.DELIVERY_PENDING, webhook_batch_size).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event_type", "payload", "attempts", "url", "secret"}).
+			AddRow("delivery", "sub", model.EVENT_USER_CREATED, `{"type":"user.created"}`, 0, srv.URL, "secret"))
+	mock.ExpectExec(`update webhook_deliveries set status=\?`).
+		WithArgs(model.DELIVERY_DELIVERED, 1, sqlmock.AnyArg(), http.StatusNoContent, nil, sqlmock.AnyArg(), "delivery").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := NewApp("", db).dispatchWebhooks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := <-received; r.Header.Get("X-Webhook-Event") != model.EVENT_USER_CREATED {
+		t.Errorf("wrong event. expected: %s, got: %s", model.EVENT_USER_CREATED, r.Header.Get("X-Webhook-Event"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPingWebhookFailureIsNotRetried(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	received := make(chan *http.Request, 1)
+	srv := webhookReceiver(t, "secret", http.StatusInternalServerError, received)
+	defer srv.Close()
+
+	mock.ExpectQuery(`select id, url, events, secret, created_at from webhook_subscriptions where id=\?`).WithArgs("sub").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "events", "secret", "created_at"}).AddRow("sub", srv.URL, "*", "secret", time.Now()))
+	mock.ExpectExec(`insert into webhook_deliveries`).WithArgs(sqlmock.AnyArg(), "sub", model.EVENT_PING, sqlmock.AnyArg(), model.DELIVERY_PENDING, 0, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`update webhook_deliveries set status=\?`).
+		WithArgs(model.DELIVERY_FAILED, 1, sqlmock.AnyArg(), http.StatusInternalServerError, sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	d, err := NewApp("", db).PingWebhook(context.Background(), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Status != model.DELIVERY_FAILED || d.LastStatusCode != http.StatusInternalServerError {
+		t.Errorf("wrong ping delivery: %+v", d)
+	}
+
+	if r := <-received; r.Header.Get("X-Webhook-Event") != model.EVENT_PING {
+		t.Errorf("wrong event. expected: %s, got: %s", model.EVENT_PING, r.Header.Get("X-Webhook-Event"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as in RFC 6238, with the defaults authenticator apps expect
+const (
+	totp_period      = 30 // seconds
+	totp_digits      = 6
+	totp_skew        = 1  // steps accepted before and after the current one, for clock drift
+	totp_secret_size = 20 // bytes, the size of a SHA-1 key
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret, base32 encoded
+func newTOTPSecret() (string, error) {
+
+	b := make([]byte, totp_secret_size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totp_period
+}
+
+// totpCode is the code for the step, as an authenticator app shows it
+func totpCode(secret string, step int64) (string, error) {
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", n%1000000), nil
+}
+
+// totpMatch checks the code against the steps around `now`. Only steps after `after` are accepted, so a code can't be used twice.
+// Returns the matching step.
+func totpMatch(secret, code string, now time.Time, after int64) (int64, bool) {
+
+	if len(code) != totp_digits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+
+	for step := current - totp_skew; step <= current+totp_skew; step++ {
+		if step <= after {
+			continue
+		}
+
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI is the otpauth URI authenticator apps read from a QR code
+func totpURI(issuer, account, secret string) string {
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(totp_period))
+	v.Set("digits", fmt.Sprint(totp_digits))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// newRecoveryCode returns a random one-time code like `abcde-fghij`
+func newRecoveryCode() (string, error) {
+
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+
+	return s[:5] + "-" + s[5:], nil
+}
+
+// recoveryCodeHash is what is stored of a recovery code. The codes are random, so a plain hash is enough
+func recoveryCodeHash(code string) string {
+
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+
+	type scenario struct {
+		unix     int64
+		expected string
+	}
+
+	// the last 6 digits of the RFC 6238 vectors
+	scenarios := []scenario{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, s := range scenarios {
+		code, err := totpCode(rfcTOTPSecret, totpStep(time.Unix(s.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != s.expected {
+			t.Errorf("%d: wrong code. expected: %s, got: %s", s.unix, s.expected, code)
+		}
+	}
+}
+
+func TestTOTPMatch(t *testing.T) {
+
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+
+	previous, _ := totpCode(rfcTOTPSecret, step-1)
+	tooOld, _ := totpCode(rfcTOTPSecret, step-2)
+
+	if got, ok := totpMatch(rfcTOTPSecret, "081804", now, 0); !ok || got != step {
+		t.Errorf("current code should match step %d, got: %d %v", step, got, ok)
+	}
+
+	if _, ok := totpMatch(rfcTOTPSecret, previous, now, 0); !ok {
+		t.Error("previous code should match, for clock drift")
+	}
+
+	if _, ok := totpMatch(rfcTOTPSecret, tooOld, now, 0); ok {
+		t.Error("code 2 steps old should not match")
+	}
+
+	if _, ok := totpMatch(rfcTOTPSecret, "081804", now, step); ok {
+		t.Error("code of a used step should not match")
+	}
+
+	if _, ok := totpMatch(rfcTOTPSecret, "81804", now, 0); ok {
+		t.Error("short code should not match")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+
+	uri := totpURI("Vending Machine", "mihai", rfcTOTPSecret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Vending%20Machine:mihai?") || !strings.Contains(uri, "secret="+rfcTOTPSecret) {
+		t.Errorf("wrong uri: %s", uri)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+
+	code, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(code) != 11 || code[5] != '-' {
+		t.Errorf("wrong code format. expected: xxxxx-xxxxx, got: %s", code)
+	}
+
+	// codes are matched without the dash and the case
+	if recoveryCodeHash(code) != recoveryCodeHash(" "+strings.ToUpper(strings.ReplaceAll(code, "-", ""))) {
+		t.Error("the hash should ignore the dash, the case and spaces")
+	}
+}
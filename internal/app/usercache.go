@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+const (
+	default_user_cache_ttl = 30 * time.Second
+
+	// expired users are dropped once the cache grows past this size
+	user_cache_prune_size = 1000
+)
+
+func userCacheTTLFromEnv() (time.Duration, error) {
+
+	s := os.Getenv("USER_CACHE_TTL")
+	if s == "" {
+		return default_user_cache_ttl, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return default_user_cache_ttl, fmt.Errorf("USER_CACHE_TTL: %w", err)
+	}
+	if d < 0 {
+		return default_user_cache_ttl, fmt.Errorf("USER_CACHE_TTL cannot be negative")
+	}
+
+	return d, nil
+}
+
+type cachedUser struct {
+	user    model.User
+	expires time.Time
+}
+
+// UserCache keeps the users read by the authenticated requests for a short time, so that they don't all read the users table.
+// The API drops a user from it when their roles, password or deposit change. Servers sharing the load only see the changes
+// made by the others when the user expires, so the deposit is read again where it matters.
+type UserCache struct {
+	TTL time.Duration // 0 turns the cache off
+
+	mu    sync.Mutex
+	users map[string]cachedUser
+	gen   uint64 // changed on every invalidation, a user read before it is not cached
+	now   func() time.Time
+}
+
+func NewUserCache(ttl time.Duration) *UserCache {
+	return &UserCache{
+		TTL:   ttl,
+		users: make(map[string]cachedUser),
+		now:   time.Now,
+	}
+}
+
+// Get returns the user from the cache, or reads it with load and keeps it. cached tells if the user came from the cache
+func (c *UserCache) Get(ctx context.Context, id string, load func(context.Context, string) (*model.User, error)) (usr *model.User, cached bool, err error) {
+
+	c.mu.Lock()
+	now := c.now()
+	if e, ok := c.users[id]; ok && e.expires.After(now) {
+		c.mu.Unlock()
+		u := e.user
+		return &u, true, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	usr, err = load(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.put(usr, gen)
+
+	return usr, false, nil
+}
+
+// put keeps the user, unless a user was invalidated since it was read: it could be this one, with the old values
+func (c *UserCache) put(usr *model.User, gen uint64) {
+
+	if c.TTL <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	now := c.now()
+
+	if len(c.users) >= user_cache_prune_size {
+		for id, e := range c.users {
+			if !e.expires.After(now) {
+				delete(c.users, id)
+			}
+		}
+	}
+
+	c.users[usr.ID] = cachedUser{user: *usr, expires: now.Add(c.TTL)}
+}
+
+// Invalidate drops the user, the next request reads it again
+func (c *UserCache) Invalidate(id string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	delete(c.users, id)
+}
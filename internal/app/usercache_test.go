@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mehiX/vending-machine-api/internal/app/model"
+)
+
+func TestUserCacheGet(t *testing.T) {
+
+	now := time.Now()
+	c := NewUserCache(30 * time.Second)
+	c.now = func() time.Time { return now }
+
+	loads := 0
+	load := func(_ context.Context, id string) (*model.User, error) {
+		loads++
+		return &model.User{ID: id, Deposit: int64(loads)}, nil
+	}
+
+	usr, cached, err := c.Get(context.Background(), "id1", load)
+	if err != nil || cached || usr.Deposit != 1 {
+		t.Fatalf("first get should load the user. got: %+v, cached: %v, err: %v", usr, cached, err)
+	}
+
+	usr, cached, _ = c.Get(context.Background(), "id1", load)
+	if !cached || usr.Deposit != 1 || loads != 1 {
+		t.Errorf("second get should come from the cache. got: %+v, cached: %v, loads: %d", usr, cached, loads)
+	}
+
+	// changes to a returned user don't reach the cache
+	usr.Deposit = 100
+	if usr, _, _ = c.Get(context.Background(), "id1", load); usr.Deposit != 1 {
+		t.Errorf("cached user was changed: %+v", usr)
+	}
+
+	now = now.Add(31 * time.Second)
+	if _, cached, _ = c.Get(context.Background(), "id1", load); cached || loads != 2 {
+		t.Errorf("expired user should be loaded again. cached: %v, loads: %d", cached, loads)
+	}
+
+	c.Invalidate("id1")
+	if _, cached, _ = c.Get(context.Background(), "id1", load); cached || loads != 3 {
+		t.Errorf("invalidated user should be loaded again. cached: %v, loads: %d", cached, loads)
+	}
+}
+
+func TestUserCacheLoadError(t *testing.T) {
+
+	c := NewUserCache(30 * time.Second)
+
+	fail := errors.New("no database")
+	if _, _, err := c.Get(context.Background(), "id1", func(context.Context, string) (*model.User, error) { return nil, fail }); err != fail {
+		t.Fatalf("expected the load error, got: %v", err)
+	}
+
+	if len(c.users) != 0 {
+		t.Error("nothing should be cached after an error")
+	}
+}
+
+func TestUserCacheOff(t *testing.T) {
+
+	c := NewUserCache(0)
+
+	load := func(_ context.Context, id string) (*model.User, error) { return &model.User{ID: id}, nil }
+
+	c.Get(context.Background(), "id1", load)
+	if _, cached, _ := c.Get(context.Background(), "id1", load); cached {
+		t.Error("the cache is off, the user should be loaded every time")
+	}
+}
+
+func TestUserCacheInvalidatedWhileLoading(t *testing.T) {
+
+	c := NewUserCache(30 * time.Second)
+
+	// the deposit changes while the old row is read
+	c.Get(context.Background(), "id1", func(_ context.Context, id string) (*model.User, error) {
+		c.Invalidate(id)
+		return &model.User{ID: id, Deposit: 10}, nil
+	})
+
+	usr, cached, _ := c.Get(context.Background(), "id1", func(_ context.Context, id string) (*model.User, error) {
+		return &model.User{ID: id, Deposit: 20}, nil
+	})
+
+	if cached || usr.Deposit != 20 {
+		t.Errorf("the user read before the change should not be cached. got: %+v, cached: %v", usr, cached)
+	}
+}
+
+func TestUserCacheTTLFromEnv(t *testing.T) {
+
+	type scenario struct {
+		value    string
+		expected time.Duration
+		isValid  bool
+	}
+
+	scenarios := []scenario{
+		{"", default_user_cache_ttl, true},
+		{"1m", time.Minute, true},
+		{"0", 0, true},
+		{"-5s", default_user_cache_ttl, false},
+		{"soon", default_user_cache_ttl, false},
+	}
+
+	defer os.Unsetenv("USER_CACHE_TTL")
+
+	for _, s := range scenarios {
+		os.Setenv("USER_CACHE_TTL", s.value)
+
+		ttl, err := userCacheTTLFromEnv()
+		if s.isValid && err != nil {
+			t.Errorf("%q should be valid, got: %v", s.value, err)
+		}
+		if !s.isValid && err == nil {
+			t.Errorf("%q should not be valid", s.value)
+		}
+		if ttl != s.expected {
+			t.Errorf("wrong ttl for %q. expected: %s, got: %s", s.value, s.expected, ttl)
+		}
+	}
+}
@@ -50,9 +50,9 @@ func validatePassword(p string) error {
 	return nil
 }
 
-func validateDeposit(d int64) error {
-	if d%5 != 0 {
-		return errors.New("deposit should be multiple of 5")
+func (c Currency) validateDeposit(d int64) error {
+	if d%c.PriceStep != 0 {
+		return fmt.Errorf("deposit should be multiple of %d", c.PriceStep)
 	}
 
 	return nil
@@ -66,22 +66,51 @@ func validateRole(r string) error {
 	return nil
 }
 
-func validateCost(c int64) error {
-	if c == 0 || c%5 != 0 {
-		return errors.New("cost is 0 or not a multiple of 5")
+// validateRoles checks the roles are known and not repeated
+func validateRoles(roles []model.TypeRole) error {
+
+	if len(roles) == 0 {
+		return errors.New("at least one role is needed")
+	}
+
+	seen := make(map[model.TypeRole]bool)
+	for _, r := range roles {
+		if err := validateRole(r); err != nil {
+			return err
+		}
+		if seen[r] {
+			return errors.New("repeated role: " + r)
+		}
+		seen[r] = true
 	}
 
 	return nil
 }
 
-var acceptedCoinValues = []int{5, 10, 20, 50, 100}
+func (c Currency) validateCost(v int64) error {
+	if v <= 0 || v%c.PriceStep != 0 {
+		return fmt.Errorf("cost is not positive or not a multiple of %d", c.PriceStep)
+	}
+
+	return nil
+}
+
+func (c Currency) validateDepositCoin(v int) error {
+	for _, a := range c.Coins {
+		if a == int64(v) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("accepted values: %v", c.Coins)
+}
 
-func validateDepositCoin(v int) error {
-	for _, a := range acceptedCoinValues {
-		if a == v {
+func (c Currency) validateNote(v int) error {
+	for _, a := range c.Notes {
+		if a == int64(v) {
 			return nil
 		}
 	}
 
-	return fmt.Errorf("accepted values: %v", acceptedCoinValues)
+	return fmt.Errorf("accepted notes: %v", c.Notes)
 }
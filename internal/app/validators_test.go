@@ -70,13 +70,13 @@ func TestDepositValidate(t *testing.T) {
 	bad := []int64{1, 2, 3, 4, 6, 7, 18, 23, 22, 2501}
 
 	for _, d := range good {
-		if err := validateDeposit(d); err != nil {
+		if err := defaultCurrency.validateDeposit(d); err != nil {
 			t.Errorf("unexpected error for deposit: %d. Error: %s", d, err)
 		}
 	}
 
 	for _, d := range bad {
-		if err := validateDeposit(d); err == nil {
+		if err := defaultCurrency.validateDeposit(d); err == nil {
 			t.Errorf("deposit should be rejected: %d", d)
 		}
 	}
@@ -99,18 +99,35 @@ func TestRoleValidate(t *testing.T) {
 	}
 }
 
+func TestRolesValidate(t *testing.T) {
+	good := [][]string{{"ADMIN"}, {"SELLER", "BUYER"}, {"BUYER", "SELLER", "ADMIN"}}
+	bad := [][]string{nil, {}, {"SELLER", "SELLER"}, {"BUYER", "root"}}
+
+	for _, r := range good {
+		if err := validateRoles(r); err != nil {
+			t.Errorf("unexpected validation error for roles: %v", r)
+		}
+	}
+
+	for _, r := range bad {
+		if err := validateRoles(r); err == nil {
+			t.Errorf("roles should be rejected: %v", r)
+		}
+	}
+}
+
 func TestCostValidate(t *testing.T) {
 	good := []int64{5, 10, 15, 20, 25, 30, 35, 50, 100, 105, 150, 2005}
 	bad := []int64{0, 1, 2, 3, 4, 6, 7, 18, 23, 22, 2501}
 
 	for _, c := range good {
-		if err := validateCost(c); err != nil {
+		if err := defaultCurrency.validateCost(c); err != nil {
 			t.Errorf("unexpected error for cost: %d. Error: %s", c, err)
 		}
 	}
 
 	for _, c := range bad {
-		if err := validateCost(c); err == nil {
+		if err := defaultCurrency.validateCost(c); err == nil {
 			t.Errorf("cost should be rejected: %d", c)
 		}
 	}
@@ -139,8 +156,9 @@ func TestValidateDepositCoin(t *testing.T) {
 	}
 
 	for _, s := range scenarios {
+		s := s
 		t.Run(fmt.Sprintf("%d", s.input), func(t *testing.T) {
-			res := validateDepositCoin(s.input)
+			res := defaultCurrency.validateDepositCoin(s.input)
 			if s.result == nil && res != nil {
 				t.Errorf("coin should be valid: %d", s.input)
 			} else if s.result != nil && res == nil {